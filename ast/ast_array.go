@@ -30,7 +30,7 @@ func (al *ArrayLiteral) String() string {
 	}
 	out.WriteString("[")
 	out.WriteString(strings.Join(elements, ", "))
-	out.WriteString("];\n")
+	out.WriteString("]")
 	return out.String()
 }
 
@@ -61,3 +61,44 @@ func (ie *IndexExpression) String() string {
 	out.WriteString("])")
 	return out.String()
 }
+
+// SliceExpression holds a slice-expression, such as `array[1:3]`.
+type SliceExpression struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Left is the thing being sliced.
+	Left Expression
+
+	// Start is the index of the first element to return.
+	//
+	// This is optional.
+	Start Expression
+
+	// End is the index after the last element to return.
+	//
+	// This is optional.
+	End Expression
+}
+
+func (se *SliceExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+
+// String returns this object as a string.
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	out.WriteString("])")
+	return out.String()
+}
@@ -0,0 +1,43 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// ChainedComparison holds a chain of relational comparisons, such as
+// `0 < score < 100`.
+//
+// This is equivalent to `0 < score && score < 100`, except that `score`
+// is only evaluated once.
+type ChainedComparison struct {
+	// Token holds the token of the first comparison.
+	Token token.Token
+
+	// Operands holds the values being compared, one more than
+	// the number of operators.
+	Operands []Expression
+
+	// Operators holds the comparisons to be carried out between
+	// each adjacent pair of operands.
+	Operators []string
+}
+
+func (cc *ChainedComparison) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (cc *ChainedComparison) TokenLiteral() string { return cc.Token.Literal }
+
+// String returns this object as a string.
+func (cc *ChainedComparison) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(cc.Operands[0].String())
+	for i, op := range cc.Operators {
+		out.WriteString(" " + op + " ")
+		out.WriteString(cc.Operands[i+1].String())
+	}
+	out.WriteString(")")
+	return out.String()
+}
@@ -0,0 +1,189 @@
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Dump returns an indented, human-readable, representation of the given
+// node and all of its children.
+//
+// Each node is written upon a line of its own, indented beneath its
+// parent, which makes the structure of a program - for example the
+// precedence of `&&` and `||` - easy to see.  Children which have a
+// particular role, such as the branches of an `if` expression, are
+// labelled.
+//
+// The output is stable, so it may be compared against in tests.
+func Dump(node Node) string {
+	var out bytes.Buffer
+	dumpNode(&out, node, 0, "")
+	return out.String()
+}
+
+// dumpNode writes the representation of the given node to the buffer,
+// at the specified depth, and then recurses into its children.
+func dumpNode(out *bytes.Buffer, node Node, depth int, label string) {
+
+	// Write a line, at the current depth.
+	line := func(format string, args ...interface{}) {
+		out.WriteString(strings.Repeat("  ", depth))
+		if label != "" {
+			out.WriteString(label + ": ")
+		}
+		out.WriteString(fmt.Sprintf(format, args...))
+		out.WriteString("\n")
+	}
+
+	// Write a child, at the next depth.
+	child := func(n Node, label string) {
+		dumpNode(out, n, depth+1, label)
+	}
+
+	switch node := node.(type) {
+
+	case *Program:
+		line("Program")
+		for _, s := range node.Statements {
+			child(s, "")
+		}
+
+	case *BlockStatement:
+		line("BlockStatement")
+		for _, s := range node.Statements {
+			child(s, "")
+		}
+
+	case *ExpressionStatement:
+		line("ExpressionStatement")
+		child(node.Expression, "")
+
+	case *ReturnStatement:
+		line("ReturnStatement")
+		child(node.ReturnValue, "")
+
+	case *AssignStatement:
+		line("AssignStatement %s", node.Name.String())
+		child(node.Value, "")
+
+	case *Identifier:
+		line("Identifier %s", node.Value)
+
+	case *BooleanLiteral:
+		line("BooleanLiteral %t", node.Value)
+
+	case *NullLiteral:
+		line("NullLiteral")
+
+	case *IntegerLiteral:
+		line("IntegerLiteral %d", node.Value)
+
+	case *FloatLiteral:
+		line("FloatLiteral %v", node.Value)
+
+	case *StringLiteral:
+		line("StringLiteral %q", node.Value)
+
+	case *RegexpLiteral:
+		line("RegexpLiteral /%s/%s", node.Value, node.Flags)
+
+	case *ArrayLiteral:
+		line("ArrayLiteral")
+		for _, e := range node.Elements {
+			child(e, "")
+		}
+
+	case *HashLiteral:
+		line("HashLiteral")
+		for _, pair := range node.Pairs {
+			child(pair.Key, "Key")
+			child(pair.Value, "Value")
+		}
+
+	case *PrefixExpression:
+		line("PrefixExpression %s", node.Operator)
+		child(node.Right, "")
+
+	case *PostfixExpression:
+		line("PostfixExpression %s%s", node.Token.Literal, node.Operator)
+
+	case *InfixExpression:
+		line("InfixExpression %s", node.Operator)
+		child(node.Left, "")
+		child(node.Right, "")
+
+	case *ChainedComparison:
+		line("ChainedComparison %s", strings.Join(node.Operators, " "))
+		for _, e := range node.Operands {
+			child(e, "")
+		}
+
+	case *IndexExpression:
+		line("IndexExpression")
+		child(node.Left, "")
+		child(node.Index, "Index")
+
+	case *SliceExpression:
+		line("SliceExpression")
+		child(node.Left, "")
+		if node.Start != nil {
+			child(node.Start, "Start")
+		}
+		if node.End != nil {
+			child(node.End, "End")
+		}
+
+	case *MemberExpression:
+		if node.Optional {
+			line("MemberExpression ?.%s", node.Field)
+		} else {
+			line("MemberExpression .%s", node.Field)
+		}
+		child(node.Left, "")
+
+	case *CallExpression:
+		line("CallExpression %s", node.Function.String())
+		for _, a := range node.Arguments {
+			child(a, "")
+		}
+
+	case *IfExpression:
+		line("IfExpression")
+		child(node.Condition, "Condition")
+		child(node.Consequence, "Consequence")
+		if node.Alternative != nil {
+			child(node.Alternative, "Alternative")
+		}
+
+	case *TernaryExpression:
+		line("TernaryExpression")
+		child(node.Condition, "Condition")
+		child(node.IfTrue, "IfTrue")
+		child(node.IfFalse, "IfFalse")
+
+	case *WhileStatement:
+		line("WhileStatement")
+		child(node.Condition, "Condition")
+		child(node.Body, "Body")
+
+	case *ForeachStatement:
+		if node.Index != "" {
+			line("ForeachStatement %s, %s", node.Index, node.Ident)
+		} else {
+			line("ForeachStatement %s", node.Ident)
+		}
+		child(node.Value, "Value")
+		child(node.Body, "Body")
+
+	case *FunctionDefinition:
+		line("FunctionDefinition %s(%s)", node.Name, strings.Join(node.Parameters, ", "))
+		child(node.Body, "Body")
+
+	case nil:
+		line("<nil>")
+
+	default:
+		line("%T %s", node, node.String())
+	}
+}
@@ -0,0 +1,40 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// FunctionDefinition holds the definition of a function, made by a script.
+type FunctionDefinition struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Name is the name of the function.
+	Name string
+
+	// Parameters holds the names of the function's parameters.
+	Parameters []string
+
+	// Body is the block we'll execute when the function is called.
+	Body *BlockStatement
+}
+
+func (fd *FunctionDefinition) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (fd *FunctionDefinition) TokenLiteral() string { return fd.Token.Literal }
+
+// String returns this object as a string.
+func (fd *FunctionDefinition) String() string {
+	var out bytes.Buffer
+	out.WriteString("function ")
+	out.WriteString(fd.Name)
+	out.WriteString("(")
+	out.WriteString(strings.Join(fd.Parameters, ", "))
+	out.WriteString(")")
+	out.WriteString(fd.Body.String())
+	return out.String()
+}
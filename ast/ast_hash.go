@@ -0,0 +1,45 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// HashPair holds a single key/value pair of a hash literal.
+type HashPair struct {
+	// Key is the expression which gives the key.
+	Key Expression
+
+	// Value is the expression which gives the value.
+	Value Expression
+}
+
+// HashLiteral holds an inline hash, such as `{ "name": "Steve" }`.
+type HashLiteral struct {
+	// Token is the token
+	Token token.Token
+
+	// Pairs holds the key/value pairs of the hash, in the order
+	// they were written.
+	Pairs []HashPair
+}
+
+func (hl *HashLiteral) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+
+// String returns this object as a string.
+func (hl *HashLiteral) String() string {
+	var out bytes.Buffer
+	pairs := make([]string, 0)
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+	}
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+	return out.String()
+}
@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"bytes"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// MemberExpression holds a field-access expression, such as `user.name`,
+// or `user?.name`.
+type MemberExpression struct {
+	// Token is the actual token
+	Token token.Token
+
+	// Left is the thing whose member is being accessed.
+	Left Expression
+
+	// Field is the name of the member being accessed.
+	Field string
+
+	// Optional is true if this is an optional-chaining access, via
+	// `?.`, which results in null rather than an error if the left
+	// side is null.
+	Optional bool
+}
+
+func (me *MemberExpression) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
+
+// String returns this object as a string.
+func (me *MemberExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(me.Left.String())
+	out.WriteString(me.Token.Literal)
+	out.WriteString(me.Field)
+	out.WriteString(")")
+	return out.String()
+}
@@ -0,0 +1,17 @@
+package ast
+
+import "github.com/skx/evalfilter/v2/token"
+
+// NullLiteral holds the null value.
+type NullLiteral struct {
+	// Token holds the actual token
+	Token token.Token
+}
+
+func (nl *NullLiteral) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (nl *NullLiteral) TokenLiteral() string { return nl.Token.Literal }
+
+// String returns this object as a string.
+func (nl *NullLiteral) String() string { return nl.Token.Literal }
@@ -0,0 +1,101 @@
+package ast
+
+// Walk traverses the given node, and all of its children, in depth-first
+// order, invoking the supplied function for each of them.
+//
+// If the function returns false the children of that node are skipped.
+//
+// Only nodes are visited, so names which are not themselves nodes - such
+// as the variable of a `foreach` statement, or the field of a member
+// expression - are not.
+func Walk(node Node, fn func(Node) bool) {
+
+	if node == nil || !fn(node) {
+		return
+	}
+
+	// Walk each of the given children, skipping any which are absent.
+	walk := func(children ...Node) {
+		for _, c := range children {
+			if c != nil {
+				Walk(c, fn)
+			}
+		}
+	}
+
+	switch node := node.(type) {
+
+	case *Program:
+		for _, s := range node.Statements {
+			walk(s)
+		}
+
+	case *BlockStatement:
+		for _, s := range node.Statements {
+			walk(s)
+		}
+
+	case *ExpressionStatement:
+		walk(node.Expression)
+
+	case *ReturnStatement:
+		walk(node.ReturnValue)
+
+	case *AssignStatement:
+		walk(node.Name, node.Value)
+
+	case *ArrayLiteral:
+		for _, e := range node.Elements {
+			walk(e)
+		}
+
+	case *HashLiteral:
+		for _, pair := range node.Pairs {
+			walk(pair.Key, pair.Value)
+		}
+
+	case *PrefixExpression:
+		walk(node.Right)
+
+	case *InfixExpression:
+		walk(node.Left, node.Right)
+
+	case *ChainedComparison:
+		for _, e := range node.Operands {
+			walk(e)
+		}
+
+	case *IndexExpression:
+		walk(node.Left, node.Index)
+
+	case *SliceExpression:
+		walk(node.Left, node.Start, node.End)
+
+	case *MemberExpression:
+		walk(node.Left)
+
+	case *CallExpression:
+		walk(node.Function)
+		for _, a := range node.Arguments {
+			walk(a)
+		}
+
+	case *IfExpression:
+		walk(node.Condition, node.Consequence)
+		if node.Alternative != nil {
+			walk(node.Alternative)
+		}
+
+	case *TernaryExpression:
+		walk(node.Condition, node.IfTrue, node.IfFalse)
+
+	case *WhileStatement:
+		walk(node.Condition, node.Body)
+
+	case *ForeachStatement:
+		walk(node.Value, node.Body)
+
+	case *FunctionDefinition:
+		walk(node.Body)
+	}
+}
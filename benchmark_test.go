@@ -2,6 +2,7 @@ package evalfilter
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 )
 
@@ -173,3 +174,56 @@ func Benchmark_evalfilter_trivial(b *testing.B) {
 		b.Fail()
 	}
 }
+
+// filterSliceBenchmark returns a prepared script, and a large slice of
+// objects to filter with it, for comparing serial and parallel filtering.
+func filterSliceBenchmark(b *testing.B) (*Eval, []interface{}) {
+
+	eval := New(`
+total = 0;
+foreach word in split(Text, " ") { if ( len(word) > 3 ) { total++; } }
+return total > 2 && Text ~= /quick/i;
+`)
+
+	err := eval.Prepare()
+	if err != nil {
+		b.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	var objs []interface{}
+	for i := 0; i < 10000; i++ {
+		objs = append(objs, map[string]interface{}{
+			"Text": fmt.Sprintf("The quick brown fox %d jumps over the lazy dog", i),
+		})
+	}
+
+	return eval, objs
+}
+
+// BenchmarkFilterSlice filters a large slice serially.
+func BenchmarkFilterSlice(b *testing.B) {
+
+	eval, objs := filterSliceBenchmark(b)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := eval.FilterSlice(objs)
+		if err != nil {
+			b.Fatalf("Failed to run: %s", err.Error())
+		}
+	}
+}
+
+// BenchmarkFilterSliceParallel filters a large slice with a pool of workers.
+func BenchmarkFilterSliceParallel(b *testing.B) {
+
+	eval, objs := filterSliceBenchmark(b)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := eval.FilterSliceParallel(objs, runtime.NumCPU())
+		if err != nil {
+			b.Fatalf("Failed to run: %s", err.Error())
+		}
+	}
+}
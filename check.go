@@ -0,0 +1,241 @@
+// This file contains a static checker, which looks for operations in a
+// script which are certain to fail when it is executed.
+
+package evalfilter
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// Check examines the compiled script for operations which will always
+// fail when it is executed, returning a description of each of them.
+//
+// Only values whose types are known before the script runs, such as
+// literals, can be checked - field values are not known until the script
+// is executed against an object.  The problems found are operators which
+// are applied to values of the wrong type, such as `"a" < [1]`, division
+// by a literal zero, calls to functions which don't exist, and calls to
+// our default functions with the wrong number of arguments.
+//
+// The script is not executed.  It must have been compiled, via Prepare,
+// first, and any functions you wish to use must have been added.
+func (e *Eval) Check() ([]string, error) {
+	if e.program == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	var problems []string
+
+	report := func(pos token.Position, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, args...)))
+	}
+
+	ast.Walk(e.program, func(node ast.Node) bool {
+		switch node := node.(type) {
+
+		case *ast.InfixExpression:
+			msg := checkOperator(node.Operator, staticType(node.Left), staticType(node.Right), e.environment.StrictStringEquality())
+			if msg == "" && (node.Operator == "/" || node.Operator == "%") {
+				if i, ok := node.Right.(*ast.IntegerLiteral); ok && i.Value == 0 {
+					msg = "division by zero"
+				}
+				if f, ok := node.Right.(*ast.FloatLiteral); ok && f.Value == 0 {
+					msg = "division by zero"
+				}
+			}
+			if msg != "" {
+				report(node.Token.Position, "%s", msg)
+			}
+
+		case *ast.ChainedComparison:
+			for i, op := range node.Operators {
+				msg := checkOperator(op, staticType(node.Operands[i]), staticType(node.Operands[i+1]), e.environment.StrictStringEquality())
+				if msg != "" {
+					report(node.Token.Position, "%s", msg)
+				}
+			}
+
+		case *ast.PrefixExpression:
+			t := staticType(node.Right)
+			if (node.Operator == "-" || node.Operator == "√") && t != "" && !isNumeric(t) {
+				report(node.Token.Position, "unsupported type for %s: %s", node.Operator, t)
+			}
+
+		case *ast.CallExpression:
+			id, ok := node.Function.(*ast.Identifier)
+			if !ok {
+				break
+			}
+			if (id.Value == "coalesce" || id.Value == "exists" || id.Value == "inspect") && e.specialForm(id.Value) {
+				break
+			}
+			if _, ok := e.environment.GetFunction(id.Value); !ok {
+				report(node.Token.Position, "the function %s does not exist", id.Value)
+				break
+			}
+			min, max, ok := e.environment.Arity(id.Value)
+			for _, fn := range e.functions {
+				if fn.Name == id.Value {
+					min, max, ok = len(fn.Parameters), len(fn.Parameters), true
+				}
+			}
+			n := len(node.Arguments)
+			if ok && (n < min || (max != -1 && n > max)) {
+				report(node.Token.Position, "wrong number of arguments to %s: got %d, expected %s", id.Value, n, describeArity(min, max))
+			}
+		}
+		return true
+	})
+
+	return problems, nil
+}
+
+// staticType returns the type of the given expression, if it can be known
+// before the script is executed, otherwise it returns an empty string.
+func staticType(node ast.Expression) object.Type {
+
+	switch node := node.(type) {
+	case *ast.ArrayLiteral:
+		return object.ARRAY
+	case *ast.HashLiteral:
+		return object.HASH
+	case *ast.BooleanLiteral, *ast.ChainedComparison:
+		return object.BOOLEAN
+	case *ast.FloatLiteral:
+		return object.FLOAT
+	case *ast.IntegerLiteral:
+		return object.INTEGER
+	case *ast.NullLiteral:
+		return object.NULL
+	case *ast.RegexpLiteral, *ast.StringLiteral:
+		return object.STRING
+
+	case *ast.PrefixExpression:
+		if node.Operator == "!" {
+			return object.BOOLEAN
+		}
+
+	case *ast.InfixExpression:
+		switch node.Operator {
+		case "<", "<=", ">", ">=", "==", "!=", "~=", "!~", "==*", "!=*", "~=*", "!~*", "in", "&&", "||":
+			return object.BOOLEAN
+		case "..":
+			return object.ARRAY
+		case "/":
+			if isNumeric(staticType(node.Left)) && isNumeric(staticType(node.Right)) {
+				return object.FLOAT
+			}
+		case "+", "-", "*", "%":
+			l := staticType(node.Left)
+			r := staticType(node.Right)
+			if l == object.INTEGER && r == object.INTEGER {
+				return object.INTEGER
+			}
+			if isNumeric(l) && isNumeric(r) {
+				return object.FLOAT
+			}
+			if node.Operator == "+" && l == object.STRING && r == object.STRING {
+				return object.STRING
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkOperator returns a description of the error which will occur if
+// the given infix operator is applied to values of the given types, or
+// an empty string if it will not fail, or the types are not known.
+//
+// If strict equality is enabled `==` and `!=` accept any numbers,
+// strings, and booleans, which are simply unequal if their types differ.
+func checkOperator(op string, left object.Type, right object.Type, strict bool) string {
+
+	switch op {
+	case "&&", "||", "??":
+		return ""
+	case "in":
+		if right != "" && right != object.ARRAY {
+			return fmt.Sprintf("operand for 'in' must be an array, not %s", right)
+		}
+		return ""
+	case "..":
+		if left != "" && left != object.INTEGER {
+			return "argument for the start of the range must be an integer"
+		}
+		if right != "" && right != object.INTEGER {
+			return "argument for the end of the range must be an integer"
+		}
+		return ""
+	}
+
+	if left == "" || right == "" {
+		return ""
+	}
+
+	// The case-insensitive operators accept the same types as their
+	// regular counterparts.
+	name := op
+	if base, ok := caseInsensitive[op]; ok {
+		op = base
+	}
+
+	var valid bool
+
+	switch {
+	case isNumeric(left) && isNumeric(right):
+		valid = op != "~=" && op != "!~"
+	case left == object.NULL || right == object.NULL:
+		valid = op == "==" || op == "!="
+	case (op == "==" || op == "!=") && strict && environment.IsScalar(left) && environment.IsScalar(right):
+		valid = true
+	case (op == "==" || op == "!=") && right == object.ARRAY:
+		return fmt.Sprintf("cannot compare %s with an array using %s, use 'in' to test whether an array contains a value", left, name)
+	case left != right:
+		return fmt.Sprintf("type mismatch: %s %s %s", left, name, right)
+	case left == object.STRING || left == object.BOOLEAN:
+		switch op {
+		case "==", "!=", "<", "<=", ">", ">=", "~=", "!~", "+":
+			valid = true
+		}
+	case left == object.ARRAY:
+		valid = op == "==" || op == "!="
+	}
+
+	if !valid {
+		return fmt.Sprintf("unknown operator: %s %s %s", left, name, right)
+	}
+	return ""
+}
+
+// caseInsensitive maps each of the case-insensitive operators to the
+// regular operator it is a variant of.
+var caseInsensitive = map[string]string{
+	"==*": "==",
+	"!=*": "!=",
+	"~=*": "~=",
+	"!~*": "!~",
+}
+
+// isNumeric returns true if the given type is a number.
+func isNumeric(t object.Type) bool {
+	return t == object.INTEGER || t == object.FLOAT
+}
+
+// describeArity returns a description of the number of arguments which
+// a function accepts.
+func describeArity(min, max int) string {
+	switch {
+	case max == -1:
+		return fmt.Sprintf("at least %d", min)
+	case min == max:
+		return fmt.Sprintf("%d", min)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
+	}
+}
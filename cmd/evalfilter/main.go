@@ -30,6 +30,7 @@ func main() {
 	subcommands.Register(&lexCmd{}, "")
 	subcommands.Register(&bytecodeCmd{}, "")
 	subcommands.Register(&parseCmd{}, "")
+	subcommands.Register(&replCmd{}, "")
 	subcommands.Register(&runCmd{}, "")
 
 	flag.Parse()
@@ -8,14 +8,17 @@ import (
 	"strings"
 
 	"github.com/google/subcommands"
+	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/lexer"
 	"github.com/skx/evalfilter/v2/parser"
 )
 
 //
-// The options set by our command-line flags: None
+// The options set by our command-line flags.
 //
 type parseCmd struct {
+	// Show the AST as an indented tree
+	tree bool
 }
 
 //
@@ -33,6 +36,7 @@ func (*parseCmd) Usage() string {
 // Flag setup
 //
 func (p *parseCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.tree, "tree", false, "Show the AST as an indented tree.")
 }
 
 // Parse parses the given file, and dumps the AST which
@@ -72,6 +76,10 @@ func (p *parseCmd) Parse(file string) {
 	//
 	// Print the parsed program.
 	//
+	if p.tree {
+		fmt.Print(ast.Dump(program))
+		return
+	}
 	fmt.Printf("%s\n", program.String())
 }
 
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/skx/evalfilter/v2"
+)
+
+//
+// The options set by our command-line flags.
+//
+type replCmd struct {
+
+	// The user may specify a JSON file.
+	jsonFile string
+}
+
+//
+// Glue
+//
+func (*replCmd) Name() string     { return "repl" }
+func (*replCmd) Synopsis() string { return "Evaluate expressions interactively, against a JSON object." }
+func (*replCmd) Usage() string {
+	return `repl [-json=x.json]:
+  Read expressions from STDIN, and show their values, using the object
+  in the JSON-file as input.
+`
+}
+
+//
+// Flag setup
+//
+func (p *replCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.jsonFile, "json", "", "The JSON file, containing the object to evaluate expressions against.")
+}
+
+//
+// Entry-point.
+//
+func (p *replCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	obj := make(map[string]interface{})
+
+	//
+	// If we have a JSON file then populate our object.
+	//
+	if p.jsonFile != "" {
+
+		dat, err := ioutil.ReadFile(p.jsonFile)
+		if err != nil {
+			fmt.Printf("Error reading file %s - %s\n", p.jsonFile, err.Error())
+			return subcommands.ExitFailure
+		}
+
+		err = json.Unmarshal(dat, &obj)
+		if err != nil {
+			fmt.Printf("Error parsing JSON %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	err := evalfilter.New("").REPL(obj, os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Printf("Error reading input %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
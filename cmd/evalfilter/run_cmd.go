@@ -23,6 +23,9 @@ type runCmd struct {
 	// Disable the bytecode optimizer
 	raw bool
 
+	// Explain the comparisons made, and branches taken
+	explain bool
+
 	// The user may specify a JSON file.
 	jsonFile string
 }
@@ -45,6 +48,7 @@ func (p *runCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.jsonFile, "json", "", "The JSON file, containing the object to test the script with.")
 	f.BoolVar(&p.raw, "no-optimizer", false, "Disable the bytecode optimizer")
 	f.BoolVar(&p.debug, "debug", false, "Show instructions and the stack at ever step")
+	f.BoolVar(&p.explain, "explain", false, "Show the comparisons made, and the branches taken, by the script")
 }
 
 //
@@ -117,6 +121,20 @@ func (p *runCmd) Run(file string) {
 		return
 	}
 
+	//
+	// If we're explaining the script then show that, which
+	// includes the result.
+	//
+	if p.explain {
+		exp, err := eval.Explain(obj)
+		if err != nil {
+			fmt.Printf("Failed to run script: %s\n", err.Error())
+			return
+		}
+		fmt.Print(exp.String())
+		return
+	}
+
 	//
 	// Run the script.
 	//
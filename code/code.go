@@ -178,48 +178,186 @@ const (
 	// Given two integer values produce an array holding
 	// items between them.
 	OpRange
+
+	// Pop three values from the stack; the object to slice, the
+	// start-index, and the end-index.  Push the slice of the
+	// array/string which was selected.
+	OpSlice
+
+	// Pop a value from the stack, if it is not null then push it
+	// back and jump to the specified offset.  Otherwise discard it,
+	// and proceed to the next instruction.
+	//
+	// 16-bit argument is the offset to jump to.
+	OpJumpIfNotNull
+
+	// If the value on the top of the stack is null then jump to the
+	// specified offset, leaving it in place.  Otherwise proceed to the
+	// next instruction.
+	//
+	// 16-bit argument is the offset to jump to.
+	OpJumpIfNull
+
+	// Pop a field-name and a hash from the stack, and push the value
+	// of the named field.
+	OpMember
+
+	// Duplicate the value on the top of the stack.
+	OpDup
+
+	// Move the value on the top of the stack beneath the two values
+	// below it.
+	OpRot
+
+	// Discard the value on the top of the stack.
+	OpPop
+
+	// If the value on the top of the stack is false then record a
+	// diagnostic, leaving the value in place.
+	//
+	// The 16-bit argument is the offset of the constant describing
+	// the condition which was tested.
+	OpCheck
+
+	// Start a new node in the explanation which is being recorded,
+	// nested beneath the current one.
+	//
+	// The 16-bit argument is the offset of the constant describing
+	// the node.
+	OpEnter
+
+	// Finish the current node in the explanation which is being
+	// recorded, returning to its parent.
+	OpLeave
+
+	// Push the null value onto the stack.
+	OpNull
+
+	// Pop two values from the stack.  If equal push TRUE, else push
+	// FALSE.  Strings are compared without regard to case.
+	OpEqualFold
+
+	// Pop two values from the stack.  If unequal push TRUE, else push
+	// FALSE.  Strings are compared without regard to case.
+	OpNotEqualFold
+
+	// Pop two values from the stack, if the first matches the regexp
+	// in the second, without regard to case, push TRUE, else push FALSE.
+	OpMatchesFold
+
+	// Pop two values from the stack, if the first does not match the
+	// regexp in the second, without regard to case, push TRUE, else
+	// push FALSE.
+	OpNotMatchesFold
+
+	// Store a literal hash.
+	//
+	// The 16-bit argument is the number of key/value pairs to pop from
+	// the stack, each key is beneath its value.
+	OpHash
+
+	// Test whether a field exists.
+	//
+	// The 16-bit argument is the index of a constant holding the
+	// dotted path of the field, push TRUE if it resolves, else
+	// push FALSE.
+	OpExists
+
+	// Pop two integers from the stack, and push the bitwise AND of them.
+	OpBitAnd
+
+	// Pop two integers from the stack, and push the bitwise OR of them.
+	OpBitOr
+
+	// Pop two integers from the stack, and push the bitwise XOR of them.
+	OpBitXor
+
+	// Pop two integers from the stack, shift the first left by the
+	// number of bits given by the second, and push the result.
+	OpShiftLeft
+
+	// Pop two integers from the stack, shift the first right by the
+	// number of bits given by the second, and push the result.
+	OpShiftRight
+
+	// Push a hash holding all of the fields of the object the
+	// script is running against.
+	OpObject
+
+	// If the value on the top of the stack, the result of a comparison,
+	// is false then record a diagnostic which includes the values that
+	// were compared, leaving the value in place.
+	//
+	// The 16-bit argument is the offset of three constants: the
+	// condition which was tested, and the source of its left and
+	// right operands.
+	OpCheckComparison
 )
 
 // OpCodeNames allows mapping opcodes to their names.
 var OpCodeNames = [...]string{
-	OpAdd:            "OpAdd",
-	OpAnd:            "OpAnd",
-	OpArray:          "OpArray",
-	OpArrayIn:        "OpArrayIn",
-	OpBang:           "OpBang",
-	OpCall:           "OpCall",
-	OpConstant:       "OpConstant",
-	OpDec:            "OpDec",
-	OpDiv:            "OpDiv",
-	OpEqual:          "OpEqual",
-	OpFalse:          "OpFalse",
-	OpGreater:        "OpGreater",
-	OpGreaterEqual:   "OpGreaterEqual",
-	OpInc:            "OpInc",
-	OpIndex:          "OpIndex",
-	OpIterationNext:  "OpIterationNext",
-	OpIterationReset: "OpIterationReset",
-	OpJump:           "OpJump",
-	OpJumpIfFalse:    "OpJumpIfFalse",
-	OpLess:           "OpLess",
-	OpLessEqual:      "OpLessEqual",
-	OpLookup:         "OpLookup",
-	OpMatches:        "OpMatches",
-	OpMinus:          "OpMinus",
-	OpMod:            "OpMod",
-	OpMul:            "OpMul",
-	OpNop:            "OpNop",
-	OpNotEqual:       "OpNotEqual",
-	OpNotMatches:     "OpNotMatches",
-	OpOr:             "OpOr",
-	OpPower:          "OpPower",
-	OpPush:           "OpPush",
-	OpRange:          "OpRange",
-	OpReturn:         "OpReturn",
-	OpSet:            "OpSet",
-	OpSquareRoot:     "OpSquareRoot",
-	OpSub:            "OpSub",
-	OpTrue:           "OpTrue",
+	OpAdd:             "OpAdd",
+	OpAnd:             "OpAnd",
+	OpArray:           "OpArray",
+	OpArrayIn:         "OpArrayIn",
+	OpBang:            "OpBang",
+	OpBitAnd:          "OpBitAnd",
+	OpBitOr:           "OpBitOr",
+	OpBitXor:          "OpBitXor",
+	OpCall:            "OpCall",
+	OpCheck:           "OpCheck",
+	OpCheckComparison: "OpCheckComparison",
+	OpConstant:        "OpConstant",
+	OpDec:             "OpDec",
+	OpDiv:             "OpDiv",
+	OpDup:             "OpDup",
+	OpEnter:           "OpEnter",
+	OpEqual:           "OpEqual",
+	OpEqualFold:       "OpEqualFold",
+	OpExists:          "OpExists",
+	OpFalse:           "OpFalse",
+	OpGreater:         "OpGreater",
+	OpGreaterEqual:    "OpGreaterEqual",
+	OpHash:            "OpHash",
+	OpInc:             "OpInc",
+	OpIndex:           "OpIndex",
+	OpIterationNext:   "OpIterationNext",
+	OpIterationReset:  "OpIterationReset",
+	OpJump:            "OpJump",
+	OpJumpIfFalse:     "OpJumpIfFalse",
+	OpJumpIfNotNull:   "OpJumpIfNotNull",
+	OpJumpIfNull:      "OpJumpIfNull",
+	OpLeave:           "OpLeave",
+	OpLess:            "OpLess",
+	OpLessEqual:       "OpLessEqual",
+	OpLookup:          "OpLookup",
+	OpMember:          "OpMember",
+	OpMatches:         "OpMatches",
+	OpMatchesFold:     "OpMatchesFold",
+	OpMinus:           "OpMinus",
+	OpMod:             "OpMod",
+	OpMul:             "OpMul",
+	OpNop:             "OpNop",
+	OpNotEqual:        "OpNotEqual",
+	OpNotEqualFold:    "OpNotEqualFold",
+	OpNotMatches:      "OpNotMatches",
+	OpNotMatchesFold:  "OpNotMatchesFold",
+	OpNull:            "OpNull",
+	OpObject:          "OpObject",
+	OpOr:              "OpOr",
+	OpPop:             "OpPop",
+	OpPower:           "OpPower",
+	OpPush:            "OpPush",
+	OpRange:           "OpRange",
+	OpReturn:          "OpReturn",
+	OpRot:             "OpRot",
+	OpSet:             "OpSet",
+	OpShiftLeft:       "OpShiftLeft",
+	OpShiftRight:      "OpShiftRight",
+	OpSlice:           "OpSlice",
+	OpSquareRoot:      "OpSquareRoot",
+	OpSub:             "OpSub",
+	OpTrue:            "OpTrue",
 }
 
 // Length returns the length of the given opcode, including any optional
@@ -240,11 +378,21 @@ func Length(op Opcode) int {
 		return 3
 	case OpCall:
 		return 3
+	case OpCheck:
+		return 3
+	case OpCheckComparison:
+		return 3
 	case OpConstant:
 		return 3
 	case OpDec:
 		return 3
-	case OpJump, OpJumpIfFalse:
+	case OpEnter:
+		return 3
+	case OpExists:
+		return 3
+	case OpHash:
+		return 3
+	case OpJump, OpJumpIfFalse, OpJumpIfNotNull, OpJumpIfNull:
 		return 3
 	case OpInc:
 		return 3
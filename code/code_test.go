@@ -33,9 +33,16 @@ func TestOpcodes(t *testing.T) {
 			c := Opcode(k)
 			if c != OpArray &&
 				c != OpCall &&
+				c != OpCheck &&
+				c != OpCheckComparison &&
 				c != OpConstant &&
+				c != OpEnter &&
+				c != OpExists &&
+				c != OpHash &&
 				c != OpJump &&
 				c != OpJumpIfFalse &&
+				c != OpJumpIfNotNull &&
+				c != OpJumpIfNull &&
 				c != OpLookup &&
 				c != OpInc &&
 				c != OpDec &&
@@ -7,15 +7,26 @@ package evalfilter
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
 
 	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
 // compile is core-code for converting the AST into a series of bytecodes.
 func (e *Eval) compile(node ast.Node) error {
 
+	// Record the position of the node, so that the instructions we
+	// emit for it can be used to report the location of errors.
+	if pos, ok := nodePosition(node); ok {
+		saved := e.position
+		e.position = pos
+		defer func() { e.position = saved }()
+	}
+
 	switch node := node.(type) {
 
 	case *ast.Program:
@@ -41,6 +52,9 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpFalse)
 		}
 
+	case *ast.NullLiteral:
+		e.emit(code.OpNull)
+
 	case *ast.FloatLiteral:
 		str := &object.Float{Value: node.Value}
 		e.emit(code.OpConstant, e.addConstant(str))
@@ -94,6 +108,19 @@ func (e *Eval) compile(node ast.Node) error {
 		}
 		e.emit(code.OpArray, len(node.Elements))
 
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			err := e.compile(pair.Key)
+			if err != nil {
+				return err
+			}
+			err = e.compile(pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+		e.emit(code.OpHash, len(node.Pairs))
+
 	case *ast.ReturnStatement:
 		err := e.compile(node.ReturnValue)
 		if err != nil {
@@ -107,16 +134,32 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+	case *ast.FunctionDefinition:
+		return e.compileFunction(node)
+
 	case *ast.InfixExpression:
+
+		// The null-coalescing operator is lazy, so it
+		// is handled specially.
+		if node.Operator == "??" {
+			return e.compileCoalesce([]ast.Expression{node.Left, node.Right})
+		}
+
 		err := e.compile(node.Left)
 		if err != nil {
 			return err
 		}
+		if node.Operator == "&&" {
+			e.emitCheck(node.Left)
+		}
 
 		err = e.compile(node.Right)
 		if err != nil {
 			return err
 		}
+		if node.Operator == "&&" {
+			e.emitCheck(node.Right)
+		}
 
 		switch node.Operator {
 
@@ -134,6 +177,18 @@ func (e *Eval) compile(node ast.Node) error {
 		case "**":
 			e.emit(code.OpPower)
 
+			// bitwise
+		case "&":
+			e.emit(code.OpBitAnd)
+		case "|":
+			e.emit(code.OpBitOr)
+		case "^":
+			e.emit(code.OpBitXor)
+		case "<<":
+			e.emit(code.OpShiftLeft)
+		case ">>":
+			e.emit(code.OpShiftRight)
+
 			// comparisons
 		case "<":
 			e.emit(code.OpLess)
@@ -147,12 +202,20 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpEqual)
 		case "!=":
 			e.emit(code.OpNotEqual)
+		case "==*":
+			e.emit(code.OpEqualFold)
+		case "!=*":
+			e.emit(code.OpNotEqualFold)
 
 			// special matches - regexp and array membership
 		case "~=":
 			e.emit(code.OpMatches)
 		case "!~":
 			e.emit(code.OpNotMatches)
+		case "~=*":
+			e.emit(code.OpMatchesFold)
+		case "!~*":
+			e.emit(code.OpNotMatchesFold)
 		case "in":
 			e.emit(code.OpArrayIn)
 
@@ -169,6 +232,9 @@ func (e *Eval) compile(node ast.Node) error {
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 
+	case *ast.ChainedComparison:
+		return e.compileChainedComparison(node)
+
 	case *ast.PrefixExpression:
 		err := e.compile(node.Right)
 		if err != nil {
@@ -246,6 +312,9 @@ func (e *Eval) compile(node ast.Node) error {
 		return nil
 	case *ast.IfExpression:
 
+		// When explaining we record the test, and the branch taken.
+		e.emitEnter("if "+node.Condition.String(), e.position)
+
 		// Compile the expression.
 		err := e.compile(node.Condition)
 		if err != nil {
@@ -278,10 +347,12 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		// Compile the code in block A
 		//
+		e.emitEnter("then", token.Position{})
 		err = e.compile(node.Consequence)
 		if err != nil {
 			return err
 		}
+		e.emitLeave()
 
 		//
 		// Here we're calculating the length END of A.
@@ -302,7 +373,10 @@ func (e *Eval) compile(node ast.Node) error {
 		// needed to jump over the first block if the condition
 		// was not true - and we've already handled that case.
 		//
-		if node.Alternative != nil {
+		// When explaining we always have an else-branch, so that
+		// the explanation shows it was taken.
+		//
+		if node.Alternative != nil || e.explain {
 
 			//
 			// Add a jump to the end of A - which will
@@ -324,10 +398,14 @@ func (e *Eval) compile(node ast.Node) error {
 			//
 			// Compile the block
 			//
-			err := e.compile(node.Alternative)
-			if err != nil {
-				return err
+			e.emitEnter("else", token.Position{})
+			if node.Alternative != nil {
+				err := e.compile(node.Alternative)
+				if err != nil {
+					return err
+				}
 			}
+			e.emitLeave()
 
 			//
 			// Now we change the offset to be C, which
@@ -362,6 +440,7 @@ func (e *Eval) compile(node ast.Node) error {
 		//     // fall-through
 		//  C:
 		//
+		e.emitLeave()
 
 	case *ast.TernaryExpression:
 
@@ -530,7 +609,47 @@ func (e *Eval) compile(node ast.Node) error {
 		// emit `OpCall NN` where NN is the number of arguments
 		// to pop and invoke the function with.
 		//
+		// The exception is `coalesce`, which evaluates its
+		// arguments lazily and is handled specially.
+		//
+		// Calls to `assert` are replaced by `true`, without their
+		// arguments being evaluated, if we were asked to remove them.
+		//
+		// So is `exists`, which tests whether a field is present
+		// rather than looking up its value, and `inspect`, which
+		// returns all of the fields of the object.
+		//
+		// Those special forms are only used if neither the host
+		// application, nor the script, defined a function of the
+		// same name - which would otherwise be silently ignored.
+		//
+		if node.Function.String() == "coalesce" && e.specialForm("coalesce") {
+			return e.compileCoalesce(node.Arguments)
+		}
+		if node.Function.String() == "exists" && e.specialForm("exists") {
+			return e.compileExists(node)
+		}
+		if node.Function.String() == "inspect" && e.specialForm("inspect") {
+			if len(node.Arguments) != 0 {
+				return fmt.Errorf("%s: inspect takes no arguments", node.Token.Position)
+			}
+			e.emit(code.OpObject)
+			return nil
+		}
+		if node.Function.String() == "assert" && e.noAssert {
+			e.emit(code.OpTrue)
+			return nil
+		}
+
+		// A call to `anyMatch` which is only given a path, and
+		// a value, resolves the path against the fields of the
+		// object - which are passed as an extra first argument.
 		args := len(node.Arguments)
+		if node.Function.String() == "anyMatch" && args == 2 {
+			e.emit(code.OpObject)
+			args++
+		}
+
 		for _, a := range node.Arguments {
 
 			err := e.compile(a)
@@ -546,22 +665,348 @@ func (e *Eval) compile(node ast.Node) error {
 		// then a call instruction with the number of args.
 		e.emit(code.OpCall, args)
 
-	case *ast.IndexExpression:
+	case *ast.IndexExpression, *ast.MemberExpression:
+		return e.compileChain(node.(ast.Expression))
+
+	case *ast.SliceExpression:
 		err := e.compile(node.Left)
 		if err != nil {
 			return err
 		}
 
+		// Missing indexes are represented by null.
+		for _, idx := range []ast.Expression{node.Start, node.End} {
+			if idx == nil {
+				e.emit(code.OpConstant, e.addConstant(&object.Null{}))
+				continue
+			}
+
+			err = e.compile(idx)
+			if err != nil {
+				return err
+			}
+		}
+
+		e.emit(code.OpSlice)
+
+	default:
+		return fmt.Errorf("unknown node type %T %v", node, node)
+	}
+	return nil
+}
+
+// nodePosition returns the position of the given node, if it is one
+// which might lead to a run-time error.
+func nodePosition(node ast.Node) (token.Position, bool) {
+
+	switch node := node.(type) {
+	case *ast.AssignStatement:
+		return node.Token.Position, true
+	case *ast.CallExpression:
+		return node.Token.Position, true
+	case *ast.ChainedComparison:
+		return node.Token.Position, true
+	case *ast.ExpressionStatement:
+		return node.Token.Position, true
+	case *ast.ForeachStatement:
+		return node.Token.Position, true
+	case *ast.IndexExpression:
+		return node.Token.Position, true
+	case *ast.InfixExpression:
+		return node.Token.Position, true
+	case *ast.MemberExpression:
+		return node.Token.Position, true
+	case *ast.PostfixExpression:
+		return node.Token.Position, true
+	case *ast.PrefixExpression:
+		return node.Token.Position, true
+	case *ast.ReturnStatement:
+		return node.Token.Position, true
+	case *ast.SliceExpression:
+		return node.Token.Position, true
+	}
+
+	return token.Position{}, false
+}
+
+// compileCoalesce compiles a list of expressions such that the value of
+// the first non-null one is left upon the stack.
+//
+// Given `a ?? b ?? c` we'll emit:
+//
+//	   a
+//	   jmp END if not null
+//	   b
+//	   jmp END if not null
+//	   c
+//	END:
+//
+// The expressions are evaluated lazily, so the later expressions are
+// never evaluated if an earlier one was non-null.
+func (e *Eval) compileCoalesce(exprs []ast.Expression) error {
+
+	if len(exprs) == 0 {
+		return fmt.Errorf("coalesce requires at least one argument")
+	}
+
+	var jumps []int
+
+	for i, expr := range exprs {
+
+		err := e.compile(expr)
+		if err != nil {
+			return err
+		}
+
+		// Jump to the end - placeholder.
+		if i < len(exprs)-1 {
+			jumps = append(jumps, e.emit(code.OpJumpIfNotNull, 9999))
+		}
+	}
+
+	// Now we know our ending position we can update the jumps.
+	for _, pos := range jumps {
+		e.changeOperand(pos, len(e.instructions))
+	}
+
+	return nil
+}
+
+// compileExists compiles a call to `exists`, which is given a field, or
+// a path of fields such as `User.Address.City`.
+//
+// We emit a single instruction which refers to the path of the field,
+// joined by periods, so that it can be resolved without the value of
+// any missing segment becoming null.
+func (e *Eval) compileExists(node *ast.CallExpression) error {
+
+	usage := fmt.Errorf("%s: exists requires a single field, such as Name or User.Address", node.Token.Position)
+
+	if len(node.Arguments) != 1 {
+		return usage
+	}
+
+	var path []string
+
+	arg := node.Arguments[0]
+	for {
+		if member, ok := arg.(*ast.MemberExpression); ok {
+			path = append([]string{member.Field}, path...)
+			arg = member.Left
+			continue
+		}
+		if ident, ok := arg.(*ast.Identifier); ok {
+			path = append([]string{ident.Value}, path...)
+			break
+		}
+		return usage
+	}
+
+	str := &object.String{Value: strings.Join(path, ".")}
+	e.emit(code.OpExists, e.addConstant(str))
+	return nil
+}
+
+// compileChain compiles a chain of field-accesses and index operations,
+// such as `user?.address.lines[0]`.
+//
+// If an optional-chaining access, via `?.`, finds a null value then the
+// remainder of the chain is skipped and the result is null.
+func (e *Eval) compileChain(node ast.Expression) error {
+
+	var jumps []int
+
+	err := e.compileChainLink(node, &jumps)
+	if err != nil {
+		return err
+	}
+
+	// Now we know our ending position we can update the jumps.
+	for _, pos := range jumps {
+		e.changeOperand(pos, len(e.instructions))
+	}
+
+	return nil
+}
+
+// compileChainLink compiles a single link of a chain, recording the
+// positions of any short-circuiting jumps.
+func (e *Eval) compileChainLink(node ast.Expression, jumps *[]int) error {
+
+	switch node := node.(type) {
+
+	case *ast.MemberExpression:
+		err := e.compileChainLink(node.Left, jumps)
+		if err != nil {
+			return err
+		}
+
+		// Skip the rest of the chain if we have a null - placeholder.
+		if node.Optional {
+			*jumps = append(*jumps, e.emit(code.OpJumpIfNull, 9999))
+		}
+
+		e.position = node.Token.Position
+		str := &object.String{Value: node.Field}
+		e.emit(code.OpConstant, e.addConstant(str))
+		e.emit(code.OpMember)
+
+	case *ast.IndexExpression:
+		err := e.compileChainLink(node.Left, jumps)
+		if err != nil {
+			return err
+		}
+
 		err = e.compile(node.Index)
 		if err != nil {
 			return err
 		}
 
+		e.position = node.Token.Position
 		e.emit(code.OpIndex)
 
 	default:
-		return fmt.Errorf("unknown node type %T %v", node, node)
+		return e.compile(node)
+	}
+
+	return nil
+}
+
+// compileChainedComparison compiles a chain of comparisons, such as
+// `a < b < c`, ensuring that each operand is only evaluated once.
+//
+// We'll emit:
+//
+//	    a
+//	    b
+//	    dup
+//	    rot
+//	    compare
+//	    jmp FAIL if false
+//	    c
+//	    compare
+//	    jmp END
+//	FAIL:
+//	    pop
+//	    false
+//	END:
+//
+// The `dup` + `rot` leaves a copy of `b` beneath the result of the
+// first comparison, ready to be compared against `c`.  As with the
+// `&&` operator the chain stops at the first failing comparison.
+func (e *Eval) compileChainedComparison(node *ast.ChainedComparison) error {
+
+	ops := map[string]code.Opcode{
+		"<":  code.OpLess,
+		"<=": code.OpLessEqual,
+		">":  code.OpGreater,
+		">=": code.OpGreaterEqual,
+	}
+
+	var fails []int
+
+	err := e.compile(node.Operands[0])
+	if err != nil {
+		return err
+	}
+
+	for i, operator := range node.Operators {
+
+		op, ok := ops[operator]
+		if !ok {
+			return fmt.Errorf("unknown operator %s", operator)
+		}
+
+		err = e.compile(node.Operands[i+1])
+		if err != nil {
+			return err
+		}
+
+		// The last comparison is the result.
+		if i == len(node.Operators)-1 {
+			e.emit(op)
+			break
+		}
+
+		e.emit(code.OpDup)
+		e.emit(code.OpRot)
+		e.emit(op)
+		fails = append(fails, e.emit(code.OpJumpIfFalse, 9999))
+	}
+
+	// Jump over the failure-handler - placeholder.
+	end := e.emit(code.OpJump, 9999)
+
+	// Now we know where the failure-handler starts.
+	for _, pos := range fails {
+		e.changeOperand(pos, len(e.instructions))
+	}
+	e.emit(code.OpPop)
+	e.emit(code.OpFalse)
+
+	e.changeOperand(end, len(e.instructions))
+
+	return nil
+}
+
+// specialForm returns true if calls to the named function are compiled
+// specially, rather than invoking a function of that name.  That isn't
+// the case if the host application, or the script, defined one.
+func (e *Eval) specialForm(name string) bool {
+
+	if _, ok := e.environment.GetFunction(name); ok {
+		return false
+	}
+
+	defined := false
+	if e.program != nil {
+		ast.Walk(e.program, func(node ast.Node) bool {
+			if fn, ok := node.(*ast.FunctionDefinition); ok && fn.Name == name {
+				defined = true
+			}
+			return !defined
+		})
+	}
+	return !defined
+}
+
+// compileFunction compiles the body of a function which the script
+// defined.
+//
+// The body is compiled separately from the main program, using the same
+// constant-pool, and the function is made available before the script
+// runs - so it may be called before the point at which it is defined.
+func (e *Eval) compileFunction(node *ast.FunctionDefinition) error {
+
+	for _, fn := range e.functions {
+		if fn.Name == node.Name {
+			return fmt.Errorf("%s: the function %s is already defined", node.Token.Position, node.Name)
+		}
 	}
+
+	instructions, positions := e.instructions, e.positions
+	e.instructions, e.positions = nil, make(map[int]token.Position)
+
+	err := e.compile(node.Body)
+
+	// A function which doesn't return a value returns null.
+	e.emit(code.OpNull)
+	e.emit(code.OpReturn)
+
+	fn := &vm.Function{
+		Name:         node.Name,
+		Parameters:   node.Parameters,
+		Instructions: e.instructions,
+		Positions:    e.positions,
+	}
+
+	e.instructions, e.positions = instructions, positions
+
+	if err != nil {
+		return err
+	}
+
+	e.functions = append(e.functions, fn)
 	return nil
 }
 
@@ -610,9 +1055,115 @@ func (e *Eval) emit(op code.Opcode, operands ...int) int {
 	posNewInstruction := len(e.instructions)
 	e.instructions = append(e.instructions, ins...)
 
+	// Record the position of the source which generated this.
+	if e.positions != nil && e.position.Line > 0 {
+		e.positions[posNewInstruction] = e.position
+	}
+
 	return posNewInstruction
 }
 
+// emitCheck emits an instruction to record a diagnostic if the given
+// operand of an `&&` expression was false.
+//
+// This is only done if diagnostics were enabled when the script was
+// compiled, and if the operand isn't itself an `&&` expression - as
+// the failures of its operands will already have been recorded.
+func (e *Eval) emitCheck(operand ast.Expression) {
+
+	if !e.diagnostics {
+		return
+	}
+
+	if infix, ok := operand.(*ast.InfixExpression); ok && infix.Operator == "&&" {
+		return
+	}
+
+	if pos, ok := nodePosition(operand); ok {
+		saved := e.position
+		e.position = pos
+		defer func() { e.position = saved }()
+	}
+
+	str := &object.String{Value: operand.String()}
+
+	// If the operand is a comparison then the diagnostic includes the
+	// values which were compared, described by the source of each
+	// operand.  The three constants must be adjacent, so they're
+	// added directly rather than being shared.
+	if infix, ok := operand.(*ast.InfixExpression); ok && isComparison(infix.Operator) {
+		offset := len(e.constants)
+		e.constants = append(e.constants,
+			str,
+			&object.String{Value: operandSource(infix.Left)},
+			&object.String{Value: operandSource(infix.Right)})
+		e.emit(code.OpCheckComparison, offset)
+		return
+	}
+
+	e.emit(code.OpCheck, e.addConstant(str))
+}
+
+// isComparison returns true if the given operator compares two values.
+func isComparison(operator string) bool {
+	switch operator {
+	case "<", "<=", ">", ">=", "==", "!=", "~=", "!~", "==*", "!=*", "~=*", "!~*", "in":
+		return true
+	}
+	return false
+}
+
+// operandSource returns the source of an operand of a comparison, for
+// the reason given by a diagnostic, or an empty string if the operand is
+// a literal - as its source would only repeat its value.
+func operandSource(node ast.Expression) string {
+	switch node := node.(type) {
+	case *ast.BooleanLiteral, *ast.FloatLiteral, *ast.IntegerLiteral, *ast.NullLiteral, *ast.RegexpLiteral, *ast.StringLiteral:
+		return ""
+	case *ast.ArrayLiteral:
+		literal := true
+		for _, el := range node.Elements {
+			if operandSource(el) != "" {
+				literal = false
+			}
+		}
+		if literal {
+			return ""
+		}
+	}
+
+	// Calls are stringified as statements, with a terminator.
+	return strings.ReplaceAll(node.String(), ";\n", "")
+}
+
+// emitEnter emits an instruction to start a new node, with the given
+// description and position, in the explanation of a script's execution.
+//
+// This is only done if we're compiling the script to be explained.
+func (e *Eval) emitEnter(description string, pos token.Position) {
+
+	if !e.explain {
+		return
+	}
+
+	saved := e.position
+	e.position = pos
+	defer func() { e.position = saved }()
+
+	str := &object.String{Value: description}
+	e.emit(code.OpEnter, e.addConstant(str))
+}
+
+// emitLeave emits an instruction to finish the current node in the
+// explanation of a script's execution.
+//
+// This is only done if we're compiling the script to be explained.
+func (e *Eval) emitLeave() {
+	if e.explain {
+		e.emit(code.OpLeave)
+	}
+}
+
 // changeOperand is designed to patch the operand of
 // an instruction.
 //
@@ -3,23 +3,51 @@
 package environment
 
 import (
+	"bytes"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/skx/evalfilter/v2/object"
 )
 
+// maxStringLength is the length of the largest string which our `repeat`,
+// padding, and formatting functions will create, unless a different limit
+// is set via SetMaxStringLength, to prevent scripts from exhausting the
+// memory of their host.
+const maxStringLength = 16 * 1024 * 1024
+
+// maxRangeLength is the number of elements in the largest array which our
+// `range` function will create, for the same reason.
+const maxRangeLength = 1024 * 1024
+
 // regCache is a cache of compiled regular expression objects.
 // These may persist between runs because a regular expression object
 // is essentially constant.
 var regCache map[string]*regexp.Regexp
 
+// regCacheLock protects our regexp cache, as scripts may be executed
+// concurrently.
+var regCacheLock sync.Mutex
+
 // init ensures that our regexp cache is populated
 func init() {
 	regCache = make(map[string]*regexp.Regexp)
@@ -48,283 +76,2993 @@ func fnFloat(args []object.Object) object.Object {
 	return &object.Float{Value: i}
 }
 
-// fnInt is the implementation of the `int` function.
+// fnAll is the implementation of our `all` function.
 //
-// It converts an object to an integer, if it can.
-//
-// On failure it returns Null
-func fnInt(args []object.Object) object.Object {
+// It returns true if the named function returns a true value for every
+// element of the given array, stopping at the first which is false.
+func (e *Environment) fnAll(args []object.Object) object.Object {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	arr, fn, err := e.higherOrderArgs("all", args)
+	if err != nil {
+		return err
 	}
 
-	// Stringify
-	str := args[0].Inspect()
+	for i, el := range arr.Elements {
+		res := fn([]object.Object{el})
+		if res.Type() == object.ERROR {
+			return &object.Error{Message: fmt.Sprintf("all: element %d: %s", i, res.Inspect())}
+		}
+		if !res.True() {
+			return &object.Boolean{Value: false}
+		}
+	}
 
-	i, err := strconv.ParseInt(str, 10, 64)
+	return &object.Boolean{Value: true}
+}
+
+// fnAny is the implementation of our `any` function.
+//
+// It returns true if the named function returns a true value for any
+// element of the given array, stopping at the first which is true.
+func (e *Environment) fnAny(args []object.Object) object.Object {
+
+	arr, fn, err := e.higherOrderArgs("any", args)
 	if err != nil {
-		return &object.Null{}
+		return err
 	}
 
-	return &object.Integer{Value: i}
+	for i, el := range arr.Elements {
+		res := fn([]object.Object{el})
+		if res.Type() == object.ERROR {
+			return &object.Error{Message: fmt.Sprintf("any: element %d: %s", i, res.Inspect())}
+		}
+		if res.True() {
+			return &object.Boolean{Value: true}
+		}
+	}
+
+	return &object.Boolean{Value: false}
 }
 
-// fnLen is the implementation of our `len` function.
+// fnAnyMatch is the implementation of our `anyMatch` function.
 //
-// Interestingly this function doesn't just count the length of string
-// objects, instead we cast all objects to strings and allow their lengths
-// to be calculated.
+// It returns true if any of the values found by following the given
+// path, such as "items.*.status", from the given value is equal to the
+// expected one.  Scripts usually omit the first argument, in which case
+// the compiler supplies the fields of the object being tested.
+func (e *Environment) fnAnyMatch(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Message: "anyMatch: wrong number of arguments"}
+	}
+
+	path, ok := args[1].(*object.String)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("anyMatch: path must be a string, not %s", args[1].Type())}
+	}
+
+	for _, val := range wildcardPath(args[0], strings.Split(path.Value, ".")) {
+		if equal, _ := e.Equal(val, args[2]); equal {
+			return &object.Boolean{Value: true}
+		}
+	}
+
+	return &object.Boolean{Value: false}
+}
+
+// wildcardPath returns the values found by following the given path, of
+// field-names, through nested hashes and arrays.
 //
-// The obvious exception is the handling of arrays.  The length of
-// an array is the number of elements which it contains.
+// A name of "*" matches every value of a hash, or element of an array,
+// and a number matches the element of an array at that index.  Parts of
+// the path which don't resolve contribute no values.
+func wildcardPath(obj object.Object, names []string) []object.Object {
+
+	if len(names) == 0 {
+		return []object.Object{obj}
+	}
+
+	var children []object.Object
+	switch obj := obj.(type) {
+	case *object.Hash:
+		if names[0] == "*" {
+			for _, val := range obj.Pairs {
+				children = append(children, val)
+			}
+		} else if val, ok := obj.Pairs[names[0]]; ok {
+			children = append(children, val)
+		}
+	case *object.Array:
+		if names[0] == "*" {
+			children = obj.Elements
+		} else if i, err := strconv.Atoi(names[0]); err == nil && i >= 0 && i < len(obj.Elements) {
+			children = append(children, obj.Elements[i])
+		}
+	}
+
+	var out []object.Object
+	for _, child := range children {
+		out = append(out, wildcardPath(child, names[1:])...)
+	}
+	return out
+}
+
+// fnAppend is the implementation of our `append` function.
 //
-// So `len(false)` is 5, len(3) is 1, and `len(0.123)` is 5, and arrays
-// work as expectd: len([]) is zero, and len(["steve", "kemp"]) is two.
+// It returns a copy of the given array with the additional arguments
+// appended to it, the original array is not modified.
+func fnAppend(args []object.Object) object.Object {
+
+	// We expect at least one argument
+	if len(args) < 1 {
+		return &object.Error{Message: "append: wrong number of arguments"}
+	}
+
+	// The first must be an array
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("append: first argument must be an array, not %s", args[0].Type())}
+	}
+
+	// Copy the elements, and append the new ones.
+	out := make([]object.Object, len(arr.Elements), len(arr.Elements)+len(args)-1)
+	copy(out, arr.Elements)
+	out = append(out, args[1:]...)
+
+	return &object.Array{Elements: out}
+}
+
+// fnApproxEqual is the implementation of our `approxEqual` function.
 //
-func fnLen(args []object.Object) object.Object {
+// It returns true if the two numbers differ by no more than the given
+// epsilon.
+func fnApproxEqual(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Message: "approxEqual: wrong number of arguments"}
+	}
+
+	// Convert them all to numbers.
+	var vals [3]float64
+	for i, arg := range args {
+		num, err := toNumberArg(arg)
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("approxEqual: %s", err.Error())}
+		}
+		vals[i], _ = numericValue(num)
+	}
+
+	if vals[2] < 0 || math.IsNaN(vals[2]) {
+		return &object.Error{Message: fmt.Sprintf("approxEqual: epsilon must not be negative, got %s", args[2].Inspect())}
+	}
+
+	return &object.Boolean{Value: ApproxEqual(vals[0], vals[1], vals[2])}
+}
+
+// ApproxEqual returns true if the two values differ by no more than the
+// given epsilon.
+//
+// An epsilon of zero requires the values to be identical.
+func ApproxEqual(a, b, epsilon float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= epsilon
+}
+
+// fnAssert is the implementation of our `assert` function.
+//
+// It returns true if the condition is true, otherwise it returns an
+// error which aborts the script, containing the optional message.
+func fnAssert(args []object.Object) object.Object {
+
+	// We expect one or two arguments
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: "assert: wrong number of arguments"}
+	}
+
+	if args[0].True() {
+		return &object.Boolean{Value: true}
+	}
+
+	if len(args) == 2 {
+		return &object.Error{Message: fmt.Sprintf("assertion failed: %s", args[1].Inspect())}
+	}
+	return &object.Error{Message: "assertion failed"}
+}
+
+// fnAvg is the implementation of our `avg` function.
+//
+// It returns the mean of the numbers in the given array, as a float.
+func fnAvg(args []object.Object) object.Object {
+
+	nums, err := numericArrayArgs("avg", args)
+	if err != nil {
+		return err
+	}
+
+	// Avoid dividing by zero
+	if len(nums) == 0 {
+		return &object.Error{Message: "avg: cannot average an empty array"}
+	}
+
+	total := 0.0
+	for _, n := range nums {
+		v, _ := numericValue(n)
+		total += v
+	}
+
+	return &object.Float{Value: total / float64(len(nums))}
+}
+
+// fnBase64Decode is the implementation of our `base64decode` function.
+//
+// Input which isn't valid base64, or which doesn't decode to a valid
+// UTF-8 string, results in an error.
+func fnBase64Decode(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: "base64decode: wrong number of arguments"}
 	}
 
-	// array is handled differently
-	switch arg := args[0].(type) {
-	case *object.Array:
-		return &object.Integer{Value: int64(len(arg.Elements))}
+	out, err := base64.StdEncoding.DecodeString(args[0].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("base64decode: %s", err.Error())}
+	}
+	if !utf8.Valid(out) {
+		return &object.Error{Message: "base64decode: input does not decode to a valid string"}
 	}
 
-	// Stringify
-	str := args[0].Inspect()
-	sum := utf8.RuneCountInString(str)
+	return &object.String{Value: string(out)}
+}
 
-	// return
-	return &object.Integer{Value: int64(sum)}
+// fnBase64Encode is the implementation of our `base64encode` function.
+func fnBase64Encode(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "base64encode: wrong number of arguments"}
+	}
+
+	return &object.String{Value: base64.StdEncoding.EncodeToString([]byte(args[0].Inspect()))}
 }
 
-// fnLower is the implementation of our `lower` function.
+// fnCapitalize is the implementation of our `capitalize` function.
 //
-// Much like the `len` function here we cast to a string before
-// we lower-case.
-func fnLower(args []object.Object) object.Object {
+// It upper-cases the first character of the value, if it is a letter,
+// and lower-cases the remainder.
+func fnCapitalize(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: "capitalize: wrong number of arguments"}
 	}
 
-	// Stringify and lower-case
-	arg := fmt.Sprintf("%v", args[0].Inspect())
-	arg = strings.ToLower(arg)
+	return &object.String{Value: capitalizeWord(args[0].Inspect())}
+}
 
-	// Return
-	return &object.String{Value: arg}
+// capitalizeWord upper-cases the first character of the given string, if
+// it is a letter, and lower-cases the remainder.
+func capitalizeWord(s string) string {
+
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+
+	return string(unicode.ToTitle(r)) + strings.ToLower(s[size:])
 }
 
-// fnMatch is the implementation of our regex `match` function.
-func fnMatch(args []object.Object) object.Object {
+// fnTitle is the implementation of our `title` function.
+//
+// It capitalizes each word of the value, where words are separated by
+// whitespace, which is preserved.
+func fnTitle(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "title: wrong number of arguments"}
+	}
+
+	str := args[0].Inspect()
+
+	var out strings.Builder
+	start := -1
+	for i, r := range str {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				out.WriteString(capitalizeWord(str[start:i]))
+				start = -1
+			}
+			out.WriteRune(r)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		out.WriteString(capitalizeWord(str[start:]))
+	}
+
+	return &object.String{Value: out.String()}
+}
+
+// fnCeil is the implementation of our `ceil` function.
+func fnCeil(args []object.Object) object.Object {
+	return roundHelper("ceil", args, math.Ceil)
+}
+
+// fnChunk is the implementation of our `chunk` function.
+//
+// It splits the given array into arrays holding the given number of
+// elements, the last of which may be shorter.
+func fnChunk(args []object.Object) object.Object {
 
 	// We expect two arguments
 	if len(args) != 2 {
-		return &object.Boolean{Value: false}
+		return &object.Error{Message: "chunk: wrong number of arguments"}
 	}
 
-	str := args[0].Inspect()
-	reg := args[1].Inspect()
+	// The first must be an array
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("chunk: first argument must be an array, not %s", args[0].Type())}
+	}
 
-	// Look for the compiled regular-expression object in our cache.
-	r, ok := regCache[reg]
+	// The second a positive integer
+	size, ok := args[1].(*object.Integer)
 	if !ok {
+		return &object.Error{Message: fmt.Sprintf("chunk: size must be an integer, not %s", args[1].Type())}
+	}
+	if size.Value <= 0 {
+		return &object.Error{Message: fmt.Sprintf("chunk: size must be positive, not %d", size.Value)}
+	}
 
-		// OK it wasn't found, so compile it.
-		var err error
-		r, err = regexp.Compile(reg)
+	out := []object.Object{}
+	for i := 0; i < len(arr.Elements); i += int(size.Value) {
+		// A huge size might overflow.
+		end := i + int(size.Value)
+		if end > len(arr.Elements) || end < i {
+			end = len(arr.Elements)
+		}
+		out = append(out, &object.Array{Elements: append([]object.Object{}, arr.Elements[i:end]...)})
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// fnClamp is the implementation of our `clamp` function.
+//
+// This returns the given value, limited to the range [lo, hi].  The
+// result has the same type as the input value, where that is exact.
+func fnClamp(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Message: "clamp: wrong number of arguments"}
+	}
 
-		// Ensure it compiled
+	// Convert them all to numbers.
+	var nums [3]object.Object
+	for i, arg := range args {
+		num, err := toNumberArg(arg)
 		if err != nil {
-			fmt.Printf("Invalid regular expression %s %s", reg, err.Error())
-			return &object.Boolean{Value: false}
+			return &object.Error{Message: fmt.Sprintf("clamp: %s", err.Error())}
 		}
+		nums[i] = num
+	}
+	x, lo, hi := nums[0], nums[1], nums[2]
+
+	xVal, _ := numericValue(x)
+	loVal, _ := numericValue(lo)
+	hiVal, _ := numericValue(hi)
 
-		// store in the cache for next time
-		regCache[reg] = r
+	if loVal > hiVal {
+		return &object.Error{Message: fmt.Sprintf("clamp: lower bound %s is greater than upper bound %s", lo.Inspect(), hi.Inspect())}
 	}
 
-	// Split the input by newline.
-	for _, s := range strings.Split(str, "\n") {
+	res := x
+	if xVal < loVal {
+		res = lo
+	} else if xVal > hiVal {
+		res = hi
+	}
 
-		// Strip leading-trailing whitespace
-		s = strings.TrimSpace(s)
+	// Return the same type as the input, where we can.
+	switch x.(type) {
+	case *object.Integer:
+		if f, ok := res.(*object.Float); ok && f.Value == math.Trunc(f.Value) {
+			return &object.Integer{Value: int64(f.Value)}
+		}
+	case *object.Float:
+		if i, ok := res.(*object.Integer); ok {
+			return &object.Float{Value: float64(i.Value)}
+		}
+	}
+	return res
+}
 
-		// Test if it matched
-		if r.MatchString(s) {
-			return &object.Boolean{Value: true}
+// fnCoerceLike is the implementation of our `coerceLike` function.
+//
+// It converts the first value to the type of the second, which must be
+// a string, number, or boolean, so that the two may be compared.  It
+// is an error if the conversion would lose information, or isn't
+// possible.
+func fnCoerceLike(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "coerceLike: wrong number of arguments"}
+	}
+
+	out, err := Convert(args[0], args[1].Type())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("coerceLike: %s", err.Error())}
+	}
+	return out
+}
+
+// Convert converts the given value, which must be a string, number, or
+// boolean, to the given type, which must be one of those too.
+//
+// Strings are converted to numbers as they are by our `num` function,
+// and to booleans as they are by strconv.ParseBool, while numbers may
+// only become booleans if they are zero or one.  It is an error if the
+// conversion isn't possible, or would lose information - for example
+// converting the float 3.5 to an integer.
+func Convert(val object.Object, typ object.Type) (object.Object, error) {
+
+	// Describe the value, for our error-messages.
+	failed := func() error {
+		desc := val.Inspect()
+		if val.Type() == object.STRING {
+			desc = strconv.Quote(desc)
 		}
+		return fmt.Errorf("cannot convert %s to %s", desc, strings.ToLower(string(typ)))
 	}
-	return &object.Boolean{Value: false}
+
+	switch val.Type() {
+	case object.STRING, object.INTEGER, object.FLOAT, object.BOOLEAN:
+	default:
+		return nil, failed()
+	}
+
+	switch typ {
+	case object.STRING:
+		return &object.String{Value: val.Inspect()}, nil
+
+	case object.INTEGER, object.FLOAT:
+		if val.Type() == object.BOOLEAN {
+			return nil, failed()
+		}
+		num, err := toNumberArg(val)
+		if err != nil {
+			return nil, failed()
+		}
+		f, _ := numericValue(num)
+
+		if typ == object.FLOAT {
+			return &object.Float{Value: f}, nil
+		}
+		if _, ok := num.(*object.Integer); ok {
+			return num, nil
+		}
+		// Only whole numbers, within range, may become integers.
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, failed()
+		}
+		return &object.Integer{Value: int64(f)}, nil
+
+	case object.BOOLEAN:
+		switch val.Type() {
+		case object.BOOLEAN:
+			return val, nil
+		case object.STRING:
+			b, err := strconv.ParseBool(strings.TrimSpace(val.Inspect()))
+			if err != nil {
+				return nil, failed()
+			}
+			return &object.Boolean{Value: b}, nil
+		default:
+			// Numbers must be zero, or one.
+			f, _ := numericValue(val)
+			if f != 0 && f != 1 {
+				return nil, failed()
+			}
+			return &object.Boolean{Value: f == 1}, nil
+		}
+	}
+
+	return nil, failed()
 }
 
-// fnNow is the implementation of our `now` function.
-func fnNow(args []object.Object) object.Object {
+// fnCount is the implementation of our `count` function.
+//
+// Given an array it returns the number of elements which are true,
+// given any other object it returns 1 if that object is true, and 0
+// otherwise.
+func fnCount(args []object.Object) object.Object {
 
-	// Handle timezones, by reading $TZ, and if not set
-	// defaulting to UTC.
-	env := os.Getenv("TZ")
-	if env == "" {
-		env = "UTC"
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "count: wrong number of arguments"}
 	}
 
-	now := time.Now()
+	count := 0
 
-	// Ensure we set that timezone.
-	loc, err := time.LoadLocation(env)
-	if err == nil {
-		now = now.In(loc)
+	arr, ok := args[0].(*object.Array)
+	if ok {
+		for _, e := range arr.Elements {
+			if e.True() {
+				count++
+			}
+		}
+	} else if args[0].True() {
+		count = 1
 	}
 
-	return &object.Integer{Value: now.Unix()}
+	return &object.Integer{Value: int64(count)}
 }
 
-// fnSplit is the implementation of our `split` primitive.
-func fnSplit(args []object.Object) object.Object {
+// fnCounter is the implementation of our `counter` function.
+//
+// It returns the value of the named counter, from the counter store.
+func (e *Environment) fnCounter(args []object.Object) object.Object {
 
-	// We expect two arguments
-	if len(args) != 2 {
-		return &object.Null{}
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "counter: wrong number of arguments"}
 	}
 
-	// String to split
-	input := args[0]
+	if e.counters == nil {
+		return noCounters("counter")
+	}
 
-	// String to split by
-	split := args[1]
+	return &object.Integer{Value: e.counters.Count(args[0].Inspect())}
+}
 
-	// Typecheck
-	if input.Type() != object.STRING ||
-		split.Type() != object.STRING {
-		return &object.Null{}
+// fnIncrement is the implementation of our `increment` function.
+//
+// It adds the given amount, which defaults to one, to the named counter
+// in the counter store, and returns the new value.
+func (e *Environment) fnIncrement(args []object.Object) object.Object {
+
+	// We expect one or two arguments
+	if len(args) < 1 || len(args) > 2 {
+		return &object.Error{Message: "increment: wrong number of arguments"}
 	}
 
-	// Perform the split
-	pieces := strings.Split(input.(*object.String).Value,
-		split.(*object.String).Value)
+	if e.counters == nil {
+		return noCounters("increment")
+	}
 
-	// Convert the results into an array of string-objects
-	elements := make([]object.Object, len(pieces))
-	for i, e := range pieces {
+	n := int64(1)
+	if len(args) == 2 {
+		i, ok := args[1].(*object.Integer)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("increment: amount must be an integer, not %s", args[1].Type())}
+		}
+		n = i.Value
+	}
+
+	return &object.Integer{Value: e.counters.Increment(args[0].Inspect(), n)}
+}
+
+// fnWindowCount is the implementation of our `windowCount` function.
+//
+// It records an event under the given key, in the counter store, and
+// returns the number of events recorded under that key within the given
+// window, including this one.  The time of the event defaults to now.
+func (e *Environment) fnWindowCount(args []object.Object) object.Object {
+
+	// We expect two or three arguments
+	if len(args) < 2 || len(args) > 3 {
+		return &object.Error{Message: "windowCount: wrong number of arguments"}
+	}
+
+	if e.counters == nil {
+		return noCounters("windowCount")
+	}
+
+	// The window may be a duration, such as "1m", or a number of
+	// seconds - as returned by our `duration` function.
+	var window time.Duration
+	switch arg := args[1].(type) {
+	case *object.String:
+		d, err := parseDuration(arg.Value)
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("windowCount: invalid duration '%s'", arg.Value)}
+		}
+		window = d
+	case *object.Integer, *object.Float:
+		secs, _ := numericValue(arg)
+		window = time.Duration(secs * float64(time.Second))
+	default:
+		return &object.Error{Message: fmt.Sprintf("windowCount: window must be a duration, not %s", args[1].Type())}
+	}
+	if window <= 0 {
+		return &object.Error{Message: fmt.Sprintf("windowCount: window must be positive, not %s", args[1].Inspect())}
+	}
+
+	at := time.Now()
+	if len(args) == 3 {
+		secs, ok := numericValue(args[2])
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("windowCount: time must be a number, not %s", args[2].Type())}
+		}
+		at = time.Unix(0, int64(secs*float64(time.Second)))
+	}
+
+	return &object.Integer{Value: int64(e.counters.Record(args[0].Inspect(), at, window))}
+}
+
+// noCounters returns the error raised by the functions which need a
+// counter store, when none has been configured.
+func noCounters(name string) object.Object {
+	return &object.Error{Message: fmt.Sprintf("%s: no counter store has been configured, see SetCounters", name)}
+}
+
+// fnCSVField is the implementation of our `csvField` function.
+//
+// It returns the field with the given (zero-based) index from a line of
+// CSV, or null if there is no such field.
+func fnCSVField(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "csvField: wrong number of arguments"}
+	}
+
+	fields, err := csvRecord("csvField", args[0])
+	if err != nil {
+		return err
+	}
+
+	n, ok := args[1].(*object.Integer)
+	if !ok || n.Value < 0 {
+		return &object.Error{Message: fmt.Sprintf("csvField: index must be a non-negative integer, not %s", args[1].Inspect())}
+	}
+
+	if n.Value >= int64(len(fields)) {
+		return &object.Null{}
+	}
+	return &object.String{Value: fields[n.Value]}
+}
+
+// fnCSVFields is the implementation of our `csvFields` function.
+//
+// It returns an array of the fields in a line of CSV.  Unlike `split`
+// quoted fields may contain commas, and quotes.
+func fnCSVFields(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "csvFields: wrong number of arguments"}
+	}
+
+	fields, err := csvRecord("csvFields", args[0])
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(fields))
+	for i, f := range fields {
+		elements[i] = &object.String{Value: f}
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// csvRecord parses the given string as a single record of CSV, returning
+// its fields.  An empty string has no fields.
+func csvRecord(name string, arg object.Object) ([]string, *object.Error) {
+
+	str, ok := arg.(*object.String)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: argument must be a string, not %s", name, arg.Type())}
+	}
+
+	records, err := csv.NewReader(strings.NewReader(str.Value)).ReadAll()
+	if err != nil {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: %s", name, err.Error())}
+	}
+
+	switch len(records) {
+	case 0:
+		return []string{}, nil
+	case 1:
+		return records[0], nil
+	}
+	return nil, &object.Error{Message: fmt.Sprintf("%s: expected a single line of CSV, found %d", name, len(records))}
+}
+
+// fnDifference is the implementation of our `difference` function.
+//
+// It returns the unique elements of the first array which are not
+// present in the second.
+func (e *Environment) fnDifference(args []object.Object) object.Object {
+
+	a, b, err := setArgs("difference", args)
+	if err != nil {
+		return err
+	}
+
+	out := []object.Object{}
+	for _, el := range a {
+		if !e.Contains(b, el) && !e.Contains(out, el) {
+			out = append(out, el)
+		}
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// fnDuration is the implementation of our `duration` function.
+//
+// It parses a duration, such as "24h" or "1h30m", and returns the number
+// of seconds it represents.  As times are represented as seconds past the
+// epoch this allows durations to be compared with the difference between
+// two times.
+func fnDuration(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "duration: wrong number of arguments"}
+	}
+
+	str, ok := args[0].(*object.String)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("duration: argument must be a string, not %s", args[0].Type())}
+	}
+
+	d, err := parseDuration(str.Value)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("duration: invalid duration '%s'", str.Value)}
+	}
+
+	// Whole seconds are returned as an integer.
+	if d%time.Second == 0 {
+		return &object.Integer{Value: int64(d / time.Second)}
+	}
+	return &object.Float{Value: d.Seconds()}
+}
+
+// parseDuration parses a duration, such as "1h30m", in the same way as
+// time.ParseDuration - but also allows a leading number of days, with
+// the suffix "d", as in "7d" or "1d12h".
+func parseDuration(str string) (time.Duration, error) {
+
+	i := strings.Index(str, "d")
+	if i < 0 {
+		return time.ParseDuration(str)
+	}
+
+	days, err := strconv.ParseFloat(str[:i], 64)
+	if err != nil || strings.Trim(str[:i], "+-.0123456789") != "" {
+		return 0, fmt.Errorf("invalid duration %q", str)
+	}
+	d := time.Duration(days * float64(24*time.Hour))
+
+	// Anything after the days has the same sign.
+	rest := str[i+1:]
+	if rest == "" {
+		return d, nil
+	}
+	if strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, "+") {
+		return 0, fmt.Errorf("invalid duration %q", str)
+	}
+	extra, err := time.ParseDuration(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", str)
+	}
+	if strings.HasPrefix(str, "-") {
+		extra = -extra
+	}
+	return d + extra, nil
+}
+
+// location returns the timezone used by our time functions, which is
+// read from $TZ, defaulting to UTC.
+func location() *time.Location {
+
+	env := os.Getenv("TZ")
+	if env == "" {
+		env = "UTC"
+	}
+
+	loc, err := time.LoadLocation(env)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// fnFilter is the implementation of our `filter` function.
+//
+// It returns a new array holding the elements of the given array for
+// which the named function returns a true value.
+func (e *Environment) fnFilter(args []object.Object) object.Object {
+
+	arr, fn, err := e.higherOrderArgs("filter", args)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, 0)
+	for i, el := range arr.Elements {
+		res := fn([]object.Object{el})
+		if res.Type() == object.ERROR {
+			return &object.Error{Message: fmt.Sprintf("filter: element %d: %s", i, res.Inspect())}
+		}
+		if res.True() {
+			elements = append(elements, el)
+		}
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// fnFirst is the implementation of our `first` function.
+//
+// It returns the first element of an array, or null if it is empty.
+func fnFirst(args []object.Object) object.Object {
+	return endpointHelper("first", args, false)
+}
+
+// endpointHelper implements `first` and `last`.
+func endpointHelper(name string, args []object.Object, last bool) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	// Which must be an array
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: argument must be an array, not %s", name, args[0].Type())}
+	}
+
+	if len(arr.Elements) == 0 {
+		return &object.Null{}
+	}
+	if last {
+		return arr.Elements[len(arr.Elements)-1]
+	}
+	return arr.Elements[0]
+}
+
+// fnFlatten is the implementation of our `flatten` function.
+//
+// It returns a new array with the contents of any nested arrays
+// spliced into it, recursively.
+func fnFlatten(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "flatten: wrong number of arguments"}
+	}
+
+	// Which must be an array
+	if args[0].Type() != object.ARRAY {
+		return &object.Error{Message: fmt.Sprintf("flatten: argument must be an array, not %s", args[0].Type())}
+	}
+
+	// Defer to our helper
+	return &object.Array{Elements: flattenHelper(args[0].(*object.Array).Elements)}
+}
+
+// flattenHelper returns the given elements, with the contents of any
+// nested arrays spliced in-place.
+func flattenHelper(elements []object.Object) []object.Object {
+
+	out := []object.Object{}
+
+	for _, e := range elements {
+		if e.Type() == object.ARRAY {
+			out = append(out, flattenHelper(e.(*object.Array).Elements)...)
+		} else {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// fnFloor is the implementation of our `floor` function.
+func fnFloor(args []object.Object) object.Object {
+	return roundHelper("floor", args, math.Floor)
+}
+
+// datePresets holds the names of the layouts which may be given to our
+// `formatDate` function, rather than a golang layout.
+var datePresets = map[string]string{
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	"rfc1123":  time.RFC1123,
+	"rfc3339":  time.RFC3339,
+	"time":     "15:04:05",
+}
+
+// fnFormatDate is the implementation of our `formatDate` function.
+//
+// It formats a time, in seconds past the Unix Epoch, using the named
+// preset or golang layout, which defaults to RFC3339.
+func fnFormatDate(args []object.Object) object.Object {
+
+	// We expect one or two arguments
+	if len(args) < 1 || len(args) > 2 {
+		return &object.Error{Message: "formatDate: wrong number of arguments"}
+	}
+
+	// A missing time gives null.
+	if args[0].Type() == object.NULL {
+		return args[0]
+	}
+
+	secs, ok := numericValue(args[0])
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("formatDate: time must be a number, not %s", args[0].Type())}
+	}
+
+	layout := "rfc3339"
+	if len(args) == 2 {
+		layout = args[1].Inspect()
+	}
+
+	// The epoch presets don't depend upon the timezone.
+	switch layout {
+	case "unix":
+		return &object.String{Value: strconv.FormatInt(int64(math.Floor(secs)), 10)}
+	case "unixmilli":
+		return &object.String{Value: strconv.FormatInt(int64(math.Floor(secs*1000)), 10)}
+	}
+
+	if preset, ok := datePresets[layout]; ok {
+		layout = preset
+	}
+
+	whole := math.Floor(secs)
+	ts := time.Unix(int64(whole), int64((secs-whole)*1e9))
+
+	return &object.String{Value: ts.In(location()).Format(layout)}
+}
+
+// fnFormatNumber is the implementation of our `formatNumber` function.
+//
+// This formats a number with a fixed number of decimal places, and
+// with commas separating the thousands - e.g. `1,234,567.89`.
+func (e *Environment) fnFormatNumber(args []object.Object) object.Object {
+
+	// We expect one or two arguments
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: "formatNumber: wrong number of arguments"}
+	}
+
+	num, err := toNumberArg(args[0])
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("formatNumber: %s", err.Error())}
+	}
+
+	// The number of decimal places defaults to zero.
+	decimals := 0
+	if len(args) == 2 {
+		d, ok := args[1].(*object.Integer)
+		if !ok || d.Value < 0 {
+			return &object.Error{Message: fmt.Sprintf("formatNumber: decimal places must be a non-negative integer, not %s", args[1].Inspect())}
+		}
+		if d.Value > int64(e.maxLength()) {
+			return tooLong("formatNumber", e.maxLength())
+		}
+		decimals = int(d.Value)
+	}
+
+	// Format the number, integers are formatted exactly.
+	var str string
+	switch n := num.(type) {
+	case *object.Integer:
+		str = strconv.FormatInt(n.Value, 10)
+		if decimals > 0 {
+			str += "." + strings.Repeat("0", decimals)
+		}
+	case *object.Float:
+		str = strconv.FormatFloat(n.Value, 'f', decimals, 64)
+	}
+
+	// Split into sign, integer, and fractional parts.
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign = "-"
+		str = str[1:]
+	}
+	frac := ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		frac = str[i:]
+		str = str[:i]
+	}
+
+	// Insert the thousands separators.
+	var out strings.Builder
+	for i, c := range str {
+		if i > 0 && (len(str)-i)%3 == 0 {
+			out.WriteRune(',')
+		}
+		out.WriteRune(c)
+	}
+
+	return &object.String{Value: sign + out.String() + frac}
+}
+
+// fnInCIDR is the implementation of our `inCIDR` function.
+//
+// It returns true if the given IP address is contained within the
+// given CIDR range, e.g. `inCIDR("10.1.2.3", "10.0.0.0/8")`.
+func fnInCIDR(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "inCIDR: wrong number of arguments"}
+	}
+
+	ip := net.ParseIP(args[0].Inspect())
+	if ip == nil {
+		return &object.Error{Message: fmt.Sprintf("inCIDR: invalid IP address '%s'", args[0].Inspect())}
+	}
+
+	_, network, err := net.ParseCIDR(args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("inCIDR: invalid CIDR range '%s'", args[1].Inspect())}
+	}
+
+	return &object.Boolean{Value: network.Contains(ip)}
+}
+
+// fnIndexOf is the implementation of our `indexOf` function.
+//
+// It returns the position of the first occurrence of a value within an
+// array, or a string, or -1 if it is not present.
+func (e *Environment) fnIndexOf(args []object.Object) object.Object {
+	return e.indexHelper("indexOf", args, false)
+}
+
+// indexHelper implements `indexOf` and `lastIndexOf`.
+//
+// Arrays are searched for an element equal to the value, according to
+// Equal.  Anything else is converted to a string, and searched for the
+// value as a substring, with the position counted in characters rather
+// than bytes.
+func (e *Environment) indexHelper(name string, args []object.Object, last bool) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	if arr, ok := args[0].(*object.Array); ok {
+
+		found := -1
+		for i, el := range arr.Elements {
+			if equal, _ := e.Equal(el, args[1]); equal {
+				found = i
+				if !last {
+					break
+				}
+			}
+		}
+		return &object.Integer{Value: int64(found)}
+	}
+
+	haystack := args[0].Inspect()
+	needle := args[1].Inspect()
+
+	var idx int
+	if last {
+		idx = strings.LastIndex(haystack, needle)
+	} else {
+		idx = strings.Index(haystack, needle)
+	}
+
+	// Convert the byte-offset to a character-offset.
+	if idx > 0 {
+		idx = utf8.RuneCountInString(haystack[:idx])
+	}
+	return &object.Integer{Value: int64(idx)}
+}
+
+// fnInt is the implementation of the `int` function.
+//
+// It converts an object to an integer, if it can.
+//
+// On failure it returns Null
+func fnInt(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	// Stringify
+	str := args[0].Inspect()
+
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return &object.Null{}
+	}
+
+	return &object.Integer{Value: i}
+}
+
+// fnIntersection is the implementation of our `intersection` function.
+//
+// It returns the unique elements which are present in both arrays.
+func (e *Environment) fnIntersection(args []object.Object) object.Object {
+
+	a, b, err := setArgs("intersection", args)
+	if err != nil {
+		return err
+	}
+
+	out := []object.Object{}
+	for _, el := range a {
+		if e.Contains(b, el) && !e.Contains(out, el) {
+			out = append(out, el)
+		}
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// fnIPVersion is the implementation of our `ipVersion` function.
+//
+// It returns 4 or 6 depending upon the type of the given IP address.
+func fnIPVersion(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "ipVersion: wrong number of arguments"}
+	}
+
+	ip := net.ParseIP(args[0].Inspect())
+	if ip == nil {
+		return &object.Error{Message: fmt.Sprintf("ipVersion: invalid IP address '%s'", args[0].Inspect())}
+	}
+
+	if ip.To4() != nil {
+		return &object.Integer{Value: 4}
+	}
+	return &object.Integer{Value: 6}
+}
+
+// jsonPathStep is a single step of a parsed JSONPath expression.
+type jsonPathStep struct {
+	// key holds the name of a hash-key to lookup.
+	key string
+
+	// index holds the array-index to lookup, if isIndex is set.
+	index   int
+	isIndex bool
+
+	// wildcard is true if this step matches all children.
+	wildcard bool
+}
+
+// parseJSONPath parses the given JSONPath expression into a series
+// of steps.
+//
+// We support a subset of JSONPath:
+//
+//	$            the root object, which may be omitted.
+//	.name        a hash-key.
+//	['name']     a hash-key, which may contain any character.
+//	[N]          an array-index, negative indexes count from the end.
+//	.* or [*]    all the children of a hash or array.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+
+	var steps []jsonPathStep
+
+	// Strip any leading `$`, and allow `items[0]` to mean `$.items[0]`.
+	path = strings.TrimPrefix(path, "$")
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		path = "." + path
+	}
+
+	for len(path) > 0 {
+
+		switch path[0] {
+
+		case '.':
+			path = path[1:]
+
+			// Read the name, which runs until the next separator.
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			name := path[:end]
+			path = path[end:]
+
+			if name == "" {
+				return nil, fmt.Errorf("empty key")
+			}
+			if name == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+			} else {
+				steps = append(steps, jsonPathStep{key: name})
+			}
+
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']'")
+			}
+			sel := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+
+			if sel == "*" {
+				steps = append(steps, jsonPathStep{wildcard: true})
+				continue
+			}
+
+			// Quoted keys.
+			if len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0] {
+				steps = append(steps, jsonPathStep{key: sel[1 : len(sel)-1]})
+				continue
+			}
+
+			n, err := strconv.Atoi(sel)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index '%s'", sel)
+			}
+			steps = append(steps, jsonPathStep{index: n, isIndex: true})
+
+		default:
+			return nil, fmt.Errorf("unexpected character '%c'", path[0])
+		}
+	}
+
+	return steps, nil
+}
+
+// fnJoinNonNull is the implementation of our `joinNonNull` function.
+//
+// It joins the values which follow the separator, skipping any which are
+// null or empty strings, so that optional values don't leave behind
+// doubled separators.
+func (e *Environment) fnJoinNonNull(args []object.Object) object.Object {
+
+	// We expect at least a separator
+	if len(args) < 1 {
+		return &object.Error{Message: "joinNonNull: wrong number of arguments"}
+	}
+
+	sep := args[0].Inspect()
+
+	var parts []string
+	for _, arg := range args[1:] {
+		if arg.Type() == object.NULL {
+			continue
+		}
+		str := arg.Inspect()
+		if str == "" {
+			continue
+		}
+		parts = append(parts, str)
+	}
+
+	// Refuse to join the parts if the result would be too long.
+	if len(parts) > 0 {
+		size := len(sep) * (len(parts) - 1)
+		for _, str := range parts {
+			size += len(str)
+		}
+		if size > e.maxLength() {
+			return tooLong("joinNonNull", e.maxLength())
+		}
+	}
+
+	return &object.String{Value: strings.Join(parts, sep)}
+}
+
+// fnJSONPath is the implementation of our `jsonpath` function.
+//
+// This returns the value addressed by the given path within a hash or
+// array, or null if the path doesn't resolve.  If the path contains a
+// wildcard then an array of all the matching values is returned.
+func fnJSONPath(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "jsonpath: wrong number of arguments"}
+	}
+
+	steps, err := parseJSONPath(args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("jsonpath: invalid path '%s': %s", args[1].Inspect(), err.Error())}
+	}
+
+	// The set of values we've matched so far.
+	cur := []object.Object{args[0]}
+	wildcard := false
+
+	for _, step := range steps {
+
+		var next []object.Object
+
+		for _, obj := range cur {
+
+			switch o := obj.(type) {
+
+			case *object.Hash:
+				if step.wildcard {
+					for _, k := range o.Keys() {
+						next = append(next, o.Pairs[k])
+					}
+				} else if !step.isIndex {
+					if val, ok := o.Pairs[step.key]; ok {
+						next = append(next, val)
+					}
+				}
+
+			case *object.Array:
+				if step.wildcard {
+					next = append(next, o.Elements...)
+				} else if step.isIndex {
+					idx := step.index
+					if idx < 0 {
+						idx += len(o.Elements)
+					}
+					if idx >= 0 && idx < len(o.Elements) {
+						next = append(next, o.Elements[idx])
+					}
+				}
+			}
+		}
+
+		if step.wildcard {
+			wildcard = true
+		}
+		cur = next
+	}
+
+	if wildcard {
+		if cur == nil {
+			cur = []object.Object{}
+		}
+		return &object.Array{Elements: cur}
+	}
+	if len(cur) != 1 {
+		return &object.Null{}
+	}
+	return cur[0]
+}
+
+// fnToArray is the implementation of our `toArray` function.
+//
+// It returns arrays unchanged, wraps any other value in an array, and
+// converts null to an empty array.
+func fnToArray(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "toArray: wrong number of arguments"}
+	}
+
+	switch arg := args[0].(type) {
+	case *object.Array:
+		return arg
+	case *object.Null:
+		return &object.Array{Elements: []object.Object{}}
+	}
+	return &object.Array{Elements: []object.Object{args[0]}}
+}
+
+// fnToJSON is the implementation of our `toJSON` function.
+//
+// It returns the JSON encoding of the given value.
+func fnToJSON(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "toJSON: wrong number of arguments"}
+	}
+
+	val, err := jsonValue(args[0], make(map[object.Object]bool))
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("toJSON: %s", err.Error())}
+	}
+
+	// We don't want "<", ">", and "&" to be escaped, as they
+	// would be by json.Marshal.
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(val)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("toJSON: %s", err.Error())}
+	}
+
+	return &object.String{Value: strings.TrimSuffix(out.String(), "\n")}
+}
+
+// jsonValue converts the given object to a value which may be encoded
+// as JSON.
+//
+// This is the same as calling ToInterface, except that we keep track
+// of the arrays and hashes we're inside, so that we can report an
+// error if one contains itself, rather than recursing forever.
+func jsonValue(obj object.Object, seen map[object.Object]bool) (interface{}, error) {
+
+	switch o := obj.(type) {
+
+	case *object.Array:
+		if seen[o] {
+			return nil, fmt.Errorf("an array contains itself")
+		}
+		seen[o] = true
+		defer delete(seen, o)
+
+		res := make([]interface{}, 0, len(o.Elements))
+		for _, el := range o.Elements {
+			v, err := jsonValue(el, seen)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		return res, nil
+
+	case *object.Hash:
+		if seen[o] {
+			return nil, fmt.Errorf("a hash contains itself")
+		}
+		seen[o] = true
+		defer delete(seen, o)
+
+		res := make(map[string]interface{}, len(o.Pairs))
+		for k, el := range o.Pairs {
+			v, err := jsonValue(el, seen)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = v
+		}
+		return res, nil
+
+	case *object.Float:
+		if math.IsNaN(o.Value) || math.IsInf(o.Value, 0) {
+			return nil, fmt.Errorf("cannot encode the number %s", o.Inspect())
+		}
+	}
+
+	return obj.ToInterface(), nil
+}
+
+// fnFromJSON is the implementation of our `fromJSON` function.
+//
+// It parses the given JSON string, returning the value it contains.
+// JSON objects become hashes, and numbers become integers if they are
+// written without a fraction or exponent, otherwise floats.
+func fnFromJSON(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "fromJSON: wrong number of arguments"}
+	}
+
+	dec := json.NewDecoder(strings.NewReader(args[0].Inspect()))
+	dec.UseNumber()
+
+	var val interface{}
+	err := dec.Decode(&val)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("fromJSON: %s", err.Error())}
+	}
+
+	// There should be nothing after the value.
+	if dec.More() {
+		return &object.Error{Message: "fromJSON: unexpected data after the value"}
+	}
+
+	out, err := jsonObject(val)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("fromJSON: %s", err.Error())}
+	}
+	return out
+}
+
+// jsonObject converts a value decoded from JSON to an object.
+//
+// Numbers which are too large to be represented are an error.
+func jsonObject(val interface{}) (object.Object, error) {
+
+	switch v := val.(type) {
+
+	case bool:
+		return &object.Boolean{Value: v}, nil
+
+	case string:
+		return &object.String{Value: v}, nil
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return &object.Integer{Value: i}, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("the number %s is out of range", v.String())
+		}
+		return &object.Float{Value: f}, nil
+
+	case []interface{}:
+		elements := make([]object.Object, len(v))
+		for i, el := range v {
+			obj, err := jsonObject(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = obj
+		}
+		return &object.Array{Elements: elements}, nil
+
+	case map[string]interface{}:
+		pairs := make(map[string]object.Object, len(v))
+		for k, el := range v {
+			obj, err := jsonObject(el)
+			if err != nil {
+				return nil, err
+			}
+			pairs[k] = obj
+		}
+		return &object.Hash{Pairs: pairs}, nil
+	}
+
+	return &object.Null{}, nil
+}
+
+// fnLast is the implementation of our `last` function.
+//
+// It returns the last element of an array, or null if it is empty.
+func fnLast(args []object.Object) object.Object {
+	return endpointHelper("last", args, true)
+}
+
+// fnLastIndexOf is the implementation of our `lastIndexOf` function.
+//
+// It returns the position of the last occurrence of a value within an
+// array, or a string, or -1 if it is not present.
+func (e *Environment) fnLastIndexOf(args []object.Object) object.Object {
+	return e.indexHelper("lastIndexOf", args, true)
+}
+
+// fnLen is the implementation of our `len` function.
+//
+// Interestingly this function doesn't just count the length of string
+// objects, instead we cast all objects to strings and allow their lengths
+// to be calculated.
+//
+// The obvious exception is the handling of arrays.  The length of
+// an array is the number of elements which it contains, similarly the
+// length of a hash is the number of keys it contains.
+//
+// So `len(false)` is 5, len(3) is 1, and `len(0.123)` is 5, and arrays
+// work as expectd: len([]) is zero, and len(["steve", "kemp"]) is two.
+//
+func fnLen(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	// array is handled differently
+	switch arg := args[0].(type) {
+	case *object.Array:
+		return &object.Integer{Value: int64(len(arg.Elements))}
+	case *object.Hash:
+		return &object.Integer{Value: int64(len(arg.Pairs))}
+	}
+
+	// Stringify
+	str := args[0].Inspect()
+	sum := utf8.RuneCountInString(str)
+
+	// return
+	return &object.Integer{Value: int64(sum)}
+}
+
+// fnLower is the implementation of our `lower` function.
+//
+// Much like the `len` function here we cast to a string before
+// we lower-case.
+func fnLower(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	// Stringify and lower-case
+	arg := fmt.Sprintf("%v", args[0].Inspect())
+	arg = strings.ToLower(arg)
+
+	// Return
+	return &object.String{Value: arg}
+}
+
+// fnMap is the implementation of our `map` function.
+//
+// It returns a new array holding the result of calling the named
+// function with each element of the given array.
+func (e *Environment) fnMap(args []object.Object) object.Object {
+
+	arr, fn, err := e.higherOrderArgs("map", args)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+		res := fn([]object.Object{el})
+		switch res.Type() {
+		case object.ERROR:
+			return &object.Error{Message: fmt.Sprintf("map: element %d: %s", i, res.Inspect())}
+		case object.VOID:
+			res = &object.Null{}
+		}
+		elements[i] = res
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// fnMapIndexed is the implementation of our `mapIndexed` function.
+//
+// It returns a new array holding the result of calling the named
+// function with each element of the given array, and its index.
+func (e *Environment) fnMapIndexed(args []object.Object) object.Object {
+
+	arr, fn, err := e.higherOrderArgs("mapIndexed", args)
+	if err != nil {
+		return err
+	}
+
+	elements := make([]object.Object, len(arr.Elements))
+	for i, el := range arr.Elements {
+
+		// The function receives a copy of the element, so that
+		// operations such as `x++` don't modify the original.
+		res := fn([]object.Object{object.Copy(el), &object.Integer{Value: int64(i)}})
+		switch res.Type() {
+		case object.ERROR:
+			return &object.Error{Message: fmt.Sprintf("mapIndexed: element %d: %s", i, res.Inspect())}
+		case object.VOID:
+			res = &object.Null{}
+		}
+		elements[i] = res
+	}
+
+	return &object.Array{Elements: elements}
+}
+
+// higherOrderArgs validates the arguments of our `all`, `any`, `filter`,
+// `map`, and `mapIndexed` functions, returning the array and the function
+// which were named.
+func (e *Environment) higherOrderArgs(name string, args []object.Object) (*object.Array, func([]object.Object) object.Object, *object.Error) {
+
+	if len(args) != 2 {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: first argument must be an array, not %s", name, args[0].Type())}
+	}
+
+	fn, err := e.functionArg(name, "second", args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return arr, fn, nil
+}
+
+// functionArg returns the function named by the given argument, which is
+// described by its position in errors.
+func (e *Environment) functionArg(name string, position string, arg object.Object) (func([]object.Object) object.Object, *object.Error) {
+
+	str, ok := arg.(*object.String)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: %s argument must be the name of a function, not %s", name, position, arg.Type())}
+	}
+
+	fun, ok := e.GetFunction(str.Value)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: the function %s does not exist", name, str.Value)}
+	}
+
+	fn, ok := fun.(func([]object.Object) object.Object)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: the function %s cannot be called", name, str.Value)}
+	}
+
+	return fn, nil
+}
+
+// getRegexp returns the compiled version of the given regular expression,
+// using our cache to avoid compiling the same expression repeatedly.
+func getRegexp(reg string) (*regexp.Regexp, error) {
+
+	regCacheLock.Lock()
+	defer regCacheLock.Unlock()
+
+	// Look for the compiled regular-expression object in our cache.
+	r, ok := regCache[reg]
+	if ok {
+		return r, nil
+	}
+
+	// OK it wasn't found, so compile it.
+	r, err := regexp.Compile(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	// store in the cache for next time
+	regCache[reg] = r
+	return r, nil
+}
+
+// findSubmatch tests the given string against the specified regular
+// expression, returning the match and any capture groups.
+//
+// The input is split by newline, with each line tested in turn after
+// stripping leading and trailing whitespace.  The first line which
+// matches is used.
+func findSubmatch(str string, reg string) (*regexp.Regexp, []string, error) {
+
+	r, err := getRegexp(reg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid regular expression '%s': %s", reg, err.Error())
+	}
+
+	// Split the input by newline.
+	for _, s := range strings.Split(str, "\n") {
+
+		// Strip leading-trailing whitespace
+		s = strings.TrimSpace(s)
+
+		// Test if it matched
+		m := r.FindStringSubmatch(s)
+		if m != nil {
+			return r, m, nil
+		}
+	}
+	return r, nil, nil
+}
+
+// fnMatch is the implementation of our regex `match` function.
+//
+// This returns true if the string matches the regular expression, and
+// is also used to implement the `~=` and `!~` operators.
+func fnMatch(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "match: wrong number of arguments"}
+	}
+
+	_, m, err := findSubmatch(args[0].Inspect(), args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("match: %s", err.Error())}
+	}
+
+	return &object.Boolean{Value: m != nil}
+}
+
+// fnMatchGroups is the implementation of our `matchGroups` function.
+//
+// This returns an array containing the matched text, followed by the
+// contents of any capture groups, or null if there was no match.
+func fnMatchGroups(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "matchGroups: wrong number of arguments"}
+	}
+
+	_, m, err := findSubmatch(args[0].Inspect(), args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("matchGroups: %s", err.Error())}
+	}
+	if m == nil {
+		return &object.Null{}
+	}
+
+	res := make([]object.Object, len(m))
+	for i, v := range m {
+		res[i] = &object.String{Value: v}
+	}
+	return &object.Array{Elements: res}
+}
+
+// fnMatchesAll is the implementation of our `matchesAll` function.
+//
+// It returns true if the string matches every one of the given array
+// of regular expressions.
+func fnMatchesAll(args []object.Object) object.Object {
+	return matchesHelper("matchesAll", args, true)
+}
+
+// fnMatchesAny is the implementation of our `matchesAny` function.
+//
+// It returns true if the string matches any of the given array of
+// regular expressions.
+func fnMatchesAny(args []object.Object) object.Object {
+	return matchesHelper("matchesAny", args, false)
+}
+
+// matchesHelper implements `matchesAll` and `matchesAny`.
+//
+// Each pattern is tested in the same way as the `~=` operator.  All the
+// patterns are compiled before any are tested, so that an invalid one is
+// always reported, regardless of the input.
+func matchesHelper(name string, args []object.Object, all bool) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	patterns, ok := args[1].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: second argument must be an array, not %s", name, args[1].Type())}
+	}
+
+	var regs []*regexp.Regexp
+	for _, p := range patterns.Elements {
+		r, err := getRegexp(p.Inspect())
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("%s: invalid regular expression '%s': %s", name, p.Inspect(), err.Error())}
+		}
+		regs = append(regs, r)
+	}
+
+	str := args[0].Inspect()
+
+	for _, r := range regs {
+
+		_, m, _ := findSubmatch(str, r.String())
+		if all && m == nil {
+			return &object.Boolean{Value: false}
+		}
+		if !all && m != nil {
+			return &object.Boolean{Value: true}
+		}
+	}
+
+	// If we're looking for all matches then we found them, otherwise
+	// we found none.
+	return &object.Boolean{Value: all}
+}
+
+// fnMatchNamed is the implementation of our `matchNamed` function.
+//
+// This returns a hash of the named capture groups in the regular
+// expression, or null if there was no match.
+func fnMatchNamed(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "matchNamed: wrong number of arguments"}
+	}
+
+	r, m, err := findSubmatch(args[0].Inspect(), args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("matchNamed: %s", err.Error())}
+	}
+	if m == nil {
+		return &object.Null{}
+	}
+
+	res := make(map[string]object.Object)
+	for i, name := range r.SubexpNames() {
+		if name != "" {
+			res[name] = &object.String{Value: m[i]}
+		}
+	}
+	return &object.Hash{Pairs: res}
+}
+
+// fnMaxBy is the implementation of our `maxBy` function.
+//
+// It returns the element of the given array which has the highest value
+// of the named field.
+func (e *Environment) fnMaxBy(args []object.Object) object.Object {
+	return e.extremeBy("maxBy", args, 1)
+}
+
+// fnMD5 is the implementation of our `md5` function.
+//
+// It returns the hex-encoded MD5 digest of the given value.
+func fnMD5(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "md5: wrong number of arguments"}
+	}
+
+	sum := md5.Sum([]byte(args[0].Inspect()))
+	return &object.String{Value: hex.EncodeToString(sum[:])}
+}
+
+// fnMerge is the implementation of our `merge` function.
+//
+// It returns a new hash holding the keys of all the given hashes, where
+// the values of later hashes replace those of earlier ones.  The merge
+// is shallow, so nested hashes are replaced rather than merged.
+func fnMerge(args []object.Object) object.Object {
+
+	// We expect at least one argument
+	if len(args) < 1 {
+		return &object.Error{Message: "merge: wrong number of arguments"}
+	}
+
+	out := &object.Hash{Pairs: make(map[string]object.Object)}
+	for i, arg := range args {
+		hash, ok := arg.(*object.Hash)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("merge: argument %d must be a hash, not %s", i+1, arg.Type())}
+		}
+		for k, v := range hash.Pairs {
+			out.Pairs[k] = v
+		}
+	}
+
+	return out
+}
+
+// fnMinBy is the implementation of our `minBy` function.
+//
+// It returns the element of the given array which has the lowest value
+// of the named field.
+func (e *Environment) fnMinBy(args []object.Object) object.Object {
+	return e.extremeBy("minBy", args, -1)
+}
+
+// extremeBy implements `maxBy` and `minBy`, returning the first element
+// whose field compares with the others in the given direction.
+//
+// The field is found in the same way as by `pluck`, and the values are
+// compared in the same way as by the relational operators, comparing
+// values which can't be ordered, such as a string and a number, is an
+// error.  Elements which don't have the field, or where it is null, are
+// ignored, and if there are no other elements the result is null.
+func (e *Environment) extremeBy(name string, args []object.Object, direction int) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: first argument must be an array, not %s", name, args[0].Type())}
+	}
+
+	path, ok := args[1].(*object.String)
+	if !ok || path.Value == "" {
+		return &object.Error{Message: fmt.Sprintf("%s: second argument must be the name of a field, not %s", name, args[1].Type())}
+	}
+
+	names := strings.Split(path.Value, ".")
+
+	var best, bestVal object.Object
+	for i, el := range arr.Elements {
+
+		val, found := fieldPath(el, names)
+		if !found || val.Type() == object.NULL || isNaN(val) {
+			continue
+		}
+
+		if best == nil {
+			best, bestVal = el, val
+			continue
+		}
+
+		cmp, ok := e.Compare(val, bestVal)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("%s: element %d: cannot compare %s with %s", name, i, val.Type(), bestVal.Type())}
+		}
+		if cmp*direction > 0 {
+			best, bestVal = el, val
+		}
+	}
+
+	if best == nil {
+		return &object.Null{}
+	}
+	return best
+}
+
+// fnNow is the implementation of our `now` function.
+func fnNow(args []object.Object) object.Object {
+	return &object.Integer{Value: time.Now().Unix()}
+}
+
+// fnAgo is the implementation of our `ago` function.
+//
+// It returns the current time minus the given duration, which may be a
+// string such as "7d", or a number of seconds.
+func fnAgo(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "ago: wrong number of arguments"}
+	}
+
+	var d time.Duration
+	switch arg := args[0].(type) {
+	case *object.String:
+		var err error
+		d, err = parseDuration(arg.Value)
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("ago: invalid duration '%s'", arg.Value)}
+		}
+	case *object.Integer, *object.Float:
+		secs, _ := numericValue(arg)
+		d = time.Duration(secs * float64(time.Second))
+	default:
+		return &object.Error{Message: fmt.Sprintf("ago: argument must be a duration, not %s", args[0].Type())}
+	}
+
+	return &object.Integer{Value: time.Now().Add(-d).Unix()}
+}
+
+// fnStartOfDay is the implementation of our `startOfDay` function.
+//
+// It returns midnight at the start of the day containing the given time.
+func fnStartOfDay(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "startOfDay: wrong number of arguments"}
+	}
+
+	// A missing time gives null.
+	if args[0].Type() == object.NULL {
+		return args[0]
+	}
+
+	secs, ok := numericValue(args[0])
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("startOfDay: time must be a number, not %s", args[0].Type())}
+	}
+
+	return &object.Integer{Value: startOfDay(time.Unix(int64(math.Floor(secs)), 0))}
+}
+
+// fnToday is the implementation of our `today` function.
+//
+// It returns midnight at the start of the current day.
+func fnToday(args []object.Object) object.Object {
+	return &object.Integer{Value: startOfDay(time.Now())}
+}
+
+// startOfDay returns midnight at the start of the day containing the
+// given time, in our timezone, as seconds past the epoch.
+func startOfDay(t time.Time) int64 {
+	loc := location()
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc).Unix()
+}
+
+// fnNum is the implementation of our `num` function.
+//
+// It converts the value to a number, returning the default if the value
+// is null, or cannot be converted.
+func fnNum(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "num: wrong number of arguments"}
+	}
+
+	def := args[1]
+	if def.Type() != object.INTEGER && def.Type() != object.FLOAT {
+		return &object.Error{Message: fmt.Sprintf("num: default must be a number, not %s", def.Type())}
+	}
+
+	num, err := toNumberArg(args[0])
+	if err != nil {
+		return def
+	}
+	return num
+}
+
+// fnPadLeft is the implementation of our `padLeft` function.
+//
+// It pads the given value, on the left, to the specified width.
+func (e *Environment) fnPadLeft(args []object.Object) object.Object {
+	return padHelper("padLeft", args, true, e.maxLength())
+}
+
+// fnPadRight is the implementation of our `padRight` function.
+//
+// It pads the given value, on the right, to the specified width.
+func (e *Environment) fnPadRight(args []object.Object) object.Object {
+	return padHelper("padRight", args, false, e.maxLength())
+}
+
+// padHelper implements `padLeft` and `padRight`.
+//
+// The width is measured in characters, rather than bytes, and the
+// padding defaults to a space.  If the padding is longer than a single
+// character it is repeated, and truncated, to fill the width exactly.
+// The result may be no longer than limit bytes.
+func padHelper(name string, args []object.Object, left bool, limit int) object.Object {
+
+	// We expect two or three arguments
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	str := args[0].Inspect()
+
+	width, ok := args[1].(*object.Integer)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: width must be an integer, not %s", name, args[1].Type())}
+	}
+
+	pad := " "
+	if len(args) == 3 {
+		pad = args[2].Inspect()
+		if pad == "" {
+			return &object.Error{Message: fmt.Sprintf("%s: padding must not be empty", name)}
+		}
+	}
+
+	// The amount of padding we need, if any.
+	need := int(width.Value) - utf8.RuneCountInString(str)
+	if need <= 0 {
+		return &object.String{Value: str}
+	}
+	if width.Value > int64(limit) {
+		return tooLong(name, limit)
+	}
+
+	// Every character is at least one byte, but the padding might be
+	// longer, so check the size of the result before constructing it.
+	runes := []rune(pad)
+	size := len(str) + need/len(runes)*len(pad) + len(string(runes[:need%len(runes)]))
+	if size > limit {
+		return tooLong(name, limit)
+	}
+	var out strings.Builder
+	out.Grow(size)
+	if !left {
+		out.WriteString(str)
+	}
+	for i := 0; i < need; i++ {
+		out.WriteRune(runes[i%len(runes)])
+	}
+	if left {
+		out.WriteString(str)
+	}
+
+	return &object.String{Value: out.String()}
+}
+
+// fnSemverCompare is the implementation of our `semverCompare` function.
+//
+// It compares two semantic-version strings, returning -1 if the first
+// is older than the second, 0 if they're equal, and 1 if the first is
+// newer.
+func fnSemverCompare(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "semverCompare: wrong number of arguments"}
+	}
+
+	a, err := parseSemver(args[0].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("semverCompare: %s", err.Error())}
+	}
+	b, err := parseSemver(args[1].Inspect())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("semverCompare: %s", err.Error())}
+	}
+
+	return &object.Integer{Value: int64(compareSemver(a, b))}
+}
+
+// semver holds the components of a parsed semantic-version.
+type semver struct {
+	version    [3]int64
+	prerelease []string
+}
+
+// parseSemver parses a version-string such as "1.2.3-rc.1+build".
+//
+// A leading "v" is permitted, and build-metadata is discarded since
+// it has no bearing on the ordering of versions.
+func parseSemver(str string) (semver, error) {
+
+	var out semver
+
+	ver := strings.TrimPrefix(str, "v")
+
+	// Remove any build-metadata
+	if i := strings.Index(ver, "+"); i >= 0 {
+		ver = ver[:i]
+	}
+
+	// Split off any prerelease tag
+	if i := strings.Index(ver, "-"); i >= 0 {
+		if i == len(ver)-1 {
+			return out, fmt.Errorf("malformed version '%s'", str)
+		}
+		out.prerelease = strings.Split(ver[i+1:], ".")
+		ver = ver[:i]
+	}
+
+	parts := strings.Split(ver, ".")
+	if len(parts) != 3 {
+		return out, fmt.Errorf("malformed version '%s'", str)
+	}
+
+	for i, p := range parts {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 0 {
+			return out, fmt.Errorf("malformed version '%s'", str)
+		}
+		out.version[i] = n
+	}
+
+	for _, p := range out.prerelease {
+		if p == "" {
+			return out, fmt.Errorf("malformed version '%s'", str)
+		}
+	}
+
+	return out, nil
+}
+
+// compareSemver compares two versions according to the semver
+// specification, returning -1, 0, or 1.
+func compareSemver(a, b semver) int {
+
+	for i := range a.version {
+		if a.version[i] < b.version[i] {
+			return -1
+		}
+		if a.version[i] > b.version[i] {
+			return 1
+		}
+	}
+
+	// A prerelease version has lower precedence than the release.
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+
+	// Compare prerelease identifiers one at a time.
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+
+		x, y := a.prerelease[i], b.prerelease[i]
+		if x == y {
+			continue
+		}
+
+		xn, xErr := strconv.ParseInt(x, 10, 64)
+		yn, yErr := strconv.ParseInt(y, 10, 64)
+
+		switch {
+		case xErr == nil && yErr == nil:
+			// Numeric identifiers are compared numerically
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case xErr == nil:
+			// Numeric identifiers sort before alphanumeric ones
+			return -1
+		case yErr == nil:
+			return 1
+		case x < y:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	// A larger set of identifiers has a higher precedence
+	switch {
+	case len(a.prerelease) < len(b.prerelease):
+		return -1
+	case len(a.prerelease) > len(b.prerelease):
+		return 1
+	}
+	return 0
+}
+
+// fnSHA1 is the implementation of our `sha1` function.
+//
+// It returns the hex-encoded SHA1 digest of the given value.
+func fnSHA1(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "sha1: wrong number of arguments"}
+	}
+
+	sum := sha1.Sum([]byte(args[0].Inspect()))
+	return &object.String{Value: hex.EncodeToString(sum[:])}
+}
+
+// fnSHA256 is the implementation of our `sha256` function.
+//
+// It returns the hex-encoded SHA256 digest of the given value.
+func fnSHA256(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "sha256: wrong number of arguments"}
+	}
+
+	sum := sha256.Sum256([]byte(args[0].Inspect()))
+	return &object.String{Value: hex.EncodeToString(sum[:])}
+}
+
+// fnSkip is the implementation of our `skip` function.
+//
+// It returns a new array holding all but the first n elements of the
+// given array, or if n is negative all but the last -n elements.
+func fnSkip(args []object.Object) object.Object {
+	return takeHelper("skip", args, false)
+}
+
+// fnTake is the implementation of our `take` function.
+//
+// It returns a new array holding the first n elements of the given
+// array, or if n is negative the last -n elements.
+func fnTake(args []object.Object) object.Object {
+	return takeHelper("take", args, true)
+}
+
+// takeHelper implements `take` and `skip`.
+//
+// The count is clamped to the length of the array, so taking more
+// elements than there are returns them all, and skipping them returns
+// an empty array.
+func takeHelper(name string, args []object.Object, take bool) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: first argument must be an array, not %s", name, args[0].Type())}
+	}
+	n, ok := args[1].(*object.Integer)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("%s: second argument must be an integer, not %s", name, args[1].Type())}
+	}
+
+	// Find the index which divides the elements we take from those
+	// we skip, counting backwards from the end if n is negative.
+	length := int64(len(arr.Elements))
+	idx := n.Value
+	if idx < 0 {
+		idx += length
+		take = !take
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > length {
+		idx = length
+	}
+
+	var selected []object.Object
+	if take {
+		selected = arr.Elements[:idx]
+	} else {
+		selected = arr.Elements[idx:]
+	}
+
+	// Copy the elements, so that the result is a new array.
+	out := make([]object.Object, len(selected))
+	copy(out, selected)
+	return &object.Array{Elements: out}
+}
+
+// fnSplit is the implementation of our `split` primitive.
+func fnSplit(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Null{}
+	}
+
+	// String to split
+	input := args[0]
+
+	// String to split by
+	split := args[1]
+
+	// Typecheck
+	if input.Type() != object.STRING ||
+		split.Type() != object.STRING {
+		return &object.Null{}
+	}
+
+	// Perform the split
+	pieces := strings.Split(input.(*object.String).Value,
+		split.(*object.String).Value)
+
+	// Convert the results into an array of string-objects
+	elements := make([]object.Object, len(pieces))
+	for i, e := range pieces {
 		elements[i] = &object.String{Value: e}
 	}
 
-	// Now return that as an array.
-	return (&object.Array{Elements: elements})
+	// Now return that as an array.
+	return (&object.Array{Elements: elements})
+}
+
+// fnSubstring is the implementation of our `substring` function.
+//
+// It returns the characters of the given string from the start-index
+// up to, but not including, the end-index.  The semantics are the same
+// as those of the slice operator: a missing end-index defaults to the
+// length of the string, negative indexes count backwards from the end,
+// and indexes which are out of range are clamped.
+func fnSubstring(args []object.Object) object.Object {
+
+	// We expect two or three arguments
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Message: "substring: wrong number of arguments"}
+	}
+
+	// Indexes are counted in characters, not bytes.
+	chars := []rune(args[0].Inspect())
+	length := int64(len(chars))
+
+	from, err := substringIndex(args[1], 0, length)
+	if err != nil {
+		return err
+	}
+	to := length
+	if len(args) == 3 {
+		to, err = substringIndex(args[2], length, length)
+		if err != nil {
+			return err
+		}
+	}
+
+	// An empty range.
+	if from > to {
+		to = from
+	}
+
+	return &object.String{Value: string(chars[from:to])}
+}
+
+// substringIndex converts the given object to an index for our
+// substring function, handling negative indexes and clamping.
+func substringIndex(obj object.Object, def int64, length int64) (int64, *object.Error) {
+
+	if obj.Type() == object.NULL {
+		return def, nil
+	}
+
+	i, ok := obj.(*object.Integer)
+	if !ok {
+		return 0, &object.Error{Message: fmt.Sprintf("substring: indexes must be integers, not %s", obj.Type())}
+	}
+
+	idx := i.Value
+	if idx < 0 {
+		idx += length
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > length {
+		idx = length
+	}
+	return idx, nil
+}
+
+// fnSum is the implementation of our `sum` function.
+//
+// It returns the total of the numbers in the given array, the result
+// is an integer unless any of the elements were floats.
+func fnSum(args []object.Object) object.Object {
+
+	nums, err := numericArrayArgs("sum", args)
+	if err != nil {
+		return err
+	}
+
+	isFloat := false
+	overflow := false
+	var iTotal int64
+	fTotal := 0.0
+
+	for _, n := range nums {
+		switch v := n.(type) {
+		case *object.Integer:
+			// The integer total doesn't matter if there are
+			// floats too, so only note that it overflowed.
+			if (v.Value > 0 && iTotal > math.MaxInt64-v.Value) || (v.Value < 0 && iTotal < math.MinInt64-v.Value) {
+				overflow = true
+			}
+			iTotal += v.Value
+			fTotal += float64(v.Value)
+		case *object.Float:
+			isFloat = true
+			fTotal += v.Value
+		}
+	}
+
+	if isFloat {
+		return &object.Float{Value: fTotal}
+	}
+
+	// Rather than silently wrapping-around, as with the
+	// arithmetic operators an overflow is an error.
+	if overflow {
+		return &object.Error{Message: "sum: integer overflow"}
+	}
+	return &object.Integer{Value: iTotal}
+}
+
+// numericArrayArgs handles the arguments of our aggregate functions,
+// which are an array and an optional boolean "strict" flag.
+//
+// The array members are converted to numbers via toNumberArg.  If
+// a member cannot be converted then an error is returned, unless the
+// strict flag is false in which case the member is skipped.
+func numericArrayArgs(name string, args []object.Object) ([]object.Object, *object.Error) {
+
+	// We expect either one or two arguments
+	//    sum([array], bool)
+	if len(args) != 1 && len(args) != 2 {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	// Type-check the first argument
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: argument must be an array, not %s", name, args[0].Type())}
+	}
+
+	// Default to being strict
+	strict := true
+
+	// Second (optional) argument controls strictness.
+	if len(args) == 2 {
+
+		// Type-check second argument
+		if args[1].Type() != object.BOOLEAN {
+			return nil, &object.Error{Message: fmt.Sprintf("%s: strict-flag must be a boolean, not %s", name, args[1].Type())}
+		}
+		strict = args[1].(*object.Boolean).Value
+	}
+
+	var out []object.Object
+
+	for i, e := range arr.Elements {
+		num, err := toNumberArg(e)
+		if err != nil {
+			if strict {
+				return nil, &object.Error{Message: fmt.Sprintf("%s: element %d: %s", name, i, err.Error())}
+			}
+			continue
+		}
+
+		out = append(out, num)
+	}
+
+	return out, nil
+}
+
+// toNumberArg converts the given object to a number, if it can.
+//
+// Integers and floats are returned unchanged, and strings are parsed
+// as either an integer or a float.  Other types result in an error.
+func toNumberArg(obj object.Object) (object.Object, error) {
+
+	switch o := obj.(type) {
+	case *object.Integer, *object.Float:
+		return obj, nil
+	case *object.String:
+		num, err := object.ParseNumber(strings.TrimSpace(o.Value))
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to a number", o.Value)
+		}
+		return num, nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %s to a number", obj.Type())
+}
+
+// fnString is the implementation of our `string` function.
+func fnString(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	str := args[0].Inspect()
+	return &object.String{Value: str}
+}
+
+// fnTrim is the implementation of our `trim` function.
+func fnTrim(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	arg := args[0]
+	val := strings.TrimSpace(arg.Inspect())
+
+	return &object.String{Value: val}
+}
+
+// fnType is the implementation of our `type` function.
+func fnType(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
+	}
+
+	// Get the arg
+	arg := args[0]
+
+	// Get the type - lower-case
+	val := string(arg.Type())
+	val = strings.ToLower(val)
+
+	// Return
+	return &object.String{Value: val}
+}
+
+// fnPrint is the implementation of our `print` function.
+//
+// Output is written to the writer configured in the environment.
+func (e *Environment) fnPrint(args []object.Object) object.Object {
+	for _, arg := range args {
+		fmt.Fprintf(e.output, "%s", arg.Inspect())
+	}
+	return &object.Void{}
+}
+
+// fnPrintf is the implementation of our `printf` function.
+//
+// Output is written to the writer configured in the environment.
+func (e *Environment) fnPrintf(args []object.Object) object.Object {
+
+	// Convert to the formatted version, via our `sprintf`
+	// function.
+	out := e.fnSprintf(args)
+
+	// If that returned a string then we can print it
+	if out.Type() == object.STRING {
+		fmt.Fprint(e.output, out.(*object.String).Value)
+
+	}
+	if out.Type() == object.ERROR {
+		return out
+	}
+
+	return &object.Void{}
+}
+
+// fnSort implements our `sort` function
+func (e *Environment) fnSort(args []object.Object) object.Object {
+
+	// We expect either one or two arguments
+	//    sort([array], bool)
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Null{}
+	}
+
+	// Type-check the first argument
+	if args[0].Type() != object.ARRAY {
+		return &object.Null{}
+	}
+
+	// Default to not lower-casing items
+	lower := false
+
+	// Second (optional) argument controls case-sensitivity.
+	if len(args) == 2 {
+
+		// Type-check second argument
+		if args[1].Type() != object.BOOLEAN {
+			return &object.Null{}
+		}
+
+		// Copy value.
+		lower = args[1].(*object.Boolean).Value
+	}
+
+	// defer to our helper methd
+	return (e.sortHelper(args, lower, false))
+}
+
+// fnPluck is the implementation of our `pluck` function.
+//
+// It returns an array holding the value of the named field from each
+// element of the given array, which are typically hashes.  The name may
+// be a path of field-names separated by periods, such as "price.net",
+// which is resolved in the same way as a field reference in a script.
+//
+// Elements which don't have the field give null, unless the optional
+// third argument is true, in which case they are skipped.
+func fnPluck(args []object.Object) object.Object {
+
+	// We expect two or three arguments
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Message: "pluck: wrong number of arguments"}
+	}
+
+	arr, ok := args[0].(*object.Array)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("pluck: first argument must be an array, not %s", args[0].Type())}
+	}
+
+	path, ok := args[1].(*object.String)
+	if !ok || path.Value == "" {
+		return &object.Error{Message: fmt.Sprintf("pluck: second argument must be the name of a field, not %s", args[1].Type())}
+	}
+
+	skip := false
+	if len(args) == 3 {
+		b, ok := args[2].(*object.Boolean)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("pluck: third argument must be a boolean, not %s", args[2].Type())}
+		}
+		skip = b.Value
+	}
+
+	names := strings.Split(path.Value, ".")
+
+	out := []object.Object{}
+	for _, el := range arr.Elements {
+
+		val, found := fieldPath(el, names)
+		if !found {
+			if skip {
+				continue
+			}
+			val = &object.Null{}
+		}
+		out = append(out, val)
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// fieldPath returns the value found by following the given path, of
+// field-names, through nested hashes - returning false if it is missing.
+func fieldPath(obj object.Object, names []string) (object.Object, bool) {
+
+	val := obj
+	for _, name := range names {
+		hash, ok := val.(*object.Hash)
+		if !ok {
+			return nil, false
+		}
+		val, ok = hash.Pairs[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// fnPush is the implementation of our `push` function.
+//
+// It returns a copy of the given array with a single item appended
+// to it, the original array is not modified.
+func fnPush(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "push: wrong number of arguments"}
+	}
+
+	return fnAppend(args)
 }
 
-// fnString is the implementation of our `string` function.
-func fnString(args []object.Object) object.Object {
+// fnRandom is the implementation of our `random` function.
+//
+// It returns a random floating-point number in the range [0, 1).
+func (e *Environment) fnRandom(args []object.Object) object.Object {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	// We expect no arguments
+	if len(args) != 0 {
+		return &object.Error{Message: "random: wrong number of arguments"}
 	}
 
-	str := args[0].Inspect()
-	return &object.String{Value: str}
+	return &object.Float{Value: e.rand.Float64()}
 }
 
-// fnTrim is the implementation of our `trim` function.
-func fnTrim(args []object.Object) object.Object {
+// fnRandomInt is the implementation of our `randomInt` function.
+//
+// It returns a random integer in the range [0, n).
+func (e *Environment) fnRandomInt(args []object.Object) object.Object {
 
 	// We expect one argument
 	if len(args) != 1 {
-		return &object.Null{}
+		return &object.Error{Message: "randomInt: wrong number of arguments"}
 	}
 
-	arg := args[0]
-	val := strings.TrimSpace(arg.Inspect())
+	n, ok := args[0].(*object.Integer)
+	if !ok || n.Value <= 0 {
+		return &object.Error{Message: fmt.Sprintf("randomInt: argument must be a positive integer, not %s", args[0].Inspect())}
+	}
 
-	return &object.String{Value: val}
+	return &object.Integer{Value: e.rand.Int63n(n.Value)}
 }
 
-// fnType is the implementation of our `type` function.
-func fnType(args []object.Object) object.Object {
+// fnRange implements our `range` function.
+//
+// This returns an array of integers, much like python's `range`:
+//
+//    range(end)
+//    range(start, end)
+//    range(start, end, step)
+//
+// The start defaults to zero, the step defaults to one, and the end
+// value is not included in the result.  A negative step counts down.
+func fnRange(args []object.Object) object.Object {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	// We expect between one and three arguments
+	if len(args) < 1 || len(args) > 3 {
+		return &object.Error{Message: "range: wrong number of arguments"}
 	}
 
-	// Get the arg
-	arg := args[0]
+	// All of which must be integers
+	var vals []int64
+	for _, arg := range args {
+		i, ok := arg.(*object.Integer)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("range: arguments must be integers, not %s", arg.Type())}
+		}
+		vals = append(vals, i.Value)
+	}
 
-	// Get the type - lower-case
-	val := string(arg.Type())
-	val = strings.ToLower(val)
+	var start, end, step int64
+	step = 1
+
+	switch len(vals) {
+	case 1:
+		end = vals[0]
+	case 2:
+		start = vals[0]
+		end = vals[1]
+	case 3:
+		start = vals[0]
+		end = vals[1]
+		step = vals[2]
+	}
 
-	// Return
-	return &object.String{Value: val}
-}
+	if step == 0 {
+		return &object.Error{Message: "range: step must not be zero"}
+	}
 
-// fnPrint is the implementation of our `print` function.
-func fnPrint(args []object.Object) object.Object {
-	for _, e := range args {
-		fmt.Printf("%s", e.Inspect())
+	// Count the elements before creating them.  The distance between
+	// the start and the end might not fit in an int64, but it always
+	// fits in a uint64, as does the size of the step.
+	var count uint64
+	if step > 0 && start < end {
+		count = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+	}
+	if step < 0 && start > end {
+		count = (uint64(start)-uint64(end)-1)/(0-uint64(step)) + 1
+	}
+	if count > maxRangeLength {
+		return &object.Error{Message: fmt.Sprintf("range: the result would have %d elements, more than the maximum of %d", count, maxRangeLength)}
 	}
-	return &object.Void{}
-}
 
-// fnPrintf is the implementation of our `printf` function.
-func fnPrintf(args []object.Object) object.Object {
+	elements := make([]object.Object, count)
+	val := start
+	for i := range elements {
+		elements[i] = &object.Integer{Value: val}
+		val += step
+	}
 
-	// Convert to the formatted version, via our `sprintf`
-	// function.
-	out := fnSprintf(args)
+	return &object.Array{Elements: elements}
+}
 
-	// If that returned a string then we can print it
-	if out.Type() == object.STRING {
-		fmt.Print(out.(*object.String).Value)
+// fnRepeat is the implementation of our `repeat` function.
+//
+// It returns the given value repeated the specified number of times, a
+// count of zero, or less, gives an empty string.
+func (e *Environment) fnRepeat(args []object.Object) object.Object {
 
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Error{Message: "repeat: wrong number of arguments"}
 	}
 
-	return &object.Void{}
-}
+	str := args[0].Inspect()
 
-// fnSort implements our `sort` function
-func fnSort(args []object.Object) object.Object {
+	n, ok := args[1].(*object.Integer)
+	if !ok {
+		return &object.Error{Message: fmt.Sprintf("repeat: count must be an integer, not %s", args[1].Type())}
+	}
 
-	// We expect either one or two arguments
-	//    sort([array], bool)
-	if len(args) != 1 && len(args) != 2 {
-		return &object.Null{}
+	if n.Value <= 0 || str == "" {
+		return &object.String{Value: ""}
+	}
+	if n.Value > int64(e.maxLength()/len(str)) {
+		return tooLong("repeat", e.maxLength())
 	}
 
-	// Type-check the first argument
-	if args[0].Type() != object.ARRAY {
-		return &object.Null{}
+	return &object.String{Value: strings.Repeat(str, int(n.Value))}
+}
+
+// fnReplaceRegex is the implementation of our `replaceRegex` function.
+//
+// It replaces every match of the regular expression with the replacement,
+// which may refer to capture groups as `$1`, or `${name}`.
+func (e *Environment) fnReplaceRegex(args []object.Object) object.Object {
+
+	// We expect three arguments
+	if len(args) != 3 {
+		return &object.Error{Message: "replaceRegex: wrong number of arguments"}
 	}
 
-	// Default to not lower-casing items
-	lower := false
+	pattern := args[1].Inspect()
 
-	// Second (optional) argument controls case-sensitivity.
-	if len(args) == 2 {
+	r, err := getRegexp(pattern)
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("replaceRegex: invalid regular expression '%s': %s", pattern, err.Error())}
+	}
 
-		// Type-check second argument
-		if args[1].Type() != object.BOOLEAN {
-			return &object.Null{}
+	// Replace each match in turn, rather than via ReplaceAllString,
+	// so that we can stop as soon as the result is too long.
+	src := args[0].Inspect()
+	repl := args[2].Inspect()
+	limit := e.maxLength()
+
+	var out []byte
+	last := 0
+	for _, m := range r.FindAllStringSubmatchIndex(src, -1) {
+		out = append(out, src[last:m[0]]...)
+		out = r.ExpandString(out, repl, src, m)
+		last = m[1]
+
+		if len(out) > limit {
+			return tooLong("replaceRegex", limit)
 		}
-
-		// Copy value.
-		lower = args[1].(*object.Boolean).Value
 	}
+	out = append(out, src[last:]...)
 
-	// defer to our helper methd
-	return (sortHelper(args, lower, false))
+	return &object.String{Value: string(out)}
 }
 
 // fnReverse implements our `reverse` function
-func fnReverse(args []object.Object) object.Object {
+func (e *Environment) fnReverse(args []object.Object) object.Object {
 
 	// We expect either one or two arguments
 	//    reverse([array], bool)
@@ -353,23 +3091,26 @@ func fnReverse(args []object.Object) object.Object {
 	}
 
 	// Defer to our helper method.
-	return (sortHelper(args, lower, true))
+	return (e.sortHelper(args, lower, true))
 }
 
 // sortHelper is a helper function which allows sorting/reversing an array of items.
 //
-// TODO: See if we can avoid juggling this sort with a temporary object.
-// TODO: It might be we can sort.Slice on array.Elements,  but when I tried
-// TODO: that first I got "panic Swapper on nil"
-func sortHelper(args []object.Object, lowerCase bool, doReverse bool) object.Object {
+// Values are ordered in the same way as by the comparison operators, so
+// numbers are compared by value rather than as strings.  Values which
+// can't be compared with each other are grouped by their type, with
+// numbers first, then NaN, then strings, then booleans, and then
+// everything else - ordered by their string representation.
+func (e *Environment) sortHelper(args []object.Object, lowerCase bool, doReverse bool) object.Object {
 
 	// We convert the input-array we're sorting into an
 	// array of structures which we can sort natively.
 	type Temp struct {
 
-		// key is the (stringified) copy of the
-		// object-members contents
-		key string
+		// key is the value we compare, which is a
+		// lower-cased copy of strings if we're
+		// ignoring case.
+		key object.Object
 
 		// index is the ORIGINAL index of the item
 		// in the input array.
@@ -379,31 +3120,37 @@ func sortHelper(args []object.Object, lowerCase bool, doReverse bool) object.Obj
 	//
 	// Make a copy of the keys + indexes
 	//
-	items := make([]Temp, len(args[0].(*object.Array).Elements))
-	for i := range items {
-		items[i].key = args[0].(*object.Array).Elements[i].Inspect()
+	elements := args[0].(*object.Array).Elements
+	items := make([]Temp, len(elements))
+	for i, el := range elements {
+		items[i].key = el
 		items[i].index = i
+
+		if str, ok := el.(*object.String); ok && lowerCase {
+			items[i].key = &object.String{Value: strings.ToLower(str.Value)}
+		}
 	}
 
 	// Sort the temporary structure we have been given.
 	//
 	// Here we handle "sort vs. reverse".
-	//
-	// We also handle the optional case-insensitivity.
-	sort.Slice(items, func(i, j int) bool {
+	sort.SliceStable(items, func(i, j int) bool {
 
 		a := items[i].key
 		b := items[j].key
 
-		if lowerCase {
-			a = strings.ToLower(a)
-			b = strings.ToLower(b)
+		cmp, ok := e.Compare(a, b)
+		if !ok {
+			cmp = sortRank(a) - sortRank(b)
+		}
+		if !ok && cmp == 0 {
+			cmp = strings.Compare(a.Inspect(), b.Inspect())
 		}
 
 		if doReverse {
-			return b < a
+			return cmp > 0
 		}
-		return a < b
+		return cmp < 0
 	})
 
 	// Now we've sorted our result - populate an array
@@ -416,16 +3163,107 @@ func sortHelper(args []object.Object, lowerCase bool, doReverse bool) object.Obj
 	// regard to the items keeping their types.
 	//
 	out := make([]object.Object, len(items))
-	for i, e := range items {
-		out[i] = args[0].(*object.Array).Elements[e.index]
+	for i, item := range items {
+		out[i] = elements[item.index]
 	}
 
 	// All done.
 	return &object.Array{Elements: out}
 }
 
+// sortRank returns the position of the given value's type in the order
+// used by sortHelper, for values which can't be compared directly.
+func sortRank(obj object.Object) int {
+	switch {
+	case isNaN(obj):
+		return 1
+	case obj.Type() == object.INTEGER || obj.Type() == object.FLOAT:
+		return 0
+	case obj.Type() == object.STRING:
+		return 2
+	case obj.Type() == object.BOOLEAN:
+		return 3
+	}
+	return 4
+}
+
+// fnRound is the implementation of our `round` function.
+//
+// Halves are rounded away from zero, rather than to the nearest even
+// value, so `round(2.5)` is 3, and `round(-2.5)` is -3.
+func fnRound(args []object.Object) object.Object {
+	return roundHelper("round", args, math.Round)
+}
+
+// roundHelper implements our `ceil`, `floor`, and `round` functions,
+// which take a number and an optional number of decimal places.
+//
+// The given function is used to round the value, once it has been
+// scaled by the number of places.  Integers are returned unchanged,
+// unless the number of places is negative, and floats remain floats.
+func roundHelper(name string, args []object.Object, fn func(float64) float64) object.Object {
+
+	// We expect one or two arguments
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	num, err := toNumberArg(args[0])
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("%s: %s", name, err.Error())}
+	}
+
+	places := 0
+	if len(args) == 2 {
+		p, ok := args[1].(*object.Integer)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("%s: decimal places must be an integer, not %s", name, args[1].Type())}
+		}
+		if p.Value < -18 || p.Value > 18 {
+			return &object.Error{Message: fmt.Sprintf("%s: decimal places must be between -18 and 18", name)}
+		}
+		places = int(p.Value)
+	}
+
+	switch n := num.(type) {
+	case *object.Integer:
+		if places >= 0 {
+			return n
+		}
+		return &object.Integer{Value: int64(shiftDecimal(fn(shiftDecimal(float64(n.Value), places)), -places))}
+	case *object.Float:
+		if math.IsInf(n.Value, 0) || math.IsNaN(n.Value) {
+			return n
+		}
+		res := shiftDecimal(fn(shiftDecimal(n.Value, places)), -places)
+
+		// Avoid returning "-0".
+		if res == 0 {
+			res = 0
+		}
+		return &object.Float{Value: res}
+	}
+	return &object.Null{}
+}
+
+// shiftDecimal multiplies the given value by 10 to the power of places.
+//
+// This is done by adjusting the exponent of the shortest decimal
+// representation of the value, rather than by multiplication, so that
+// a value such as 1.005 becomes exactly 100.5, rather than 100.49999...
+func shiftDecimal(val float64, places int) float64 {
+
+	str := strconv.FormatFloat(val, 'e', -1, 64)
+
+	i := strings.IndexByte(str, 'e')
+	exp, _ := strconv.Atoi(str[i+1:])
+
+	res, _ := strconv.ParseFloat(fmt.Sprintf("%se%d", str[:i], exp+places), 64)
+	return res
+}
+
 // fnSprintf is the implementation of our `sprintf` function.
-func fnSprintf(args []object.Object) object.Object {
+func (e *Environment) fnSprintf(args []object.Object) object.Object {
 
 	// We expect 1+ arguments
 	if len(args) < 1 {
@@ -440,6 +3278,12 @@ func fnSprintf(args []object.Object) object.Object {
 	// Get the format-string.
 	fs := args[0].(*object.String).Value
 
+	// The widths and precisions of the verbs can make the result
+	// far longer than the format, so check them before formatting.
+	if formatPadding(fs, args[1:]) > int64(e.maxLength()) {
+		return tooLong("sprintf", e.maxLength())
+	}
+
 	// Convert the arguments to something go's sprintf
 	// code will understand.
 	argLen := len(args)
@@ -457,6 +3301,234 @@ func fnSprintf(args []object.Object) object.Object {
 	return &object.String{Value: out}
 }
 
+// formatPadding returns the sum of the widths, and precisions, given to
+// the verbs of the specified format-string, which is the most that they
+// can add to the formatted values.
+//
+// A width given as `*` is taken from the arguments, so we assume the
+// largest integer argument.  Go ignores widths over a million, so no
+// single width can add more than that.
+func formatPadding(format string, args []object.Object) int64 {
+	const most = 1000000
+
+	star := int64(0)
+	for _, arg := range args {
+		if i, ok := arg.(*object.Integer); ok {
+			n := i.Value
+			if n < 0 {
+				n = -n
+			}
+			if n < 0 || n > most {
+				n = most
+			}
+			if n > star {
+				star = n
+			}
+		}
+	}
+
+	total := int64(0)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		// Walk the flags, argument indexes, width and precision
+		// until we reach the verb.
+	verb:
+		for i++; i < len(format); i++ {
+			c := format[i]
+			switch {
+			case c == '*':
+				total += star
+			case c >= '0' && c <= '9':
+				n := int64(0)
+				for ; i < len(format) && format[i] >= '0' && format[i] <= '9'; i++ {
+					if n < most {
+						n = n*10 + int64(format[i]-'0')
+					}
+				}
+				if n > most {
+					n = most
+				}
+				total += n
+				i--
+			case c == '[':
+				for i < len(format) && format[i] != ']' {
+					i++
+				}
+			case strings.IndexByte("+-# .", c) >= 0:
+			default:
+				break verb
+			}
+		}
+	}
+	return total
+}
+
+// fnUnion is the implementation of our `union` function.
+//
+// It returns the unique elements which are present in either array.
+func (e *Environment) fnUnion(args []object.Object) object.Object {
+
+	a, b, err := setArgs("union", args)
+	if err != nil {
+		return err
+	}
+
+	out := []object.Object{}
+	for _, el := range append(append([]object.Object{}, a...), b...) {
+		if !e.Contains(out, el) {
+			out = append(out, el)
+		}
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// setArgs validates the arguments to our set-functions, which must
+// be invoked with exactly two arrays, and returns their elements.
+func setArgs(name string, args []object.Object) ([]object.Object, []object.Object, *object.Error) {
+
+	if len(args) != 2 {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	for _, arg := range args {
+		if arg.Type() != object.ARRAY {
+			return nil, nil, &object.Error{Message: fmt.Sprintf("%s: arguments must be arrays, not %s", name, arg.Type())}
+		}
+	}
+
+	return args[0].(*object.Array).Elements, args[1].(*object.Array).Elements, nil
+}
+
+// fnUnique is the implementation of our `unique` function.
+//
+// It returns a new array with any duplicate elements removed, the
+// first occurrence of each element is kept.
+func (e *Environment) fnUnique(args []object.Object) object.Object {
+
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Error{Message: "unique: wrong number of arguments"}
+	}
+
+	// Which must be an array
+	if args[0].Type() != object.ARRAY {
+		return &object.Error{Message: fmt.Sprintf("unique: argument must be an array, not %s", args[0].Type())}
+	}
+
+	out := []object.Object{}
+
+	for _, el := range args[0].(*object.Array).Elements {
+		if !e.Contains(out, el) {
+			out = append(out, el)
+		}
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// numericValue returns the value of an integer, or float, object as
+// a float64.  The boolean return value is false for other types.
+func numericValue(obj object.Object) (float64, bool) {
+	switch o := obj.(type) {
+	case *object.Integer:
+		return float64(o.Value), true
+	case *object.Float:
+		return o.Value, true
+	}
+	return 0, false
+}
+
+// parseURLArg parses the URL given as the first argument of our `url*`
+// functions, returning an error if it is missing or malformed.
+func parseURLArg(name string, args []object.Object, count int) (*url.URL, object.Object) {
+
+	if len(args) != count {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	u, err := url.Parse(args[0].Inspect())
+	if err != nil {
+		return nil, &object.Error{Message: fmt.Sprintf("%s: %s", name, err.Error())}
+	}
+	return u, nil
+}
+
+// fnURLHost is the implementation of our `urlHost` function.
+//
+// It returns the hostname of the given URL, without any port.
+func fnURLHost(args []object.Object) object.Object {
+	u, err := parseURLArg("urlHost", args, 1)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: u.Hostname()}
+}
+
+// fnURLPath is the implementation of our `urlPath` function.
+func fnURLPath(args []object.Object) object.Object {
+	u, err := parseURLArg("urlPath", args, 1)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: u.Path}
+}
+
+// fnURLQuery is the implementation of our `urlQuery` function.
+//
+// It returns the value of the given query-parameter, or null if it
+// is not present.
+func fnURLQuery(args []object.Object) object.Object {
+	u, err := parseURLArg("urlQuery", args, 2)
+	if err != nil {
+		return err
+	}
+
+	vals, ok := u.Query()[args[1].Inspect()]
+	if !ok || len(vals) == 0 {
+		return &object.Null{}
+	}
+	return &object.String{Value: vals[0]}
+}
+
+// fnURLScheme is the implementation of our `urlScheme` function.
+func fnURLScheme(args []object.Object) object.Object {
+	u, err := parseURLArg("urlScheme", args, 1)
+	if err != nil {
+		return err
+	}
+	return &object.String{Value: u.Scheme}
+}
+
+// fnUUID is the implementation of our `uuid` function.
+//
+// It returns a random (version 4) UUID.  The bytes come from crypto/rand,
+// so that they can't be predicted, unless a seed has been set via
+// SetRandSeed - in which case they're reproducible instead.
+func (e *Environment) fnUUID(args []object.Object) object.Object {
+
+	// We expect no arguments
+	if len(args) != 0 {
+		return &object.Error{Message: "uuid: wrong number of arguments"}
+	}
+
+	b := make([]byte, 16)
+	if e.seeded {
+		e.rand.Read(b)
+	} else if _, err := crand.Read(b); err != nil {
+		return &object.Error{Message: fmt.Sprintf("uuid: %s", err.Error())}
+	}
+
+	// Set the version, and variant, bits.
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return &object.String{Value: fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])}
+}
+
 // fnUpper is the implementation of our `upper` function.
 //
 // Again we stringify our arguments here so `upper(true)` is
@@ -475,6 +3547,87 @@ func fnUpper(args []object.Object) object.Object {
 	return &object.String{Value: arg}
 }
 
+// fnZip is the implementation of our `zip` function.
+//
+// It returns an array of pairs, each holding the elements at the same
+// position in the two given arrays.  If the arrays have different lengths
+// the result is truncated to the length of the shorter.
+func fnZip(args []object.Object) object.Object {
+
+	a, b, err := zipArgs("zip", args)
+	if err != nil {
+		return err
+	}
+
+	out := make([]object.Object, len(a))
+	for i := range a {
+		out[i] = &object.Array{Elements: []object.Object{a[i], b[i]}}
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// fnZipWith is the implementation of our `zipWith` function.
+//
+// It returns an array holding the result of calling the named function
+// with each pair of elements from the two given arrays, truncated in the
+// same way as `zip`.
+func (e *Environment) fnZipWith(args []object.Object) object.Object {
+
+	if len(args) != 3 {
+		return &object.Error{Message: "zipWith: wrong number of arguments"}
+	}
+
+	a, b, err := zipArgs("zipWith", args[:2])
+	if err != nil {
+		return err
+	}
+
+	fn, err := e.functionArg("zipWith", "third", args[2])
+	if err != nil {
+		return err
+	}
+
+	out := make([]object.Object, len(a))
+	for i := range a {
+		res := fn([]object.Object{a[i], b[i]})
+		switch res.Type() {
+		case object.ERROR:
+			return &object.Error{Message: fmt.Sprintf("zipWith: element %d: %s", i, res.Inspect())}
+		case object.VOID:
+			res = &object.Null{}
+		}
+		out[i] = res
+	}
+
+	return &object.Array{Elements: out}
+}
+
+// zipArgs validates the arrays given to our `zip` and `zipWith`
+// functions, returning their elements truncated to the same length.
+func zipArgs(name string, args []object.Object) ([]object.Object, []object.Object, *object.Error) {
+
+	if len(args) != 2 {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+	}
+
+	a, ok := args[0].(*object.Array)
+	if !ok {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: first argument must be an array, not %s", name, args[0].Type())}
+	}
+	b, ok := args[1].(*object.Array)
+	if !ok {
+		return nil, nil, &object.Error{Message: fmt.Sprintf("%s: second argument must be an array, not %s", name, args[1].Type())}
+	}
+
+	n := len(a.Elements)
+	if len(b.Elements) < n {
+		n = len(b.Elements)
+	}
+
+	return a.Elements[:n], b.Elements[:n], nil
+}
+
 // getTimeField handles returning a time-related field from an object
 // which is assumed to contain a time in the Unix Epoch format.
 func getTimeField(args []object.Object, val string) object.Object {
@@ -489,21 +3642,8 @@ func getTimeField(args []object.Object, val string) object.Object {
 		return &object.Null{}
 	}
 
-	// Convert that to a time
-	ts := time.Unix(args[0].(*object.Integer).Value, 0)
-
-	// Handle timezones, by reading $TZ, and if not set
-	// defaulting to UTC.
-	env := os.Getenv("TZ")
-	if env == "" {
-		env = "UTC"
-	}
-
-	// Ensure we set that timezone.
-	loc, err := time.LoadLocation(env)
-	if err == nil {
-		ts = ts.In(loc)
-	}
+	// Convert that to a time, in our timezone.
+	ts := time.Unix(args[0].(*object.Integer).Value, 0).In(location())
 
 	// Now get the fields
 	hr, min, sec := ts.Clock()
@@ -1,7 +1,13 @@
 package environment
 
 import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -287,10 +293,6 @@ func TestMatch(t *testing.T) {
 
 		{String: "Steve", Regexp: "^steve$", Result: false},
 		{String: "Steve", Regexp: "^steve$", Result: false},
-
-		// invalid regexp
-		{String: "Steve", Regexp: "+", Result: false},
-		{String: "Steve", Regexp: "+", Result: false},
 	}
 
 	for _, test := range tests {
@@ -302,19 +304,199 @@ func TestMatch(t *testing.T) {
 
 		res := fnMatch(args)
 
-		if res.(*object.Boolean).Value != test.Result {
+		if res.Type() != object.BOOLEAN || res.True() != test.Result {
 			t.Errorf("Invalid result for %s =~ /%s/", test.String, test.Regexp)
 		}
 
 	}
 
-	// Calling the function with != 2 arguments should return false
+	// Calling the function with != 2 arguments, or an invalid
+	// regular expression, is an error.
 	var args []object.Object
 	out := fnMatch(args)
-	if out.(*object.Boolean).Value != false {
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+	out = fnMatch([]object.Object{&object.String{Value: "Steve"}, &object.String{Value: "+"}})
+	if out.Type() != object.ERROR || !strings.Contains(out.Inspect(), "invalid regular expression '+'") {
+		t.Errorf("invalid regexp returns a weird result: %s", out.Inspect())
+	}
+}
+
+// Test extracting capture groups
+func TestMatchGroups(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{str("user=steve id=42"), str("user=([a-z]+) id=([0-9]+)")}, Result: "[user=steve id=42, steve, 42]"},
+		{Args: []object.Object{str("user=steve"), str("steve")}, Result: "[steve]"},
+		{Args: []object.Object{str("user=steve"), str("^nope")}, Result: "null"},
+	}
+
+	for _, tst := range tests {
+		out := fnMatchGroups(tst.Args)
+		if out.Inspect() != tst.Result {
+			t.Errorf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	for _, args := range [][]object.Object{{}, {str("user=steve"), str("+")}} {
+		out := fnMatchGroups(args)
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for %v, got %s", args, out.Inspect())
+		}
+	}
+}
+
+// Test extracting named capture groups
+func TestMatchNamed(t *testing.T) {
+
+	type TestCase struct {
+		String string
+		Regexp string
+		Result string
+	}
+
+	tests := []TestCase{
+		{String: "user=steve id=42", Regexp: "user=(?P<user>[a-z]+) id=(?P<id>[0-9]+)", Result: "{id: 42, user: steve}"},
+		{String: "user=steve id=42", Regexp: "user=(?P<user>[a-z]+) id=([0-9]+)", Result: "{user: steve}"},
+		{String: "user=steve", Regexp: "^(?P<name>[0-9]+)$", Result: "null"},
+	}
+
+	for _, test := range tests {
+
+		res := fnMatchNamed([]object.Object{
+			&object.String{Value: test.String},
+			&object.String{Value: test.Regexp},
+		})
+
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for %s =~ /%s/, got %s", test.String, test.Regexp, res.Inspect())
+		}
+	}
+
+	// Calling the function with != 2 arguments, or an invalid
+	// regular expression, is an error.
+	var args []object.Object
+	out := fnMatchNamed(args)
+	if out.Type() != object.ERROR {
 		t.Errorf("no arguments returns a weird result")
 	}
+	out = fnMatchNamed([]object.Object{&object.String{Value: "user=steve"}, &object.String{Value: "+"}})
+	if out.Type() != object.ERROR {
+		t.Errorf("invalid regexp returns a weird result: %s", out.Inspect())
+	}
+}
+
+// Test matching against lists of regular expressions.
+func TestMatchesAnyAll(t *testing.T) {
+
+	type TestCase struct {
+		String   string
+		Patterns []string
+		Any      bool
+		All      bool
+	}
+
+	tests := []TestCase{
+		{String: "steve", Patterns: []string{}, Any: false, All: true},
+		{String: "steve", Patterns: []string{"^s", "e$"}, Any: true, All: true},
+		{String: "steve", Patterns: []string{"^s", "^x"}, Any: true, All: false},
+		{String: "steve", Patterns: []string{"^x", "^y"}, Any: false, All: false},
+		{String: "Steve", Patterns: []string{"(?i)^steve$"}, Any: true, All: true},
+		{String: "one\n  two  ", Patterns: []string{"^two$"}, Any: true, All: true},
+	}
+
+	for _, test := range tests {
+
+		var patterns []object.Object
+		for _, p := range test.Patterns {
+			patterns = append(patterns, &object.String{Value: p})
+		}
+		args := []object.Object{
+			&object.String{Value: test.String},
+			&object.Array{Elements: patterns},
+		}
+
+		res := fnMatchesAny(args)
+		if res.Inspect() != fmt.Sprintf("%t", test.Any) {
+			t.Errorf("matchesAny(%s, %v) gave %s", test.String, test.Patterns, res.Inspect())
+		}
+		res = fnMatchesAll(args)
+		if res.Inspect() != fmt.Sprintf("%t", test.All) {
+			t.Errorf("matchesAll(%s, %v) gave %s", test.String, test.Patterns, res.Inspect())
+		}
+	}
+
+	// Errors: invalid patterns are reported even after a match
+	bad := [][]object.Object{
+		{&object.String{Value: "steve"}},
+		{&object.String{Value: "steve"}, &object.String{Value: "^s"}},
+		{&object.String{Value: "steve"}, &object.Array{Elements: []object.Object{
+			&object.String{Value: "^s"},
+			&object.String{Value: "+"},
+		}}},
+	}
+	for _, args := range bad {
+		for _, fn := range []func([]object.Object) object.Object{fnMatchesAny, fnMatchesAll} {
+			res := fn(args)
+			if res.Type() != object.ERROR {
+				t.Errorf("expected an error, got %s", res.Inspect())
+			}
+		}
+	}
+
+	res := fnMatchesAny(bad[2])
+	if !strings.Contains(res.Inspect(), "'+'") {
+		t.Errorf("error didn't identify the pattern: %s", res.Inspect())
+	}
+}
+
+// Test capitalize and title
+func TestCapitalize(t *testing.T) {
+
+	tests := []struct {
+		Input      string
+		Capitalize string
+		Title      string
+	}{
+		{Input: "", Capitalize: "", Title: ""},
+		{Input: "steve", Capitalize: "Steve", Title: "Steve"},
+		{Input: "hELLO wORLD", Capitalize: "Hello world", Title: "Hello World"},
+		{Input: "  mary  ann\to'neil ", Capitalize: "  mary  ann\to'neil ", Title: "  Mary  Ann\tO'neil "},
+		{Input: "1st PLACE", Capitalize: "1st place", Title: "1st Place"},
+		{Input: "émile ZOLA", Capitalize: "Émile zola", Title: "Émile Zola"},
+		{Input: "ǆemal", Capitalize: "ǅemal", Title: "ǅemal"},
+		{Input: "éa ÉB", Capitalize: "Éa éb", Title: "Éa Éb"},
+	}
+
+	for _, test := range tests {
+
+		res := fnCapitalize([]object.Object{&object.String{Value: test.Input}})
+		if res.Inspect() != test.Capitalize {
+			t.Errorf("Invalid result for capitalize(%q), got %q", test.Input, res.Inspect())
+		}
+
+		res = fnTitle([]object.Object{&object.String{Value: test.Input}})
+		if res.Inspect() != test.Title {
+			t.Errorf("Invalid result for title(%q), got %q", test.Input, res.Inspect())
+		}
+	}
+
+	// Non-strings are stringified
+	res := fnTitle([]object.Object{&object.Boolean{Value: true}})
+	if res.Inspect() != "True" {
+		t.Errorf("unexpected result for title(true): %s", res.Inspect())
+	}
 
+	// Calling the functions with != 1 argument is an error
+	if fnCapitalize(nil).Type() != object.ERROR || fnTitle(nil).Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
 }
 
 // Test trimming strings
@@ -428,13 +610,24 @@ func TestUpper(t *testing.T) {
 	}
 }
 
-// NOP-test
+// Test printing writes to the configured output
 func TestPrint(t *testing.T) {
+	env := New()
+
+	var buf bytes.Buffer
+	env.SetOutput(&buf)
+
 	var args []object.Object
-	fnPrint(args)
+	env.fnPrint(args)
 
-	args = append(args, &object.String{Value: ""})
-	fnPrint(args)
+	args = append(args, &object.String{Value: "Steve "}, &object.Integer{Value: 3})
+	env.fnPrint(args)
+
+	env.fnPrintf([]object.Object{&object.String{Value: " %d-%s"}, &object.Integer{Value: 1}, &object.String{Value: "two"}})
+
+	if buf.String() != "Steve 3 1-two" {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
 }
 
 // TestTime performs *minimal* invocation of time-fields
@@ -566,9 +759,80 @@ func TestNow(t *testing.T) {
 	}
 }
 
+// Test `today`, `startOfDay`, and `ago`
+func TestNowRelative(t *testing.T) {
+
+	loc := location()
+	now := time.Now().In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).Unix()
+
+	out := fnToday(nil)
+	if out.Type() != object.INTEGER || out.(*object.Integer).Value != midnight {
+		t.Errorf("unexpected result from today: %s", out.Inspect())
+	}
+
+	// The start of the day of any time during that day is midnight.
+	for _, offset := range []int64{0, 1, 3600, 86399} {
+		out = fnStartOfDay([]object.Object{&object.Integer{Value: midnight + offset}})
+		if out.Inspect() != fmt.Sprintf("%d", midnight) {
+			t.Errorf("unexpected result from startOfDay(midnight + %d): %s", offset, out.Inspect())
+		}
+	}
+	out = fnStartOfDay([]object.Object{&object.Float{Value: float64(midnight) + 0.5}})
+	if out.Inspect() != fmt.Sprintf("%d", midnight) {
+		t.Errorf("unexpected result from startOfDay: %s", out.Inspect())
+	}
+	out = fnStartOfDay([]object.Object{&object.Integer{Value: midnight - 1}})
+	if out.(*object.Integer).Value >= midnight {
+		t.Errorf("unexpected result from startOfDay for the previous day: %s", out.Inspect())
+	}
+	out = fnStartOfDay([]object.Object{&object.Null{}})
+	if out.Type() != object.NULL {
+		t.Errorf("expected null from startOfDay(null), got %s", out.Inspect())
+	}
+
+	// ago
+	tests := []struct {
+		Arg     object.Object
+		Seconds int64
+	}{
+		{Arg: &object.String{Value: "7d"}, Seconds: 7 * 86400},
+		{Arg: &object.String{Value: "24h"}, Seconds: 86400},
+		{Arg: &object.String{Value: "1d12h"}, Seconds: 129600},
+		{Arg: &object.Integer{Value: 60}, Seconds: 60},
+		{Arg: &object.Float{Value: 1.5}, Seconds: 1},
+	}
+	for _, tst := range tests {
+		out = fnAgo([]object.Object{tst.Arg})
+		if out.Type() != object.INTEGER {
+			t.Fatalf("unexpected result from ago(%s): %s", tst.Arg.Inspect(), out.Inspect())
+		}
+		diff := time.Now().Unix() - tst.Seconds - out.(*object.Integer).Value
+		if diff < 0 || diff > 2 {
+			t.Errorf("unexpected result from ago(%s): %s", tst.Arg.Inspect(), out.Inspect())
+		}
+	}
+
+	// bad arguments are errors
+	errors := []object.Object{
+		fnAgo(nil),
+		fnAgo([]object.Object{&object.String{Value: "7 days"}}),
+		fnAgo([]object.Object{&object.Boolean{Value: true}}),
+		fnStartOfDay(nil),
+		fnStartOfDay([]object.Object{&object.String{Value: "today"}}),
+	}
+	for i, out := range errors {
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+}
+
 // Test formatting strings
 func TestSprintf(t *testing.T) {
 
+	e := New()
+
 	type TestCase struct {
 		Input  []object.Object
 		Result string
@@ -612,7 +876,7 @@ func TestSprintf(t *testing.T) {
 		var args []object.Object
 		args = append(args, test.Input...)
 
-		x := fnSprintf(args)
+		x := e.fnSprintf(args)
 		if x.(*object.String).Value != test.Result {
 			t.Errorf("Invalid result for test %d, got %s", i, x)
 		}
@@ -620,17 +884,23 @@ func TestSprintf(t *testing.T) {
 
 	// Calling the function with no-arguments should return null
 	var args []object.Object
-	out := fnSprintf(args)
+	out := e.fnSprintf(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
 
 	// Calling the an argument of non-string
 	args = append(args, &object.Integer{Value: 32})
-	out = fnSprintf(args)
+	out = e.fnSprintf(args)
 	if out.Type() != object.NULL {
 		t.Errorf("non-string argument returns a weird result")
 	}
+
+	// Widths which would construct a huge string are errors.
+	out = e.fnSprintf([]object.Object{&object.String{Value: strings.Repeat("%999999d", 20)}})
+	if out.Type() != object.ERROR {
+		t.Errorf("huge widths returned %s", out.Type())
+	}
 }
 
 // Test printing formatting strings
@@ -682,7 +952,7 @@ func TestPrintf(t *testing.T) {
 		var args []object.Object
 		args = append(args, test.Input...)
 
-		x := fnPrintf(args)
+		x := New().fnPrintf(args)
 		if x.Type() != object.VOID {
 			t.Errorf("Invalid return type for test %d, got %s", i, x)
 		}
@@ -695,14 +965,14 @@ func TestSort(t *testing.T) {
 
 	// Calling the function with no-arguments should return null
 	var args []object.Object
-	out := fnSort(args)
+	out := New().fnSort(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
 
 	// Calling the an initial argument which isn't an array
 	args = append(args, &object.Integer{Value: 32})
-	out = fnSort(args)
+	out = New().fnSort(args)
 	if out.Type() != object.NULL {
 		t.Errorf("non-string argument returns a weird result")
 	}
@@ -712,7 +982,7 @@ func TestSort(t *testing.T) {
 	args = []object.Object{&object.Array{Elements: []object.Object{
 		&object.String{Value: "steve"}}},
 		&object.Integer{Value: 32}}
-	out = fnSort(args)
+	out = New().fnSort(args)
 	if out.Type() != object.NULL {
 		t.Errorf("non-string argument returns a weird result")
 	}
@@ -731,7 +1001,7 @@ func TestSort(t *testing.T) {
 	//
 	// Expected result: "Apples", "Cake", "and"
 	//
-	out = fnSort(in)
+	out = New().fnSort(in)
 	first := out.(*object.Array).Elements[0]
 	if first.(*object.String).Value != "Apples" {
 		t.Errorf("post-sort the result was wrong")
@@ -743,7 +1013,7 @@ func TestSort(t *testing.T) {
 	// Expected result: "and", "Apples", "Cake".
 	//
 	in = append(in, &object.Boolean{Value: true})
-	out = fnSort(in)
+	out = New().fnSort(in)
 	first = out.(*object.Array).Elements[0]
 	if first.(*object.String).Value != "and" {
 		t.Errorf("post-sort the result was wrong")
@@ -758,11 +1028,36 @@ func TestSort(t *testing.T) {
 		},
 		&object.Boolean{Value: true}}
 
-	out = fnSort(cased)
+	out = New().fnSort(cased)
 	first = out.(*object.Array).Elements[0]
 	if first.(*object.String).Value != "A" {
 		t.Errorf("post-sort the result was wrong")
 	}
+
+	//
+	// Numbers are sorted by value, not as strings, and values
+	// of different types are grouped by type.
+	//
+	tests := []struct {
+		Input   []object.Object
+		Sorted  string
+		Reverse string
+	}{
+		{Input: []object.Object{&object.Integer{Value: 10}, &object.Integer{Value: 9}, &object.Float{Value: 1.5}, &object.Integer{Value: 100}},
+			Sorted: "[1.5, 9, 10, 100]", Reverse: "[100, 10, 9, 1.5]"},
+		{Input: []object.Object{&object.String{Value: "b"}, &object.Boolean{Value: true}, &object.Integer{Value: 20}, &object.String{Value: "a"}, &object.Float{Value: 3.5}, &object.Null{}},
+			Sorted: "[3.5, 20, a, b, true, null]", Reverse: "[null, true, b, a, 20, 3.5]"},
+	}
+	for _, tst := range tests {
+		out = New().fnSort([]object.Object{&object.Array{Elements: tst.Input}})
+		if out.Inspect() != tst.Sorted {
+			t.Errorf("unexpected sort result, got %s expected %s", out.Inspect(), tst.Sorted)
+		}
+		out = New().fnReverse([]object.Object{&object.Array{Elements: tst.Input}})
+		if out.Inspect() != tst.Reverse {
+			t.Errorf("unexpected reverse result, got %s expected %s", out.Inspect(), tst.Reverse)
+		}
+	}
 }
 
 // Test sorting works in reverse
@@ -770,14 +1065,14 @@ func TestReverseSort(t *testing.T) {
 
 	// Calling the function with no-arguments should return null
 	var args []object.Object
-	out := fnReverse(args)
+	out := New().fnReverse(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
 
 	// Calling the an initial argument which isn't an array
 	args = append(args, &object.Integer{Value: 32})
-	out = fnReverse(args)
+	out = New().fnReverse(args)
 	if out.Type() != object.NULL {
 		t.Errorf("non-string argument returns a weird result")
 	}
@@ -787,7 +1082,7 @@ func TestReverseSort(t *testing.T) {
 	args = []object.Object{&object.Array{Elements: []object.Object{
 		&object.String{Value: "steve"}}},
 		&object.Integer{Value: 32}}
-	out = fnReverse(args)
+	out = New().fnReverse(args)
 	if out.Type() != object.NULL {
 		t.Errorf("non-string argument returns a weird result")
 	}
@@ -806,7 +1101,7 @@ func TestReverseSort(t *testing.T) {
 	//
 	// Expected result: "and", "Cake", "Apples"
 	//
-	out = fnReverse(in)
+	out = New().fnReverse(in)
 	first := out.(*object.Array).Elements[0]
 	if first.(*object.String).Value != "and" {
 		t.Errorf("post-sort the result was wrong")
@@ -822,7 +1117,7 @@ func TestReverseSort(t *testing.T) {
 	// Expected result: "Cake", "Apples", "and"
 	//
 	in = append(in, &object.Boolean{Value: true})
-	out = fnReverse(in)
+	out = New().fnReverse(in)
 	first = out.(*object.Array).Elements[0]
 	if first.(*object.String).Value != "Cake" {
 		t.Errorf("post-sort the result was wrong")
@@ -833,3 +1128,2196 @@ func TestReverseSort(t *testing.T) {
 	}
 
 }
+
+// Test flattening arrays
+func TestFlatten(t *testing.T) {
+
+	// Calling the function with no-arguments is an error
+	var args []object.Object
+	out := fnFlatten(args)
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+
+	// Calling with a non-array is an error
+	out = fnFlatten([]object.Object{&object.Integer{Value: 3}})
+	if out.Type() != object.ERROR || out.Inspect() != "flatten: argument must be an array, not INTEGER" {
+		t.Errorf("non-array argument returns a weird result")
+	}
+
+	// [1, [2, [3, "four"]], []]
+	input := &object.Array{Elements: []object.Object{
+		&object.Integer{Value: 1},
+		&object.Array{Elements: []object.Object{
+			&object.Integer{Value: 2},
+			&object.Array{Elements: []object.Object{
+				&object.Integer{Value: 3},
+				&object.String{Value: "four"},
+			}},
+		}},
+		&object.Array{},
+	}}
+
+	out = fnFlatten([]object.Object{input})
+	if out.Inspect() != "[1, 2, 3, four]" {
+		t.Errorf("flatten gave the wrong result: %s", out.Inspect())
+	}
+
+	// The input must not be modified
+	if len(input.Elements) != 3 {
+		t.Errorf("flatten modified the input")
+	}
+}
+
+// Test removing duplicates from arrays
+func TestUnique(t *testing.T) {
+
+	e := New()
+
+	// Calling the function with no-arguments is an error
+	var args []object.Object
+	out := e.fnUnique(args)
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+
+	// Calling with a non-array is an error
+	out = e.fnUnique([]object.Object{&object.String{Value: "steve"}})
+	if out.Type() != object.ERROR || out.Inspect() != "unique: argument must be an array, not STRING" {
+		t.Errorf("non-array argument returns a weird result")
+	}
+
+	input := &object.Array{Elements: []object.Object{
+		&object.String{Value: "b"},
+		&object.Integer{Value: 1},
+		&object.String{Value: "a"},
+		&object.Float{Value: 1.0},
+		&object.String{Value: "1"},
+		&object.String{Value: "b"},
+	}}
+
+	out = e.fnUnique([]object.Object{input})
+	if out.Inspect() != "[b, 1, a, 1]" {
+		t.Errorf("unique gave the wrong result: %s", out.Inspect())
+	}
+
+	// The first-seen element is retained
+	if out.(*object.Array).Elements[1].Type() != object.INTEGER {
+		t.Errorf("unique didn't preserve the first-seen element")
+	}
+	if out.(*object.Array).Elements[3].Type() != object.STRING {
+		t.Errorf("unique treated a string as a number")
+	}
+
+	// The input must not be modified
+	if len(input.Elements) != 6 {
+		t.Errorf("unique modified the input")
+	}
+}
+
+// Test our aggregate functions.
+func TestAggregates(t *testing.T) {
+
+	nums := &object.Array{Elements: []object.Object{
+		&object.Integer{Value: 3},
+		&object.String{Value: "4"},
+		&object.Integer{Value: 5},
+	}}
+	mixed := &object.Array{Elements: []object.Object{
+		&object.Integer{Value: 1},
+		&object.Float{Value: 2.5},
+		&object.String{Value: "steve"},
+	}}
+	empty := &object.Array{}
+
+	type TestCase struct {
+		Fn     func(args []object.Object) object.Object
+		Args   []object.Object
+		Type   object.Type
+		Result string
+	}
+
+	tests := []TestCase{
+		{Fn: fnSum, Args: []object.Object{nums}, Type: object.INTEGER, Result: "12"},
+		{Fn: fnSum, Args: []object.Object{empty}, Type: object.INTEGER, Result: "0"},
+		{Fn: fnSum, Args: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: math.MaxInt64}, &object.Integer{Value: 1}}}}, Type: object.ERROR},
+		{Fn: fnSum, Args: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: math.MinInt64}, &object.Integer{Value: -1}}}}, Type: object.ERROR},
+		{Fn: fnSum, Args: []object.Object{mixed}, Type: object.ERROR},
+		{Fn: fnSum, Args: []object.Object{mixed, &object.Boolean{Value: false}}, Type: object.FLOAT, Result: "3.5"},
+		{Fn: fnSum, Args: []object.Object{mixed, &object.Integer{Value: 3}}, Type: object.ERROR},
+		{Fn: fnSum, Args: []object.Object{&object.Integer{Value: 3}}, Type: object.ERROR},
+		{Fn: fnSum, Args: []object.Object{}, Type: object.ERROR},
+		{Fn: fnAvg, Args: []object.Object{nums}, Type: object.FLOAT, Result: "4"},
+		{Fn: fnAvg, Args: []object.Object{empty}, Type: object.ERROR},
+		{Fn: fnAvg, Args: []object.Object{mixed}, Type: object.ERROR},
+		{Fn: fnAvg, Args: []object.Object{mixed, &object.Boolean{Value: false}}, Type: object.FLOAT, Result: "1.75"},
+		{Fn: fnCount, Args: []object.Object{mixed}, Type: object.INTEGER, Result: "3"},
+		{Fn: fnCount, Args: []object.Object{empty}, Type: object.INTEGER, Result: "0"},
+		{Fn: fnCount, Args: []object.Object{&object.Array{Elements: []object.Object{&object.Boolean{Value: false}, &object.String{Value: ""}, &object.Integer{Value: 1}}}}, Type: object.INTEGER, Result: "1"},
+		{Fn: fnCount, Args: []object.Object{&object.String{Value: "steve"}}, Type: object.INTEGER, Result: "1"},
+		{Fn: fnCount, Args: []object.Object{&object.Null{}}, Type: object.INTEGER, Result: "0"},
+		{Fn: fnCount, Args: []object.Object{}, Type: object.ERROR},
+	}
+
+	for i, test := range tests {
+
+		out := test.Fn(test.Args)
+		if out.Type() != test.Type {
+			t.Errorf("test %d: expected %s, got %s", i, test.Type, out.Type())
+			continue
+		}
+		if test.Result != "" && out.Inspect() != test.Result {
+			t.Errorf("test %d: expected %s, got %s", i, test.Result, out.Inspect())
+		}
+	}
+}
+
+// Test generating ranges.
+func TestRange(t *testing.T) {
+
+	type TestCase struct {
+		Args   []int64
+		Result string
+	}
+
+	tests := []TestCase{
+		{Args: []int64{3}, Result: "[0, 1, 2]"},
+		{Args: []int64{0}, Result: "[]"},
+		{Args: []int64{-3}, Result: "[]"},
+		{Args: []int64{2, 5}, Result: "[2, 3, 4]"},
+		{Args: []int64{5, 2}, Result: "[]"},
+		{Args: []int64{0, 10, 3}, Result: "[0, 3, 6, 9]"},
+		{Args: []int64{5, 0, -2}, Result: "[5, 3, 1]"},
+		{Args: []int64{0, 5, -1}, Result: "[]"},
+		{Args: []int64{math.MaxInt64 - 2, math.MaxInt64}, Result: "[9223372036854775805, 9223372036854775806]"},
+		{Args: []int64{math.MaxInt64 - 5, math.MaxInt64, 4}, Result: "[9223372036854775802, 9223372036854775806]"},
+		{Args: []int64{math.MinInt64 + 2, math.MinInt64, -1}, Result: "[-9223372036854775806, -9223372036854775807]"},
+		{Args: []int64{math.MinInt64 + 5, math.MinInt64, -4}, Result: "[-9223372036854775803, -9223372036854775807]"},
+		{Args: []int64{math.MinInt64, math.MaxInt64, math.MaxInt64}, Result: "[-9223372036854775808, -1, 9223372036854775806]"},
+		{Args: []int64{math.MaxInt64, math.MinInt64, math.MinInt64}, Result: "[9223372036854775807, -1]"},
+	}
+
+	for _, test := range tests {
+
+		var args []object.Object
+		for _, a := range test.Args {
+			args = append(args, &object.Integer{Value: a})
+		}
+
+		out := fnRange(args)
+		if out.Inspect() != test.Result {
+			t.Errorf("range(%v) gave %s, expected %s", test.Args, out.Inspect(), test.Result)
+		}
+	}
+
+	// Error cases
+	errors := [][]object.Object{
+		{},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 2}, &object.Integer{Value: 3}, &object.Integer{Value: 4}},
+		{&object.String{Value: "steve"}},
+		{&object.Float{Value: 3.2}},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 2}, &object.Integer{Value: 0}},
+		{&object.Integer{Value: math.MinInt64}, &object.Integer{Value: math.MaxInt64}},
+		{&object.Integer{Value: 0}, &object.Integer{Value: maxRangeLength + 1}},
+	}
+
+	for _, args := range errors {
+		out := fnRange(args)
+		if out.Type() != object.ERROR {
+			t.Errorf("expected error for %v, got %s", args, out.Type())
+		}
+	}
+}
+
+// Test appending to arrays
+func TestAppend(t *testing.T) {
+
+	// No arguments, or a non-array, are errors.
+	if fnAppend([]object.Object{}).Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+	if fnAppend([]object.Object{&object.Integer{Value: 1}}).Type() != object.ERROR {
+		t.Errorf("non-array argument returns a weird result")
+	}
+	if fnPush([]object.Object{&object.Array{}}).Type() != object.ERROR {
+		t.Errorf("push with one argument returns a weird result")
+	}
+
+	input := &object.Array{Elements: []object.Object{&object.Integer{Value: 1}}}
+
+	out := fnPush([]object.Object{input, &object.String{Value: "two"}})
+	if out.Inspect() != "[1, two]" {
+		t.Errorf("push gave the wrong result: %s", out.Inspect())
+	}
+
+	out = fnAppend([]object.Object{input, &object.Integer{Value: 2}, &object.Integer{Value: 3}})
+	if out.Inspect() != "[1, 2, 3]" {
+		t.Errorf("append gave the wrong result: %s", out.Inspect())
+	}
+
+	out = fnAppend([]object.Object{input})
+	if out.Inspect() != "[1]" {
+		t.Errorf("append gave the wrong result: %s", out.Inspect())
+	}
+
+	// The input must not be modified
+	if input.Inspect() != "[1]" {
+		t.Errorf("the input array was modified: %s", input.Inspect())
+	}
+}
+
+// Test our set-operations
+func TestSetOperations(t *testing.T) {
+
+	e := New()
+
+	type TestCase struct {
+		Fn     func(args []object.Object) object.Object
+		Result string
+	}
+
+	a := &object.Array{Elements: []object.Object{
+		&object.Integer{Value: 1},
+		&object.Integer{Value: 2},
+		&object.Integer{Value: 2},
+		&object.String{Value: "three"},
+	}}
+	b := &object.Array{Elements: []object.Object{
+		&object.Float{Value: 2.0},
+		&object.String{Value: "three"},
+		&object.String{Value: "four"},
+	}}
+
+	tests := []TestCase{
+		{Fn: e.fnUnion, Result: "[1, 2, three, four]"},
+		{Fn: e.fnIntersection, Result: "[2, three]"},
+		{Fn: e.fnDifference, Result: "[1]"},
+	}
+
+	for _, test := range tests {
+
+		out := test.Fn([]object.Object{a, b})
+		if out.Inspect() != test.Result {
+			t.Errorf("set operation gave the wrong result: %s != %s", out.Inspect(), test.Result)
+		}
+
+		// Bogus arguments are errors
+		out = test.Fn([]object.Object{a})
+		if out.Type() != object.ERROR {
+			t.Errorf("wrong number of arguments didn't error")
+		}
+		out = test.Fn([]object.Object{a, &object.String{Value: "steve"}})
+		if out.Type() != object.ERROR {
+			t.Errorf("non-array argument didn't error")
+		}
+	}
+
+	// The inputs must not be modified
+	if len(a.Elements) != 4 || len(b.Elements) != 3 {
+		t.Errorf("set operations modified their input")
+	}
+}
+
+// Test our encoding & hashing functions
+func TestEncoding(t *testing.T) {
+
+	type TestCase struct {
+		Fn     func(args []object.Object) object.Object
+		Input  string
+		Result string
+	}
+
+	tests := []TestCase{
+		{Fn: fnBase64Encode, Input: "Steve", Result: "U3RldmU="},
+		{Fn: fnBase64Decode, Input: "U3RldmU=", Result: "Steve"},
+		{Fn: fnMD5, Input: "Steve", Result: "81b8a1b77068d06e1c8190825253066f"},
+		{Fn: fnSHA1, Input: "Steve", Result: "2121f63fa2843c8a5ce400bb6f83824f7491269d"},
+		{Fn: fnSHA256, Input: "", Result: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+
+	for _, test := range tests {
+
+		out := test.Fn([]object.Object{&object.String{Value: test.Input}})
+		if out.Inspect() != test.Result {
+			t.Errorf("unexpected result for '%s': %s != %s", test.Input, out.Inspect(), test.Result)
+		}
+
+		// No arguments
+		out = test.Fn([]object.Object{})
+		if out.Type() != object.ERROR {
+			t.Errorf("no arguments returns a weird result")
+		}
+	}
+
+	// Bogus base64 input is an error
+	for _, input := range []string{"!!!", "/w=="} {
+		out := fnBase64Decode([]object.Object{&object.String{Value: input}})
+		if out.Type() != object.ERROR {
+			t.Errorf("decoding '%s' didn't error", input)
+		}
+	}
+}
+
+// Test our IP-address functions
+func TestIP(t *testing.T) {
+
+	type TestCase struct {
+		IP     string
+		CIDR   string
+		Result bool
+	}
+
+	tests := []TestCase{
+		{IP: "10.1.2.3", CIDR: "10.0.0.0/8", Result: true},
+		{IP: "11.1.2.3", CIDR: "10.0.0.0/8", Result: false},
+		{IP: "192.168.1.1", CIDR: "192.168.1.0/24", Result: true},
+		{IP: "2001:db8::1", CIDR: "2001:db8::/32", Result: true},
+		{IP: "2001:db9::1", CIDR: "2001:db8::/32", Result: false},
+		{IP: "10.1.2.3", CIDR: "2001:db8::/32", Result: false},
+	}
+
+	for _, test := range tests {
+		out := fnInCIDR([]object.Object{&object.String{Value: test.IP}, &object.String{Value: test.CIDR}})
+		if out.Type() != object.BOOLEAN {
+			t.Fatalf("unexpected result type for %s in %s: %s", test.IP, test.CIDR, out.Type())
+		}
+		if out.(*object.Boolean).Value != test.Result {
+			t.Errorf("unexpected result for %s in %s", test.IP, test.CIDR)
+		}
+	}
+
+	// Errors
+	bogus := [][]object.Object{
+		{&object.String{Value: "10.1.2.3"}},
+		{&object.String{Value: "steve"}, &object.String{Value: "10.0.0.0/8"}},
+		{&object.String{Value: "10.1.2.3"}, &object.String{Value: "10.0.0.0"}},
+	}
+	for _, args := range bogus {
+		if fnInCIDR(args).Type() != object.ERROR {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+
+	// Versions
+	versions := map[string]string{
+		"127.0.0.1":   "4",
+		"::1":         "6",
+		"2001:db8::1": "6",
+	}
+	for ip, version := range versions {
+		out := fnIPVersion([]object.Object{&object.String{Value: ip}})
+		if out.Inspect() != version {
+			t.Errorf("wrong version for %s: %s", ip, out.Inspect())
+		}
+	}
+	if fnIPVersion([]object.Object{&object.String{Value: "bogus"}}).Type() != object.ERROR {
+		t.Errorf("expected an error for a bogus IP")
+	}
+	if fnIPVersion([]object.Object{}).Type() != object.ERROR {
+		t.Errorf("expected an error for no arguments")
+	}
+}
+
+// Test comparing semantic versions
+func TestSemverCompare(t *testing.T) {
+
+	type TestCase struct {
+		A      string
+		B      string
+		Result string
+	}
+
+	tests := []TestCase{
+		{A: "1.10.0", B: "1.9.0", Result: "1"},
+		{A: "1.9.0", B: "1.10.0", Result: "-1"},
+		{A: "1.2.3", B: "v1.2.3", Result: "0"},
+		{A: "1.2.3+build.4", B: "1.2.3", Result: "0"},
+		{A: "1.0.0-rc.1", B: "1.0.0", Result: "-1"},
+		{A: "1.0.0", B: "1.0.0-rc.1", Result: "1"},
+		{A: "1.0.0-alpha", B: "1.0.0-alpha.1", Result: "-1"},
+		{A: "1.0.0-alpha.1", B: "1.0.0-alpha.beta", Result: "-1"},
+		{A: "1.0.0-beta.2", B: "1.0.0-beta.11", Result: "-1"},
+		{A: "1.0.0-rc.1", B: "1.0.0-beta.11", Result: "1"},
+		{A: "2.0.0", B: "10.0.0", Result: "-1"},
+	}
+
+	for _, test := range tests {
+		out := fnSemverCompare([]object.Object{&object.String{Value: test.A}, &object.String{Value: test.B}})
+		if out.Inspect() != test.Result {
+			t.Errorf("unexpected result comparing %s with %s: %s", test.A, test.B, out.Inspect())
+		}
+	}
+
+	// Malformed versions are errors
+	for _, bogus := range []string{"1.2", "1.2.3.4", "a.b.c", "1.2.3-", "1.2.-3", "1.2.3-rc..1"} {
+		out := fnSemverCompare([]object.Object{&object.String{Value: bogus}, &object.String{Value: "1.0.0"}})
+		if out.Type() != object.ERROR {
+			t.Errorf("expected an error for version %s", bogus)
+		}
+	}
+
+	if fnSemverCompare([]object.Object{}).Type() != object.ERROR {
+		t.Errorf("expected an error with no arguments")
+	}
+}
+
+// Test JSONPath queries
+func TestJSONPath(t *testing.T) {
+
+	doc := &object.Hash{Pairs: map[string]object.Object{
+		"name": &object.String{Value: "order"},
+		"items": &object.Array{Elements: []object.Object{
+			&object.Hash{Pairs: map[string]object.Object{
+				"price": &object.Integer{Value: 3},
+				"sku":   &object.String{Value: "a"},
+			}},
+			&object.Hash{Pairs: map[string]object.Object{
+				"price": &object.Float{Value: 4.5},
+				"sku":   &object.String{Value: "b"},
+			}},
+		}},
+		"odd key": &object.Boolean{Value: true},
+	}}
+
+	type TestCase struct {
+		Path   string
+		Result string
+	}
+
+	tests := []TestCase{
+		{Path: "$.name", Result: "order"},
+		{Path: "name", Result: "order"},
+		{Path: "$.items[0].price", Result: "3"},
+		{Path: "$.items[-1].sku", Result: "b"},
+		{Path: "$['items'][1][\"price\"]", Result: "4.5"},
+		{Path: "$['odd key']", Result: "true"},
+		{Path: "$.items[*].sku", Result: "[a, b]"},
+		{Path: "$.items.*.price", Result: "[3, 4.5]"},
+		{Path: "$.items[*].missing", Result: "[]"},
+		{Path: "$.items[2].price", Result: "null"},
+		{Path: "$.missing.price", Result: "null"},
+		{Path: "$.name[0]", Result: "null"},
+		{Path: "$", Result: doc.Inspect()},
+	}
+
+	for _, test := range tests {
+
+		res := fnJSONPath([]object.Object{doc, &object.String{Value: test.Path}})
+
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for %s, got %s expected %s", test.Path, res.Inspect(), test.Result)
+		}
+	}
+
+	// Invalid paths are an error.
+	for _, path := range []string{"$.items[0", "$.items[x]", "$..items"} {
+		res := fnJSONPath([]object.Object{doc, &object.String{Value: path}})
+		if res.Type() != object.ERROR {
+			t.Errorf("expected an error for %s, got %s", path, res.Inspect())
+		}
+	}
+
+	// Calling the function with != 2 arguments is an error
+	var args []object.Object
+	out := fnJSONPath(args)
+	if out.Type() != object.ERROR {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+// Test clamping numbers
+func TestChunk(t *testing.T) {
+
+	ints := func(vals ...int64) *object.Array {
+		arr := &object.Array{}
+		for _, v := range vals {
+			arr.Elements = append(arr.Elements, &object.Integer{Value: v})
+		}
+		return arr
+	}
+
+	tests := []struct {
+		Array  *object.Array
+		Size   int64
+		Result string
+	}{
+		// exact multiples
+		{Array: ints(1, 2, 3, 4), Size: 2, Result: "[[1, 2], [3, 4]]"},
+		{Array: ints(1, 2, 3), Size: 1, Result: "[[1], [2], [3]]"},
+		{Array: ints(1, 2, 3), Size: 3, Result: "[[1, 2, 3]]"},
+
+		// a remainder
+		{Array: ints(1, 2, 3, 4, 5), Size: 2, Result: "[[1, 2], [3, 4], [5]]"},
+		{Array: ints(1, 2, 3, 4, 5), Size: 3, Result: "[[1, 2, 3], [4, 5]]"},
+		{Array: ints(1, 2), Size: 10, Result: "[[1, 2]]"},
+		{Array: ints(1, 2), Size: math.MaxInt64, Result: "[[1, 2]]"},
+
+		// nothing to split
+		{Array: ints(), Size: 2, Result: "[]"},
+	}
+
+	for _, tst := range tests {
+		out := fnChunk([]object.Object{tst.Array, &object.Integer{Value: tst.Size}})
+		if out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result chunking %s by %d: %s", tst.Array.Inspect(), tst.Size, out.Inspect())
+		}
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{ints(1)},
+		{ints(1), &object.Integer{Value: 0}},
+		{ints(1), &object.Integer{Value: -1}},
+		{ints(1), &object.Float{Value: 2.5}},
+		{ints(1), &object.String{Value: "2"}},
+		{&object.String{Value: "steve"}, &object.Integer{Value: 2}},
+	}
+	for _, args := range errors {
+		out := fnChunk(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+	}
+}
+
+func TestClamp(t *testing.T) {
+
+	type TestCase struct {
+		Args   []object.Object
+		Result string
+		Type   object.Type
+	}
+
+	tests := []TestCase{
+		{Args: []object.Object{&object.Integer{Value: 5}, &object.Integer{Value: 0}, &object.Integer{Value: 10}}, Result: "5", Type: object.INTEGER},
+		{Args: []object.Object{&object.Integer{Value: -5}, &object.Integer{Value: 0}, &object.Integer{Value: 10}}, Result: "0", Type: object.INTEGER},
+		{Args: []object.Object{&object.Integer{Value: 15}, &object.Integer{Value: 0}, &object.Integer{Value: 10}}, Result: "10", Type: object.INTEGER},
+		{Args: []object.Object{&object.Integer{Value: 15}, &object.Float{Value: 0}, &object.Float{Value: 10}}, Result: "10", Type: object.INTEGER},
+		{Args: []object.Object{&object.Integer{Value: 15}, &object.Float{Value: 0}, &object.Float{Value: 9.5}}, Result: "9.5", Type: object.FLOAT},
+		{Args: []object.Object{&object.Float{Value: 0.5}, &object.Integer{Value: 1}, &object.Integer{Value: 2}}, Result: "1", Type: object.FLOAT},
+		{Args: []object.Object{&object.Float{Value: 1.5}, &object.Integer{Value: 1}, &object.Integer{Value: 2}}, Result: "1.5", Type: object.FLOAT},
+		{Args: []object.Object{&object.String{Value: "7"}, &object.String{Value: "1"}, &object.Integer{Value: 3}}, Result: "3", Type: object.INTEGER},
+		{Args: []object.Object{&object.Integer{Value: 2}, &object.Integer{Value: 2}, &object.Integer{Value: 2}}, Result: "2", Type: object.INTEGER},
+	}
+
+	for _, test := range tests {
+
+		res := fnClamp(test.Args)
+
+		if res.Type() != test.Type || res.Inspect() != test.Result {
+			t.Errorf("Invalid result for clamp(%v), got %s %s", test.Args, res.Type(), res.Inspect())
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 2}},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 10}, &object.Integer{Value: 0}},
+		{&object.String{Value: "steve"}, &object.Integer{Value: 0}, &object.Integer{Value: 10}},
+		{&object.Integer{Value: 1}, &object.Boolean{Value: true}, &object.Integer{Value: 10}},
+	}
+	for _, args := range errors {
+		res := fnClamp(args)
+		if res.Type() != object.ERROR {
+			t.Errorf("expected error for clamp(%v), got %s", args, res.Inspect())
+		}
+	}
+}
+
+// Test lenient numeric conversion
+func TestNum(t *testing.T) {
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+		Type   object.Type
+	}{
+		{Args: []object.Object{&object.Integer{Value: 3}, &object.Integer{Value: 0}}, Result: "3", Type: object.INTEGER},
+		{Args: []object.Object{&object.Float{Value: 3.5}, &object.Integer{Value: 0}}, Result: "3.5", Type: object.FLOAT},
+		{Args: []object.Object{&object.String{Value: " 42 "}, &object.Integer{Value: 0}}, Result: "42", Type: object.INTEGER},
+		{Args: []object.Object{&object.String{Value: "4.25"}, &object.Integer{Value: 0}}, Result: "4.25", Type: object.FLOAT},
+		{Args: []object.Object{&object.String{Value: "free"}, &object.Integer{Value: 0}}, Result: "0", Type: object.INTEGER},
+		{Args: []object.Object{&object.String{Value: ""}, &object.Float{Value: -1.5}}, Result: "-1.5", Type: object.FLOAT},
+		{Args: []object.Object{&object.Null{}, &object.Integer{Value: 7}}, Result: "7", Type: object.INTEGER},
+		{Args: []object.Object{&object.Boolean{Value: true}, &object.Integer{Value: 7}}, Result: "7", Type: object.INTEGER},
+		{Args: []object.Object{&object.Array{}, &object.Integer{Value: 7}}, Result: "7", Type: object.INTEGER},
+	}
+
+	for _, test := range tests {
+
+		res := fnNum(test.Args)
+		if res.Type() != test.Type || res.Inspect() != test.Result {
+			t.Errorf("Invalid result for num(%v), got %s %s", test.Args, res.Type(), res.Inspect())
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.Integer{Value: 1}},
+		{&object.Integer{Value: 1}, &object.Null{}},
+		{&object.Integer{Value: 1}, &object.String{Value: "0"}},
+	}
+	for _, args := range errors {
+		res := fnNum(args)
+		if res.Type() != object.ERROR {
+			t.Errorf("expected error for num(%v), got %s", args, res.Inspect())
+		}
+	}
+}
+
+// Test normalizing values to arrays
+func TestToArray(t *testing.T) {
+
+	tests := []struct {
+		Arg    object.Object
+		Result string
+	}{
+		{Arg: &object.String{Value: "admin"}, Result: "[admin]"},
+		{Arg: &object.String{Value: ""}, Result: "[]"},
+		{Arg: &object.Integer{Value: 3}, Result: "[3]"},
+		{Arg: &object.Boolean{Value: false}, Result: "[false]"},
+		{Arg: &object.Null{}, Result: "[]"},
+		{Arg: &object.Array{Elements: []object.Object{}}, Result: "[]"},
+		{Arg: &object.Array{Elements: []object.Object{&object.String{Value: "a"}, &object.Integer{Value: 1}}}, Result: "[a, 1]"},
+		{Arg: &object.Hash{Pairs: map[string]object.Object{"a": &object.Integer{Value: 1}}}, Result: "[{a: 1}]"},
+	}
+
+	for _, test := range tests {
+
+		res := fnToArray([]object.Object{test.Arg})
+		if res.Type() != object.ARRAY {
+			t.Errorf("expected an array for toArray(%s), got %s", test.Arg.Inspect(), res.Type())
+		}
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for toArray(%s), got %s", test.Arg.Inspect(), res.Inspect())
+		}
+	}
+
+	// The array with one element isn't the same as an empty string.
+	if len(fnToArray([]object.Object{&object.String{Value: ""}}).(*object.Array).Elements) != 1 {
+		t.Errorf("expected a single empty string")
+	}
+
+	res := fnToArray([]object.Object{})
+	if res.Type() != object.ERROR {
+		t.Errorf("expected an error with no arguments, got %s", res.Inspect())
+	}
+}
+
+// Test assertions
+func TestAssert(t *testing.T) {
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{&object.Boolean{Value: true}}, Result: "true"},
+		{Args: []object.Object{&object.Integer{Value: 3}, &object.String{Value: "ok"}}, Result: "true"},
+		{Args: []object.Object{&object.Boolean{Value: false}}, Result: "assertion failed"},
+		{Args: []object.Object{&object.Null{}, &object.String{Value: "no name"}}, Result: "assertion failed: no name"},
+		{Args: []object.Object{}, Result: "assert: wrong number of arguments"},
+	}
+
+	for _, test := range tests {
+
+		res := fnAssert(test.Args)
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for assert(%v), got %s", test.Args, res.Inspect())
+		}
+	}
+}
+
+// Test approximate equality
+func TestApproxEqual(t *testing.T) {
+
+	type TestCase struct {
+		Args   []object.Object
+		Result string
+	}
+
+	tests := []TestCase{
+		{Args: []object.Object{&object.Float{Value: 0.30000000000000004}, &object.Float{Value: 0.3}, &object.Integer{Value: 0}}, Result: "false"},
+		{Args: []object.Object{&object.Float{Value: 0.30000000000000004}, &object.Float{Value: 0.3}, &object.Float{Value: 1e-9}}, Result: "true"},
+		{Args: []object.Object{&object.Integer{Value: 10}, &object.Float{Value: 10.4}, &object.Float{Value: 0.5}}, Result: "true"},
+		{Args: []object.Object{&object.Integer{Value: 10}, &object.Integer{Value: 12}, &object.Integer{Value: 1}}, Result: "false"},
+		{Args: []object.Object{&object.String{Value: "4.5"}, &object.Float{Value: 4.5}, &object.Integer{Value: 0}}, Result: "true"},
+		{Args: []object.Object{&object.Float{Value: math.Inf(1)}, &object.Float{Value: math.Inf(1)}, &object.Integer{Value: 0}}, Result: "true"},
+		{Args: []object.Object{&object.Float{Value: math.NaN()}, &object.Float{Value: math.NaN()}, &object.Integer{Value: 1}}, Result: "false"},
+	}
+
+	for _, test := range tests {
+
+		res := fnApproxEqual(test.Args)
+
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for approxEqual(%v), got %s", test.Args, res.Inspect())
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 2}},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 1}, &object.Integer{Value: -1}},
+		{&object.String{Value: "steve"}, &object.Integer{Value: 0}, &object.Integer{Value: 1}},
+		{&object.Integer{Value: 1}, &object.Boolean{Value: true}, &object.Integer{Value: 1}},
+	}
+	for _, args := range errors {
+		res := fnApproxEqual(args)
+		if res.Type() != object.ERROR {
+			t.Errorf("expected error for approxEqual(%v), got %s", args, res.Inspect())
+		}
+	}
+}
+
+// Test ceil, floor, and round
+func TestRounding(t *testing.T) {
+
+	type TestCase struct {
+		Func   func([]object.Object) object.Object
+		Args   []object.Object
+		Result string
+		Type   object.Type
+	}
+
+	tests := []TestCase{
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: 3.14159}, &object.Integer{Value: 2}}, Result: "3.14", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: 3.14159}, &object.Integer{Value: 3}}, Result: "3.142", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: 1.005}, &object.Integer{Value: 2}}, Result: "1.01", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: 2.5}}, Result: "3", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: -2.5}}, Result: "-3", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: -0.4}}, Result: "0", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Float{Value: 1234.5}, &object.Integer{Value: -2}}, Result: "1200", Type: object.FLOAT},
+		{Func: fnRound, Args: []object.Object{&object.Integer{Value: 1250}, &object.Integer{Value: -2}}, Result: "1300", Type: object.INTEGER},
+		{Func: fnRound, Args: []object.Object{&object.Integer{Value: 17}, &object.Integer{Value: 2}}, Result: "17", Type: object.INTEGER},
+		{Func: fnRound, Args: []object.Object{&object.String{Value: "2.675"}, &object.Integer{Value: 2}}, Result: "2.68", Type: object.FLOAT},
+		{Func: fnCeil, Args: []object.Object{&object.Float{Value: 3.14159}, &object.Integer{Value: 2}}, Result: "3.15", Type: object.FLOAT},
+		{Func: fnCeil, Args: []object.Object{&object.Float{Value: 1.1}}, Result: "2", Type: object.FLOAT},
+		{Func: fnCeil, Args: []object.Object{&object.Float{Value: -1.1}}, Result: "-1", Type: object.FLOAT},
+		{Func: fnCeil, Args: []object.Object{&object.Float{Value: 0.29}, &object.Integer{Value: 2}}, Result: "0.29", Type: object.FLOAT},
+		{Func: fnFloor, Args: []object.Object{&object.Float{Value: 3.14159}, &object.Integer{Value: 3}}, Result: "3.141", Type: object.FLOAT},
+		{Func: fnFloor, Args: []object.Object{&object.Float{Value: -1.1}}, Result: "-2", Type: object.FLOAT},
+		{Func: fnFloor, Args: []object.Object{&object.Float{Value: 0.57}, &object.Integer{Value: 2}}, Result: "0.57", Type: object.FLOAT},
+		{Func: fnFloor, Args: []object.Object{&object.Integer{Value: -15}, &object.Integer{Value: -1}}, Result: "-20", Type: object.INTEGER},
+	}
+
+	for _, test := range tests {
+
+		res := test.Func(test.Args)
+
+		if res.Type() != test.Type || res.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v, got %s %s", test.Args, res.Type(), res.Inspect())
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.Float{Value: 1.5}, &object.Integer{Value: 1}, &object.Integer{Value: 2}},
+		{&object.String{Value: "steve"}},
+		{&object.Float{Value: 1.5}, &object.Float{Value: 1}},
+		{&object.Float{Value: 1.5}, &object.Integer{Value: 100}},
+	}
+	for _, args := range errors {
+		for _, fn := range []func([]object.Object) object.Object{fnCeil, fnFloor, fnRound} {
+			res := fn(args)
+			if res.Type() != object.ERROR {
+				t.Errorf("expected error for %v, got %s", args, res.Inspect())
+			}
+		}
+	}
+}
+
+// Test formatting numbers
+func TestFormatNumber(t *testing.T) {
+
+	e := New()
+
+	type TestCase struct {
+		Args   []object.Object
+		Result string
+	}
+
+	tests := []TestCase{
+		{Args: []object.Object{&object.Integer{Value: 0}}, Result: "0"},
+		{Args: []object.Object{&object.Integer{Value: 999}}, Result: "999"},
+		{Args: []object.Object{&object.Integer{Value: 1000}}, Result: "1,000"},
+		{Args: []object.Object{&object.Integer{Value: -1234567}}, Result: "-1,234,567"},
+		{Args: []object.Object{&object.Integer{Value: 1234567}, &object.Integer{Value: 2}}, Result: "1,234,567.00"},
+		{Args: []object.Object{&object.Float{Value: 1234567.891}, &object.Integer{Value: 2}}, Result: "1,234,567.89"},
+		{Args: []object.Object{&object.Float{Value: -999.999}, &object.Integer{Value: 2}}, Result: "-1,000.00"},
+		{Args: []object.Object{&object.Float{Value: 123456.5}}, Result: "123,456"},
+		{Args: []object.Object{&object.String{Value: "12345.678"}, &object.Integer{Value: 1}}, Result: "12,345.7"},
+	}
+
+	for _, test := range tests {
+
+		res := e.fnFormatNumber(test.Args)
+
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for formatNumber(%v), got %s expected %s", test.Args, res.Inspect(), test.Result)
+		}
+	}
+
+	// Errors
+	errors := [][]object.Object{
+		{},
+		{&object.String{Value: "steve"}},
+		{&object.Integer{Value: 1}, &object.Integer{Value: -1}},
+		{&object.Integer{Value: 1}, &object.Float{Value: 1.5}},
+		{&object.Integer{Value: 1}, &object.Integer{Value: 1 << 40}},
+	}
+	for _, args := range errors {
+		res := e.fnFormatNumber(args)
+		if res.Type() != object.ERROR {
+			t.Errorf("expected error for formatNumber(%v), got %s", args, res.Inspect())
+		}
+	}
+}
+
+// Test random values
+func TestRandom(t *testing.T) {
+
+	e := New()
+	e.SetRandSeed(42)
+
+	// random() returns a float in [0,1)
+	for i := 0; i < 100; i++ {
+		out := e.fnRandom(nil)
+		f, ok := out.(*object.Float)
+		if !ok || f.Value < 0 || f.Value >= 1 {
+			t.Fatalf("unexpected result from random: %s", out.Inspect())
+		}
+	}
+
+	// randomInt(n) returns an int in [0,n)
+	for i := 0; i < 100; i++ {
+		out := e.fnRandomInt([]object.Object{&object.Integer{Value: 3}})
+		n, ok := out.(*object.Integer)
+		if !ok || n.Value < 0 || n.Value >= 3 {
+			t.Fatalf("unexpected result from randomInt: %s", out.Inspect())
+		}
+	}
+
+	// uuid() returns a v4 UUID
+	uuid := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	for i := 0; i < 100; i++ {
+		out := e.fnUUID(nil)
+		if !uuid.MatchString(out.Inspect()) {
+			t.Fatalf("unexpected result from uuid: %s", out.Inspect())
+		}
+	}
+
+	// The same seed gives the same results
+	a := New()
+	a.SetRandSeed(1)
+	b := New()
+	b.SetRandSeed(1)
+	if a.fnUUID(nil).Inspect() != b.fnUUID(nil).Inspect() {
+		t.Fatalf("seeded uuids differ")
+	}
+	if a.fnRandom(nil).Inspect() != b.fnRandom(nil).Inspect() {
+		t.Fatalf("seeded random values differ")
+	}
+
+	// Without a seed uuids don't come from the generator, so can't be
+	// predicted from it.
+	a = New()
+	a.rand = rand.New(rand.NewSource(1))
+	b = New()
+	b.rand = rand.New(rand.NewSource(1))
+	if a.fnUUID(nil).Inspect() == b.fnUUID(nil).Inspect() {
+		t.Fatalf("unseeded uuids came from the generator")
+	}
+
+	// Errors
+	if e.fnRandom([]object.Object{&object.Integer{Value: 3}}).Type() != object.ERROR {
+		t.Fatalf("expected error with arguments to random")
+	}
+	if e.fnUUID([]object.Object{&object.Integer{Value: 3}}).Type() != object.ERROR {
+		t.Fatalf("expected error with arguments to uuid")
+	}
+	for _, arg := range []object.Object{&object.Integer{Value: 0}, &object.Float{Value: 3}, &object.String{Value: "3"}} {
+		if e.fnRandomInt([]object.Object{arg}).Type() != object.ERROR {
+			t.Fatalf("expected error with randomInt(%s)", arg.Inspect())
+		}
+	}
+}
+
+// Test URL parsing
+func TestURL(t *testing.T) {
+
+	type TestCase struct {
+		Fn     func([]object.Object) object.Object
+		Args   []string
+		Result string
+	}
+
+	u := "https://user@example.com:8080/path/to/page?q=search&id=3&empty=#frag"
+
+	tests := []TestCase{
+		{Fn: fnURLHost, Args: []string{u}, Result: "example.com"},
+		{Fn: fnURLPath, Args: []string{u}, Result: "/path/to/page"},
+		{Fn: fnURLScheme, Args: []string{u}, Result: "https"},
+		{Fn: fnURLQuery, Args: []string{u, "q"}, Result: "search"},
+		{Fn: fnURLQuery, Args: []string{u, "id"}, Result: "3"},
+		{Fn: fnURLQuery, Args: []string{u, "empty"}, Result: ""},
+		{Fn: fnURLQuery, Args: []string{u, "missing"}, Result: "null"},
+		{Fn: fnURLHost, Args: []string{"/relative/path"}, Result: ""},
+		{Fn: fnURLPath, Args: []string{"/relative/path"}, Result: "/relative/path"},
+
+		// malformed
+		{Fn: fnURLHost, Args: []string{"http://[::1"}, Result: `urlHost: parse "http://[::1": missing ']' in host`},
+		{Fn: fnURLPath, Args: []string{"%zz"}, Result: `urlPath: parse "%zz": invalid URL escape "%zz"`},
+		{Fn: fnURLScheme, Args: []string{":nope"}, Result: `urlScheme: parse ":nope": missing protocol scheme`},
+		{Fn: fnURLQuery, Args: []string{":nope", "q"}, Result: `urlQuery: parse ":nope": missing protocol scheme`},
+
+		// wrong number of arguments
+		{Fn: fnURLHost, Args: []string{}, Result: "urlHost: wrong number of arguments"},
+		{Fn: fnURLQuery, Args: []string{u}, Result: "urlQuery: wrong number of arguments"},
+	}
+
+	for _, test := range tests {
+
+		var args []object.Object
+		for _, a := range test.Args {
+			args = append(args, &object.String{Value: a})
+		}
+
+		res := test.Fn(args)
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for %v, got %s expected %s", test.Args, res.Inspect(), test.Result)
+		}
+	}
+}
+
+// Test map and filter
+func TestMapFilter(t *testing.T) {
+
+	e := New()
+	e.SetFunction("isPositive", func(args []object.Object) object.Object {
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return &object.Error{Message: "not an integer"}
+		}
+		return &object.Boolean{Value: n.Value > 0}
+	})
+
+	arr := &object.Array{Elements: []object.Object{
+		&object.Integer{Value: 3},
+		&object.Integer{Value: -1},
+		&object.Integer{Value: 0},
+		&object.Integer{Value: 7},
+	}}
+
+	out := e.fnFilter([]object.Object{arr, &object.String{Value: "isPositive"}})
+	if out.Inspect() != "[3, 7]" {
+		t.Fatalf("unexpected result from filter: %s", out.Inspect())
+	}
+
+	out = e.fnMap([]object.Object{arr, &object.String{Value: "isPositive"}})
+	if out.Inspect() != "[true, false, false, true]" {
+		t.Fatalf("unexpected result from map: %s", out.Inspect())
+	}
+
+	// builtins may be used too
+	words := &object.Array{Elements: []object.Object{&object.String{Value: "Steve"}, &object.String{Value: "Kemp"}}}
+	out = e.fnMap([]object.Object{words, &object.String{Value: "upper"}})
+	if out.Inspect() != "[STEVE, KEMP]" {
+		t.Fatalf("unexpected result from map: %s", out.Inspect())
+	}
+
+	// empty arrays give empty arrays
+	empty := &object.Array{}
+	for _, fn := range []func([]object.Object) object.Object{e.fnFilter, e.fnMap} {
+		out = fn([]object.Object{empty, &object.String{Value: "isPositive"}})
+		if out.Type() != object.ARRAY || out.Inspect() != "[]" {
+			t.Fatalf("unexpected result with an empty array: %s", out.Inspect())
+		}
+	}
+
+	// errors from the function report the element
+	mixed := &object.Array{Elements: []object.Object{&object.Integer{Value: 3}, &object.String{Value: "x"}}}
+	out = e.fnMap([]object.Object{mixed, &object.String{Value: "isPositive"}})
+	if out.Type() != object.ERROR || out.Inspect() != "map: element 1: not an integer" {
+		t.Fatalf("unexpected error from map: %s", out.Inspect())
+	}
+	out = e.fnFilter([]object.Object{mixed, &object.String{Value: "isPositive"}})
+	if out.Type() != object.ERROR || out.Inspect() != "filter: element 1: not an integer" {
+		t.Fatalf("unexpected error from filter: %s", out.Inspect())
+	}
+	out = e.fnMapIndexed([]object.Object{mixed, &object.String{Value: "isPositive"}})
+	if out.Type() != object.ERROR || out.Inspect() != "mapIndexed: element 1: not an integer" {
+		t.Fatalf("unexpected error from mapIndexed: %s", out.Inspect())
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{arr},
+		{&object.String{Value: "steve"}, &object.String{Value: "upper"}},
+		{arr, &object.Integer{Value: 3}},
+		{arr, &object.String{Value: "missing"}},
+	}
+	for _, args := range errors {
+		for _, fn := range []func([]object.Object) object.Object{e.fnFilter, e.fnMap, e.fnMapIndexed} {
+			out = fn(args)
+			if out.Type() != object.ERROR {
+				t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+			}
+		}
+	}
+}
+
+// Test all and any
+func TestAllAny(t *testing.T) {
+
+	e := New()
+
+	// Record the elements tested, to confirm we short-circuit.
+	var seen []string
+	e.SetFunction("isPositive", func(args []object.Object) object.Object {
+		seen = append(seen, args[0].Inspect())
+		n, ok := args[0].(*object.Integer)
+		if !ok {
+			return &object.Error{Message: "not an integer"}
+		}
+		return &object.Boolean{Value: n.Value > 0}
+	})
+
+	array := func(vals ...int64) *object.Array {
+		arr := &object.Array{Elements: []object.Object{}}
+		for _, v := range vals {
+			arr.Elements = append(arr.Elements, &object.Integer{Value: v})
+		}
+		return arr
+	}
+
+	tests := []struct {
+		Fn     func([]object.Object) object.Object
+		Input  *object.Array
+		Result bool
+		Seen   string
+	}{
+		{Fn: e.fnAll, Input: array(1, 2, 3), Result: true, Seen: "1,2,3"},
+		{Fn: e.fnAll, Input: array(1, -2, 3), Result: false, Seen: "1,-2"},
+		{Fn: e.fnAll, Input: array(), Result: true, Seen: ""},
+		{Fn: e.fnAny, Input: array(-1, 2, 3), Result: true, Seen: "-1,2"},
+		{Fn: e.fnAny, Input: array(-1, -2), Result: false, Seen: "-1,-2"},
+		{Fn: e.fnAny, Input: array(), Result: false, Seen: ""},
+	}
+
+	for _, tst := range tests {
+		seen = nil
+		out := tst.Fn([]object.Object{tst.Input, &object.String{Value: "isPositive"}})
+		if out.Type() != object.BOOLEAN || out.(*object.Boolean).Value != tst.Result {
+			t.Fatalf("unexpected result for %s: %s", tst.Input.Inspect(), out.Inspect())
+		}
+		if strings.Join(seen, ",") != tst.Seen {
+			t.Fatalf("unexpected elements tested for %s: %v", tst.Input.Inspect(), seen)
+		}
+	}
+
+	// errors from the function report the element
+	mixed := &object.Array{Elements: []object.Object{&object.Integer{Value: -3}, &object.String{Value: "x"}}}
+	out := e.fnAny([]object.Object{mixed, &object.String{Value: "isPositive"}})
+	if out.Type() != object.ERROR || out.Inspect() != "any: element 1: not an integer" {
+		t.Fatalf("unexpected error from any: %s", out.Inspect())
+	}
+	mixed = &object.Array{Elements: []object.Object{&object.Integer{Value: 3}, &object.String{Value: "x"}}}
+	out = e.fnAll([]object.Object{mixed, &object.String{Value: "isPositive"}})
+	if out.Type() != object.ERROR || out.Inspect() != "all: element 1: not an integer" {
+		t.Fatalf("unexpected error from all: %s", out.Inspect())
+	}
+
+	// bad arguments are errors
+	for _, args := range [][]object.Object{{}, {array(1)}, {array(1), &object.String{Value: "missing"}}} {
+		for _, fn := range []func([]object.Object) object.Object{e.fnAll, e.fnAny} {
+			out = fn(args)
+			if out.Type() != object.ERROR {
+				t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+			}
+		}
+	}
+}
+
+func TestAnyMatch(t *testing.T) {
+
+	e := New()
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	hash := func(pairs ...interface{}) *object.Hash {
+		h := &object.Hash{Pairs: make(map[string]object.Object)}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Pairs[pairs[i].(string)] = pairs[i+1].(object.Object)
+		}
+		return h
+	}
+
+	order := hash(
+		"items", &object.Array{Elements: []object.Object{
+			hash("status", str("closed"), "qty", &object.Integer{Value: 2}),
+			hash("status", str("open"), "qty", &object.Float{Value: 3}),
+			str("not a hash"),
+		}},
+		"tags", hash("a", str("urgent"), "b", str("new")),
+	)
+
+	tests := []struct {
+		Path   string
+		Value  object.Object
+		Result bool
+	}{
+		{Path: "items.*.status", Value: str("open"), Result: true},
+		{Path: "items.*.status", Value: str("pending"), Result: false},
+		{Path: "items.1.status", Value: str("open"), Result: true},
+		{Path: "items.0.status", Value: str("open"), Result: false},
+		{Path: "tags.*", Value: str("urgent"), Result: true},
+		{Path: "tags.a", Value: str("new"), Result: false},
+
+		// numbers are compared by value
+		{Path: "items.*.qty", Value: &object.Integer{Value: 3}, Result: true},
+		{Path: "items.*.qty", Value: &object.Float{Value: 2.0}, Result: true},
+		{Path: "items.*.qty", Value: str("3"), Result: false},
+
+		// paths which don't resolve are false
+		{Path: "missing.*.status", Value: str("open"), Result: false},
+		{Path: "items.*.missing", Value: &object.Null{}, Result: false},
+		{Path: "items.9.status", Value: str("open"), Result: false},
+		{Path: "tags.a.b", Value: str("urgent"), Result: false},
+		{Path: "items.*.status.*", Value: str("open"), Result: false},
+	}
+
+	for _, tst := range tests {
+		out := e.fnAnyMatch([]object.Object{order, str(tst.Path), tst.Value})
+		if out.Type() != object.BOOLEAN || out.True() != tst.Result {
+			t.Fatalf("unexpected result from anyMatch(%q, %s): %s", tst.Path, tst.Value.Inspect(), out.Inspect())
+		}
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{order, str("items")},
+		{order, &object.Integer{Value: 1}, str("open")},
+	}
+	for _, args := range errors {
+		out := e.fnAnyMatch(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+	}
+}
+
+// Test csvField and csvFields
+func TestCSV(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `a,b,c`, Result: "[a, b, c]"},
+		{Input: `"Kemp, Steve",42,"say ""hi"""`, Result: `[Kemp, Steve, 42, say "hi"]`},
+		{Input: `a,,c`, Result: "[a, , c]"},
+		{Input: "a,b\n", Result: "[a, b]"},
+		{Input: ``, Result: "[]"},
+	}
+
+	for _, tst := range tests {
+		out := fnCSVFields([]object.Object{&object.String{Value: tst.Input}})
+		if out.Type() != object.ARRAY || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result from csvFields(%q): %s", tst.Input, out.Inspect())
+		}
+	}
+
+	line := &object.String{Value: `"Kemp, Steve",42`}
+	out := fnCSVField([]object.Object{line, &object.Integer{Value: 0}})
+	if out.Inspect() != "Kemp, Steve" {
+		t.Fatalf("unexpected result from csvField: %s", out.Inspect())
+	}
+	out = fnCSVField([]object.Object{line, &object.Integer{Value: 1}})
+	if out.Inspect() != "42" {
+		t.Fatalf("unexpected result from csvField: %s", out.Inspect())
+	}
+	out = fnCSVField([]object.Object{line, &object.Integer{Value: 2}})
+	if out.Type() != object.NULL {
+		t.Fatalf("expected null for a missing field, got %s", out.Inspect())
+	}
+
+	// errors
+	bad := [][]object.Object{
+		{&object.String{Value: `a,"b`}},
+		{&object.String{Value: `a,b"c"`}},
+		{&object.String{Value: "a,b\nc,d"}},
+		{&object.Integer{Value: 3}},
+		{},
+	}
+	for _, args := range bad {
+		out = fnCSVFields(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error from csvFields, got %s", out.Inspect())
+		}
+	}
+	for _, idx := range []object.Object{&object.Integer{Value: -1}, &object.String{Value: "1"}} {
+		out = fnCSVField([]object.Object{line, idx})
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error from csvField, got %s", out.Inspect())
+		}
+	}
+}
+
+// Test the duration function
+func TestDuration(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+		Type   object.Type
+	}{
+		{Input: "24h", Result: "86400", Type: object.INTEGER},
+		{Input: "1h30m", Result: "5400", Type: object.INTEGER},
+		{Input: "-5m", Result: "-300", Type: object.INTEGER},
+		{Input: "0s", Result: "0", Type: object.INTEGER},
+		{Input: "1.5s", Result: "1.5", Type: object.FLOAT},
+		{Input: "250ms", Result: "0.25", Type: object.FLOAT},
+
+		// days
+		{Input: "1d", Result: "86400", Type: object.INTEGER},
+		{Input: "7d", Result: "604800", Type: object.INTEGER},
+		{Input: "1d12h", Result: "129600", Type: object.INTEGER},
+		{Input: "0.5d", Result: "43200", Type: object.INTEGER},
+		{Input: "-1d1h", Result: "-90000", Type: object.INTEGER},
+	}
+
+	for _, tst := range tests {
+		out := fnDuration([]object.Object{&object.String{Value: tst.Input}})
+		if out.Type() != tst.Type || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result from duration(%q): %s %s", tst.Input, out.Type(), out.Inspect())
+		}
+	}
+
+	bad := [][]object.Object{
+		{&object.String{Value: "24"}},
+		{&object.String{Value: "1w"}},
+		{&object.String{Value: "d"}},
+		{&object.String{Value: "1dd"}},
+		{&object.String{Value: "1d-1h"}},
+		{&object.String{Value: "1h1d"}},
+		{&object.String{Value: "1e2d"}},
+		{&object.String{Value: "Infd"}},
+		{&object.String{Value: ""}},
+		{&object.Integer{Value: 3}},
+		{},
+	}
+	for _, args := range bad {
+		out := fnDuration(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error from duration, got %s", out.Inspect())
+		}
+	}
+}
+
+// Test repeat, padLeft, and padRight
+func TestRepeatPad(t *testing.T) {
+
+	e := New()
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	tests := []struct {
+		Fn     func([]object.Object) object.Object
+		Args   []object.Object
+		Result string
+	}{
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab"), num(3)}, Result: "ababab"},
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab"), num(0)}, Result: ""},
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab"), num(-2)}, Result: ""},
+		{Fn: e.fnRepeat, Args: []object.Object{num(7), num(2)}, Result: "77"},
+		{Fn: e.fnRepeat, Args: []object.Object{str(""), num(1 << 40)}, Result: ""},
+		{Fn: e.fnPadLeft, Args: []object.Object{num(42), num(5), str("0")}, Result: "00042"},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("abc"), num(5)}, Result: "  abc"},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("abc"), num(2)}, Result: "abc"},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("abc"), num(-2)}, Result: "abc"},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("狐犬"), num(4), str("*")}, Result: "**狐犬"},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("x"), num(6), str("ab")}, Result: "ababax"},
+		{Fn: e.fnPadRight, Args: []object.Object{str("abc"), num(5)}, Result: "abc  "},
+		{Fn: e.fnPadRight, Args: []object.Object{str("狐"), num(3), str("犬")}, Result: "狐犬犬"},
+		{Fn: e.fnPadRight, Args: []object.Object{str("x"), num(4), str("ab")}, Result: "xaba"},
+	}
+
+	for _, tst := range tests {
+		out := tst.Fn(tst.Args)
+		if out.Type() != object.STRING || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	errors := []struct {
+		Fn   func([]object.Object) object.Object
+		Args []object.Object
+	}{
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab")}},
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab"), str("3")}},
+		{Fn: e.fnRepeat, Args: []object.Object{str("ab"), num(1 << 40)}},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("ab")}},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("ab"), str("5")}},
+		{Fn: e.fnPadLeft, Args: []object.Object{str("ab"), num(5), str("")}},
+		{Fn: e.fnPadRight, Args: []object.Object{str("ab"), num(1 << 40)}},
+	}
+	for _, tst := range errors {
+		out := tst.Fn(tst.Args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error for %v, got %s", tst.Args, out.Inspect())
+		}
+	}
+}
+
+// Test indexOf and lastIndexOf
+func TestIndexOf(t *testing.T) {
+
+	e := New()
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	arr := &object.Array{Elements: []object.Object{num(1), str("a"), &object.Float{Value: 2.0}, str("a"), num(2)}}
+
+	tests := []struct {
+		Haystack object.Object
+		Needle   object.Object
+		First    int64
+		Last     int64
+	}{
+		{Haystack: str("hello world"), Needle: str("o"), First: 4, Last: 7},
+		{Haystack: str("hello"), Needle: str("z"), First: -1, Last: -1},
+		{Haystack: str("hello"), Needle: str("hello"), First: 0, Last: 0},
+		{Haystack: str("hello"), Needle: str(""), First: 0, Last: 5},
+		{Haystack: str("狐犬狐犬"), Needle: str("犬"), First: 1, Last: 3},
+		{Haystack: str("ÅÄÖ-ÅÄÖ"), Needle: str("-"), First: 3, Last: 3},
+		{Haystack: num(12321), Needle: num(2), First: 1, Last: 3},
+		{Haystack: arr, Needle: str("a"), First: 1, Last: 3},
+		{Haystack: arr, Needle: num(2), First: 2, Last: 4},
+		{Haystack: arr, Needle: &object.Float{Value: 1.0}, First: 0, Last: 0},
+		{Haystack: arr, Needle: str("1"), First: -1, Last: -1},
+		{Haystack: &object.Array{}, Needle: num(1), First: -1, Last: -1},
+	}
+
+	for _, tst := range tests {
+		out := e.fnIndexOf([]object.Object{tst.Haystack, tst.Needle})
+		if out.Type() != object.INTEGER || out.(*object.Integer).Value != tst.First {
+			t.Fatalf("unexpected result from indexOf(%s, %s): %s", tst.Haystack.Inspect(), tst.Needle.Inspect(), out.Inspect())
+		}
+		out = e.fnLastIndexOf([]object.Object{tst.Haystack, tst.Needle})
+		if out.Type() != object.INTEGER || out.(*object.Integer).Value != tst.Last {
+			t.Fatalf("unexpected result from lastIndexOf(%s, %s): %s", tst.Haystack.Inspect(), tst.Needle.Inspect(), out.Inspect())
+		}
+	}
+
+	for _, fn := range []func([]object.Object) object.Object{e.fnIndexOf, e.fnLastIndexOf} {
+		out := fn([]object.Object{str("x")})
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error with the wrong number of arguments")
+		}
+	}
+}
+
+// Test substring
+func TestSubstring(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{str("Steve"), num(0), num(3)}, Result: "Ste"},
+		{Args: []object.Object{str("Steve"), num(2)}, Result: "eve"},
+		{Args: []object.Object{str("Steve"), num(-3)}, Result: "eve"},
+		{Args: []object.Object{str("Steve"), num(1), num(-1)}, Result: "tev"},
+		{Args: []object.Object{str("Steve"), num(-100), num(100)}, Result: "Steve"},
+		{Args: []object.Object{str("Steve"), num(4), num(2)}, Result: ""},
+		{Args: []object.Object{str("Steve"), num(10)}, Result: ""},
+		{Args: []object.Object{str("Steve"), &object.Null{}, num(2)}, Result: "St"},
+		{Args: []object.Object{str("狐犬狐犬"), num(1), num(3)}, Result: "犬狐"},
+		{Args: []object.Object{num(12345), num(1), num(3)}, Result: "23"},
+	}
+
+	for _, tst := range tests {
+		out := fnSubstring(tst.Args)
+		if out.Type() != object.STRING {
+			t.Fatalf("expected a string, got %s", out.Inspect())
+		}
+		if out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result, got '%s' expected '%s'", out.Inspect(), tst.Result)
+		}
+	}
+
+	errors := [][]object.Object{
+		{str("Steve")},
+		{str("Steve"), str("1")},
+		{str("Steve"), num(1), &object.Float{Value: 2.5}},
+	}
+	for _, args := range errors {
+		out := fnSubstring(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error, got %s", out.Inspect())
+		}
+	}
+}
+
+// Test toJSON and fromJSON
+func TestJSON(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	hash := &object.Hash{Pairs: map[string]object.Object{
+		"name":  str("<Steve & co>"),
+		"age":   num(45),
+		"ratio": &object.Float{Value: 1.5},
+		"tags":  &object.Array{Elements: []object.Object{str("a"), &object.Null{}, &object.Boolean{Value: true}}},
+		"empty": &object.Array{},
+	}}
+
+	// Encoding
+	tests := []struct {
+		Input  object.Object
+		Result string
+	}{
+		{Input: str("hello"), Result: `"hello"`},
+		{Input: num(-3), Result: `-3`},
+		{Input: &object.Float{Value: 2.25}, Result: `2.25`},
+		{Input: &object.Null{}, Result: `null`},
+		{Input: &object.Boolean{Value: false}, Result: `false`},
+		{Input: &object.Array{}, Result: `[]`},
+		{Input: hash, Result: `{"age":45,"empty":[],"name":"<Steve & co>","ratio":1.5,"tags":["a",null,true]}`},
+	}
+
+	for _, tst := range tests {
+		out := fnToJSON([]object.Object{tst.Input})
+		if out.Type() != object.STRING {
+			t.Fatalf("expected a string, got %s", out.Inspect())
+		}
+		if out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result, got '%s' expected '%s'", out.Inspect(), tst.Result)
+		}
+	}
+
+	// Round-tripping
+	out := fnFromJSON([]object.Object{fnToJSON([]object.Object{hash})})
+	if out.Type() != object.HASH {
+		t.Fatalf("expected a hash, got %s", out.Inspect())
+	}
+	if out.Inspect() != hash.Inspect() {
+		t.Fatalf("round-trip failed, got %s expected %s", out.Inspect(), hash.Inspect())
+	}
+
+	// Decoding
+	decode := []struct {
+		Input string
+		Type  object.Type
+		Value string
+	}{
+		{Input: `3`, Type: object.INTEGER, Value: "3"},
+		{Input: `3.5`, Type: object.FLOAT, Value: "3.5"},
+		{Input: `1e3`, Type: object.FLOAT, Value: "1000"},
+		{Input: `99999999999999999999`, Type: object.FLOAT, Value: "100000000000000000000"},
+		{Input: ` "x" `, Type: object.STRING, Value: "x"},
+		{Input: `null`, Type: object.NULL, Value: "null"},
+		{Input: `[1, [2]]`, Type: object.ARRAY, Value: "[1, [2]]"},
+		{Input: `{"a": {"b": true}}`, Type: object.HASH, Value: "{a: {b: true}}"},
+	}
+	for _, tst := range decode {
+		out := fnFromJSON([]object.Object{str(tst.Input)})
+		if out.Type() != tst.Type {
+			t.Fatalf("unexpected type decoding %s: %s", tst.Input, out.Type())
+		}
+		if out.Inspect() != tst.Value {
+			t.Fatalf("unexpected result decoding %s: %s", tst.Input, out.Inspect())
+		}
+	}
+
+	// A cyclic value
+	cyclic := &object.Array{}
+	cyclic.Elements = []object.Object{num(1), &object.Hash{Pairs: map[string]object.Object{"self": cyclic}}}
+
+	// Errors
+	errors := []object.Object{
+		fnToJSON([]object.Object{}),
+		fnToJSON([]object.Object{cyclic}),
+		fnToJSON([]object.Object{&object.Float{Value: math.Inf(1)}}),
+		fnFromJSON([]object.Object{}),
+		fnFromJSON([]object.Object{str(`{"a": `)}),
+		fnFromJSON([]object.Object{str(`[1] [2]`)}),
+		fnFromJSON([]object.Object{str(``)}),
+		fnFromJSON([]object.Object{str(`1e400`)}),
+		fnFromJSON([]object.Object{str(`[1, -1e400]`)}),
+		fnFromJSON([]object.Object{str(`{"a": {"b": 1e400}}`)}),
+	}
+	for i, out := range errors {
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected an error for case %d, got %s", i, out.Inspect())
+		}
+	}
+	out = fnFromJSON([]object.Object{str(`1e400`)})
+	if out.Inspect() != "fromJSON: the number 1e400 is out of range" {
+		t.Fatalf("unexpected error for an out of range number: %s", out.Inspect())
+	}
+
+	// The same value may appear twice, without being a cycle.
+	shared := &object.Array{Elements: []object.Object{num(1)}}
+	out = fnToJSON([]object.Object{&object.Array{Elements: []object.Object{shared, shared}}})
+	if out.Inspect() != "[[1],[1]]" {
+		t.Fatalf("unexpected result encoding a shared value: %s", out.Inspect())
+	}
+}
+
+// Test first and last
+func TestFirstLast(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	arr := &object.Array{Elements: []object.Object{str("a"), str("b"), str("c")}}
+	one := &object.Array{Elements: []object.Object{str("x")}}
+
+	tests := []struct {
+		Input object.Object
+		First string
+		Last  string
+	}{
+		{Input: arr, First: "a", Last: "c"},
+		{Input: one, First: "x", Last: "x"},
+		{Input: &object.Array{}, First: "null", Last: "null"},
+	}
+
+	for _, tst := range tests {
+		out := fnFirst([]object.Object{tst.Input})
+		if out.Inspect() != tst.First {
+			t.Fatalf("unexpected result from first(%s): %s", tst.Input.Inspect(), out.Inspect())
+		}
+		out = fnLast([]object.Object{tst.Input})
+		if out.Inspect() != tst.Last {
+			t.Fatalf("unexpected result from last(%s): %s", tst.Input.Inspect(), out.Inspect())
+		}
+	}
+
+	for _, fn := range []func([]object.Object) object.Object{fnFirst, fnLast} {
+		for _, args := range [][]object.Object{{}, {str("abc")}, {arr, arr}} {
+			out := fn(args)
+			if out.Type() != object.ERROR {
+				t.Fatalf("expected an error, got %s", out.Inspect())
+			}
+		}
+	}
+}
+
+// Test take and skip
+func TestTakeSkip(t *testing.T) {
+
+	arr := &object.Array{}
+	for i := 1; i <= 5; i++ {
+		arr.Elements = append(arr.Elements, &object.Integer{Value: int64(i)})
+	}
+
+	tests := []struct {
+		N    int64
+		Take string
+		Skip string
+	}{
+		{N: 0, Take: "[]", Skip: "[1, 2, 3, 4, 5]"},
+		{N: 2, Take: "[1, 2]", Skip: "[3, 4, 5]"},
+		{N: 5, Take: "[1, 2, 3, 4, 5]", Skip: "[]"},
+		{N: 6, Take: "[1, 2, 3, 4, 5]", Skip: "[]"},
+		{N: -2, Take: "[4, 5]", Skip: "[1, 2, 3]"},
+		{N: -5, Take: "[1, 2, 3, 4, 5]", Skip: "[]"},
+		{N: -6, Take: "[1, 2, 3, 4, 5]", Skip: "[]"},
+	}
+
+	for _, tst := range tests {
+		n := &object.Integer{Value: tst.N}
+
+		out := fnTake([]object.Object{arr, n})
+		if out.Type() != object.ARRAY || out.Inspect() != tst.Take {
+			t.Fatalf("unexpected result from take(arr, %d): %s", tst.N, out.Inspect())
+		}
+		out = fnSkip([]object.Object{arr, n})
+		if out.Type() != object.ARRAY || out.Inspect() != tst.Skip {
+			t.Fatalf("unexpected result from skip(arr, %d): %s", tst.N, out.Inspect())
+		}
+	}
+
+	// The result is a copy.
+	out := fnTake([]object.Object{arr, &object.Integer{Value: 2}}).(*object.Array)
+	out.Elements[0] = &object.Integer{Value: 100}
+	if arr.Elements[0].Inspect() != "1" {
+		t.Fatalf("modifying the result changed the original")
+	}
+
+	// An empty array
+	empty := &object.Array{}
+	for _, fn := range []func([]object.Object) object.Object{fnTake, fnSkip} {
+		out := fn([]object.Object{empty, &object.Integer{Value: 3}})
+		if out.Inspect() != "[]" {
+			t.Fatalf("unexpected result with an empty array: %s", out.Inspect())
+		}
+	}
+
+	// Errors
+	for _, fn := range []func([]object.Object) object.Object{fnTake, fnSkip} {
+		for _, args := range [][]object.Object{
+			{arr},
+			{&object.String{Value: "steve"}, &object.Integer{Value: 1}},
+			{arr, &object.Float{Value: 1.5}},
+		} {
+			out := fn(args)
+			if out.Type() != object.ERROR {
+				t.Fatalf("expected an error, got %s", out.Inspect())
+			}
+		}
+	}
+}
+
+func TestReplaceRegex(t *testing.T) {
+
+	e := New()
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{str("(555) 123-4567"), str("[^0-9]"), str("")}, Result: "5551234567"},
+		{Args: []object.Object{str("Smith, John"), str("^(\\w+), (\\w+)$"), str("$2 $1")}, Result: "John Smith"},
+		{Args: []object.Object{str("a1b22"), str("(\\d+)"), str("${1}x")}, Result: "a1xb22x"},
+		{Args: []object.Object{str("abc"), str("z"), str("y")}, Result: "abc"},
+		{Args: []object.Object{&object.Integer{Value: 1234}, str("3"), str("-")}, Result: "12-4"},
+		{Args: []object.Object{str("abc"), str(""), str("-")}, Result: "-a-b-c-"},
+		{Args: []object.Object{str("aaa"), str("a*"), str("-")}, Result: "-"},
+		{Args: []object.Object{str("baaab"), str("a*"), str("<$0>")}, Result: "<>b<aaa>b<>"},
+	}
+
+	for _, tst := range tests {
+		out := e.fnReplaceRegex(tst.Args)
+		if out.Type() != object.STRING || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	out := e.fnReplaceRegex([]object.Object{str("abc"), str("(")})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error, got %v", out)
+	}
+
+	out = e.fnReplaceRegex([]object.Object{str("abc"), str("("), str("x")})
+	if out.Type() != object.ERROR || !strings.Contains(out.Inspect(), "invalid regular expression '('") {
+		t.Fatalf("expected an error, got %v", out)
+	}
+}
+
+func TestCoerceLike(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+	flt := func(f float64) object.Object { return &object.Float{Value: f} }
+	bln := func(b bool) object.Object { return &object.Boolean{Value: b} }
+
+	tests := []struct {
+		Value  object.Object
+		Like   object.Object
+		Type   object.Type
+		Result string
+	}{
+		{Value: num(200), Like: str(""), Type: object.STRING, Result: "200"},
+		{Value: bln(true), Like: str(""), Type: object.STRING, Result: "true"},
+		{Value: str(" 21 "), Like: num(0), Type: object.INTEGER, Result: "21"},
+		{Value: str("0x10"), Like: num(0), Type: object.INTEGER, Result: "16"},
+		{Value: flt(3.0), Like: num(0), Type: object.INTEGER, Result: "3"},
+		{Value: str("2.0"), Like: num(0), Type: object.INTEGER, Result: "2"},
+		{Value: num(3), Like: flt(0), Type: object.FLOAT, Result: "3"},
+		{Value: str("1.5"), Like: flt(0), Type: object.FLOAT, Result: "1.5"},
+		{Value: str("true"), Like: bln(false), Type: object.BOOLEAN, Result: "true"},
+		{Value: str("0"), Like: bln(false), Type: object.BOOLEAN, Result: "false"},
+		{Value: num(1), Like: bln(false), Type: object.BOOLEAN, Result: "true"},
+		{Value: flt(0), Like: bln(true), Type: object.BOOLEAN, Result: "false"},
+		{Value: bln(false), Like: bln(true), Type: object.BOOLEAN, Result: "false"},
+	}
+
+	for _, tst := range tests {
+		out := fnCoerceLike([]object.Object{tst.Value, tst.Like})
+		if out.Type() != tst.Type || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for coerceLike(%s, %s): %s %s", tst.Value.Inspect(), tst.Like.Inspect(), out.Type(), out.Inspect())
+		}
+	}
+
+	errors := []struct {
+		Args  []object.Object
+		Error string
+	}{
+		{Args: []object.Object{str("abc"), num(1)}, Error: `cannot convert "abc" to integer`},
+		{Args: []object.Object{flt(3.5), num(1)}, Error: "cannot convert 3.5 to integer"},
+		{Args: []object.Object{flt(1e20), num(1)}, Error: "to integer"},
+		{Args: []object.Object{bln(true), num(1)}, Error: "cannot convert true to integer"},
+		{Args: []object.Object{bln(true), flt(1)}, Error: "cannot convert true to float"},
+		{Args: []object.Object{str("yes"), bln(true)}, Error: `cannot convert "yes" to boolean`},
+		{Args: []object.Object{num(2), bln(true)}, Error: "cannot convert 2 to boolean"},
+		{Args: []object.Object{&object.Null{}, str("")}, Error: "cannot convert null to string"},
+		{Args: []object.Object{&object.Array{}, str("")}, Error: "to string"},
+		{Args: []object.Object{num(1), &object.Null{}}, Error: "cannot convert 1 to null"},
+		{Args: []object.Object{num(1)}, Error: "wrong number of arguments"},
+	}
+
+	for _, tst := range errors {
+		out := fnCoerceLike(tst.Args)
+		if out.Type() != object.ERROR || !strings.Contains(out.Inspect(), tst.Error) {
+			t.Fatalf("expected an error for %v, got %s", tst.Args, out.Inspect())
+		}
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+
+	// Run the tests in UTC.
+	tz := os.Getenv("TZ")
+	os.Setenv("TZ", "UTC")
+	defer os.Setenv("TZ", tz)
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	ts := &object.Integer{Value: 1710495000}
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{ts}, Result: "2024-03-15T09:30:00Z"},
+		{Args: []object.Object{ts, str("rfc3339")}, Result: "2024-03-15T09:30:00Z"},
+		{Args: []object.Object{ts, str("rfc1123")}, Result: "Fri, 15 Mar 2024 09:30:00 UTC"},
+		{Args: []object.Object{ts, str("datetime")}, Result: "2024-03-15 09:30:00"},
+		{Args: []object.Object{ts, str("date")}, Result: "2024-03-15"},
+		{Args: []object.Object{ts, str("time")}, Result: "09:30:00"},
+		{Args: []object.Object{ts, str("unix")}, Result: "1710495000"},
+		{Args: []object.Object{ts, str("unixmilli")}, Result: "1710495000000"},
+		{Args: []object.Object{&object.Float{Value: 1710495000.25}, str("unixmilli")}, Result: "1710495000250"},
+		{Args: []object.Object{&object.Float{Value: 1710495000.25}, str("15:04:05.000")}, Result: "09:30:00.250"},
+		{Args: []object.Object{ts, str("02/01/2006")}, Result: "15/03/2024"},
+		{Args: []object.Object{ts, str("Monday")}, Result: "Friday"},
+	}
+
+	for _, tst := range tests {
+		out := fnFormatDate(tst.Args)
+		if out.Type() != object.STRING || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	// The timezone is respected.
+	os.Setenv("TZ", "Europe/Helsinki")
+	out := fnFormatDate([]object.Object{ts, str("datetime")})
+	if out.Inspect() != "2024-03-15 11:30:00" {
+		t.Fatalf("unexpected result: %s", out.Inspect())
+	}
+
+	out = fnFormatDate([]object.Object{&object.Null{}, str("date")})
+	if out.Type() != object.NULL {
+		t.Fatalf("expected null, got %s", out.Inspect())
+	}
+
+	out = fnFormatDate([]object.Object{str("yesterday")})
+	if out.Type() != object.ERROR || out.Inspect() != "formatDate: time must be a number, not STRING" {
+		t.Fatalf("expected an error, got %s", out.Inspect())
+	}
+
+	out = fnFormatDate([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestJoinNonNull(t *testing.T) {
+
+	e := New()
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	null := &object.Null{}
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{str("-"), str("Bob"), str("J"), str("Smith")}, Result: "Bob-J-Smith"},
+		{Args: []object.Object{str("-"), str("Bob"), null, str("Smith")}, Result: "Bob-Smith"},
+		{Args: []object.Object{str("-"), str("Bob"), str(""), str("Smith")}, Result: "Bob-Smith"},
+		{Args: []object.Object{str("-"), str("Bob"), str(" "), str("Smith")}, Result: "Bob- -Smith"},
+		{Args: []object.Object{str(", "), null, str("Helsinki"), &object.Integer{Value: 100}}, Result: "Helsinki, 100"},
+		{Args: []object.Object{str("-"), null, str("")}, Result: ""},
+		{Args: []object.Object{str("-")}, Result: ""},
+	}
+
+	for _, tst := range tests {
+		out := e.fnJoinNonNull(tst.Args)
+		if out.Type() != object.STRING || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	out := e.fnJoinNonNull([]object.Object{})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error, got %s", out.Inspect())
+	}
+}
+
+func TestCounters(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	e := New()
+
+	// Without a store these are errors.
+	for _, out := range []object.Object{
+		e.fnCounter([]object.Object{str("a")}),
+		e.fnIncrement([]object.Object{str("a")}),
+		e.fnWindowCount([]object.Object{str("a"), str("1m")}),
+	} {
+		if out.Type() != object.ERROR || !strings.Contains(out.Inspect(), "no counter store has been configured") {
+			t.Fatalf("expected an error, got %s", out.Inspect())
+		}
+	}
+
+	store := NewCounters()
+	e.SetCounters(store)
+
+	if out := e.fnCounter([]object.Object{str("a")}); out.Inspect() != "0" {
+		t.Fatalf("unexpected counter: %s", out.Inspect())
+	}
+	e.fnIncrement([]object.Object{str("a")})
+	e.fnIncrement([]object.Object{str("a"), num(5)})
+	if out := e.fnIncrement([]object.Object{str("b"), num(-2)}); out.Inspect() != "-2" {
+		t.Fatalf("unexpected counter: %s", out.Inspect())
+	}
+	if out := e.fnCounter([]object.Object{str("a")}); out.Inspect() != "6" {
+		t.Fatalf("unexpected counter: %s", out.Inspect())
+	}
+
+	// The store is shared with clones.
+	c := e.Clone()
+	c.fnIncrement([]object.Object{str("a")})
+	if store.Count("a") != 7 {
+		t.Fatalf("unexpected counter: %d", store.Count("a"))
+	}
+
+	// Events are counted within their window.
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{str("ip"), str("1m"), num(1000)}, Result: "1"},
+		{Args: []object.Object{str("ip"), str("1m"), num(1030)}, Result: "2"},
+		{Args: []object.Object{str("other"), str("1m"), num(1030)}, Result: "1"},
+		{Args: []object.Object{str("ip"), num(60), num(1059)}, Result: "3"},
+		{Args: []object.Object{str("ip"), str("1m"), num(1060)}, Result: "3"},
+		{Args: []object.Object{str("ip"), str("1m"), num(1200)}, Result: "1"},
+		{Args: []object.Object{str("ip"), &object.Float{Value: 0.5}, &object.Float{Value: 1200.25}}, Result: "2"},
+	}
+
+	for _, tst := range tests {
+		out := e.fnWindowCount(tst.Args)
+		if out.Type() != object.INTEGER || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	// Without a time the event happens now.
+	if out := e.fnWindowCount([]object.Object{str("now"), str("1h")}); out.Inspect() != "1" {
+		t.Fatalf("unexpected result: %s", out.Inspect())
+	}
+	if out := e.fnWindowCount([]object.Object{str("now"), str("1h")}); out.Inspect() != "2" {
+		t.Fatalf("unexpected result: %s", out.Inspect())
+	}
+
+	errors := []struct {
+		Out   object.Object
+		Error string
+	}{
+		{Out: e.fnIncrement([]object.Object{str("a"), str("1")}), Error: "increment: amount must be an integer, not STRING"},
+		{Out: e.fnWindowCount([]object.Object{str("a"), str("soon")}), Error: "windowCount: invalid duration 'soon'"},
+		{Out: e.fnWindowCount([]object.Object{str("a"), num(0)}), Error: "windowCount: window must be positive, not 0"},
+		{Out: e.fnWindowCount([]object.Object{str("a"), &object.Null{}}), Error: "windowCount: window must be a duration, not NULL"},
+		{Out: e.fnWindowCount([]object.Object{str("a"), str("1m"), str("now")}), Error: "windowCount: time must be a number, not STRING"},
+		{Out: e.fnCounter([]object.Object{}), Error: "counter: wrong number of arguments"},
+	}
+
+	for _, tst := range errors {
+		if tst.Out.Type() != object.ERROR || tst.Out.Inspect() != tst.Error {
+			t.Fatalf("expected error %q, got %s", tst.Error, tst.Out.Inspect())
+		}
+	}
+
+	// Reset discards everything.
+	store.Reset()
+	if store.Count("a") != 0 {
+		t.Fatalf("unexpected counter after reset: %d", store.Count("a"))
+	}
+	if out := e.fnWindowCount([]object.Object{str("ip"), str("1h"), num(1200)}); out.Inspect() != "1" {
+		t.Fatalf("unexpected result after reset: %s", out.Inspect())
+	}
+}
+
+func TestPluck(t *testing.T) {
+
+	hash := func(pairs map[string]object.Object) object.Object { return &object.Hash{Pairs: pairs} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	items := &object.Array{Elements: []object.Object{
+		hash(map[string]object.Object{"price": num(10), "tax": hash(map[string]object.Object{"rate": num(20)})}),
+		hash(map[string]object.Object{"name": &object.String{Value: "free"}}),
+		hash(map[string]object.Object{"price": &object.Null{}, "tax": num(3)}),
+		num(7),
+		hash(map[string]object.Object{"price": &object.Float{Value: 2.5}}),
+	}}
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{items, &object.String{Value: "price"}}, Result: "[10, null, null, null, 2.5]"},
+		{Args: []object.Object{items, &object.String{Value: "price"}, &object.Boolean{Value: true}}, Result: "[10, null, 2.5]"},
+		{Args: []object.Object{items, &object.String{Value: "tax.rate"}}, Result: "[20, null, null, null, null]"},
+		{Args: []object.Object{items, &object.String{Value: "tax.rate"}, &object.Boolean{Value: true}}, Result: "[20]"},
+		{Args: []object.Object{&object.Array{}, &object.String{Value: "price"}}, Result: "[]"},
+	}
+
+	for _, tst := range tests {
+		out := fnPluck(tst.Args)
+		if out.Type() != object.ARRAY || out.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{items},
+		{num(3), &object.String{Value: "price"}},
+		{items, num(3)},
+		{items, &object.String{Value: ""}},
+		{items, &object.String{Value: "price"}, num(1)},
+	}
+	for _, args := range errors {
+		out := fnPluck(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+	}
+}
+
+func TestZip(t *testing.T) {
+
+	e := New()
+	e.SetFunction("add", func(args []object.Object) object.Object {
+		a, ok := args[0].(*object.Integer)
+		if !ok {
+			return &object.Error{Message: "not an integer"}
+		}
+		b := args[1].(*object.Integer)
+		return &object.Integer{Value: a.Value + b.Value}
+	})
+
+	ints := func(vals ...int64) *object.Array {
+		arr := &object.Array{}
+		for _, v := range vals {
+			arr.Elements = append(arr.Elements, &object.Integer{Value: v})
+		}
+		return arr
+	}
+	add := &object.String{Value: "add"}
+
+	tests := []struct {
+		A, B   *object.Array
+		Zip    string
+		ZipAdd string
+	}{
+		{A: ints(1, 2, 3), B: ints(10, 20, 30), Zip: "[[1, 10], [2, 20], [3, 30]]", ZipAdd: "[11, 22, 33]"},
+		{A: ints(1, 2, 3), B: ints(10), Zip: "[[1, 10]]", ZipAdd: "[11]"},
+		{A: ints(1), B: ints(10, 20), Zip: "[[1, 10]]", ZipAdd: "[11]"},
+		{A: ints(), B: ints(10, 20), Zip: "[]", ZipAdd: "[]"},
+	}
+
+	for _, tst := range tests {
+		out := fnZip([]object.Object{tst.A, tst.B})
+		if out.Inspect() != tst.Zip {
+			t.Fatalf("unexpected result from zip: %s", out.Inspect())
+		}
+		out = e.fnZipWith([]object.Object{tst.A, tst.B, add})
+		if out.Inspect() != tst.ZipAdd {
+			t.Fatalf("unexpected result from zipWith: %s", out.Inspect())
+		}
+	}
+
+	// errors from the function report the element
+	mixed := &object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.String{Value: "x"}}}
+	out := e.fnZipWith([]object.Object{mixed, ints(1, 2), add})
+	if out.Type() != object.ERROR || out.Inspect() != "zipWith: element 1: not an integer" {
+		t.Fatalf("unexpected error from zipWith: %s", out.Inspect())
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{ints(1)},
+		{ints(1), &object.Integer{Value: 3}},
+		{&object.String{Value: "steve"}, ints(1)},
+	}
+	for _, args := range errors {
+		out = fnZip(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+		out = e.fnZipWith(append(args, add))
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+	}
+	for _, fn := range []object.Object{&object.Integer{Value: 3}, &object.String{Value: "missing"}} {
+		out = e.fnZipWith([]object.Object{ints(1), ints(2), fn})
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for function %s, got %s", fn.Inspect(), out.Inspect())
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+
+	hash := func(pairs ...interface{}) *object.Hash {
+		h := &object.Hash{Pairs: make(map[string]object.Object)}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Pairs[pairs[i].(string)] = &object.Integer{Value: int64(pairs[i+1].(int))}
+		}
+		return h
+	}
+
+	a := hash("x", 1, "y", 2)
+	b := hash("y", 3, "z", 4)
+	c := hash("z", 5)
+
+	out := fnMerge([]object.Object{a, b, c})
+	h, ok := out.(*object.Hash)
+	if !ok {
+		t.Fatalf("expected a hash, got %s", out.Inspect())
+	}
+	for k, v := range map[string]string{"x": "1", "y": "3", "z": "5"} {
+		if h.Pairs[k] == nil || h.Pairs[k].Inspect() != v {
+			t.Fatalf("unexpected value for %s in %s", k, out.Inspect())
+		}
+	}
+	if len(h.Pairs) != 3 {
+		t.Fatalf("unexpected result %s", out.Inspect())
+	}
+
+	// The inputs are unchanged.
+	if len(a.Pairs) != 2 || a.Pairs["y"].Inspect() != "2" || len(b.Pairs) != 2 {
+		t.Fatalf("merge modified its arguments")
+	}
+
+	// A single hash is copied.
+	out = fnMerge([]object.Object{a})
+	if out == a || len(out.(*object.Hash).Pairs) != 2 {
+		t.Fatalf("unexpected result merging a single hash: %s", out.Inspect())
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{a, &object.Integer{Value: 3}},
+		{&object.Array{}, a},
+		{a, &object.Null{}},
+	}
+	for _, args := range errors {
+		out = fnMerge(args)
+		if out.Type() != object.ERROR {
+			t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+		}
+	}
+}
+
+func TestMaxMinBy(t *testing.T) {
+
+	e := New()
+
+	item := func(name string, price object.Object) object.Object {
+		pairs := map[string]object.Object{"name": &object.String{Value: name}}
+		if price != nil {
+			pairs["price"] = price
+		}
+		return &object.Hash{Pairs: pairs}
+	}
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+
+	items := &object.Array{Elements: []object.Object{
+		item("a", num(10)),
+		item("b", &object.Float{Value: 25.5}),
+		item("c", nil),
+		item("d", num(3)),
+		item("e", &object.Null{}),
+		item("f", num(3)),
+		item("g", &object.Float{Value: 25.5}),
+	}}
+
+	tests := []struct {
+		Fn     func([]object.Object) object.Object
+		Args   []object.Object
+		Result string
+	}{
+		{Fn: e.fnMaxBy, Args: []object.Object{items, &object.String{Value: "price"}}, Result: "b"},
+		{Fn: e.fnMinBy, Args: []object.Object{items, &object.String{Value: "price"}}, Result: "d"},
+		{Fn: e.fnMaxBy, Args: []object.Object{items, &object.String{Value: "name"}}, Result: "g"},
+		{Fn: e.fnMinBy, Args: []object.Object{items, &object.String{Value: "name"}}, Result: "a"},
+	}
+
+	for _, tst := range tests {
+		out := tst.Fn(tst.Args)
+		hash, ok := out.(*object.Hash)
+		if !ok || hash.Pairs["name"].Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Args, out.Inspect())
+		}
+	}
+
+	// Arrays without the field give null.
+	for _, fn := range []func([]object.Object) object.Object{e.fnMaxBy, e.fnMinBy} {
+		for _, arr := range []*object.Array{{}, {Elements: []object.Object{item("c", nil), num(3)}}} {
+			out := fn([]object.Object{arr, &object.String{Value: "price"}})
+			if out.Type() != object.NULL {
+				t.Fatalf("expected null, got %s", out.Inspect())
+			}
+		}
+	}
+
+	// Values which can't be compared are an error.
+	mixed := &object.Array{Elements: []object.Object{item("a", num(3)), item("b", &object.String{Value: "x"})}}
+	out := e.fnMaxBy([]object.Object{mixed, &object.String{Value: "price"}})
+	if out.Type() != object.ERROR || out.Inspect() != "maxBy: element 1: cannot compare STRING with INTEGER" {
+		t.Fatalf("unexpected error from maxBy: %s", out.Inspect())
+	}
+
+	// bad arguments are errors
+	errors := [][]object.Object{
+		{},
+		{items},
+		{num(3), &object.String{Value: "price"}},
+		{items, num(3)},
+		{items, &object.String{Value: ""}},
+	}
+	for _, args := range errors {
+		for _, fn := range []func([]object.Object) object.Object{e.fnMaxBy, e.fnMinBy} {
+			out = fn(args)
+			if out.Type() != object.ERROR {
+				t.Fatalf("expected error for %v, got %s", args, out.Inspect())
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// This file contains the rules for comparing two values, which are used
+// by the comparison operators, and by the functions which search arrays,
+// so that they always agree upon whether two values are equal.
+
+package environment
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// Equal reports whether two values are equal, in the same way as the `==`
+// operator.
+//
+// Integers and floats are compared by value, so `1` is equal to `1.0`,
+// and two floats are considered equal if they differ by no more than the
+// tolerance set via SetFloatTolerance.  Arrays and hashes are equal if
+// their contents are equal, null is only equal to itself, and strings and
+// booleans must be identical.
+//
+// If strict equality is enabled, via SetStrictStringEquality, numbers,
+// strings, and booleans are only equal to values of the same type, so
+// `1` is not equal to `1.0`, and a string is simply not equal to a
+// number, rather than the two being impossible to compare.
+//
+// The second return value is false if values of the given types cannot
+// be compared, in which case the first is always false.  The `==`
+// operator reports this as an error, whereas functions such as `indexOf`
+// simply treat the values as different.
+func (e *Environment) Equal(a, b object.Object) (bool, bool) {
+
+	if a.Type() == object.NULL || b.Type() == object.NULL {
+		return a.Type() == b.Type(), true
+	}
+
+	if e.strictEquality && IsScalar(a.Type()) && IsScalar(b.Type()) && a.Type() != b.Type() {
+		return false, true
+	}
+
+	switch l := a.(type) {
+	case *object.Integer:
+		switch r := b.(type) {
+		case *object.Integer:
+			return l.Value == r.Value, true
+		case *object.Float:
+			return float64(l.Value) == r.Value, true
+		}
+	case *object.Float:
+		switch r := b.(type) {
+		case *object.Integer:
+			return l.Value == float64(r.Value), true
+		case *object.Float:
+			return ApproxEqual(l.Value, r.Value, e.floatTolerance), true
+		}
+	case *object.String:
+		if r, ok := b.(*object.String); ok {
+			return l.Value == r.Value, true
+		}
+	case *object.Boolean:
+		if r, ok := b.(*object.Boolean); ok {
+			return l.Value == r.Value, true
+		}
+	case *object.Array:
+		r, ok := b.(*object.Array)
+		if !ok {
+			return false, false
+		}
+		if len(l.Elements) != len(r.Elements) {
+			return false, true
+		}
+		for i := range l.Elements {
+			if equal, _ := e.Equal(l.Elements[i], r.Elements[i]); !equal {
+				return false, true
+			}
+		}
+		return true, true
+	case *object.Hash:
+		r, ok := b.(*object.Hash)
+		if !ok {
+			return false, false
+		}
+		if len(l.Pairs) != len(r.Pairs) {
+			return false, true
+		}
+		for k, v := range l.Pairs {
+			other, ok := r.Pairs[k]
+			if !ok {
+				return false, true
+			}
+			if equal, _ := e.Equal(v, other); !equal {
+				return false, true
+			}
+		}
+		return true, true
+	}
+
+	return false, false
+}
+
+// Compare orders two values, in the same way as the `<`, `<=`, `>`, and
+// `>=` operators, returning a negative number if the first is less than
+// the second, zero if they're equal, and a positive number otherwise.
+//
+// Integers and floats are compared by value, and strings are compared
+// lexically - unless version-aware comparisons are enabled and both are
+// version numbers.  Booleans are ordered with false before true.  Unlike
+// Equal the float tolerance is not used.
+//
+// The second return value is false if values of the given types cannot
+// be ordered, for example arrays, or null.  It is also false if either
+// value is a float which is not a number (NaN), which has no place in
+// the ordering of numbers - see Unordered.
+func (e *Environment) Compare(a, b object.Object) (int, bool) {
+
+	if Unordered(a, b) {
+		return 0, false
+	}
+
+	switch l := a.(type) {
+	case *object.Integer:
+		switch r := b.(type) {
+		case *object.Integer:
+			return compareInts(l.Value, r.Value), true
+		case *object.Float:
+			return compareFloats(float64(l.Value), r.Value), true
+		}
+	case *object.Float:
+		switch r := b.(type) {
+		case *object.Integer:
+			return compareFloats(l.Value, float64(r.Value)), true
+		case *object.Float:
+			return compareFloats(l.Value, r.Value), true
+		}
+	case *object.String:
+		if r, ok := b.(*object.String); ok {
+			if e.versionAware {
+				if cmp, ok := compareVersions(l.Value, r.Value); ok {
+					return cmp, true
+				}
+			}
+			return strings.Compare(l.Value, r.Value), true
+		}
+	case *object.Boolean:
+		if r, ok := b.(*object.Boolean); ok {
+			return strings.Compare(l.Inspect(), r.Inspect()), true
+		}
+	}
+
+	return 0, false
+}
+
+// Contains returns true if the given array contains an element which is
+// equal to the given value, according to Equal.
+func (e *Environment) Contains(elements []object.Object, obj object.Object) bool {
+	for _, el := range elements {
+		if equal, _ := e.Equal(el, obj); equal {
+			return true
+		}
+	}
+	return false
+}
+
+// IsScalar returns true if the given type is a number, a string, or a
+// boolean.
+func IsScalar(t object.Type) bool {
+	switch t {
+	case object.INTEGER, object.FLOAT, object.STRING, object.BOOLEAN:
+		return true
+	}
+	return false
+}
+
+// Unordered returns true if either value is a float which is not a
+// number (NaN).  Such values can't be ordered relative to any other,
+// so comparing them via `<`, `<=`, `>`, or `>=` gives false rather than
+// an error.
+func Unordered(a, b object.Object) bool {
+	return isNaN(a) || isNaN(b)
+}
+
+// isNaN returns true if the given value is a float which is not a number.
+func isNaN(obj object.Object) bool {
+	f, ok := obj.(*object.Float)
+	return ok && math.IsNaN(f.Value)
+}
+
+// compareInts compares two integers.
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareFloats compares two floats.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareVersions compares two strings as version numbers, returning
+// false if either doesn't look like a version.
+func compareVersions(left, right string) (int, bool) {
+
+	l, ok := parseVersion(left)
+	if !ok {
+		return 0, false
+	}
+	r, ok := parseVersion(right)
+	if !ok {
+		return 0, false
+	}
+
+	// Compare the components, treating missing ones as zero.
+	for i := 0; i < len(l) || i < len(r); i++ {
+		var a, b int64
+		if i < len(l) {
+			a = l[i]
+		}
+		if i < len(r) {
+			b = r[i]
+		}
+		if cmp := compareInts(a, b); cmp != 0 {
+			return cmp, true
+		}
+	}
+	return 0, true
+}
+
+// parseVersion returns the components of a string which looks like a
+// version number: an optional leading "v", followed by two or more
+// non-negative integers separated by periods, such as "1.2" or "v1.10.3".
+//
+// If the string doesn't look like a version number false is returned.
+func parseVersion(str string) ([]int64, bool) {
+
+	parts := strings.Split(strings.TrimPrefix(str, "v"), ".")
+	if len(parts) < 2 {
+		return nil, false
+	}
+
+	out := make([]int64, len(parts))
+	for i, p := range parts {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return nil, false
+		}
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
@@ -0,0 +1,93 @@
+// This file contains the store used by the `counter`, `increment`, and
+// `windowCount` functions, which allows scripts to maintain state across
+// the objects they're run against.
+
+package environment
+
+import (
+	"sync"
+	"time"
+)
+
+// Counters holds named counters, and the times of named events, which
+// persist between runs of a script.
+//
+// A store is shared by every environment it is given to, including
+// clones, so it may be used by scripts which are running concurrently.
+// The host application controls its lifetime, for example by creating a
+// new store, or calling Reset, before each batch of objects.
+type Counters struct {
+	// lock protects our maps.
+	lock sync.Mutex
+
+	// counts holds the value of each counter, by name.
+	counts map[string]int64
+
+	// events holds the times of the events recorded under each
+	// name, in the order they were recorded.
+	events map[string][]time.Time
+}
+
+// NewCounters creates a new, empty, store.
+func NewCounters() *Counters {
+	return &Counters{
+		counts: make(map[string]int64),
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Count returns the value of the named counter, which is zero if it has
+// never been incremented.
+func (c *Counters) Count(key string) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.counts[key]
+}
+
+// Increment adds the given amount to the named counter, and returns its
+// new value.
+func (c *Counters) Increment(key string, n int64) int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.counts[key] += n
+	return c.counts[key]
+}
+
+// Record records an event, at the given time, under the named key, and
+// returns the number of events recorded under that key within the window
+// which ends at that time - including the new one.
+//
+// Events which have fallen out of the window are discarded, so each key
+// should always be used with the same window.
+func (c *Counters) Record(key string, at time.Time, window time.Duration) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	start := at.Add(-window)
+
+	var kept []time.Time
+	count := 0
+	for _, t := range c.events[key] {
+		if !t.After(start) {
+			continue
+		}
+		kept = append(kept, t)
+		if !t.After(at) {
+			count++
+		}
+	}
+	c.events[key] = append(kept, at)
+
+	return count + 1
+}
+
+// Reset discards all counters, and events.
+func (c *Counters) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.counts = make(map[string]int64)
+	c.events = make(map[string][]time.Time)
+}
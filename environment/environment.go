@@ -23,6 +23,11 @@ package environment
 
 import (
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"reflect"
+	"time"
 
 	"github.com/skx/evalfilter/v2/object"
 )
@@ -34,9 +39,8 @@ type Environment struct {
 	global map[string]object.Object
 
 	// local holds variables which are scoped for the
-	// duration of `foreach` iterations only.  If we
-	// were to support user-defined functions we'd also
-	// use local-variables too.
+	// duration of `foreach` iterations, and the parameters
+	// of functions defined by scripts.
 	//
 	// We create an entry here each time we enter a new scope,
 	// removing it on exit.
@@ -47,6 +51,229 @@ type Environment struct {
 	//
 	// These are largely static, and always global.
 	functions map[string]interface{}
+
+	// builtins records the names of the functions which we registered
+	// by default, and which haven't since been replaced by the
+	// host-application.
+	builtins map[string]bool
+
+	// params records the minimum, and maximum, number of arguments
+	// accepted by functions which were added, with their parameters,
+	// via SetFunctionWithParams.
+	params map[string][2]int
+
+	// hostAccess records the names of functions which can access
+	// the host system, for example by reading the clock, the
+	// environment, or the filesystem.
+	//
+	// These functions are disabled when running in sandbox mode.
+	hostAccess map[string]bool
+
+	// random records the names of functions which return random
+	// values, such as `uuid`.
+	//
+	// These functions are disabled when running in sandbox mode,
+	// unless a seed has been set to make them reproducible.
+	random map[string]bool
+
+	// sandboxed is true if host-access functions are disabled.
+	sandboxed bool
+
+	// rand is the source of randomness for the `random`, `randomInt`,
+	// and `uuid` functions.
+	rand *rand.Rand
+
+	// seeded is true if the random-number generator was explicitly
+	// seeded, via SetRandSeed.
+	seeded bool
+
+	// output is the destination of the output generated by the
+	// `print` and `printf` functions.
+	output io.Writer
+
+	// fieldHook is invoked each time a script reads a field from
+	// the object it is running against, if it is non-nil.
+	fieldHook FieldHook
+
+	// errorsAsFalse is true if comparisons which fail should give
+	// false, rather than aborting the script.
+	errorsAsFalse bool
+
+	// errorHook is invoked with the error of each comparison which
+	// was treated as false, if it is non-nil.
+	errorHook ErrorHook
+
+	// coercions holds the functions which convert values of the
+	// golang types the host application registered, keyed by type.
+	coercions map[reflect.Type]Coercion
+
+	// fieldTypes holds the types which fields of the object a script
+	// is running against are converted to, keyed by field name.
+	fieldTypes map[string]object.Type
+
+	// counters holds the state of the `counter`, `increment`, and
+	// `windowCount` functions, if the host application provided it.
+	counters *Counters
+
+	// versionAware is true if strings which look like version
+	// numbers should be ordered as versions.
+	versionAware bool
+
+	// floatTolerance is the largest difference between two floats
+	// which the `==` and `!=` operators treat as equal.
+	floatTolerance float64
+
+	// strictEquality is true if values of different types, such as
+	// an integer and a float, are never equal.
+	strictEquality bool
+
+	// integralFloats is true if fields holding floats which are
+	// whole numbers should be converted to integers.
+	integralFloats bool
+
+	// stringLimit is the length, in bytes, of the longest string
+	// which a script may construct, or zero if there is no limit.
+	stringLimit int
+}
+
+// FieldHook is the signature of a function which is invoked each time a
+// script reads a field from the object it is running against.
+//
+// It receives the name of the field, and the value which it resolved
+// to - which will be null if the field was not present.  Nested fields
+// are named by their full path, such as `User.Address.City`.
+type FieldHook func(name string, value object.Object)
+
+// ErrorHook is the signature of a function which is invoked each time a
+// comparison fails, and is treated as false, see SetErrorsAsFalse.
+type ErrorHook func(err error)
+
+// Coercion is the signature of a function which converts a value, of a
+// type registered via SetCoercion, to an object.
+type Coercion func(val interface{}) object.Object
+
+// Param describes a parameter of a function which is added via
+// SetFunctionWithParams.
+type Param struct {
+	// Name holds the name of the parameter, which is used when
+	// reporting that it is missing.
+	Name string
+
+	// Default holds the value which is used if the argument is
+	// omitted, or nil if the argument is required.
+	Default object.Object
+}
+
+// arity records the number of arguments which each of our default
+// functions accepts, as a minimum and a maximum.  A maximum of -1 means
+// there is no upper limit.
+//
+// This allows scripts to be checked before they are executed.
+var arity = map[string][2]int{
+	"ago":           {1, 1},
+	"all":           {2, 2},
+	"any":           {2, 2},
+	"anyMatch":      {2, 3},
+	"append":        {1, -1},
+	"approxEqual":   {3, 3},
+	"assert":        {1, 2},
+	"avg":           {1, 2},
+	"base64decode":  {1, 1},
+	"base64encode":  {1, 1},
+	"capitalize":    {1, 1},
+	"ceil":          {1, 2},
+	"chunk":         {2, 2},
+	"clamp":         {3, 3},
+	"coerceLike":    {2, 2},
+	"count":         {1, 1},
+	"counter":       {1, 1},
+	"csvField":      {2, 2},
+	"csvFields":     {1, 1},
+	"day":           {1, 1},
+	"difference":    {2, 2},
+	"duration":      {1, 1},
+	"filter":        {2, 2},
+	"first":         {1, 1},
+	"flatten":       {1, 1},
+	"float":         {1, 1},
+	"floor":         {1, 2},
+	"formatDate":    {1, 2},
+	"formatNumber":  {1, 2},
+	"fromJSON":      {1, 1},
+	"hour":          {1, 1},
+	"inCIDR":        {2, 2},
+	"increment":     {1, 2},
+	"indexOf":       {2, 2},
+	"int":           {1, 1},
+	"intersection":  {2, 2},
+	"ipVersion":     {1, 1},
+	"joinNonNull":   {1, -1},
+	"jsonpath":      {2, 2},
+	"last":          {1, 1},
+	"lastIndexOf":   {2, 2},
+	"len":           {1, 1},
+	"lower":         {1, 1},
+	"map":           {2, 2},
+	"mapIndexed":    {2, 2},
+	"match":         {2, 2},
+	"matchGroups":   {2, 2},
+	"matchNamed":    {2, 2},
+	"matchesAll":    {2, 2},
+	"matchesAny":    {2, 2},
+	"maxBy":         {2, 2},
+	"md5":           {1, 1},
+	"merge":         {1, -1},
+	"minBy":         {2, 2},
+	"minute":        {1, 1},
+	"month":         {1, 1},
+	"now":           {0, 0},
+	"num":           {2, 2},
+	"padLeft":       {2, 3},
+	"padRight":      {2, 3},
+	"pluck":         {2, 3},
+	"print":         {0, -1},
+	"printf":        {1, -1},
+	"push":          {2, 2},
+	"random":        {0, 0},
+	"randomInt":     {1, 1},
+	"range":         {1, 3},
+	"repeat":        {2, 2},
+	"replaceRegex":  {3, 3},
+	"reverse":       {1, 2},
+	"round":         {1, 2},
+	"seconds":       {1, 1},
+	"semverCompare": {2, 2},
+	"sha1":          {1, 1},
+	"sha256":        {1, 1},
+	"skip":          {2, 2},
+	"sort":          {1, 2},
+	"split":         {2, 2},
+	"sprintf":       {1, -1},
+	"startOfDay":    {1, 1},
+	"string":        {1, 1},
+	"substring":     {2, 3},
+	"sum":           {1, 2},
+	"take":          {2, 2},
+	"time":          {0, 0},
+	"title":         {1, 1},
+	"toArray":       {1, 1},
+	"toJSON":        {1, 1},
+	"today":         {0, 0},
+	"trim":          {1, 1},
+	"type":          {1, 1},
+	"union":         {2, 2},
+	"unique":        {1, 1},
+	"upper":         {1, 1},
+	"urlHost":       {1, 1},
+	"urlPath":       {1, 1},
+	"urlQuery":      {1, 1},
+	"urlScheme":     {1, 1},
+	"uuid":          {0, 0},
+	"weekday":       {1, 1},
+	"windowCount":   {2, 3},
+	"year":          {1, 1},
+	"zip":           {2, 2},
+	"zipWith":       {3, 3},
 }
 
 // New creates a new environment, which is used for storing variable
@@ -61,26 +288,103 @@ func New() *Environment {
 	functions := make(map[string]interface{})
 
 	// Create the environment object.
-	env := &Environment{global: global, functions: functions}
+	env := &Environment{global: global,
+		functions:  functions,
+		params:     make(map[string][2]int),
+		coercions:  make(map[reflect.Type]Coercion),
+		fieldTypes: make(map[string]object.Type),
+		hostAccess: make(map[string]bool),
+		random:     make(map[string]bool),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		output:     os.Stdout}
 
 	// Now register our default functions.
+	env.SetFunction("all", env.fnAll)
+	env.SetFunction("any", env.fnAny)
+	env.SetFunction("anyMatch", env.fnAnyMatch)
+	env.SetFunction("append", fnAppend)
+	env.SetFunction("approxEqual", fnApproxEqual)
+	env.SetFunction("assert", fnAssert)
+	env.SetFunction("avg", fnAvg)
+	env.SetFunction("base64decode", env.limitLength("base64decode", fnBase64Decode))
+	env.SetFunction("base64encode", env.limitLength("base64encode", fnBase64Encode))
+	env.SetFunction("capitalize", env.limitLength("capitalize", fnCapitalize))
+	env.SetFunction("ceil", fnCeil)
+	env.SetFunction("chunk", fnChunk)
+	env.SetFunction("clamp", fnClamp)
+	env.SetFunction("coerceLike", fnCoerceLike)
+	env.SetFunction("count", fnCount)
+	env.SetFunction("csvField", env.limitLength("csvField", fnCSVField))
+	env.SetFunction("csvFields", fnCSVFields)
+	env.SetFunction("difference", env.fnDifference)
+	env.SetFunction("duration", fnDuration)
+	env.SetFunction("filter", env.fnFilter)
+	env.SetFunction("first", fnFirst)
+	env.SetFunction("flatten", fnFlatten)
 	env.SetFunction("float", fnFloat)
+	env.SetFunction("floor", fnFloor)
+	env.SetFunction("formatDate", env.limitLength("formatDate", fnFormatDate))
+	env.SetFunction("formatNumber", env.limitLength("formatNumber", env.fnFormatNumber))
+	env.SetFunction("fromJSON", fnFromJSON)
+	env.SetFunction("inCIDR", fnInCIDR)
+	env.SetFunction("indexOf", env.fnIndexOf)
 	env.SetFunction("int", fnInt)
+	env.SetFunction("intersection", env.fnIntersection)
+	env.SetFunction("ipVersion", fnIPVersion)
+	env.SetFunction("joinNonNull", env.limitLength("joinNonNull", env.fnJoinNonNull))
+	env.SetFunction("jsonpath", fnJSONPath)
+	env.SetFunction("last", fnLast)
+	env.SetFunction("lastIndexOf", env.fnLastIndexOf)
 	env.SetFunction("len", fnLen)
-	env.SetFunction("lower", fnLower)
+	env.SetFunction("lower", env.limitLength("lower", fnLower))
+	env.SetFunction("map", env.fnMap)
+	env.SetFunction("mapIndexed", env.fnMapIndexed)
 	env.SetFunction("match", fnMatch)
-	env.SetFunction("now", fnNow)
-	env.SetFunction("print", fnPrint)
-	env.SetFunction("printf", fnPrintf)
-	env.SetFunction("sort", fnSort)
+	env.SetFunction("matchGroups", fnMatchGroups)
+	env.SetFunction("matchNamed", fnMatchNamed)
+	env.SetFunction("matchesAll", fnMatchesAll)
+	env.SetFunction("matchesAny", fnMatchesAny)
+	env.SetFunction("maxBy", env.fnMaxBy)
+	env.SetFunction("md5", env.limitLength("md5", fnMD5))
+	env.SetFunction("merge", fnMerge)
+	env.SetFunction("minBy", env.fnMinBy)
+	env.SetFunction("num", fnNum)
+	env.SetFunction("padLeft", env.limitLength("padLeft", env.fnPadLeft))
+	env.SetFunction("padRight", env.limitLength("padRight", env.fnPadRight))
+	env.SetFunction("pluck", fnPluck)
+	env.SetFunction("print", env.fnPrint)
+	env.SetFunction("printf", env.fnPrintf)
+	env.SetFunction("push", fnPush)
+	env.SetFunction("range", fnRange)
+	env.SetFunction("repeat", env.limitLength("repeat", env.fnRepeat))
+	env.SetFunction("replaceRegex", env.limitLength("replaceRegex", env.fnReplaceRegex))
+	env.SetFunction("reverse", env.fnReverse)
+	env.SetFunction("round", fnRound)
+	env.SetFunction("semverCompare", fnSemverCompare)
+	env.SetFunction("sha1", env.limitLength("sha1", fnSHA1))
+	env.SetFunction("sha256", env.limitLength("sha256", fnSHA256))
+	env.SetFunction("skip", fnSkip)
+	env.SetFunction("sort", env.fnSort)
 	env.SetFunction("split", fnSplit)
-	env.SetFunction("reverse", fnReverse)
-	env.SetFunction("sprintf", fnSprintf)
-	env.SetFunction("string", fnString)
-	env.SetFunction("time", fnNow)
-	env.SetFunction("trim", fnTrim)
-	env.SetFunction("type", fnType)
-	env.SetFunction("upper", fnUpper)
+	env.SetFunction("sprintf", env.limitLength("sprintf", env.fnSprintf))
+	env.SetFunction("string", env.limitLength("string", fnString))
+	env.SetFunction("substring", env.limitLength("substring", fnSubstring))
+	env.SetFunction("sum", fnSum)
+	env.SetFunction("take", fnTake)
+	env.SetFunction("title", env.limitLength("title", fnTitle))
+	env.SetFunction("toArray", fnToArray)
+	env.SetFunction("toJSON", env.limitLength("toJSON", fnToJSON))
+	env.SetFunction("trim", env.limitLength("trim", fnTrim))
+	env.SetFunction("type", env.limitLength("type", fnType))
+	env.SetFunction("union", env.fnUnion)
+	env.SetFunction("unique", env.fnUnique)
+	env.SetFunction("upper", env.limitLength("upper", fnUpper))
+	env.SetFunction("urlHost", env.limitLength("urlHost", fnURLHost))
+	env.SetFunction("urlPath", env.limitLength("urlPath", fnURLPath))
+	env.SetFunction("urlQuery", env.limitLength("urlQuery", fnURLQuery))
+	env.SetFunction("urlScheme", env.limitLength("urlScheme", fnURLScheme))
+	env.SetFunction("zip", fnZip)
+	env.SetFunction("zipWith", env.fnZipWith)
 
 	//
 	// These all refer to time.Time fields.
@@ -102,7 +406,41 @@ func New() *Environment {
 	env.SetFunction("year", fnYear)
 
 	// "Saturday", "Sunday", etc.
-	env.SetFunction("weekday", fnWeekday)
+	env.SetFunction("weekday", env.limitLength("weekday", fnWeekday))
+
+	// Midnight.
+	env.SetFunction("startOfDay", fnStartOfDay)
+
+	//
+	// These functions access the host, so they are
+	// disabled in sandbox mode.
+	//
+	env.setHostFunction("ago", fnAgo)
+	env.setHostFunction("now", fnNow)
+	env.setHostFunction("time", fnNow)
+	env.setHostFunction("today", fnToday)
+
+	//
+	// These functions are non-deterministic, so they are
+	// disabled in sandbox mode unless a seed has been set.
+	//
+	env.setRandomFunction("random", env.fnRandom)
+	env.setRandomFunction("randomInt", env.fnRandomInt)
+	env.setRandomFunction("uuid", env.limitLength("uuid", env.fnUUID))
+
+	//
+	// These functions are stateful, and require the host
+	// to provide a store, via SetCounters.
+	//
+	env.SetFunction("counter", env.fnCounter)
+	env.SetFunction("increment", env.fnIncrement)
+	env.SetFunction("windowCount", env.fnWindowCount)
+
+	// Record the names of our default functions.
+	env.builtins = make(map[string]bool)
+	for name := range env.functions {
+		env.builtins[name] = true
+	}
 
 	// All done.
 	return env
@@ -182,6 +520,132 @@ func (e *Environment) Set(name string, val object.Object) object.Object {
 	return val
 }
 
+// Has returns true if a variable with the given name has been set.
+func (e *Environment) Has(name string) bool {
+	_, ok := e.Get(name)
+	return ok
+}
+
+// Delete removes a global variable, by name.
+//
+// Deleting a variable which doesn't exist is not an error.
+func (e *Environment) Delete(name string) {
+	delete(e.global, name)
+}
+
+// SetString stores a string variable, by name.
+func (e *Environment) SetString(name string, val string) {
+	e.Set(name, &object.String{Value: val})
+}
+
+// SetInt stores an integer variable, by name.
+func (e *Environment) SetInt(name string, val int64) {
+	e.Set(name, &object.Integer{Value: val})
+}
+
+// SetFloat stores a floating-point variable, by name.
+func (e *Environment) SetFloat(name string, val float64) {
+	e.Set(name, &object.Float{Value: val})
+}
+
+// SetBool stores a boolean variable, by name.
+func (e *Environment) SetBool(name string, val bool) {
+	e.Set(name, &object.Boolean{Value: val})
+}
+
+// SetArray stores an array variable, by name.
+//
+// The elements are copied, so later changes to the given slice are
+// not visible to scripts.
+func (e *Environment) SetArray(name string, val []object.Object) {
+	elements := make([]object.Object, len(val))
+	copy(elements, val)
+	e.Set(name, &object.Array{Elements: elements})
+}
+
+// GetString returns the value of a string variable, by name.
+//
+// The second return value is false if the variable doesn't exist, or
+// isn't a string.
+func (e *Environment) GetString(name string) (string, bool) {
+	obj, ok := e.Get(name)
+	if !ok {
+		return "", false
+	}
+	str, ok := obj.(*object.String)
+	if !ok {
+		return "", false
+	}
+	return str.Value, true
+}
+
+// GetInt returns the value of an integer variable, by name.
+//
+// The second return value is false if the variable doesn't exist, or
+// isn't an integer.
+func (e *Environment) GetInt(name string) (int64, bool) {
+	obj, ok := e.Get(name)
+	if !ok {
+		return 0, false
+	}
+	i, ok := obj.(*object.Integer)
+	if !ok {
+		return 0, false
+	}
+	return i.Value, true
+}
+
+// GetFloat returns the value of a numeric variable, by name.
+//
+// Integers are converted to floats, as they are when used in scripts.
+// The second return value is false if the variable doesn't exist, or
+// isn't a number.
+func (e *Environment) GetFloat(name string) (float64, bool) {
+	obj, ok := e.Get(name)
+	if !ok {
+		return 0, false
+	}
+	switch n := obj.(type) {
+	case *object.Float:
+		return n.Value, true
+	case *object.Integer:
+		return float64(n.Value), true
+	}
+	return 0, false
+}
+
+// GetBool returns the value of a boolean variable, by name.
+//
+// The second return value is false if the variable doesn't exist, or
+// isn't a boolean.
+func (e *Environment) GetBool(name string) (bool, bool) {
+	obj, ok := e.Get(name)
+	if !ok {
+		return false, false
+	}
+	b, ok := obj.(*object.Boolean)
+	if !ok {
+		return false, false
+	}
+	return b.Value, true
+}
+
+// GetArray returns the elements of an array variable, by name.
+//
+// The second return value is false if the variable doesn't exist, or
+// isn't an array.
+func (e *Environment) GetArray(name string) ([]object.Object, bool) {
+	obj, ok := e.Get(name)
+	if !ok {
+		return nil, false
+	}
+	arr, ok := obj.(*object.Array)
+	if !ok {
+		return nil, false
+	}
+	return arr.Elements, true
+}
+
 // AddScope sets up storage for a new scope, which can store an arbitrary
 // number of local variables, these will be mass-discarded in the future
 // via `RemoveScope`.
@@ -212,6 +676,25 @@ func (e *Environment) RemoveScope() error {
 	return fmt.Errorf("attempt to RemoveScope when no scopes are present")
 }
 
+// EnterFunction hides any locally-scoped variables, and adds a new scope,
+// for use by a function which is being invoked.  This ensures that the
+// function cannot see the local variables of its caller.
+//
+// The returned function must be called when the function returns, and
+// restores the scopes which were present beforehand - even if some were
+// not removed because the function returned from within a loop.
+func (e *Environment) EnterFunction() func() {
+
+	saved := e.local
+
+	e.local = nil
+	e.AddScope()
+
+	return func() {
+		e.local = saved
+	}
+}
+
 // SetLocal stores the value of a variable, by name, but only for the local scope.
 func (e *Environment) SetLocal(name string, val object.Object) object.Object {
 
@@ -227,14 +710,451 @@ func (e *Environment) SetLocal(name string, val object.Object) object.Object {
 // environment.
 func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
 	e.functions[name] = fun
+	delete(e.builtins, name)
+	delete(e.params, name)
 	return fun
 }
 
+// SetFunctionWithParams makes a (golang) function available to the
+// scripting environment, along with a description of its parameters.
+//
+// Trailing arguments which have a default value may be omitted by the
+// caller, and the defaults are filled in before the function is invoked,
+// so it always receives one argument for each parameter.  Omitting a
+// required argument, or passing too many, is an error.
+//
+// Required parameters must precede those which have defaults.
+func (e *Environment) SetFunctionWithParams(name string, params []Param, fun func(args []object.Object) object.Object) error {
+
+	required := 0
+	for i, p := range params {
+		if p.Default == nil {
+			if i != required {
+				return fmt.Errorf("%s: required parameter %s follows a parameter with a default", name, p.Name)
+			}
+			required++
+		}
+	}
+
+	wrapper := func(args []object.Object) object.Object {
+
+		if len(args) > len(params) {
+			return &object.Error{Message: fmt.Sprintf("%s: wrong number of arguments", name)}
+		}
+		if len(args) < required {
+			return &object.Error{Message: fmt.Sprintf("%s: missing argument %s", name, params[len(args)].Name)}
+		}
+
+		// Fill in any defaults, without modifying our caller's slice.
+		full := make([]object.Object, len(params))
+		copy(full, args)
+		for i := len(args); i < len(params); i++ {
+			full[i] = object.Copy(params[i].Default)
+		}
+		return fun(full)
+	}
+
+	e.SetFunction(name, wrapper)
+	e.params[name] = [2]int{required, len(params)}
+	return nil
+}
+
 // GetFunction allows a function to be retrieved, by name.
 //
 // Functions retrieved are only those which have been previously added
 // via `SetFunction`.
+//
+// If the environment is sandboxed, and the function accesses the host,
+// then a stub is returned which will raise an error when invoked.  The
+// same is true of functions returning random values, unless a seed has
+// been set.
 func (e *Environment) GetFunction(name string) (interface{}, bool) {
 	fun, ok := e.functions[name]
+	if ok && e.sandboxed && e.hostAccess[name] {
+		return sandboxStub(name), true
+	}
+	if ok && e.sandboxed && e.random[name] && !e.seeded {
+		return sandboxStub(name), true
+	}
 	return fun, ok
 }
+
+// Arity returns the minimum, and maximum, number of arguments which the
+// named function accepts.  A maximum of -1 means there is no limit.
+//
+// This is only known for our default functions, and those which were
+// added via SetFunctionWithParams, so ok will be false for functions which
+// were otherwise added, or replaced, by the host application.
+func (e *Environment) Arity(name string) (min int, max int, ok bool) {
+	if p, ok := e.params[name]; ok {
+		return p[0], p[1], true
+	}
+	if !e.builtins[name] {
+		return 0, 0, false
+	}
+	a, ok := arity[name]
+	return a[0], a[1], ok
+}
+
+// setHostFunction registers a function which accesses the host
+// system, and which will be disabled in sandbox mode.
+func (e *Environment) setHostFunction(name string, fun interface{}) interface{} {
+	e.hostAccess[name] = true
+	return e.SetFunction(name, fun)
+}
+
+// setRandomFunction registers a function which returns random values,
+// and which will be disabled in sandbox mode unless a seed is set.
+func (e *Environment) setRandomFunction(name string, fun interface{}) interface{} {
+	e.random[name] = true
+	return e.SetFunction(name, fun)
+}
+
+// SetRandSeed seeds the random-number generator used by the `random`,
+// `randomInt`, and `uuid` functions, which makes their output
+// reproducible.
+//
+// Setting a seed also allows those functions to be used in sandbox mode.
+func (e *Environment) SetRandSeed(seed int64) {
+	e.rand = rand.New(rand.NewSource(seed))
+	e.seeded = true
+}
+
+// SetSandboxed enables, or disables, sandbox mode.
+//
+// When sandbox mode is enabled functions which can access the host
+// system, such as `now`, will raise an error if they are called by a
+// script.  This is useful when running untrusted user-supplied scripts.
+//
+// Sandbox mode is disabled by default.
+func (e *Environment) SetSandboxed(val bool) {
+	e.sandboxed = val
+}
+
+// SetVersionAware enables, or disables, version-aware comparisons.
+//
+// When enabled the relational operators, `<`, `<=`, `>`, and `>=`,
+// compare strings which both look like version numbers, such as
+// "1.10.2", component by component rather than character by character.
+//
+// Version-aware comparisons are disabled by default.
+func (e *Environment) SetVersionAware(val bool) {
+	e.versionAware = val
+}
+
+// VersionAware returns true if version-aware comparisons are enabled.
+func (e *Environment) VersionAware() bool {
+	return e.versionAware
+}
+
+// SetFloatTolerance sets the tolerance used when two floating-point
+// numbers are compared for equality, see Equal.  Two floats which differ
+// by no more than the tolerance are considered to be equal.
+//
+// The tolerance only applies when both operands are floats, comparisons
+// involving integers, or strings, are always exact.  The default of zero
+// means that floats are compared exactly too.
+func (e *Environment) SetFloatTolerance(epsilon float64) {
+	e.floatTolerance = epsilon
+}
+
+// FloatTolerance returns the tolerance used when comparing floats.
+func (e *Environment) FloatTolerance() float64 {
+	return e.floatTolerance
+}
+
+// SetStrictStringEquality enables, or disables, strict equality, see
+// Equal.
+//
+// When enabled numbers, strings, and booleans are only equal to values
+// of the same type, nothing is converted before it is compared.  So
+// `1 == 1.0` is false, and `"7" == 7` is false rather than an error.
+// The relational operators, such as `<`, are not affected, and still
+// compare integers and floats by value.
+//
+// Strict equality is disabled by default.
+func (e *Environment) SetStrictStringEquality(val bool) {
+	e.strictEquality = val
+}
+
+// StrictStringEquality returns true if strict equality is enabled.
+func (e *Environment) StrictStringEquality() bool {
+	return e.strictEquality
+}
+
+// SetIntegralFloats enables, or disables, the conversion of floats which
+// are whole numbers, such as `12345.0`, to integers when the fields of
+// the object a script is running against are read.
+//
+// This is useful when objects have been decoded from JSON, via
+// json.Unmarshal, as all of the numbers they contain are floats - even
+// those which are clearly integers, such as identifiers and counts.
+// Floats which have a fractional part, or which are too large to be held
+// in an integer, are unchanged.  The conversion is disabled by default.
+func (e *Environment) SetIntegralFloats(val bool) {
+	e.integralFloats = val
+}
+
+// IntegralFloats returns true if floats which are whole numbers should
+// be converted to integers, see SetIntegralFloats.
+func (e *Environment) IntegralFloats() bool {
+	return e.integralFloats
+}
+
+// SetMaxStringLength sets the length, in bytes, of the longest string
+// which a script may construct, by concatenation or via functions such
+// as `repeat` and `sprintf`.  Attempting to construct a longer string is
+// an error.
+//
+// This prevents an untrusted script from exhausting the memory of its
+// host.  A limit of zero, or less, means there is no limit, which is the
+// default - with one deliberate exception: the functions which can build
+// strings far longer than their arguments, such as `repeat`, `padLeft`,
+// and `sprintf`, refuse to build strings of more than 16MB unless a limit
+// has been set, in which case that limit applies to them instead, even
+// if it is larger.
+func (e *Environment) SetMaxStringLength(n int) {
+	if n < 0 {
+		n = 0
+	}
+	e.stringLimit = n
+}
+
+// MaxStringLength returns the length of the longest string which a script
+// may construct, or zero if there is no limit, see SetMaxStringLength.
+func (e *Environment) MaxStringLength() int {
+	return e.stringLimit
+}
+
+// maxLength returns the length of the longest string which our functions
+// may construct, which is the limit set via SetMaxStringLength, if any,
+// or maxStringLength otherwise.
+//
+// Functions which can construct strings much longer than their arguments,
+// such as `repeat`, compare the projected length of their result against
+// this before constructing it.
+func (e *Environment) maxLength() int {
+	if e.stringLimit > 0 {
+		return e.stringLimit
+	}
+	return maxStringLength
+}
+
+// limitLength wraps the given function, which returns strings, so that
+// it fails if the string it returns is longer than the limit set via
+// SetMaxStringLength.
+//
+// As the result has already been constructed this only suits functions
+// whose results are no more than a small multiple of the size of their
+// arguments, others must check the limit themselves, via maxLength.
+func (e *Environment) limitLength(name string, fun func(args []object.Object) object.Object) func(args []object.Object) object.Object {
+	return func(args []object.Object) object.Object {
+		out := fun(args)
+		if str, ok := out.(*object.String); ok && e.stringLimit > 0 && len(str.Value) > e.stringLimit {
+			return tooLong(name, e.stringLimit)
+		}
+		return out
+	}
+}
+
+// tooLong returns the error given when the named function would return a
+// string longer than limit.
+func tooLong(name string, limit int) object.Object {
+	return &object.Error{Message: fmt.Sprintf("%s: the result is longer than the maximum string length of %d", name, limit)}
+}
+
+// Sandboxed returns true if the environment is running in sandbox mode.
+func (e *Environment) Sandboxed() bool {
+	return e.sandboxed
+}
+
+// SetOutput changes the destination of the output generated by the
+// `print` and `printf` functions, which is STDOUT by default.
+func (e *Environment) SetOutput(w io.Writer) {
+	e.output = w
+}
+
+// Output returns the destination of the output generated by the `print`
+// and `printf` functions.
+func (e *Environment) Output() io.Writer {
+	return e.output
+}
+
+// SetFieldHook registers a function which will be invoked each time a
+// script reads a field from the object it is running against.
+//
+// Passing nil removes any previously registered function.
+func (e *Environment) SetFieldHook(hook FieldHook) {
+	e.fieldHook = hook
+}
+
+// FieldHook returns the function which is invoked each time a script
+// reads a field, or nil if there is none.
+func (e *Environment) FieldHook() FieldHook {
+	return e.fieldHook
+}
+
+// SetErrorsAsFalse enables, or disables, the treatment of comparisons
+// which fail as being false.
+//
+// By default a comparison which can't be made, such as `"abc" > 3`,
+// aborts the script with an error.  When this is enabled the result of
+// such a comparison is false instead, so that a single malformed field
+// doesn't prevent a whole collection of objects from being filtered.
+// Other errors, such as calling an unknown function, still abort the
+// script.
+func (e *Environment) SetErrorsAsFalse(val bool) {
+	e.errorsAsFalse = val
+}
+
+// ErrorsAsFalse returns true if comparisons which fail are treated as
+// being false.
+func (e *Environment) ErrorsAsFalse() bool {
+	return e.errorsAsFalse
+}
+
+// SetErrorHook registers a function which will be invoked with the error
+// of each comparison which is treated as false, allowing them to be
+// logged.
+//
+// Passing nil removes any previously registered function.
+func (e *Environment) SetErrorHook(hook ErrorHook) {
+	e.errorHook = hook
+}
+
+// ErrorHook returns the function which is invoked each time a comparison
+// is treated as false, or nil if there is none.
+func (e *Environment) ErrorHook() ErrorHook {
+	return e.errorHook
+}
+
+// SetFieldType declares the type of the named field of the objects which
+// scripts are run against.
+//
+// When a script reads the field its value is converted to the given type,
+// which must be a string, integer, float, or boolean, via Convert.  This
+// ensures that comparisons behave in the same way, whether the value was
+// provided as a string or as a number.  If the value can't be converted
+// the script aborts with an error, or if SetErrorsAsFalse is enabled the
+// value becomes null.  Missing, and null, fields remain null.
+//
+// Passing an empty type removes the declaration.
+func (e *Environment) SetFieldType(name string, typ object.Type) error {
+
+	switch typ {
+	case "":
+		delete(e.fieldTypes, name)
+	case object.STRING, object.INTEGER, object.FLOAT, object.BOOLEAN:
+		e.fieldTypes[name] = typ
+	default:
+		return fmt.Errorf("unsupported type %s for field %s", typ, name)
+	}
+	return nil
+}
+
+// FieldType returns the type which was declared, via SetFieldType, for the
+// named field, if any.
+func (e *Environment) FieldType(name string) (object.Type, bool) {
+	if len(e.fieldTypes) == 0 {
+		return "", false
+	}
+	typ, ok := e.fieldTypes[name]
+	return typ, ok
+}
+
+// SetCounters sets the store used by the `counter`, `increment`, and
+// `windowCount` functions, which allow scripts to maintain state across
+// the objects they're run against.
+//
+// The store is shared, rather than copied, by Clone.  Passing nil, which
+// is the default, causes those functions to raise an error.
+func (e *Environment) SetCounters(c *Counters) {
+	e.counters = c
+}
+
+// Counters returns the store used by the `counter`, `increment`, and
+// `windowCount` functions, or nil if there is none.
+func (e *Environment) Counters() *Counters {
+	return e.counters
+}
+
+// SetCoercion registers a function which converts values of the given
+// golang type to objects, when they're found in the object a script is
+// running against.
+//
+// This allows types which aren't otherwise supported, such as
+// `sql.NullInt64`, or which would otherwise be converted as strings or
+// hashes, to be used naturally by scripts.  The function is consulted
+// before any other conversion, and passing nil removes it.
+func (e *Environment) SetCoercion(typ reflect.Type, fn Coercion) {
+	if fn == nil {
+		delete(e.coercions, typ)
+		return
+	}
+	e.coercions[typ] = fn
+}
+
+// Coercion returns the function registered, via SetCoercion, for the
+// given type, if any.
+func (e *Environment) Coercion(typ reflect.Type) (Coercion, bool) {
+	if len(e.coercions) == 0 {
+		return nil, false
+	}
+	fn, ok := e.coercions[typ]
+	return fn, ok
+}
+
+// Clone returns a copy of the environment, which may be used independently
+// of the original - for example from a different goroutine.
+//
+// Variables are copied, as are any functions which were added by the
+// host-application.  The clone has its own random-number generator,
+// which is seeded from ours.
+func (e *Environment) Clone() *Environment {
+
+	c := New()
+	c.sandboxed = e.sandboxed
+	c.seeded = e.seeded
+	c.output = e.output
+	c.fieldHook = e.fieldHook
+	c.errorsAsFalse = e.errorsAsFalse
+	c.errorHook = e.errorHook
+	for typ, fn := range e.coercions {
+		c.coercions[typ] = fn
+	}
+	for name, typ := range e.fieldTypes {
+		c.fieldTypes[name] = typ
+	}
+	c.counters = e.counters
+	c.versionAware = e.versionAware
+	c.floatTolerance = e.floatTolerance
+	c.strictEquality = e.strictEquality
+	c.integralFloats = e.integralFloats
+	c.stringLimit = e.stringLimit
+	c.rand = rand.New(rand.NewSource(e.rand.Int63()))
+
+	for name, val := range e.global {
+		c.global[name] = object.Copy(val)
+	}
+
+	// Our default functions are bound to the new environment
+	// already, so only copy those which were added.
+	for name, fun := range e.functions {
+		if !e.builtins[name] {
+			c.SetFunction(name, fun)
+		}
+	}
+	for name, p := range e.params {
+		c.params[name] = p
+	}
+
+	return c
+}
+
+// sandboxStub returns a function which will raise an error when invoked,
+// this is used in place of functions disabled in sandbox mode.
+func sandboxStub(name string) func(args []object.Object) object.Object {
+	return func(args []object.Object) object.Object {
+		return &object.Error{Message: fmt.Sprintf("the function %s is disabled in sandbox mode", name)}
+	}
+}
@@ -1,6 +1,7 @@
 package environment
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/skx/evalfilter/v2/object"
@@ -56,3 +57,370 @@ func TestMissingSet(t *testing.T) {
 		t.Errorf("lookup of a missing value worked, bogus.")
 	}
 }
+
+func TestSandbox(t *testing.T) {
+
+	env := New()
+
+	if env.Sandboxed() {
+		t.Errorf("sandbox mode should be disabled by default")
+	}
+
+	// Host-access functions work normally.
+	fn, ok := env.GetFunction("now")
+	if !ok {
+		t.Fatalf("Failed to get function now")
+	}
+	out := fn.(func(args []object.Object) object.Object)(nil)
+	if out.Type() != object.INTEGER {
+		t.Errorf("now() returned %s", out.Type())
+	}
+
+	// But are stubbed in sandbox-mode
+	env.SetSandboxed(true)
+	for _, name := range []string{"ago", "now", "time", "today"} {
+		fn, ok = env.GetFunction(name)
+		if !ok {
+			t.Fatalf("Failed to get function %s", name)
+		}
+		out = fn.(func(args []object.Object) object.Object)(nil)
+		if out.Type() != object.ERROR {
+			t.Errorf("%s() returned %s in sandbox mode", name, out.Type())
+		}
+	}
+
+	// Other functions are unaffected.
+	fn, _ = env.GetFunction("len")
+	out = fn.(func(args []object.Object) object.Object)([]object.Object{&object.String{Value: "steve"}})
+	if out.Type() != object.INTEGER {
+		t.Errorf("len() returned %s in sandbox mode", out.Type())
+	}
+}
+
+func TestSandboxRandom(t *testing.T) {
+
+	env := New()
+	env.SetSandboxed(true)
+
+	// Random functions are stubbed in sandbox-mode
+	for _, name := range []string{"random", "uuid"} {
+		fn, ok := env.GetFunction(name)
+		if !ok {
+			t.Fatalf("Failed to get function %s", name)
+		}
+		out := fn.(func(args []object.Object) object.Object)(nil)
+		if out.Type() != object.ERROR {
+			t.Errorf("%s() returned %s in sandbox mode", name, out.Type())
+		}
+	}
+
+	// Unless a seed has been set.
+	env.SetRandSeed(3)
+	for _, name := range []string{"random", "uuid"} {
+		fn, ok := env.GetFunction(name)
+		if !ok {
+			t.Fatalf("Failed to get function %s", name)
+		}
+		out := fn.(func(args []object.Object) object.Object)(nil)
+		if out.Type() == object.ERROR {
+			t.Errorf("%s() returned an error in sandbox mode, with a seed: %s", name, out.Inspect())
+		}
+	}
+}
+
+// TestArity ensures the argument-counts of our functions are known.
+func TestArity(t *testing.T) {
+
+	e := New()
+
+	// Every default function should have a known arity.
+	for name := range e.functions {
+		min, max, ok := e.Arity(name)
+		if !ok {
+			t.Fatalf("no arity for function %s", name)
+		}
+		if max != -1 && max < min {
+			t.Fatalf("bogus arity for function %s: %d-%d", name, min, max)
+		}
+	}
+
+	min, max, ok := e.Arity("clamp")
+	if !ok || min != 3 || max != 3 {
+		t.Fatalf("unexpected arity for clamp: %d-%d %v", min, max, ok)
+	}
+
+	// Replacing a function makes its arity unknown.
+	e.SetFunction("len", func(args []object.Object) object.Object { return &object.Null{} })
+	_, _, ok = e.Arity("len")
+	if ok {
+		t.Fatalf("expected no arity for a replaced function")
+	}
+
+	_, _, ok = e.Arity("missing")
+	if ok {
+		t.Fatalf("expected no arity for a missing function")
+	}
+}
+
+func TestFunctionWithParams(t *testing.T) {
+
+	e := New()
+
+	// The function returns its arguments, so we can see the defaults.
+	echo := func(args []object.Object) object.Object {
+		return &object.Array{Elements: args}
+	}
+
+	err := e.SetFunctionWithParams("echo", []Param{
+		{Name: "x"},
+		{Name: "places", Default: &object.Integer{Value: 0}},
+		{Name: "mode", Default: &object.String{Value: "half"}},
+	}, echo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	min, max, ok := e.Arity("echo")
+	if !ok || min != 1 || max != 3 {
+		t.Fatalf("unexpected arity for echo: %d-%d %v", min, max, ok)
+	}
+
+	fn, _ := e.GetFunction("echo")
+	call := fn.(func(args []object.Object) object.Object)
+
+	tests := []struct {
+		Args   []object.Object
+		Result string
+	}{
+		{Args: []object.Object{&object.Float{Value: 3.5}}, Result: "[3.5, 0, half]"},
+		{Args: []object.Object{&object.Float{Value: 3.5}, &object.Integer{Value: 2}}, Result: "[3.5, 2, half]"},
+		{Args: []object.Object{&object.Float{Value: 3.5}, &object.Integer{Value: 2}, &object.String{Value: "up"}}, Result: "[3.5, 2, up]"},
+		{Args: []object.Object{}, Result: "echo: missing argument x"},
+		{Args: []object.Object{&object.Null{}, &object.Null{}, &object.Null{}, &object.Null{}}, Result: "echo: wrong number of arguments"},
+	}
+
+	for _, test := range tests {
+		out := call(test.Args)
+		if out.Inspect() != test.Result {
+			t.Fatalf("unexpected result for %v: %s", test.Args, out.Inspect())
+		}
+	}
+
+	// The arity is copied to clones, and forgotten if the function
+	// is replaced.
+	if _, _, ok = e.Clone().Arity("echo"); !ok {
+		t.Fatalf("expected the clone to know the arity of echo")
+	}
+	e.SetFunction("echo", echo)
+	if _, _, ok = e.Arity("echo"); ok {
+		t.Fatalf("expected no arity for a replaced function")
+	}
+
+	// Required parameters must come first.
+	err = e.SetFunctionWithParams("bogus", []Param{
+		{Name: "a", Default: &object.Integer{Value: 1}},
+		{Name: "b"},
+	}, echo)
+	if err == nil {
+		t.Fatalf("expected an error for a required parameter after a default")
+	}
+	if _, ok = e.GetFunction("bogus"); ok {
+		t.Fatalf("a function with bogus parameters was registered")
+	}
+}
+
+func TestTypedVariables(t *testing.T) {
+
+	env := New()
+
+	env.SetString("role", "admin")
+	env.SetInt("count", 3)
+	env.SetFloat("ratio", 0.5)
+	env.SetBool("enabled", true)
+
+	tags := []object.Object{&object.String{Value: "a"}, &object.String{Value: "b"}}
+	env.SetArray("tags", tags)
+	tags[0] = &object.String{Value: "changed"}
+
+	if s, ok := env.GetString("role"); !ok || s != "admin" {
+		t.Errorf("unexpected string value: %v %v", s, ok)
+	}
+	if i, ok := env.GetInt("count"); !ok || i != 3 {
+		t.Errorf("unexpected integer value: %v %v", i, ok)
+	}
+	if f, ok := env.GetFloat("ratio"); !ok || f != 0.5 {
+		t.Errorf("unexpected float value: %v %v", f, ok)
+	}
+	if f, ok := env.GetFloat("count"); !ok || f != 3 {
+		t.Errorf("integers should be readable as floats: %v %v", f, ok)
+	}
+	if b, ok := env.GetBool("enabled"); !ok || !b {
+		t.Errorf("unexpected boolean value: %v %v", b, ok)
+	}
+	if a, ok := env.GetArray("tags"); !ok || len(a) != 2 || a[0].Inspect() != "a" {
+		t.Errorf("unexpected array value: %v %v", a, ok)
+	}
+
+	// The wrong type
+	if _, ok := env.GetString("count"); ok {
+		t.Errorf("an integer was read as a string")
+	}
+	if _, ok := env.GetInt("ratio"); ok {
+		t.Errorf("a float was read as an integer")
+	}
+	if _, ok := env.GetFloat("role"); ok {
+		t.Errorf("a string was read as a float")
+	}
+	if _, ok := env.GetBool("role"); ok {
+		t.Errorf("a string was read as a boolean")
+	}
+	if _, ok := env.GetArray("role"); ok {
+		t.Errorf("a string was read as an array")
+	}
+
+	// Has and Delete
+	if !env.Has("role") {
+		t.Errorf("variable should exist")
+	}
+	env.Delete("role")
+	env.Delete("missing")
+	if env.Has("role") {
+		t.Errorf("variable should have been deleted")
+	}
+	if _, ok := env.GetString("role"); ok {
+		t.Errorf("a deleted variable was found")
+	}
+}
+
+func TestMaxStringLength(t *testing.T) {
+
+	env := New()
+	if env.MaxStringLength() != 0 {
+		t.Fatalf("expected no limit by default")
+	}
+
+	env.SetMaxStringLength(4)
+	if env.Clone().MaxStringLength() != 4 {
+		t.Fatalf("the limit wasn't copied by Clone")
+	}
+
+	fn, _ := env.GetFunction("repeat")
+	repeat := fn.(func(args []object.Object) object.Object)
+
+	out := repeat([]object.Object{&object.String{Value: "ab"}, &object.Integer{Value: 2}})
+	if out.Inspect() != "abab" {
+		t.Fatalf("unexpected result within the limit: %s", out.Inspect())
+	}
+	out = repeat([]object.Object{&object.String{Value: "ab"}, &object.Integer{Value: 3}})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error exceeding the limit, got %s", out.Inspect())
+	}
+
+	// Negative limits are the same as none.
+	env.SetMaxStringLength(-1)
+	out = repeat([]object.Object{&object.String{Value: "ab"}, &object.Integer{Value: 3}})
+	if out.Inspect() != "ababab" {
+		t.Fatalf("unexpected result without a limit: %s", out.Inspect())
+	}
+
+	// Without a limit the functions which build long strings refuse
+	// to exceed maxStringLength, but a larger limit replaces that.
+	big := []object.Object{&object.String{Value: "x"}, &object.Integer{Value: maxStringLength + 1}}
+	out = repeat(big)
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected an error exceeding the default limit")
+	}
+	env.SetMaxStringLength(maxStringLength + 1)
+	out = repeat(big)
+	if out.Type() != object.STRING || len(out.Inspect()) != maxStringLength+1 {
+		t.Fatalf("expected a larger limit to be honoured, got %s", out.Type())
+	}
+
+	// The padding functions check the length of the result before
+	// building it, counting the bytes of multi-byte padding.
+	fn, _ = env.GetFunction("padLeft")
+	pad := fn.(func(args []object.Object) object.Object)
+	env.SetMaxStringLength(10)
+	out = pad([]object.Object{&object.String{Value: "x"}, &object.Integer{Value: 5}, &object.String{Value: "€"}})
+	if out.Type() != object.ERROR {
+		t.Fatalf("expected multi-byte padding to exceed the limit, got %s", out.Inspect())
+	}
+	out = pad([]object.Object{&object.String{Value: "x"}, &object.Integer{Value: 4}, &object.String{Value: "ab"}})
+	if out.Inspect() != "abax" {
+		t.Fatalf("unexpected padding: %s", out.Inspect())
+	}
+}
+
+// TestMaxStringLengthFunctions tests that every function which returns a
+// string respects the configured limit.
+func TestMaxStringLengthFunctions(t *testing.T) {
+
+	str := func(s string) object.Object { return &object.String{Value: s} }
+	num := func(n int64) object.Object { return &object.Integer{Value: n} }
+	arr := func(n int64) object.Object {
+		a := &object.Array{}
+		for i := int64(1); i <= n; i++ {
+			a.Elements = append(a.Elements, num(i))
+		}
+		return a
+	}
+
+	tests := []struct {
+		Name string
+		Args []object.Object
+	}{
+		{Name: "base64decode", Args: []object.Object{str("aGVsbG8=")}},
+		{Name: "base64encode", Args: []object.Object{str("hello")}},
+		{Name: "capitalize", Args: []object.Object{str("hello")}},
+		{Name: "csvField", Args: []object.Object{str("hello,x"), num(0)}},
+		{Name: "formatDate", Args: []object.Object{num(0), str("2006-01-02")}},
+		{Name: "formatNumber", Args: []object.Object{num(12345)}},
+		{Name: "joinNonNull", Args: []object.Object{str("-"), str("ab"), str("cd")}},
+		{Name: "lower", Args: []object.Object{str("HELLO")}},
+		{Name: "md5", Args: []object.Object{str("x")}},
+		{Name: "padLeft", Args: []object.Object{str("x"), num(5)}},
+		{Name: "padRight", Args: []object.Object{str("x"), num(5)}},
+		{Name: "repeat", Args: []object.Object{str("ab"), num(3)}},
+		{Name: "replaceRegex", Args: []object.Object{str("abc"), str(""), str("xy")}},
+		{Name: "sha1", Args: []object.Object{str("x")}},
+		{Name: "sha256", Args: []object.Object{str("x")}},
+		{Name: "sprintf", Args: []object.Object{str("%5d"), num(1)}},
+		{Name: "sprintf", Args: []object.Object{str("%*d"), num(5), num(1)}},
+		{Name: "string", Args: []object.Object{arr(200)}},
+		{Name: "substring", Args: []object.Object{str("hello"), num(0)}},
+		{Name: "title", Args: []object.Object{str("hello")}},
+		{Name: "toJSON", Args: []object.Object{arr(200)}},
+		{Name: "trim", Args: []object.Object{str(" hello ")}},
+		{Name: "type", Args: []object.Object{&object.Float{Value: 1.5}}},
+		{Name: "upper", Args: []object.Object{str("hello")}},
+		{Name: "urlHost", Args: []object.Object{str("http://hello.com/")}},
+		{Name: "urlPath", Args: []object.Object{str("http://x/hello")}},
+		{Name: "urlQuery", Args: []object.Object{str("http://x/?q=hello"), str("q")}},
+		{Name: "urlScheme", Args: []object.Object{str("https://x/")}},
+		{Name: "uuid", Args: []object.Object{}},
+		{Name: "weekday", Args: []object.Object{num(0)}},
+	}
+
+	env := New()
+	for _, tst := range tests {
+
+		fn, ok := env.GetFunction(tst.Name)
+		if !ok {
+			t.Fatalf("function %s not found", tst.Name)
+		}
+		call := fn.(func(args []object.Object) object.Object)
+
+		// Without a limit the result is fine.
+		env.SetMaxStringLength(0)
+		out := call(tst.Args)
+		if out.Type() != object.STRING {
+			t.Fatalf("unexpected result from %s(%v): %s", tst.Name, tst.Args, out.Inspect())
+		}
+
+		env.SetMaxStringLength(4)
+		out = call(tst.Args)
+		if out.Type() != object.ERROR || !strings.HasPrefix(out.Inspect(), tst.Name+": the result is longer") {
+			t.Fatalf("expected %s(%v) to exceed the limit, got %s", tst.Name, tst.Args, out.Inspect())
+		}
+	}
+}
@@ -9,13 +9,17 @@ package evalfilter
 
 import (
 	"fmt"
+	"io"
+	"reflect"
 	"strings"
 
+	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/lexer"
 	"github.com/skx/evalfilter/v2/object"
 	"github.com/skx/evalfilter/v2/parser"
+	"github.com/skx/evalfilter/v2/token"
 	"github.com/skx/evalfilter/v2/vm"
 )
 
@@ -23,6 +27,12 @@ import (
 const (
 	// Don't run the optimizer when generating bytecode.
 	NoOptimize byte = iota
+
+	// Record the conditions which failed, for RunWithDiagnostics.
+	Diagnostics
+
+	// Remove calls to `assert`, so they have no runtime cost.
+	NoAssert
 )
 
 // Eval is our public-facing structure which stores our state.
@@ -33,12 +43,42 @@ type Eval struct {
 	// Environment
 	environment *environment.Environment
 
+	// program is the AST which our parser produced.
+	program *ast.Program
+
 	// constants compiled
 	constants []object.Object
 
 	// bytecode we generate
 	instructions code.Instructions
 
+	// positions of the source which generated our bytecode, keyed
+	// by instruction offset.
+	positions map[int]token.Position
+
+	// position of the node we're currently compiling.
+	position token.Position
+
+	// diagnostics is true if we should record the conditions
+	// which fail when the script is executed.
+	diagnostics bool
+
+	// noAssert is true if calls to `assert` should be removed when
+	// the script is compiled.
+	noAssert bool
+
+	// explain is true if we're compiling the script to record an
+	// explanation of its execution, see Explain.
+	explain bool
+
+	// maxDepth is the deepest nesting the parser allows, zero
+	// means the parser's default.
+	maxDepth int
+
+	// functions holds the functions which the script defined, in
+	// the order they were defined.
+	functions []*vm.Function
+
 	// the machine we drive
 	machine *vm.VM
 }
@@ -60,11 +100,44 @@ func New(script string) *Eval {
 	return e
 }
 
+// Compile creates a new instance of the evaluator, and compiles the given
+// script, via Prepare, with any flags supplied.
+//
+// This allows a script to be validated, for example when it is submitted
+// by a user, without an object to run it against.  If the script cannot
+// be parsed then the error is a *ParseError, which lists each of the
+// problems found.  Otherwise the result may be run against any number
+// of objects.
+func Compile(script string, flags ...[]byte) (*Eval, error) {
+
+	e := New(script)
+
+	err := e.Prepare(flags...)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ParseError is the error returned when a script cannot be parsed.
+type ParseError struct {
+	// Errors holds a description of each problem which was found,
+	// prefixed by its location, such as "line 3, col 23: ...".
+	Errors []string
+}
+
+// Error returns all of the problems, one per line.
+func (p *ParseError) Error() string {
+	return "\nErrors parsing script:\n" + strings.Join(p.Errors, "\n")
+}
+
 // Prepare is the second function the caller must invoke, it compiles
 // the user-supplied program to its final-form.
 //
 // Internally this compilation process walks through the usual steps,
 // lexing, parsing, and bytecode-compilation.
+//
+// If the script cannot be parsed then the error is a *ParseError.
 func (e *Eval) Prepare(flags ...[]byte) error {
 
 	//
@@ -80,6 +153,12 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 			if val == NoOptimize {
 				optimize = false
 			}
+			if val == Diagnostics {
+				e.diagnostics = true
+			}
+			if val == NoAssert {
+				e.noAssert = true
+			}
 		}
 	}
 
@@ -92,6 +171,7 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// Create a parser using the lexer.
 	//
 	p := parser.New(l)
+	p.SetMaxDepth(e.maxDepth)
 
 	//
 	// Parse the program into an AST.
@@ -104,13 +184,25 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// If so report that.
 	//
 	if len(p.Errors()) > 0 {
-		return fmt.Errorf("\nErrors parsing script:\n" +
-			strings.Join(p.Errors(), "\n"))
+		return &ParseError{Errors: p.Errors()}
 	}
 
+	return e.build(program, optimize)
+}
+
+// build compiles the given program to bytecode, and constructs the
+// virtual machine which will execute it.
+func (e *Eval) build(program *ast.Program, optimize bool) error {
+
+	e.program = program
+
 	//
 	// Compile the program to bytecode
 	//
+	e.constants = nil
+	e.instructions = nil
+	e.positions = make(map[int]token.Position)
+	e.functions = nil
 	err := e.compile(program)
 
 	//
@@ -137,7 +229,10 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	// The optimization will happen at this step, so that it is complete
 	// before Execute/Run are invoked - and we only take the speed hit
 	// once.
-	e.machine = vm.New(e.constants, e.instructions, e.environment)
+	e.machine = vm.NewWithPositions(e.constants, e.instructions, e.positions, e.environment)
+	for _, fn := range e.functions {
+		e.machine.AddFunction(fn)
+	}
 
 	//
 	// All done; no errors.
@@ -149,10 +244,8 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 // of the constant-pool
 func (e *Eval) Dump() error {
 
-	fmt.Printf("Bytecode:\n")
-
-	// Use the walker to dump the bytecode.
-	e.machine.WalkBytecode(func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
+	// Show each instruction.
+	dump := func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
 
 		// Show the offset + instruction.
 		fmt.Printf("%04d\t%14s", offset, code.String(opCode))
@@ -171,6 +264,15 @@ func (e *Eval) Dump() error {
 		if code.Opcode(opCode) == code.OpLookup {
 			fmt.Printf("\t// lookup field/variable: %v", e.constants[opArg.(int)])
 		}
+		if code.Opcode(opCode) == code.OpExists {
+			fmt.Printf("\t// test whether field exists: %v", e.constants[opArg.(int)])
+		}
+		if code.Opcode(opCode) == code.OpCheck || code.Opcode(opCode) == code.OpCheckComparison {
+			fmt.Printf("\t// record failure of: %v", e.constants[opArg.(int)])
+		}
+		if code.Opcode(opCode) == code.OpEnter {
+			fmt.Printf("\t// explain: %v", e.constants[opArg.(int)])
+		}
 		if code.Opcode(opCode) == code.OpCall {
 			fmt.Printf("\t// call function with %d arg(s)", opArg.(int))
 		}
@@ -181,7 +283,18 @@ func (e *Eval) Dump() error {
 
 		// Keep walking, no error.
 		return true, nil
-	})
+	}
+
+	fmt.Printf("Bytecode:\n")
+
+	// Use the walker to dump the bytecode.
+	e.machine.WalkBytecode(dump)
+
+	// Show the bytecode of any functions the script defined.
+	for _, fn := range e.functions {
+		fmt.Printf("\n\nFunction %s(%s):\n", fn.Name, strings.Join(fn.Parameters, ", "))
+		e.machine.WalkFunction(fn.Name, dump)
+	}
 
 	// Show constants, if any are present.
 	if len(e.constants) > 0 {
@@ -195,6 +308,127 @@ func (e *Eval) Dump() error {
 	return nil
 }
 
+// DumpAST returns an indented, human-readable, representation of the
+// program's abstract syntax tree.
+//
+// This is useful for confirming how a script was parsed, for example to
+// check the precedence of `&&` and `||` within a complex condition.  The
+// script must have been compiled, via Prepare, first.
+func (e *Eval) DumpAST() (string, error) {
+	if e.program == nil {
+		return "", fmt.Errorf("the script has not been prepared")
+	}
+	return ast.Dump(e.program), nil
+}
+
+// Explain runs the program against the given object, returning a record
+// of every comparison which was made, and every branch which was taken,
+// along with the result.
+//
+// This is intended for working out why a particular object did, or did
+// not, match.  The script is compiled again with additional instructions
+// to record the explanation, and is run against a copy of the environment
+// so that any variables it sets are discarded.  As a result this is much
+// slower than Run, and shouldn't be used for normal filtering.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) Explain(obj interface{}) (*vm.Explanation, error) {
+	if e.program == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	env := e.environment.Clone()
+
+	// Compile with the same flags as the script was prepared with,
+	// so that the explanation matches the result of running it.
+	x := &Eval{
+		environment: env,
+		positions:   make(map[int]token.Position),
+		explain:     true,
+		diagnostics: e.diagnostics,
+		noAssert:    e.noAssert,
+	}
+
+	err := x.compile(e.program)
+	if err != nil {
+		return nil, err
+	}
+
+	machine := vm.NewWithPositions(x.constants, x.instructions, x.positions, env)
+	for _, fn := range x.functions {
+		machine.AddFunction(fn)
+	}
+
+	return machine.Explain(obj)
+}
+
+// Fields returns the names of the fields which the script references,
+// in the order they first appear, without duplicates.
+//
+// This allows a host application to fetch only the data a script needs,
+// or to validate a script against a schema, before running it.  The
+// analysis is static, so no part of the script is executed.  Names which
+// the script assigns to, or uses as loop variables, are not fields and
+// are not included, nor are the parameters of functions the script
+// defines.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) Fields() ([]string, error) {
+	if e.program == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	// Names which are variables, rather than fields.
+	variables := make(map[string]bool)
+
+	// Identifiers which don't refer to fields, such as the names of
+	// functions, and the targets of assignments.
+	skip := make(map[*ast.Identifier]bool)
+
+	// The identifiers which are read, in order.
+	var idents []*ast.Identifier
+
+	ast.Walk(e.program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.AssignStatement:
+			variables[node.Name.Value] = true
+			skip[node.Name] = true
+		case *ast.ForeachStatement:
+			variables[node.Ident] = true
+			variables[node.Index] = true
+		case *ast.PostfixExpression:
+			variables[node.Token.Literal] = true
+		case *ast.FunctionDefinition:
+			for _, name := range node.Parameters {
+				variables[name] = true
+			}
+		case *ast.CallExpression:
+			if id, ok := node.Function.(*ast.Identifier); ok {
+				skip[id] = true
+			}
+		case *ast.Identifier:
+			if !skip[node] {
+				idents = append(idents, node)
+			}
+		}
+		return true
+	})
+
+	var fields []string
+	seen := make(map[string]bool)
+
+	for _, id := range idents {
+		name := strings.TrimPrefix(id.Value, "$")
+		if variables[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		fields = append(fields, name)
+	}
+
+	return fields, nil
+}
+
 // Execute executes the program which the user passed in the constructor,
 // and returns the object that the script finished with.
 //
@@ -224,6 +458,30 @@ func (e *Eval) Execute(obj interface{}) (object.Object, error) {
 	return out, nil
 }
 
+// RunWithDiagnostics executes the program which the user passed in the
+// constructor, returning the same result as Run, along with a list of
+// the conditions which failed.
+//
+// When a script is compiled with the `Diagnostics` flag each operand of
+// an `&&` expression which is false is recorded, rather than just the
+// overall result.  This allows the script to be used for validation,
+// reporting every reason that the object failed.
+//
+// The diagnostics are only returned if the result is false.
+func (e *Eval) RunWithDiagnostics(obj interface{}) (bool, []vm.Diagnostic, error) {
+
+	if !e.diagnostics {
+		return false, nil, fmt.Errorf("the script was not prepared with the Diagnostics flag")
+	}
+
+	res, err := e.Run(obj)
+	if err != nil || res {
+		return res, nil, err
+	}
+
+	return res, e.machine.Diagnostics(), nil
+}
+
 // Run executes the program which the user passed in the constructor.
 //
 // The return value, assuming no error, is a binary/boolean result which
@@ -262,12 +520,258 @@ func (e *Eval) AddFunction(name string, fun interface{}) {
 	e.environment.SetFunction(name, fun)
 }
 
+// AddFunctionWithParams exposes a golang function from your host
+// application to the scripting environment, along with a description of
+// its parameters.
+//
+// Parameters which have a default value may be omitted by the script,
+// for example given the parameters `x` and `places`, with a default of
+// zero for the latter, `round(3.14159)` is the same as `round(3.14159, 0)`.
+// Your function always receives one argument for each parameter.
+func (e *Eval) AddFunctionWithParams(name string, params []environment.Param, fun func(args []object.Object) object.Object) error {
+	return e.environment.SetFunctionWithParams(name, params, fun)
+}
+
+// SetSandboxed enables, or disables, sandbox mode.
+//
+// When sandbox mode is enabled the built-in functions which access the
+// host system, such as `now` and `time`, will cause the script to abort
+// with an error if they are called.  This is useful if you're running
+// scripts submitted by untrusted users.
+func (e *Eval) SetSandboxed(val bool) {
+	e.environment.SetSandboxed(val)
+}
+
+// SetVersionAware enables, or disables, version-aware comparisons.
+//
+// When enabled the relational operators, `<`, `<=`, `>`, and `>=`,
+// compare strings which both look like version numbers, such as
+// "1.10.2", numerically component by component.  So "1.10.0" is greater
+// than "1.9.0", rather than less than it.
+func (e *Eval) SetVersionAware(val bool) {
+	e.environment.SetVersionAware(val)
+}
+
+// SetFloatTolerance sets the tolerance used when the `==` and `!=`
+// operators compare two floating-point numbers, so that values which
+// suffer from representation error, such as `0.1 + 0.2` and `0.3`, may
+// be considered equal.
+//
+// The tolerance only applies when both operands are floats.  The default
+// of zero means that floats are compared exactly.
+func (e *Eval) SetFloatTolerance(epsilon float64) {
+	e.environment.SetFloatTolerance(epsilon)
+}
+
+// SetStrictStringEquality enables, or disables, strict equality.
+//
+// By default the `==` and `!=` operators compare integers and floats by
+// value, so `1 == 1.0` is true, and comparing a string with a number is
+// an error.  When enabled they only consider values of the same type to
+// be equal, so `1 == 1.0` is false, and `"7" == 7` is false rather than
+// an error.  Strings are never converted to numbers in either case, so
+// `"007" == "7"` is always false.  The relational operators, such as
+// `<`, are not affected.
+func (e *Eval) SetStrictStringEquality(val bool) {
+	e.environment.SetStrictStringEquality(val)
+}
+
+// SetRandSeed seeds the random-number generator used by the `random`,
+// `randomInt`, and `uuid` functions.
+//
+// By default these functions return different values each time a
+// script is executed, and are disabled in sandbox mode.  Setting a seed
+// makes their output reproducible, which is useful for testing, and
+// allows them to be used in sandbox mode.
+func (e *Eval) SetRandSeed(seed int64) {
+	e.environment.SetRandSeed(seed)
+}
+
+// SetOutput changes the destination of the output generated by the
+// `print` and `printf` functions, which is STDOUT by default.
+//
+// This allows output to be routed to STDERR, or captured in a buffer.
+func (e *Eval) SetOutput(w io.Writer) {
+	e.environment.SetOutput(w)
+}
+
+// SetFieldHook registers a function which will be invoked each time the
+// script reads a field from the object it is running against, receiving
+// the name of the field and the value it resolved to.  Nested fields are
+// named by their full path, such as `User.Address.City`.
+//
+// This allows the host application to audit, or log, the fields which
+// a script actually uses.  Passing nil removes the function.
+func (e *Eval) SetFieldHook(hook environment.FieldHook) {
+	e.environment.SetFieldHook(hook)
+}
+
+// SetErrorsAsFalse enables, or disables, the treatment of comparisons
+// which fail as being false.
+//
+// By default a comparison which can't be made, for example `Age > 18`
+// where the field `Age` holds the string "unknown", aborts the script
+// with an error.  When this is enabled the comparison is false instead,
+// which is useful when filtering large collections of messy data.
+func (e *Eval) SetErrorsAsFalse(val bool) {
+	e.environment.SetErrorsAsFalse(val)
+}
+
+// SetErrorHook registers a function which will be invoked with the error
+// of each comparison which was treated as false, when SetErrorsAsFalse
+// is enabled, so they may be logged.  Passing nil removes the function.
+func (e *Eval) SetErrorHook(hook environment.ErrorHook) {
+	e.environment.SetErrorHook(hook)
+}
+
+// schemaTypes maps the names of the types which may be used by SetSchema
+// to the types they represent.
+var schemaTypes = map[string]object.Type{
+	"bool":    object.BOOLEAN,
+	"boolean": object.BOOLEAN,
+	"float":   object.FLOAT,
+	"int":     object.INTEGER,
+	"integer": object.INTEGER,
+	"string":  object.STRING,
+}
+
+// SetSchema declares the types of fields of the objects the script will
+// be run against, for example "Price: float, Active: bool".
+//
+// Each declaration is the name of a field, followed by a colon and one of
+// the types string, int, float, or bool, and declarations are separated
+// by commas or newlines.  When the script reads a declared field the
+// value is converted to the declared type, so comparisons behave in the
+// same way regardless of whether the source provided, for example, the
+// string "12.5" or the number 12.5.  See environment.SetFieldType for the
+// details.
+//
+// Declarations are added to any which were made previously.  If the
+// schema is invalid an error is returned, and no declarations are made.
+func (e *Eval) SetSchema(schema string) error {
+
+	types := make(map[string]object.Type)
+
+	fields := strings.FieldsFunc(schema, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, field := range fields {
+
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		parts := strings.Split(field, ":")
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return fmt.Errorf("invalid schema declaration '%s'", strings.TrimSpace(field))
+		}
+
+		typ, ok := schemaTypes[strings.ToLower(strings.TrimSpace(parts[1]))]
+		if !ok {
+			return fmt.Errorf("unknown type '%s' for field %s", strings.TrimSpace(parts[1]), name)
+		}
+		types[name] = typ
+	}
+
+	for name, typ := range types {
+		e.environment.SetFieldType(name, typ)
+	}
+	return nil
+}
+
+// SetIntegralFloats enables, or disables, the conversion of fields which
+// hold floats that are whole numbers to integers.
+//
+// Objects decoded from JSON into a map[string]interface{} hold all of
+// their numbers as float64 values, so an identifier such as 12345 is seen
+// by scripts as the float 12345.0.  Enabling this option makes it the
+// integer 12345 instead, so it may be used wherever an integer is
+// required, such as with the bitwise operators or to index an array.
+// Floats which have a fractional part are unchanged.
+func (e *Eval) SetIntegralFloats(val bool) {
+	e.environment.SetIntegralFloats(val)
+}
+
+// SetMaxDepth sets the deepest nesting of expressions, and blocks, such
+// as parentheses or `if` statements, which Prepare will accept.
+//
+// This protects hosts which compile untrusted scripts, as a script which
+// is pathologically deeply nested could otherwise exhaust the stack and
+// crash the host.  Scripts which are nested more deeply are rejected
+// with a *ParseError instead.  The default, used if the depth is zero,
+// is parser.DefaultMaxDepth, which is far deeper than any reasonable
+// script needs.
+func (e *Eval) SetMaxDepth(depth int) {
+	e.maxDepth = depth
+}
+
+// SetMaxStringLength sets the length, in bytes, of the longest string
+// which a script may construct, by concatenation or via functions such
+// as `repeat`, `padLeft`, and `sprintf`.
+//
+// Like SetMaxDepth this protects hosts which run untrusted scripts, as a
+// script could otherwise exhaust their memory by repeatedly doubling the
+// length of a string.  A script which exceeds the limit fails with an
+// error.  By default there is no limit, except that the functions which
+// can build strings far longer than their arguments, such as `repeat`,
+// refuse to build strings of more than 16MB.  Setting a limit replaces
+// that default, even if it is larger.
+func (e *Eval) SetMaxStringLength(n int) {
+	e.environment.SetMaxStringLength(n)
+}
+
+// SetCounters sets the store used by the `counter`, `increment`, and
+// `windowCount` functions, which allow scripts to maintain state across
+// the objects they're run against - for example to count the number of
+// failed logins from each IP address within the last minute.
+//
+// The store is created via environment.NewCounters, and is retained until
+// the host application resets, or replaces, it.  By default there is no
+// store, and calling those functions is an error.
+func (e *Eval) SetCounters(c *environment.Counters) {
+	e.environment.SetCounters(c)
+}
+
 // SetVariable adds, or updates a variable which will be available
 // to the filter script.
 func (e *Eval) SetVariable(name string, value object.Object) {
 	e.environment.Set(name, value)
 }
 
+// SetPrevious makes the previous record, of a stream of objects, available
+// to the script as the variable `prev`.
+//
+// This allows scripts to compare each record with the one before it, for
+// example `return Value > prev?.Value * 1.5;`.  It is the responsibility
+// of the host application to call this, with the object the script was
+// last run against, before each run.  Passing nil, as you would before
+// the first record, sets `prev` to null.
+//
+// The object is converted when this is called, so later changes to it
+// are not visible to the script.
+func (e *Eval) SetPrevious(obj interface{}) {
+	e.environment.Set("prev", vm.ToObject(obj, e.environment))
+}
+
+// AddCoercion registers a function which converts values of the same
+// golang type as the given sample to objects, when they're found in the
+// object a script is running against.
+//
+// This allows your own types, for example a decimal type, to be used by
+// scripts as numbers:
+//
+//	eval.AddCoercion(decimal.Decimal{}, func(val interface{}) object.Object {
+//		f, _ := val.(decimal.Decimal).Float64()
+//		return &object.Float{Value: f}
+//	})
+//
+// Numbers decoded from JSON as json.Number are converted to integers,
+// or floats, by default.
+func (e *Eval) AddCoercion(sample interface{}, fn environment.Coercion) {
+	e.environment.SetCoercion(reflect.TypeOf(sample), fn)
+}
+
 // GetVariable retrieves the contents of a variable which has been
 // set within a user-script.
 //
@@ -279,3 +783,11 @@ func (e *Eval) GetVariable(name string) object.Object {
 	}
 	return &object.Null{}
 }
+
+// Environment returns the environment which the script runs within.
+//
+// This allows variables to be set, read, and removed, with the typed
+// helpers of environment.Environment, such as SetString and GetInt.
+func (e *Eval) Environment() *environment.Environment {
+	return e.environment
+}
@@ -1,10 +1,20 @@
 package evalfilter
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
 // TestLess tests uses `>` and `>=`.
@@ -327,7 +337,7 @@ func TestFunctionString(t *testing.T) {
 		{Input: `if ( EmptyStr() ) { return true; } return false;`, Result: false},
 		{Input: `if ( EmptyStr() == "Steve" ) { return true; } return false;`, Result: false},
 		{Input: `if ( EmptyStr() == "" ) { return true; } return false;`, Result: true},
-		{Input: `if ( ! EmptyStr() ) { return true; } else { return false; }`, Result: false},
+		{Input: `if ( ! EmptyStr() ) { return true; } else { return false; }`, Result: true},
 	}
 
 	for _, tst := range tests {
@@ -459,6 +469,15 @@ func TestOperations(t *testing.T) {
 		{Input: `if ( 2 ** 3  == 8 ) { return true; }`, Result: true},
 		{Input: `if ( √9 == 3 ) { return true; }`, Result: true},
 		{Input: `if ( √9.0 == 3 ) { return true; }`, Result: true},
+		{Input: `if ( 7 / 2 == 3.5 ) { return true; }`, Result: true},
+		{Input: `if ( type(12 / 4) == "float" ) { return true; }`, Result: true},
+		{Input: `if ( type(7 % 4) == "integer" ) { return true; }`, Result: true},
+		{Input: `if ( 5.5 % 2 == 1.5 ) { return true; }`, Result: true},
+		{Input: `if ( 5 % 2.5 == 0 ) { return true; }`, Result: true},
+		{Input: `if ( 5.5 % 0.4 > 0.29 && 5.5 % 0.4 < 0.31 ) { return true; }`, Result: true},
+		{Input: `if ( 1 % 0.4 > 0.19 && 1 % 0.4 < 0.21 ) { return true; }`, Result: true},
+		{Input: `if ( -5.5 % 2 == -1.5 ) { return true; }`, Result: true},
+		{Input: `a = [1, 2, 3]; if ( a[len(a) - 1] == 3 ) { return true; }`, Result: true},
 
 		// int OP float
 		{Input: `if ( 1 + 2.0 == 3.0 ) { return true; }`, Result: true},
@@ -1059,3 +1078,4290 @@ func TestStringIndex(t *testing.T) {
 		}
 	}
 }
+
+// TestRecency tests filtering by the age of times, using `ago`, `today`,
+// and `startOfDay`.
+func TestRecency(t *testing.T) {
+
+	type Record struct {
+		Created time.Time
+	}
+
+	recent := Record{Created: time.Now().Add(-48 * time.Hour)}
+	old := Record{Created: time.Now().Add(-30 * 24 * time.Hour)}
+
+	tests := []struct {
+		Input  string
+		Recent bool
+		Old    bool
+	}{
+		{Input: `return Created > ago("7d");`, Recent: true, Old: false},
+		{Input: `return Created > ago(duration("1d") * 60);`, Recent: true, Old: true},
+		{Input: `return Created < today();`, Recent: true, Old: true},
+		{Input: `return startOfDay(Created) <= Created;`, Recent: true, Old: true},
+		{Input: `return today() - startOfDay(Created) > duration("1d");`, Recent: true, Old: true},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		for _, obj := range []struct {
+			Record Record
+			Result bool
+		}{{recent, tst.Recent}, {old, tst.Old}} {
+			ret, err := e.Run(obj.Record)
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+			}
+			if ret != obj.Result {
+				t.Fatalf("Found unexpected result running '%s' against %v", tst.Input, obj.Record.Created)
+			}
+		}
+	}
+}
+
+// TestSandbox ensures that host-access functions are disabled in sandbox mode.
+func TestSandbox(t *testing.T) {
+
+	obj := New(`return( now() > 0 );`)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile")
+	}
+
+	ret, err := obj.Run(nil)
+	if err != nil {
+		t.Fatalf("Found unexpected error running script: %s", err.Error())
+	}
+	if !ret {
+		t.Fatalf("Found unexpected result running script")
+	}
+
+	obj.SetSandboxed(true)
+
+	_, err = obj.Run(nil)
+	if err == nil {
+		t.Fatalf("Expected error running script in sandbox mode")
+	}
+	if !strings.Contains(err.Error(), "sandbox") {
+		t.Fatalf("Error had wrong message: %s", err.Error())
+	}
+}
+
+// TestSlice tests slicing arrays and strings.
+func TestSlice(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: `a = [1, 2, 3, 4, 5]; return a[1:3];`, Result: "[2, 3]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:2];`, Result: "[1, 2]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[3:];`, Result: "[4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:];`, Result: "[1, 2, 3, 4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[-2:];`, Result: "[4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[:-1];`, Result: "[1, 2, 3, 4]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[-100:100];`, Result: "[1, 2, 3, 4, 5]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[4:1];`, Result: "[]"},
+		{Input: `a = [1, 2, 3, 4, 5]; return a[10:];`, Result: "[]"},
+		{Input: `a = [1, 2, 3, 4, 5]; b = 1; return a[b+1:b+3];`, Result: "[3, 4]"},
+		{Input: `return "Hachikō"[4:];`, Result: "ikō"},
+		{Input: `a = [1, 2, 3]; return a["1":];`, Error: true},
+		{Input: `return 3[1:2];`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			if !tst.Error {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			continue
+		}
+		if tst.Error {
+			t.Fatalf("Expected error running test '%s', got none", tst.Input)
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+}
+
+// TestArrayEquality tests the deep-comparison of arrays.
+func TestArrayEquality(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return [1, 2, 3] == [1, 2, 3];`, Result: true},
+		{Input: `return [1, 2, 3] == [1, 2, 3.0];`, Result: true},
+		{Input: `return [1, 2, 3] == [3, 2, 1];`, Result: false},
+		{Input: `return [1, 2, 3] == [1, 2];`, Result: false},
+		{Input: `return [1, 2, 3] != [1, 2];`, Result: true},
+		{Input: `return [] == [];`, Result: true},
+		{Input: `return ["1"] == [1];`, Result: false},
+		{Input: `return [[1, "two"], [true]] == [[1, "two"], [true]];`, Result: true},
+		{Input: `return [[1, "two"], [true]] == [[1, "two"], [false]];`, Result: false},
+		{Input: `a = [1, 2, 3, 4]; return a[0:2] == [1, 2];`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running '%s'", tst.Input)
+		}
+	}
+
+	// Comparing a value with an array is an error, which suggests `in`.
+	for _, input := range []string{`return Status == [ "open", "pending" ];`, `return Status != [ "open" ];`, `return 3 == [ 3 ];`} {
+
+		obj := New(input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", input, p.Error())
+		}
+
+		_, err := obj.Run(map[string]interface{}{"Status": "open"})
+		if err == nil || !strings.Contains(err.Error(), "use 'in' to test whether an array contains a value") {
+			t.Fatalf("expected an error suggesting 'in' running '%s', got %v", input, err)
+		}
+	}
+}
+
+// TestCoalesce tests the `??` operator, and the `coalesce` function.
+func TestCoalesce(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+		Calls  int
+	}
+
+	tests := []Test{
+		{Input: `return Missing ?? "default";`, Result: "default"},
+		{Input: `return Name ?? "default";`, Result: "Steve"},
+		{Input: `return Missing ?? Other ?? 3;`, Result: "3"},
+		{Input: `return Missing ?? Other;`, Result: "null"},
+		{Input: `return false ?? true;`, Result: "false"},
+		{Input: `return Missing ?? 1 + 2;`, Result: "3"},
+		{Input: `return Name ?? counter();`, Result: "Steve", Calls: 0},
+		{Input: `return Missing ?? counter() ?? counter();`, Result: "1", Calls: 1},
+		{Input: `return coalesce(Missing, Other, "anonymous");`, Result: "anonymous"},
+		{Input: `return coalesce(Missing, Name, counter());`, Result: "Steve", Calls: 0},
+		{Input: `return coalesce(Name);`, Result: "Steve"},
+		{Input: `if ( Missing ?? true ) { return "yes"; } return "no";`, Result: "yes"},
+	}
+
+	for _, tst := range tests {
+
+		calls := 0
+
+		obj := New(tst.Input)
+		obj.AddFunction("counter", func(args []object.Object) object.Object {
+			calls++
+			return &object.Integer{Value: int64(calls)}
+		})
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			calls = 0
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Name": "Steve"})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+			if calls != tst.Calls {
+				t.Fatalf("Unexpected number of calls running '%s': %d", tst.Input, calls)
+			}
+		}
+	}
+
+	// coalesce with no arguments is a compile-time error
+	obj := New(`return coalesce();`)
+	if obj.Prepare() == nil {
+		t.Fatalf("expected an error compiling an empty coalesce")
+	}
+
+	// A function of the same name, defined by the host application
+	// or by the script, is invoked instead.
+	obj = New(`return coalesce(Missing, "x");`)
+	obj.AddFunction("coalesce", func(args []object.Object) object.Object {
+		return &object.String{Value: "host"}
+	})
+	shadowed := []*Eval{
+		obj,
+		New(`function coalesce(a, b) { return "script"; } return coalesce(Missing, "x");`),
+		New(`function exists(a) { return "script"; } return exists(Missing);`),
+		New(`function inspect() { return "script"; } return inspect();`),
+	}
+	for i, obj := range shadowed {
+		if err := obj.Prepare(); err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+		problems, err := obj.Check()
+		if err != nil || len(problems) != 0 {
+			t.Fatalf("unexpected problems: %v %v", problems, err)
+		}
+		ret, err := obj.Execute(nil)
+		want := []string{"host", "script", "script", "script"}[i]
+		if err != nil || ret.Inspect() != want {
+			t.Fatalf("expected the %s function to be called, got %v %v", want, ret, err)
+		}
+	}
+}
+
+// TestOptionalChaining tests access to nested fields, via `.` and `?.`.
+func TestOptionalChaining(t *testing.T) {
+
+	type Address struct {
+		City  string
+		Lines []string
+	}
+	type User struct {
+		Name    string
+		Address *Address
+	}
+	type Record struct {
+		User  *User
+		Owner *User
+		Meta  map[string]interface{}
+	}
+
+	record := Record{
+		User: &User{Name: "Steve", Address: &Address{City: "Helsinki", Lines: []string{"Street 1", "Flat 2"}}},
+		Meta: map[string]interface{}{
+			"source": map[string]interface{}{"host": "example.com"},
+		},
+	}
+
+	type Test struct {
+		Input  string
+		Result string
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: `return User.Name;`, Result: "Steve"},
+		{Input: `return User.Address.City;`, Result: "Helsinki"},
+		{Input: `return User?.Address?.City;`, Result: "Helsinki"},
+		{Input: `return User.Address.Lines[1];`, Result: "Flat 2"},
+		{Input: `return User.Missing;`, Result: "null"},
+		{Input: `return Meta.source.host;`, Result: "example.com"},
+		{Input: `return Meta?.other?.host;`, Result: "null"},
+		{Input: `return Owner?.Address?.City;`, Result: "null"},
+		{Input: `return Owner?.Address.City;`, Result: "null"},
+		{Input: `return Owner?.Address.Lines[0];`, Result: "null"},
+		{Input: `return Owner?.Address?.City ?? "unknown";`, Result: "unknown"},
+		{Input: `return len(User.Address.Lines);`, Result: "2"},
+		{Input: `return User.Address == User.Address;`, Result: "true"},
+		{Input: `return Owner.Address;`, Error: true},
+		{Input: `return Owner.Address.City;`, Error: true},
+		{Input: `return User.Name.Length;`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Execute(record)
+		if err != nil {
+			if !tst.Error {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			continue
+		}
+		if tst.Error {
+			t.Fatalf("Expected error running test '%s', got none", tst.Input)
+		}
+
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+}
+
+// TestChainedComparison tests chains of comparisons, such as `a < b < c`.
+func TestChainedComparison(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+		Calls  int
+	}
+
+	tests := []Test{
+		{Input: `return 0 < Score < 100;`, Result: true},
+		{Input: `return 0 < Score < 10;`, Result: false},
+		{Input: `return 50 < Score < 100;`, Result: false},
+		{Input: `return 0 <= 0 <= Score <= 42 < 43;`, Result: true},
+		{Input: `return 0 <= 0 <= Score <= 41 < 43;`, Result: false},
+		{Input: `return 100 > Score >= 42;`, Result: true},
+		{Input: `return 1 < 2 > 0;`, Result: true},
+		{Input: `return 1 == 1 == true;`, Result: true},
+		{Input: `if ( 0 < Score < 100 ) { return true; } return false;`, Result: true},
+		{Input: `return 0 < counter() < 100;`, Result: true, Calls: 1},
+		{Input: `return 0 < counter() < 0;`, Result: false, Calls: 1},
+		{Input: `return 5 < counter() < counter();`, Result: false, Calls: 1},
+		{Input: `return 0 < counter() < counter();`, Result: true, Calls: 2},
+	}
+
+	for _, tst := range tests {
+
+		calls := 0
+
+		obj := New(tst.Input)
+		obj.AddFunction("counter", func(args []object.Object) object.Object {
+			calls++
+			return &object.Integer{Value: int64(calls)}
+		})
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			calls = 0
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Run(map[string]interface{}{"Score": 42})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret != tst.Result {
+				t.Fatalf("Found unexpected result running '%s'", tst.Input)
+			}
+			if calls != tst.Calls {
+				t.Fatalf("Unexpected number of calls running '%s': %d", tst.Input, calls)
+			}
+		}
+	}
+}
+
+// TestOutput tests that output can be redirected.
+func TestOutput(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	obj := New(`print("Hello, ", Name, "\n"); printf("%d + %d = %d\n", 1, 2, 1 + 2); return sprintf("%s!", Name) == "Steve!";`)
+	obj.SetOutput(&buf)
+
+	p := obj.Prepare()
+	if p != nil {
+		t.Fatalf("Failed to compile: %s", p.Error())
+	}
+
+	ret, err := obj.Run(map[string]interface{}{"Name": "Steve"})
+	if err != nil {
+		t.Fatalf("Found unexpected error: %s", err.Error())
+	}
+	if !ret {
+		t.Fatalf("Found unexpected result")
+	}
+
+	if buf.String() != "Hello, Steve\n1 + 2 = 3\n" {
+		t.Fatalf("Unexpected output: %q", buf.String())
+	}
+}
+
+// TestUnaryMinus tests negative numbers, and negated expressions.
+func TestUnaryMinus(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return -5;`, Result: "-5"},
+		{Input: `return -2.5;`, Result: "-2.5"},
+		{Input: `return -(a + b);`, Result: "-5"},
+		{Input: `return a - -b;`, Result: "5"},
+		{Input: `return a - - b;`, Result: "5"},
+		{Input: `return -a - b;`, Result: "-5"},
+		{Input: `return - -a;`, Result: "2"},
+		{Input: `return -balance;`, Result: "150"},
+		{Input: `return balance < -100;`, Result: "true"},
+		{Input: `return 3 * -2;`, Result: "-6"},
+		{Input: `return 3 - -2.5;`, Result: "5.5"},
+		{Input: `return 2 ** -1;`, Result: "0.5"},
+		{Input: `return clamp(-9, -7, -3);`, Result: "-7"},
+		{Input: `return [ -1, 2 ][0];`, Result: "-1"},
+		{Input: `return type(-a);`, Result: "integer"},
+	}
+
+	obj := map[string]interface{}{"a": 2, "b": 3, "balance": -150}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestPrecedence tests the precedence, and associativity, of arithmetic
+// operators.
+func TestPrecedence(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `2 + 3 * 4`, Result: "14"},
+		{Input: `2 * 3 + 4`, Result: "10"},
+		{Input: `(2 + 3) * 4`, Result: "20"},
+		{Input: `2 * (3 + 4)`, Result: "14"},
+		{Input: `10 - 4 - 3`, Result: "3"},
+		{Input: `10 - (4 - 3)`, Result: "9"},
+		{Input: `2 * 6 / 4`, Result: "3"},
+		{Input: `12 / 2 / 3`, Result: "2"},
+		{Input: `12 / (2 / 4)`, Result: "24"},
+		{Input: `7 + 10 % 4`, Result: "9"},
+		{Input: `6 * 5 % 4`, Result: "2"},
+		{Input: `10 % 4 * 3`, Result: "6"},
+		{Input: `17 % 10 % 4`, Result: "3"},
+		{Input: `2 * 3 ** 2`, Result: "18"},
+		{Input: `2 ** 3 ** 2`, Result: "512"},
+		{Input: `(2 ** 3) ** 2`, Result: "64"},
+		{Input: `-2 ** 2`, Result: "-4"},
+		{Input: `(-2) ** 2`, Result: "4"},
+		{Input: `2 ** -1`, Result: "0.5"},
+		{Input: `-3 * 2`, Result: "-6"},
+		{Input: `1 + 2 * 3 - 4 / 2`, Result: "5"},
+		{Input: `((1 + 2) * (3 + 4)) % 5`, Result: "1"},
+		{Input: `1 + 2 < 2 * 2`, Result: "true"},
+		{Input: `2 + 3 * 4 == 14 && 20 == (2 + 3) * 4`, Result: "true"},
+		{Input: `6 & 3 != 0`, Result: "true"},
+		{Input: `1 | 2 == 3`, Result: "true"},
+		{Input: `1 | 6 & 3`, Result: "3"},
+		{Input: `1 + 1 << 2`, Result: "5"},
+		{Input: `(1 + 1) << 2`, Result: "8"},
+		{Input: `5 ^ 1 | 8`, Result: "12"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(fmt.Sprintf("return %s;", tst.Input))
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestEnvironment tests that variables injected via the environment are
+// visible to scripts, and that the variables set by scripts can be read.
+func TestEnvironment(t *testing.T) {
+
+	e := New(`
+if ( role == "admin" && enabled && count * ratio == 1.5 && "b" in tags ) {
+   result = "allowed";
+   return true;
+}
+return false;
+`)
+
+	env := e.Environment()
+	env.SetString("role", "admin")
+	env.SetBool("enabled", true)
+	env.SetInt("count", 3)
+	env.SetFloat("ratio", 0.5)
+	env.SetArray("tags", []object.Object{&object.String{Value: "a"}, &object.String{Value: "b"}})
+
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ok, err := e.Run(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatalf("expected the script to return true")
+	}
+	if res, _ := env.GetString("result"); res != "allowed" {
+		t.Fatalf("unexpected value for result: %s", res)
+	}
+
+	env.SetString("role", "guest")
+	ok, err = e.Run(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatalf("expected the script to return false")
+	}
+}
+
+// TestIntegerOverflow tests that integer arithmetic which overflows is
+// reported as an error, rather than wrapping around.
+func TestIntegerOverflow(t *testing.T) {
+
+	max := "9223372036854775807"
+	min := "(-9223372036854775807 - 1)"
+
+	ok := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: max + " + 0", Result: max},
+		{Input: max + " - 1 + 1", Result: max},
+		{Input: min, Result: "-9223372036854775808"},
+		{Input: min + " + " + max, Result: "-1"},
+		{Input: min + " - -1", Result: "-9223372036854775807"},
+		{Input: max + " - " + max, Result: "0"},
+		{Input: max + " * 1", Result: max},
+		{Input: max + " * -1", Result: "-" + max},
+		{Input: min + " * 1", Result: "-9223372036854775808"},
+		{Input: min + " * 0", Result: "0"},
+		{Input: "4611686018427387903 * 2", Result: "9223372036854775806"},
+		{Input: "2 ** 62", Result: "4611686018427387904"},
+		{Input: "(-2) ** 63", Result: "-9223372036854775808"},
+		{Input: "3 ** 39", Result: "4052555153018976267"},
+		{Input: "0 ** 0", Result: "1"},
+		{Input: "-(" + max + ")", Result: "-" + max},
+		{Input: min + " % -1", Result: "0"},
+		{Input: max + " / 2", Result: "4611686018427388000"},
+		{Input: "sum([" + min + ", " + max + "])", Result: "-1"},
+		{Input: "sum([" + max + ", 1.5])", Result: "9223372036854776000"},
+	}
+
+	bad := []string{
+		max + " + 1",
+		"1 + " + max,
+		min + " - 1",
+		min + " + -1",
+		"0 - " + min,
+		max + " * 2",
+		min + " * -1",
+		"-1 * " + min,
+		"4294967296 * 4294967296",
+		"2 ** 63",
+		"-2 ** 63",
+		"2 ** 64",
+		"10 ** 19",
+		"(-2) ** 64",
+		"-" + min,
+		"sum([" + max + ", 1])",
+		"sum([" + min + ", -1])",
+	}
+
+	for _, tst := range ok {
+
+		e := New(fmt.Sprintf("return %s;", tst.Input))
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// The increment and decrement operators mustn't wrap-around either.
+	scripts := []string{
+		"x = " + max + "; x++; return x;",
+		"x = " + min + "; x--; return x;",
+	}
+	for _, input := range bad {
+		scripts = append(scripts, fmt.Sprintf("return %s;", input))
+	}
+
+	for _, input := range scripts {
+
+		e := New(input)
+
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", input, err.Error())
+		}
+
+		_, err = e.Execute(nil)
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", input)
+		}
+		if !strings.Contains(err.Error(), "integer overflow") {
+			t.Fatalf("got the wrong error running '%s': %s", input, err.Error())
+		}
+	}
+}
+
+// TestLiterals tests that the elements of array and hash literals are
+// evaluated when the script runs, against the object and the environment.
+func TestLiterals(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return [];`, Result: "[]"},
+		{Input: `return [ 1, ];`, Result: "[1]"},
+		{Input: `return [
+  "a",
+  "b",
+];`, Result: "[a, b]"},
+		{Input: `return [ Name, role, Count * 2, len(Name) ];`, Result: "[Steve, admin, 6, 5]"},
+		{Input: `return { Name: role, "count": [ Count, Count + 1 ] };`, Result: "{Steve: admin, count: [3, 4]}"},
+		{Input: `return [ [], {}, [ [] ] ];`, Result: "[[], {}, [[]]]"},
+		{Input: `return [ Name ] == [ "Steve" ];`, Result: "true"},
+		{Input: `return { "role": role } == { "role": "admin" };`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		e.Environment().SetString("role", "admin")
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(map[string]interface{}{"Name": "Steve", "Count": 3})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// A trailing comma is only permitted in a literal.
+	for _, input := range []string{`return [ , ];`, `return [ 1,, ];`, `return len("steve",);`} {
+		e := New(input)
+		if e.Prepare() == nil {
+			t.Fatalf("expected an error compiling '%s'", input)
+		}
+	}
+}
+
+// TestVersionAware tests the ordering of version numbers, when
+// version-aware comparisons are enabled.
+func TestVersionAware(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Normal string
+		Aware  string
+	}{
+		{Input: `"1.10.0" > "1.9.0"`, Normal: "false", Aware: "true"},
+		{Input: `"1.10.0" < "1.9.0"`, Normal: "true", Aware: "false"},
+		{Input: `"v2.0" >= "v1.99.99"`, Normal: "true", Aware: "true"},
+		{Input: `"v10.0" > "9.0"`, Normal: "true", Aware: "true"},
+		{Input: `"1.2" <= "1.2.0"`, Normal: "true", Aware: "true"},
+		{Input: `"1.2" >= "1.2.0"`, Normal: "false", Aware: "true"},
+		{Input: `"1.02" >= "1.2"`, Normal: "false", Aware: "true"},
+		{Input: `"1.2.3.10" > "1.2.3.9"`, Normal: "false", Aware: "true"},
+		{Input: `"1.2" == "1.2.0"`, Normal: "false", Aware: "false"},
+		{Input: `"1.2.3" == "1.2.3"`, Normal: "true", Aware: "true"},
+
+		// These don't look like versions, so are compared as strings.
+		{Input: `"10" > "9"`, Normal: "false", Aware: "false"},
+		{Input: `"1.10.0-rc1" > "1.9.0"`, Normal: "false", Aware: "false"},
+		{Input: `"1.10." > "1.9."`, Normal: "false", Aware: "false"},
+		{Input: `"1..10" > "1..9"`, Normal: "false", Aware: "false"},
+		{Input: `"a.10" > "a.9"`, Normal: "false", Aware: "false"},
+		{Input: `"1.10" > "steve"`, Normal: "false", Aware: "false"},
+		{Input: `"1.-10" > "1.-9"`, Normal: "false", Aware: "false"},
+	}
+
+	for _, tst := range tests {
+
+		for _, aware := range []bool{false, true} {
+
+			e := New(fmt.Sprintf("return %s;", tst.Input))
+			e.SetVersionAware(aware)
+
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			expected := tst.Normal
+			if aware {
+				expected = tst.Aware
+			}
+			if ret.Inspect() != expected {
+				t.Fatalf("Found unexpected result running '%s' (version-aware %t): %s", tst.Input, aware, ret.Inspect())
+			}
+		}
+	}
+
+	// Fields, and the parallel filter, respect the setting too.
+	e := New(`return Version >= "1.10";`)
+	e.SetVersionAware(true)
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	objs := []interface{}{
+		map[string]interface{}{"Version": "1.9.2"},
+		map[string]interface{}{"Version": "1.10.1"},
+		map[string]interface{}{"Version": "2.0"},
+	}
+	out, err := e.FilterSliceParallel(objs, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected two results, got %d", len(out))
+	}
+}
+
+// TestFloatTolerance tests that float equality may be made approximate.
+func TestFloatTolerance(t *testing.T) {
+
+	tests := []struct {
+		Input    string
+		Exact    string
+		Tolerant string
+	}{
+		{Input: `0.1 + 0.2 == 0.3`, Exact: "false", Tolerant: "true"},
+		{Input: `0.1 + 0.2 != 0.3`, Exact: "true", Tolerant: "false"},
+		{Input: `avg([0.1, 0.2, 0.3]) == 0.2`, Exact: "false", Tolerant: "true"},
+		{Input: `1.0 == 1.0000001`, Exact: "false", Tolerant: "true"},
+		{Input: `1.0 == 1.01`, Exact: "false", Tolerant: "false"},
+		{Input: `1.5 == 1.5`, Exact: "true", Tolerant: "true"},
+
+		// The tolerance only applies when both operands are floats,
+		// in either order.
+		{Input: `1 == 1.0000001`, Exact: "false", Tolerant: "false"},
+		{Input: `1.0000001 == 1`, Exact: "false", Tolerant: "false"},
+		{Input: `0.9999999 == 1`, Exact: "false", Tolerant: "false"},
+		{Input: `1.0000001 != 1`, Exact: "true", Tolerant: "true"},
+		{Input: `1 != 1.0000001`, Exact: "true", Tolerant: "true"},
+		{Input: `1 == 1.0`, Exact: "true", Tolerant: "true"},
+		{Input: `"1.0" == "1.0000001"`, Exact: "false", Tolerant: "false"},
+
+		// Functions which compare values use the same tolerance.
+		{Input: `1.0 in [1.0000001]`, Exact: "false", Tolerant: "true"},
+		{Input: `0.9999999 in [1]`, Exact: "false", Tolerant: "false"},
+		{Input: `indexOf([2, 1], 0.9999999)`, Exact: "-1", Tolerant: "-1"},
+		{Input: `indexOf([2, 1.0000001], 1.0)`, Exact: "-1", Tolerant: "1"},
+		{Input: `unique([1.0, 1.0000001])`, Exact: "[1, 1.0000001]", Tolerant: "[1]"},
+	}
+
+	for _, tst := range tests {
+
+		for _, epsilon := range []float64{0, 1e-6} {
+
+			e := New(fmt.Sprintf("return %s;", tst.Input))
+			e.SetFloatTolerance(epsilon)
+
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			expected := tst.Exact
+			if epsilon != 0 {
+				expected = tst.Tolerant
+			}
+			if ret.Inspect() != expected {
+				t.Fatalf("Found unexpected result running '%s' (tolerance %g): %s", tst.Input, epsilon, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestStrictStringEquality tests that strict equality only considers
+// values of the same type to be equal.
+func TestStrictStringEquality(t *testing.T) {
+
+	tests := []struct {
+		Input   string
+		Default string
+		Strict  string
+	}{
+		// Strings are never converted to numbers.
+		{Input: `"007" == "7"`, Default: "false", Strict: "false"},
+		{Input: `"007" != "7"`, Default: "true", Strict: "true"},
+		{Input: `"7" == 7`, Default: "error", Strict: "false"},
+		{Input: `7 != "7"`, Default: "error", Strict: "true"},
+		{Input: `"true" == true`, Default: "error", Strict: "false"},
+		{Input: `"a" == "a"`, Default: "true", Strict: "true"},
+
+		// Nor are integers converted to floats.
+		{Input: `1 == 1.0`, Default: "true", Strict: "false"},
+		{Input: `1.0 != 1`, Default: "false", Strict: "true"},
+		{Input: `[1, 2] == [1.0, 2.0]`, Default: "true", Strict: "false"},
+		{Input: `1 in [1.0]`, Default: "true", Strict: "false"},
+		{Input: `"7" in [7, "7"]`, Default: "true", Strict: "true"},
+		{Input: `indexOf([1.0, 1], 1)`, Default: "0", Strict: "1"},
+		{Input: `unique([1, 1.0, "1"])`, Default: "[1, 1]", Strict: "[1, 1, 1]"},
+
+		// The relational operators are unaffected.
+		{Input: `1 <= 1.0 && 1 < 1.5`, Default: "true", Strict: "true"},
+
+		// As are comparisons with arrays, and null.
+		{Input: `"a" == ["a"]`, Default: "error", Strict: "error"},
+		{Input: `1 == null`, Default: "false", Strict: "false"},
+	}
+
+	for _, tst := range tests {
+
+		for _, strict := range []bool{false, true} {
+
+			e := New(fmt.Sprintf("return %s;", tst.Input))
+			e.SetStrictStringEquality(strict)
+
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			expected := tst.Default
+			if strict {
+				expected = tst.Strict
+			}
+
+			ret, err := e.Execute(nil)
+			if expected == "error" {
+				if err == nil {
+					t.Fatalf("expected an error running '%s' (strict %t), got %s", tst.Input, strict, ret.Inspect())
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != expected {
+				t.Fatalf("Found unexpected result running '%s' (strict %t): %s", tst.Input, strict, ret.Inspect())
+			}
+		}
+	}
+
+	// The static checker only reports comparing a string with a
+	// number when strict equality is disabled.
+	for _, strict := range []bool{false, true} {
+		e := New(`return Name == "steve" || "7" == 7;`)
+		e.SetStrictStringEquality(strict)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+		problems, err := e.Check()
+		if err != nil || (len(problems) == 0) != strict {
+			t.Fatalf("unexpected problems (strict %t): %v %v", strict, problems, err)
+		}
+	}
+}
+
+// TestComparisons tests that the comparison operators, and the functions
+// which compare values, agree with each other - by testing them all
+// against the same operands.
+func TestComparisons(t *testing.T) {
+
+	// Operands in the same group are equal to each other, and to
+	// nothing else.
+	groups := [][]string{
+		{`1`, `1.0`},
+		{`2`},
+		{`2.5`},
+		{`"1"`},
+		{`"7"`},
+		{`"007"`},
+		{`"a"`},
+		{`"b"`},
+		{`true`},
+		{`false`},
+		{`null`},
+		{`[1, "a"]`, `[1.0, "a"]`},
+		{`[]`},
+		{`{"a": 1}`, `{"a": 1.0}`},
+	}
+
+	// run returns the result of evaluating the given expression.
+	run := func(expr string) (string, error) {
+		e := New(fmt.Sprintf("return %s;", expr))
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", expr, err.Error())
+		}
+		ret, err := e.Execute(nil)
+		if err != nil {
+			return "", err
+		}
+		return ret.Inspect(), nil
+	}
+
+	for i, g1 := range groups {
+		for _, a := range g1 {
+			for j, g2 := range groups {
+				for _, b := range g2 {
+
+					equal := fmt.Sprintf("%t", i == j)
+
+					// The operators may refuse to compare some
+					// types, but if they don't they must agree.
+					eq, err := run(a + " == " + b)
+					if err == nil && eq != equal {
+						t.Errorf("%s == %s gave %s", a, b, eq)
+					}
+					ne, err2 := run(a + " != " + b)
+					if (err == nil) != (err2 == nil) || (err == nil && ne == eq) {
+						t.Errorf("%s != %s gave %s, %v", a, b, ne, err2)
+					}
+
+					// The functions treat values which can't be
+					// compared as different.
+					for _, expr := range []string{
+						a + " in [" + b + "]",
+						"indexOf([" + b + "], " + a + ") == 0",
+						"len(unique([" + a + ", " + b + "])) == 1",
+						"len(intersection([" + a + "], [" + b + "])) == 1",
+						"len(difference([" + a + "], [" + b + "])) == 0",
+						"len(union([" + a + "], [" + b + "])) == 1",
+					} {
+						out, err := run(expr)
+						if err != nil {
+							t.Errorf("%s gave error %s", expr, err.Error())
+						} else if out != equal {
+							t.Errorf("%s gave %s", expr, out)
+						}
+					}
+
+					// Values which can be ordered are ordered
+					// consistently with their equality.
+					lt, err := run(a + " < " + b)
+					if err != nil {
+						continue
+					}
+					gt, _ := run(a + " > " + b)
+					le, _ := run(a + " <= " + b)
+					ge, _ := run(a + " >= " + b)
+
+					switch {
+					case eq == "true" && (lt != "false" || gt != "false" || le != "true" || ge != "true"):
+						t.Errorf("%s and %s are equal, but ordered %s %s %s %s", a, b, lt, gt, le, ge)
+					case eq == "false" && (lt == gt || le != lt || ge != gt):
+						t.Errorf("%s and %s are different, but ordered %s %s %s %s", a, b, lt, gt, le, ge)
+					}
+				}
+			}
+		}
+	}
+
+	// Strings are never compared numerically.
+	for expr, result := range map[string]string{`"007" != "7"`: "true", `"10" < "9"`: "true", `"7" in [7]`: "false"} {
+		out, err := run(expr)
+		if err != nil || out != result {
+			t.Errorf("%s gave %s, %v", expr, out, err)
+		}
+	}
+	_, err := run(`"7" == 7`)
+	if err == nil || !strings.Contains(err.Error(), "type mismatch: STRING OpEqual INTEGER") {
+		t.Errorf("expected a type mismatch, got %v", err)
+	}
+
+	// NaN is neither less than, nor greater than, anything - and is
+	// sorted after the other numbers.
+	for expr, result := range map[string]string{
+		`x < 5`:                              "false",
+		`x <= 5`:                             "false",
+		`x > 5`:                              "false",
+		`x >= 5`:                             "false",
+		`5 < x`:                              "false",
+		`5 >= x`:                             "false",
+		`x >= x`:                             "false",
+		`x == x`:                             "false",
+		`x != 5`:                             "true",
+		`sort([3, x, 1.5, "a"])`:             "[1.5, 3, NaN, a]",
+		`maxBy([{"n": x}, {"n": 2}], "n").n`: "2",
+	} {
+		e := New(fmt.Sprintf("x = √-1; return %s;", expr))
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", expr, err.Error())
+		}
+		out, err := e.Execute(nil)
+		if err != nil || out.Inspect() != result {
+			t.Errorf("%s gave %v, %v", expr, out, err)
+		}
+	}
+}
+
+// TestAssert tests that failed assertions abort the script, unless they
+// were removed at compile-time.
+func TestAssert(t *testing.T) {
+
+	script := `
+total = Price * Count;
+assert(total > 0, "total must be positive");
+assert(Name);
+return total;
+`
+
+	tests := []struct {
+		Object map[string]interface{}
+		Result string
+		Error  string
+	}{
+		{Object: map[string]interface{}{"Price": 2, "Count": 3, "Name": "Steve"}, Result: "6"},
+		{Object: map[string]interface{}{"Price": 2, "Count": 0, "Name": "Steve"}, Error: "line 3, col 7: error calling assert: assertion failed: total must be positive"},
+		{Object: map[string]interface{}{"Price": 2, "Count": 3, "Name": ""}, Error: "line 4, col 7: error calling assert: assertion failed"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(script)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+
+		ret, err := e.Execute(tst.Object)
+		if tst.Error != "" {
+			if err == nil {
+				t.Fatalf("expected an error for %v, got none", tst.Object)
+			}
+			if err.Error() != tst.Error {
+				t.Fatalf("unexpected error for %v: %s", tst.Object, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %s", tst.Object, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("unexpected result for %v: %s", tst.Object, ret.Inspect())
+		}
+	}
+
+	// With the NoAssert flag the assertions, and their arguments,
+	// are never evaluated.
+	e := New(`assert(false, "oops"); assert(1 / 0); return assert(false);`)
+	err := e.Prepare([]byte{NoAssert})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := e.Execute(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "true" {
+		t.Fatalf("unexpected result: %s", ret.Inspect())
+	}
+}
+
+// TestToHash tests running scripts against objects converted to hashes.
+func TestToHash(t *testing.T) {
+
+	type Address struct {
+		City string `json:"city"`
+	}
+	type Person struct {
+		Name    string   `json:"name"`
+		Age     int      `json:"age,omitempty"`
+		Tags    []string `json:"tags"`
+		Secret  string   `json:"-"`
+		Address *Address `json:"address"`
+		Plain   bool
+		private string
+	}
+
+	obj := &Person{
+		Name:    "Steve",
+		Age:     45,
+		Tags:    []string{"admin", "ops"},
+		Secret:  "hidden",
+		Address: &Address{City: "Helsinki"},
+		Plain:   true,
+		private: "hidden",
+	}
+
+	hash := vm.ToHash(obj, nil)
+	if hash.Inspect() != "{Plain: true, address: {city: Helsinki}, age: 45, name: Steve, tags: [admin, ops]}" {
+		t.Fatalf("unexpected hash: %s", hash.Inspect())
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return name;`, Result: "Steve"},
+		{Input: `return age + 1;`, Result: "46"},
+		{Input: `return "ops" in tags;`, Result: "true"},
+		{Input: `return address.city;`, Result: "Helsinki"},
+		{Input: `return Plain;`, Result: "true"},
+		{Input: `return Secret;`, Result: "null"},
+		{Input: `return Name;`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		// Run twice, to ensure the hash is not modified, and the
+		// fields of the original object are named the same way.
+		for _, val := range []interface{}{hash, hash, obj} {
+			ret, err := e.Execute(val)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s' against %T: %s", tst.Input, val, ret.Inspect())
+			}
+		}
+	}
+
+	// Maps are converted too, and other values give an empty hash.
+	m := vm.ToHash(map[string]interface{}{"a": 1, "b": []interface{}{"x", 2.5}}, nil)
+	if m.Inspect() != "{a: 1, b: [x, 2.5]}" {
+		t.Fatalf("unexpected hash: %s", m.Inspect())
+	}
+	for _, val := range []interface{}{nil, 3, "steve", time.Now()} {
+		if out := vm.ToHash(val, nil); len(out.Pairs) != 0 {
+			t.Fatalf("expected an empty hash for %v, got %s", val, out.Inspect())
+		}
+	}
+}
+
+// TestCyclicObjects tests running scripts against objects which refer
+// back to themselves.
+func TestCyclicObjects(t *testing.T) {
+
+	type Node struct {
+		Name   string
+		Next   *Node
+		Shared *Node
+	}
+
+	leaf := &Node{Name: "leaf"}
+	a := &Node{Name: "a", Shared: leaf}
+	b := &Node{Name: "b", Next: a, Shared: leaf}
+	a.Next = b
+
+	m := map[string]interface{}{"name": "m"}
+	m["self"] = m
+
+	tests := []struct {
+		Object interface{}
+		Input  string
+		Result string
+	}{
+		{Object: a, Input: `return Next.Name;`, Result: "b"},
+		{Object: a, Input: `return Next.Next;`, Result: "null"},
+		{Object: a, Input: `return Shared.Name + Next.Shared.Name;`, Result: "leafleaf"},
+		{Object: map[string]interface{}{"m": m}, Input: `return m.self;`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		for _, obj := range []interface{}{tst.Object, vm.ToHash(tst.Object, nil)} {
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestFunctionWithParams tests host functions with default arguments.
+func TestFunctionWithParams(t *testing.T) {
+
+	e := New(`return [ round(Price), round(Price, 2) ];`)
+
+	err := e.AddFunctionWithParams("round", []environment.Param{
+		{Name: "x"},
+		{Name: "places", Default: &object.Integer{Value: 0}},
+	}, func(args []object.Object) object.Object {
+		x := args[0].(*object.Float).Value
+		pow := math.Pow(10, float64(args[1].(*object.Integer).Value))
+		return &object.Float{Value: math.Round(x*pow) / pow}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	ret, err := e.Execute(map[string]interface{}{"Price": 3.14159})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if ret.Inspect() != "[3, 3.14]" {
+		t.Fatalf("unexpected result: %s", ret.Inspect())
+	}
+
+	// The number of arguments is checked too.
+	e = New(`return round() + round(1.5, 2, 3);`)
+	e.AddFunctionWithParams("round", []environment.Param{
+		{Name: "x"},
+		{Name: "places", Default: &object.Integer{Value: 0}},
+	}, func(args []object.Object) object.Object { return args[0] })
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	problems, err := e.Check()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(problems) != 2 ||
+		problems[0] != "line 1, col 13: wrong number of arguments to round: got 0, expected 1 to 2" ||
+		problems[1] != "line 1, col 23: wrong number of arguments to round: got 3, expected 1 to 2" {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	_, err = e.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "round: missing argument x") {
+		t.Fatalf("expected a missing argument error, got %v", err)
+	}
+}
+
+// TestCoercion tests that values of custom types may be converted.
+func TestCoercion(t *testing.T) {
+
+	// A nullable integer, as you might get from a database.
+	type NullInt struct {
+		Value int64
+		Valid bool
+	}
+
+	// A type which would otherwise be treated as a string.
+	type Cents string
+
+	type Order struct {
+		ID       json.Number
+		Quantity NullInt
+		Discount NullInt
+		Price    Cents
+		Extras   []Cents
+		Items    []interface{}
+	}
+
+	order := &Order{
+		ID:       json.Number("42"),
+		Quantity: NullInt{Value: 3, Valid: true},
+		Price:    "1250",
+		Extras:   []Cents{"100", "25"},
+		Items:    []interface{}{json.Number("1.5"), NullInt{Value: 7, Valid: true}},
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return ID + 1;`, Result: "43"},
+		{Input: `return Quantity * 2;`, Result: "6"},
+		{Input: `return Discount == null;`, Result: "true"},
+		{Input: `return Price;`, Result: "12.5"},
+		{Input: `return sum(Extras);`, Result: "1.25"},
+		{Input: `return Items;`, Result: "[1.5, 7]"},
+	}
+
+	e := New("")
+	e.AddCoercion(NullInt{}, func(val interface{}) object.Object {
+		n := val.(NullInt)
+		if !n.Valid {
+			return nil
+		}
+		return &object.Integer{Value: n.Value}
+	})
+	e.AddCoercion(Cents(""), func(val interface{}) object.Object {
+		f, _ := strconv.ParseFloat(string(val.(Cents)), 64)
+		return &object.Float{Value: f / 100}
+	})
+
+	for _, tst := range tests {
+
+		e.Script = tst.Input
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		for _, obj := range []interface{}{order, vm.ToHash(order, e.Environment())} {
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// JSON numbers are converted by default, in maps too.
+	var obj map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(`{"count": 3, "ratio": 0.5, "tags": [1, 2]}`))
+	dec.UseNumber()
+	err := dec.Decode(&obj)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err.Error())
+	}
+
+	e = New(`return count > 2 && ratio < 1 && type(count) == "integer" && tags[1] == 2;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ok, err := e.Run(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !ok {
+		t.Fatalf("expected JSON numbers to be converted")
+	}
+
+	// Removing a coercion restores the default conversion.
+	e = New(`return Price;`)
+	e.AddCoercion(Cents(""), func(val interface{}) object.Object { return &object.Integer{Value: 1} })
+	e.AddCoercion(Cents(""), nil)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := e.Execute(order)
+	if err != nil || ret.Type() != object.STRING {
+		t.Fatalf("expected a string, got %v %v", ret, err)
+	}
+}
+
+// TestHashLiteral tests that scripts may create, and return, hashes.
+func TestHashLiteral(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return {};`, Result: "{}"},
+		{Input: `return { "name": "Steve" };`, Result: "{name: Steve}"},
+		{Input: `return { "name": "Steve", "age": 40 + 5, };`, Result: "{age: 45, name: Steve}"},
+		{Input: `key = "tier"; return { key: "gold" };`, Result: "{tier: gold}"},
+		{Input: `return { "a" + "b": 1 < 2 };`, Result: "{ab: true}"},
+		{Input: `return { "a": 1, "a": 2 };`, Result: "{a: 2}"},
+		{Input: `return { "tags": [ "a", { "b": [] } ], "empty": {} };`, Result: "{empty: {}, tags: [a, {b: []}]}"},
+		{Input: `h = { "user": { "name": "Steve" } }; return h.user.name;`, Result: "Steve"},
+		{Input: `return len({ "a": 1, "b": 2 });`, Result: "2"},
+		{Input: `return { "a": 1 } == { "a": 1 };`, Result: "true"},
+		{Input: `if ( { "a": 1 } ) { return "yes"; } return "no";`, Result: "yes"},
+		{Input: `if ( {} ) { return "yes"; } return "no";`, Result: "no"},
+		{Input: `score = Count * 10; return { "score": score, "tier": score > 20 ? "gold" : "silver" };`, Result: "{score: 30, tier: gold}"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(map[string]interface{}{"Count": 3})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// Parse errors
+	for _, input := range []string{`return { "a" };`, `return { "a": 1 "b": 2 };`, `return { "a": };`, `return { "a": 1`, `return { , };`} {
+		e := New(input)
+		if e.Prepare() == nil {
+			t.Fatalf("expected an error compiling '%s'", input)
+		}
+	}
+
+	// Keys must be strings
+	e := New(`return { 1: "one" };`)
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = e.Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "hash keys must be strings, not INTEGER") {
+		t.Fatalf("expected an error with an integer key, got %v", err)
+	}
+}
+
+// TestCaseInsensitive tests the case-insensitive operators.
+func TestCaseInsensitive(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `"Steve" ==* "steve"`, Result: "true"},
+		{Input: `"Steve" ==* "STEVE"`, Result: "true"},
+		{Input: `"Steve" ==* "Stephen"`, Result: "false"},
+		{Input: `"ÅSA" ==* "åsa"`, Result: "true"},
+		{Input: `"Steve" !=* "steve"`, Result: "false"},
+		{Input: `"Steve" !=* "Stephen"`, Result: "true"},
+		{Input: `"Steve" == "steve"`, Result: "false"},
+		{Input: `"Hello World" ~=* /WORLD/`, Result: "true"},
+		{Input: `"Hello World" ~=* "^hello"`, Result: "true"},
+		{Input: `"Hello World" ~= /WORLD/`, Result: "false"},
+		{Input: `"Hello World" !~* /WORLD/`, Result: "false"},
+		{Input: `"Hello World" !~* /moon/`, Result: "true"},
+		{Input: `name ==* "STEVE"`, Result: "true"},
+		{Input: `3 ==* 3.0`, Result: "true"},
+		{Input: `3 !=* 4`, Result: "true"},
+		{Input: `true ==* true`, Result: "true"},
+		{Input: `null ==* null`, Result: "true"},
+		{Input: `"a" ==* null`, Result: "false"},
+		{Input: `["A"] ==* ["a"]`, Result: "false"},
+		{Input: `"A" ==* "a" && "b" ==* "B"`, Result: "true"},
+		{Input: `not "A" ==* "a"`, Result: "false"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(fmt.Sprintf(`name = "steve"; return %s;`, tst.Input))
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// Mismatched types are an error, as they are for the regular
+	// operators.
+	for _, input := range []string{`return "3" ==* 3;`, `return 3 ~=* /3/;`} {
+		e := New(input)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", input, err.Error())
+		}
+		_, err = e.Execute(nil)
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", input)
+		}
+	}
+}
+
+// TestNot tests the `not` keyword, and the `not in` operator.
+func TestNot(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `not true`, Result: "false"},
+		{Input: `not false`, Result: "true"},
+		{Input: `not ""`, Result: "true"},
+		{Input: `not 1 == 2`, Result: "true"},
+		{Input: `not 1 < 2`, Result: "false"},
+		{Input: `not 1 + 1 == 2`, Result: "false"},
+		{Input: `not 1 == 2 && false`, Result: "false"},
+		{Input: `not 1 == 1 || true`, Result: "true"},
+		{Input: `not (1 == 1 || true)`, Result: "false"},
+		{Input: `true && not 1 == 2`, Result: "true"},
+		{Input: `not not true`, Result: "true"},
+		{Input: `not 1 == 2 ? "yes" : "no"`, Result: "yes"},
+		{Input: `3 not in [1, 2]`, Result: "true"},
+		{Input: `2 not in [1, 2]`, Result: "false"},
+		{Input: `1 + 1 not in [1, 2]`, Result: "false"},
+		{Input: `3 not in [1, 2] && 2 in [1, 2]`, Result: "true"},
+		{Input: `not 3 in [1, 2]`, Result: "true"},
+		{Input: `not 3 not in [1, 2]`, Result: "false"},
+		{Input: `"Steve" !~ /steve/ == not "Steve" ~= /steve/`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(fmt.Sprintf("return %s;", tst.Input))
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(nil)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	for _, input := range []string{`return not;`, `return 1 not 2;`, `return 1 not;`} {
+		e := New(input)
+		if e.Prepare() == nil {
+			t.Fatalf("expected an error compiling '%s'", input)
+		}
+	}
+}
+
+// TestNumericLiterals tests that each form of numeric literal matches
+// its decimal equivalent.
+func TestNumericLiterals(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+		Error  bool
+	}
+
+	tests := []Test{
+		{Input: `0xFF`, Result: "255"},
+		{Input: `0Xff`, Result: "255"},
+		{Input: `0o17`, Result: "15"},
+		{Input: `0b1010`, Result: "10"},
+		{Input: `1_000_000`, Result: "1000000"},
+		{Input: `0xFF_FF`, Result: "65535"},
+		{Input: `1.5e3`, Result: "1500"},
+		{Input: `2E-2`, Result: "0.02"},
+		{Input: `1_000.5`, Result: "1000.5"},
+		{Input: `0b102`, Error: true},
+		{Input: `0xZ`, Error: true},
+		{Input: `1__0`, Error: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(fmt.Sprintf("return %s;", tst.Input))
+
+		p := obj.Prepare()
+		if p != nil {
+			if !tst.Error {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+			continue
+		}
+		if tst.Error {
+			t.Fatalf("Expected error compiling '%s', got none", tst.Input)
+		}
+
+		ret, err := obj.Execute(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+
+		// And the same value must be produced by converting
+		// the string at run-time.
+		obj = New(fmt.Sprintf("return sum([\"%s\"]) == %s;", tst.Input, tst.Input))
+		p = obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+		ok, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Found unexpected error converting '%s' - %s\n", tst.Input, err.Error())
+		}
+		if !ok {
+			t.Fatalf("Converting '%s' at run-time gave a different result", tst.Input)
+		}
+	}
+}
+
+// TestStringLiterals tests escape-sequences, and raw strings.
+func TestStringLiterals(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result bool
+	}
+
+	tests := []Test{
+		{Input: `return Value == "tab\there";`, Result: true},
+		{Input: `return Value == "tab\u0009here";`, Result: true},
+		{Input: "return Value == `tab\there`;", Result: true},
+		{Input: "return len(`a\\tb`) == 4;", Result: true},
+		{Input: "return `line one\nline two` == \"line one\\nline two\";", Result: true},
+		{Input: "return Value ~= `^tab\\s+here$`;", Result: true},
+		{Input: `return Quote == "say \"hi\"";`, Result: true},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Value": "tab\there", "Quote": `say "hi"`})
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+		if ret != tst.Result {
+			t.Fatalf("Found unexpected result running '%s'", tst.Input)
+		}
+	}
+
+	// Unterminated strings report their position
+	obj := New("a = 1;\nb = `oops;\n")
+	p := obj.Prepare()
+	if p == nil {
+		t.Fatalf("expected an error compiling an unterminated string")
+	}
+	if !strings.Contains(p.Error(), "line 2, column 5") {
+		t.Fatalf("unexpected error: %s", p.Error())
+	}
+}
+
+// TestErrorPositions ensures that errors report their location.
+func TestErrorPositions(t *testing.T) {
+
+	type Test struct {
+		Input string
+		Error string
+	}
+
+	tests := []Test{
+		{Input: "x = 3;\n  return x >< 2;", Error: "line 2, col 13: no prefix parse function for <"},
+		{Input: "a = 1;\nb = 2;\nreturn \"a\" - b;", Error: "line 3, col 12: type mismatch"},
+		{Input: "x = 3;\nreturn x / 0;", Error: "line 2, col 10: attempted division by zero"},
+		{Input: "x = 3;\nreturn x % 0;", Error: "line 2, col 10: attempted division by zero"},
+		{Input: "return 3 / 0;", Error: "line 1, col 10: attempted division by zero"},
+		{Input: "return 5.5 % 0;", Error: "line 1, col 12: attempted division by zero"},
+		{Input: "return 5 % 0.0;", Error: "line 1, col 10: attempted division by zero"},
+		{Input: "return 5.5 % 0.0;", Error: "line 1, col 12: attempted division by zero"},
+		{Input: "if ( true ) {\n  print(foo(3));\n}\nreturn true;", Error: "line 2, col 12: the function foo does not exist"},
+	}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+
+			err := obj.Prepare(flags)
+			if err == nil {
+				_, err = obj.Run(nil)
+			}
+			if err == nil {
+				t.Fatalf("expected an error running '%s'", tst.Input)
+			}
+			if !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error '%s', got '%s'", tst.Error, err.Error())
+			}
+		}
+	}
+}
+
+// TestMatchExtraction tests extracting values via regular expressions.
+func TestMatchExtraction(t *testing.T) {
+
+	tests := []string{
+		`m = matchGroups(Line, "user=([a-z]+) id=([0-9]+)"); return m[1] == "steve" && int(m[2]) == 42;`,
+		`return matchNamed(Line, "id=(?P<id>[0-9]+)").id == "42";`,
+		`return !match(Line, "^nope");`,
+		`return match(Line, "^user") == true && match(Line, "^nope") == false;`,
+		`return matchGroups(Line, "^nope") == null;`,
+		`return matchNamed(Line, "^nope")?.id ?? true;`,
+		`return Line ~= /user=steve/ && Line !~ /nope/;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.Run(map[string]interface{}{"Line": "user=steve id=42"})
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+		if !ret {
+			t.Fatalf("Found unexpected result running '%s'", tst)
+		}
+	}
+}
+
+// TestJSONPath tests querying reflected structures with jsonpath.
+func TestJSONPath(t *testing.T) {
+
+	type Item struct {
+		Price float64
+		Tags  []string
+	}
+	type Order struct {
+		Items []Item
+		Meta  map[string]interface{}
+	}
+
+	order := Order{
+		Items: []Item{{Price: 1.5, Tags: []string{"x"}}, {Price: 2, Tags: []string{"y", "z"}}},
+		Meta:  map[string]interface{}{"path": "$.Items[1].Price"},
+	}
+
+	tests := []string{
+		`return jsonpath(Items, "$[0].Price") == 1.5;`,
+		`return jsonpath(Meta, "path") == "$.Items[1].Price";`,
+		`return sum(jsonpath(Items, "$[*].Price")) == 3.5;`,
+		`return len(jsonpath(Items, "$[*].Tags[*]")) == 3;`,
+		`return jsonpath(Items, "$[5].Price") ?? true;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		p := obj.Prepare()
+		if p != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst, p.Error())
+		}
+
+		ret, err := obj.Run(order)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst, err.Error())
+		}
+		if !ret {
+			t.Fatalf("Found unexpected result running '%s'", tst)
+		}
+	}
+}
+
+// TestDumpAST tests the AST-dumping of a program.
+func TestDumpAST(t *testing.T) {
+
+	obj := New(`if ( a && b || !c[1] ) { return true; } else { x = len(y?.z) + 1; }`)
+
+	_, err := obj.DumpAST()
+	if err == nil {
+		t.Fatalf("expected an error dumping an unprepared script")
+	}
+
+	err = obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	out, err := obj.DumpAST()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := `Program
+  ExpressionStatement
+    IfExpression
+      Condition: InfixExpression ||
+        InfixExpression &&
+          Identifier a
+          Identifier b
+        PrefixExpression !
+          IndexExpression
+            Identifier c
+            Index: IntegerLiteral 1
+      Consequence: BlockStatement
+        ReturnStatement
+          BooleanLiteral true
+      Alternative: BlockStatement
+        ExpressionStatement
+          AssignStatement x
+            InfixExpression +
+              CallExpression len
+                MemberExpression ?.z
+                  Identifier y
+              IntegerLiteral 1
+`
+	if out != expected {
+		t.Fatalf("unexpected AST dump:\n%s", out)
+	}
+}
+
+// TestSaveLoad tests that compiled programs may be saved, and loaded.
+func TestSaveLoad(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Result string
+	}
+
+	tests := []Test{
+		{Input: `return 1 + 2 * 3;`, Result: "7"},
+		{Input: `return 3.25 * 2 - 0.5;`, Result: "6"},
+		{Input: `return 100000 * 3;`, Result: "300000"},
+		{Input: `return Name == "Steve" && Count > 2;`, Result: "true"},
+		{Input: `return Name ~= /^st/i;`, Result: "true"},
+		{Input: `a = [ 1, 2, 3 ][1:]; return a[1];`, Result: "3"},
+		{Input: `sum = 0; foreach n in 1..Count { sum = sum + n; } return sum;`, Result: "6"},
+		{Input: `if ( Missing ?? true ) { return "yes"; } else { return "no"; }`, Result: "yes"},
+		{Input: `return 1 < Count < 5;`, Result: "true"},
+		{Input: `function double(n) { return n * 2; } return double(Count);`, Result: "6"},
+	}
+
+	obj := map[string]interface{}{"Name": "Steve", "Count": 3}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			orig := New(tst.Input)
+			err := orig.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			var buf bytes.Buffer
+			err = orig.Save(&buf)
+			if err != nil {
+				t.Fatalf("Failed to save '%s': %s", tst.Input, err.Error())
+			}
+
+			loaded := New("")
+			err = loaded.Load(&buf)
+			if err != nil {
+				t.Fatalf("Failed to load '%s': %s", tst.Input, err.Error())
+			}
+
+			for _, e := range []*Eval{orig, loaded} {
+				out, err := e.Execute(obj)
+				if err != nil {
+					t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+				}
+				if out.Inspect() != tst.Result {
+					t.Fatalf("Found unexpected result running '%s': %s", tst.Input, out.Inspect())
+				}
+			}
+		}
+	}
+
+	// Positions are preserved, for error-reporting.
+	orig := New("x = 3;\nreturn x / 0;")
+	if err := orig.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	if err := orig.Save(&buf); err != nil {
+		t.Fatalf("Failed to save: %s", err.Error())
+	}
+	loaded := New("")
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Failed to load: %s", err.Error())
+	}
+	_, err := loaded.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "line 2, col 10") {
+		t.Fatalf("expected a positioned error, got %v", err)
+	}
+
+	// Saving an unprepared script is an error.
+	if err := New("return true;").Save(&buf); err == nil {
+		t.Fatalf("expected an error saving an unprepared script")
+	}
+
+	// The script is parsed again, so it may be examined.
+	orig = New(`if ( Age > 18 ) { assert(Age < 200); return true; } return false;`)
+	if err := orig.Prepare([]byte{NoAssert}); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	buf.Reset()
+	if err := orig.Save(&buf); err != nil {
+		t.Fatalf("Failed to save: %s", err.Error())
+	}
+	loaded = New("")
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Failed to load: %s", err.Error())
+	}
+	fields, err := loaded.Fields()
+	if err != nil || strings.Join(fields, ",") != "Age" {
+		t.Fatalf("unexpected fields after loading: %v %v", fields, err)
+	}
+	want, _ := orig.DumpAST()
+	dump, err := loaded.DumpAST()
+	if err != nil || dump != want {
+		t.Fatalf("unexpected AST after loading: %v", err)
+	}
+	explained, err := loaded.Explain(map[string]interface{}{"Age": 300})
+	if err != nil || !explained.Result.True() {
+		t.Fatalf("unexpected explanation after loading: %v", err)
+	}
+
+	// Loading bogus input is an error.
+	bogus := []string{
+		"",
+		"{",
+		`{"version": 99}`,
+		`{"version": 1}`,
+		`{"version": 2, "constants": [{"type": "ARRAY"}]}`,
+		`{"version": 2, "constants": [{"type": "INTEGER", "value": "x"}]}`,
+		`{"version": 2, "source": "return ("}`,
+	}
+
+	// As is loading malformed bytecode.
+	malformed := [][]byte{
+		{255},
+		{byte(code.OpConstant), 0},
+		{byte(code.OpConstant), 0, 1, byte(code.OpReturn)},
+		{byte(code.OpCheckComparison), 0, 0, byte(code.OpReturn)},
+		{byte(code.OpJump), 0, 2, byte(code.OpConstant), 0, 0, byte(code.OpReturn)},
+		{byte(code.OpJump), 0, 9, byte(code.OpReturn)},
+	}
+	for _, ins := range malformed {
+		prg, _ := json.Marshal(savedProgram{
+			Version:      programVersion,
+			Constants:    []savedConstant{{Type: object.INTEGER, Value: "1"}},
+			Instructions: ins,
+		})
+		bogus = append(bogus, string(prg))
+
+		prg, _ = json.Marshal(savedProgram{
+			Version:      programVersion,
+			Constants:    []savedConstant{{Type: object.INTEGER, Value: "1"}},
+			Instructions: []byte{byte(code.OpConstant), 0, 0, byte(code.OpReturn)},
+			Functions:    []savedFunction{{Name: "bogus", Instructions: ins}},
+		})
+		bogus = append(bogus, string(prg))
+	}
+
+	for _, input := range bogus {
+		if err := New("").Load(strings.NewReader(input)); err == nil {
+			t.Fatalf("expected an error loading '%s'", input)
+		}
+	}
+}
+
+// TestProgramVersion fails when the opcodes change, as a reminder that
+// programVersion must be increased whenever the bytecode changes.
+func TestProgramVersion(t *testing.T) {
+
+	var opcodes strings.Builder
+	for op := range code.OpCodeNames {
+		fmt.Fprintf(&opcodes, "%s:%d\n", code.String(code.Opcode(op)), code.Length(code.Opcode(op)))
+	}
+
+	// The version, and summary of the opcodes, when the version was
+	// last increased.
+	sum := crc32.ChecksumIEEE([]byte(opcodes.String()))
+	if programVersion != 2 || sum != 0x79EC134F {
+		t.Fatalf("the opcodes have changed (0x%08X) - increase programVersion, and update this test", sum)
+	}
+}
+
+// TestDiagnostics tests recording all the conditions which failed.
+func TestDiagnostics(t *testing.T) {
+
+	type Test struct {
+		Input    string
+		Result   bool
+		Failures []string
+	}
+
+	tests := []Test{
+		{Input: `return Age >= 18 && Name != "" && Email ~= /@/;`, Result: false, Failures: []string{`line 1, col 12: (Age >= 18) failed`, `line 1, col 41: (Email ~= /@/) failed`}},
+		{Input: `return Age > 1 && Name == "Steve";`, Result: true},
+		{Input: `if ( Age >= 18 && ( Name == "Bob" || Email == "" ) ) { return true; } return false;`, Result: false, Failures: []string{`line 1, col 10: (Age >= 18) failed`, `line 1, col 35: ((Name == "Bob") || (Email == "")) failed`}},
+		{Input: `return Name == "Bob" || Age < 3 && Age < 4;`, Result: false, Failures: []string{`line 1, col 22: ((Name == "Bob") || (Age < 3)) failed`}},
+		{Input: `return Age > 18;`, Result: false},
+	}
+
+	obj := map[string]interface{}{"Age": 3, "Name": "Steve", "Email": "steve.example.com"}
+
+	for _, tst := range tests {
+
+		for _, flags := range [][]byte{{Diagnostics}, {Diagnostics, NoOptimize}} {
+
+			e := New(tst.Input)
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			res, diags, err := e.RunWithDiagnostics(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+			if res != tst.Result {
+				t.Fatalf("Found unexpected result running '%s'", tst.Input)
+			}
+
+			var found []string
+			for _, d := range diags {
+				found = append(found, d.String())
+			}
+			if strings.Join(found, "\n") != strings.Join(tst.Failures, "\n") {
+				t.Fatalf("unexpected diagnostics for '%s':\n%s", tst.Input, strings.Join(found, "\n"))
+			}
+
+			// The normal result is unchanged
+			res, err = e.Run(obj)
+			if err != nil || res != tst.Result {
+				t.Fatalf("Found unexpected result running '%s'", tst.Input)
+			}
+		}
+	}
+
+	// Failed comparisons give the reason, with the values compared.
+	reasons := []struct {
+		Input  string
+		Reason []string
+	}{
+		{Input: `return Age >= 18 && Name != "";`, Reason: []string{`Age (3) is not >= 18`}},
+		{Input: `return 18 <= Age && Name == "Bob";`, Reason: []string{`18 is not <= Age (3)`, `Name ("Steve") is not == "Bob"`}},
+		{Input: `min = 4; return Age >= min && true;`, Reason: []string{`Age (3) is not >= min (4)`}},
+		{Input: `return len(Name) > 10 && Email ~= /@/;`, Reason: []string{`len(Name) (5) is not > 10`, `Email ("steve.example.com") is not ~= "@"`}},
+		{Input: `return Age in [1, 2] && true;`, Reason: []string{`Age (3) is not in [1, 2]`}},
+
+		// Conditions which aren't comparisons have no reason.
+		{Input: `return !Name && Age > 1;`, Reason: []string{``}},
+		{Input: `return (Age > 5 || Age < 1) && true;`, Reason: []string{``}},
+		{Input: `return 1 > 2 && Age > 1;`, Reason: []string{`1 is not > 2`}},
+	}
+
+	for _, tst := range reasons {
+
+		e := New(tst.Input)
+		err := e.Prepare([]byte{Diagnostics})
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		_, diags, err := e.RunWithDiagnostics(obj)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+
+		var found []string
+		for _, d := range diags {
+			found = append(found, d.Reason)
+		}
+		if strings.Join(found, "\n") != strings.Join(tst.Reason, "\n") {
+			t.Fatalf("unexpected reasons for '%s':\n%s", tst.Input, strings.Join(found, "\n"))
+		}
+	}
+
+	// A comparison which failed with an error has no operands to report.
+	e := New(`return Age > 1 && Name > 3;`)
+	e.SetErrorsAsFalse(true)
+	if err := e.Prepare([]byte{Diagnostics}); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, diags, err := e.RunWithDiagnostics(obj)
+	if err != nil || len(diags) != 1 || diags[0].Condition != "(Name > 3)" || diags[0].Reason != "" {
+		t.Fatalf("unexpected diagnostics for a comparison error: %v %v", diags, err)
+	}
+
+	// Diagnostics must be enabled
+	e = New("return false;")
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	if _, _, err := e.RunWithDiagnostics(nil); err == nil {
+		t.Fatalf("expected an error running without diagnostics enabled")
+	}
+}
+
+// TestFilterSlice tests filtering a slice of objects.
+func TestFilterSlice(t *testing.T) {
+
+	type Person struct {
+		Name string
+		Age  int
+	}
+
+	objs := []interface{}{
+		Person{Name: "Steve", Age: 44},
+		Person{Name: "Bob", Age: 12},
+		map[string]interface{}{"Name": "Alice", "Age": 31},
+		Person{Name: "Eve", Age: 17},
+	}
+
+	e := New(`return Age >= 18;`)
+
+	_, err := e.FilterSlice(objs)
+	if err == nil {
+		t.Fatalf("expected an error filtering with an unprepared script")
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	out, err := e.FilterSlice(objs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(out) != 2 || out[0] != objs[0] || fmt.Sprintf("%v", out[1]) != fmt.Sprintf("%v", objs[2]) {
+		t.Fatalf("unexpected result: %v", out)
+	}
+
+	// Empty input gives empty output
+	out, err = e.FilterSlice(nil)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("unexpected result filtering nothing: %v %v", out, err)
+	}
+
+	// Errors report the element which caused them
+	e = New(`return 10 / Age > 1;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = e.FilterSlice([]interface{}{Person{Age: 1}, Person{Age: 0}})
+	if err == nil || !strings.HasPrefix(err.Error(), "element 1:") {
+		t.Fatalf("expected an error for element 1, got %v", err)
+	}
+}
+
+// TestFilterSliceLimit tests that filtering stops after finding the
+// requested number of matches.
+func TestFilterSliceLimit(t *testing.T) {
+
+	var objs []interface{}
+	for i := 0; i < 10; i++ {
+		objs = append(objs, map[string]interface{}{"Id": i})
+	}
+
+	// Record the objects which are tested.
+	tested := 0
+	e := New(`return test(Id % 3 == 0);`)
+	e.AddFunction("test", func(args []object.Object) object.Object {
+		tested++
+		return args[0]
+	})
+
+	_, err := e.FilterSliceLimit(objs, 2)
+	if err == nil {
+		t.Fatalf("expected an error filtering with an unprepared script")
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	tests := []struct {
+		N      int
+		Result string
+		Tested int
+	}{
+		{N: 2, Result: "[map[Id:0] map[Id:3]]", Tested: 4},
+		{N: 1, Result: "[map[Id:0]]", Tested: 1},
+		{N: 4, Result: "[map[Id:0] map[Id:3] map[Id:6] map[Id:9]]", Tested: 10},
+		{N: 10, Result: "[map[Id:0] map[Id:3] map[Id:6] map[Id:9]]", Tested: 10},
+		{N: 0, Result: "[]", Tested: 0},
+		{N: -1, Result: "[]", Tested: 0},
+	}
+
+	for _, tst := range tests {
+
+		tested = 0
+		out, err := e.FilterSliceLimit(objs, tst.N)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if fmt.Sprintf("%v", out) != tst.Result || tested != tst.Tested {
+			t.Fatalf("unexpected result with limit %d: %v, after testing %d objects", tst.N, out, tested)
+		}
+	}
+}
+
+// TestFilterSliceParallel ensures that filtering in parallel gives the
+// same results as filtering serially.
+func TestTopN(t *testing.T) {
+
+	type Item struct {
+		Name     string
+		Price    float64
+		Quantity int
+	}
+
+	objs := []interface{}{
+		Item{Name: "a", Price: 1.5, Quantity: 2},
+		Item{Name: "b", Price: 10, Quantity: 1},
+		Item{Name: "c", Price: 0.5, Quantity: 100},
+		map[string]interface{}{"Name": "d", "Price": 3, "Quantity": 1},
+		Item{Name: "e", Price: 1, Quantity: 3},
+		Item{Name: "f", Price: 2, Quantity: 5},
+	}
+
+	e := New(`return Price * Quantity;`)
+
+	_, err := e.TopN(objs, 2)
+	if err == nil {
+		t.Fatalf("expected an error with an unprepared script")
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	names := func(objs []interface{}) string {
+		var out []string
+		for _, obj := range objs {
+			if item, ok := obj.(Item); ok {
+				out = append(out, item.Name)
+			} else {
+				out = append(out, obj.(map[string]interface{})["Name"].(string))
+			}
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		N      int
+		Result string
+	}{
+		{N: 0, Result: ""},
+		{N: -1, Result: ""},
+		{N: 1, Result: "c"},
+		{N: 3, Result: "c,b,f"},
+
+		// "a", "d", and "e" all score 3, so keep their order.
+		{N: 5, Result: "c,b,f,a,d"},
+		{N: 6, Result: "c,b,f,a,d,e"},
+		{N: 100, Result: "c,b,f,a,d,e"},
+	}
+
+	for _, tst := range tests {
+		out, err := e.TopN(objs, tst.N)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if names(out) != tst.Result {
+			t.Fatalf("unexpected result for TopN(%d): %s", tst.N, names(out))
+		}
+	}
+
+	// Errors report the element which caused them
+	objs = append(objs, map[string]interface{}{"Name": "g", "Price": "free", "Quantity": 1})
+	_, err = e.TopN(objs, 2)
+	if err == nil || !strings.HasPrefix(err.Error(), "element 6: ") {
+		t.Fatalf("expected an error for element 6, got %v", err)
+	}
+
+	// The score must be a number
+	e = New(`return Name;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = e.TopN(objs, 2)
+	if err == nil || err.Error() != "element 0: score must be a number, not STRING" {
+		t.Fatalf("expected an error for a non-numeric score, got %v", err)
+	}
+
+	// Integer scores are compared exactly, even beyond 2^53 where
+	// they can't all be represented as floats.
+	e = New(`return Score;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	large := []interface{}{
+		map[string]interface{}{"Name": "a", "Score": int64(1) << 53},
+		map[string]interface{}{"Name": "b", "Score": int64(1)<<53 + 1},
+		map[string]interface{}{"Name": "c", "Score": 2.5},
+	}
+	out, err := e.TopN(large, 3)
+	if err != nil || names(out) != "b,a,c" {
+		t.Fatalf("unexpected result for large scores: %s %v", names(out), err)
+	}
+
+	// NaN can't be ordered, so it is an error.
+	large = append(large, map[string]interface{}{"Name": "d", "Score": math.NaN()})
+	_, err = e.TopN(large, 3)
+	if err == nil || err.Error() != "element 3: score must be a number, not NaN" {
+		t.Fatalf("expected an error for a NaN score, got %v", err)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+
+	type Item struct {
+		Name     string
+		Category string
+		Price    float64
+	}
+
+	objs := []interface{}{
+		Item{Name: "a", Category: "fruit", Price: 1.5},
+		Item{Name: "b", Category: "veg", Price: 10},
+		Item{Name: "c", Category: "fruit", Price: 0.5},
+		map[string]interface{}{"Name": "d", "Category": "veg", "Price": 3},
+		Item{Name: "e", Price: 1},
+		Item{Name: "f", Category: "fruit", Price: 2},
+	}
+
+	e := New(`return Category;`)
+
+	_, err := e.GroupBy(objs)
+	if err == nil {
+		t.Fatalf("expected an error with an unprepared script")
+	}
+
+	names := func(objs []interface{}) string {
+		var out []string
+		for _, obj := range objs {
+			if item, ok := obj.(Item); ok {
+				out = append(out, item.Name)
+			} else {
+				out = append(out, obj.(map[string]interface{})["Name"].(string))
+			}
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		Input  string
+		Result map[string]string
+	}{
+		{Input: `return Category;`, Result: map[string]string{"fruit": "a,c,f", "veg": "b,d", "": "e"}},
+		{Input: `if ( Category == "" ) { return null; } return upper(Category);`, Result: map[string]string{"FRUIT": "a,c,f", "VEG": "b,d"}},
+		{Input: `return Price > 1.5;`, Result: map[string]string{"true": "b,d,f", "false": "a,c,e"}},
+		{Input: `return Price;`, Result: map[string]string{"0.5": "c", "1": "e", "1.5": "a", "2": "f", "3": "d", "10": "b"}},
+		{Input: `return null;`, Result: map[string]string{}},
+	}
+
+	for _, tst := range tests {
+
+		e = New(tst.Input)
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		out, err := e.GroupBy(objs)
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", tst.Input, err.Error())
+		}
+		if len(out) != len(tst.Result) {
+			t.Fatalf("unexpected number of groups for '%s': %d", tst.Input, len(out))
+		}
+		for key, val := range tst.Result {
+			if names(out[key]) != val {
+				t.Fatalf("unexpected group %q for '%s': %s", key, tst.Input, names(out[key]))
+			}
+		}
+	}
+
+	// Errors report the element which caused them
+	errors := []struct {
+		Input string
+		Error string
+	}{
+		{Input: `return Price / (Price - 10);`, Error: "element 1: "},
+		{Input: `return [ Category ];`, Error: "element 0: key must be a string, number, or boolean, not ARRAY"},
+	}
+
+	for _, tst := range errors {
+
+		e = New(tst.Input)
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+		_, err = e.GroupBy(objs)
+		if err == nil || !strings.HasPrefix(err.Error(), tst.Error) {
+			t.Fatalf("expected an error for '%s', got %v", tst.Input, err)
+		}
+	}
+}
+
+func TestDistinctBy(t *testing.T) {
+
+	type User struct {
+		Name  string
+		Email string
+		ID    int
+	}
+
+	objs := []interface{}{
+		User{Name: "a", Email: "steve@example.com", ID: 1},
+		User{Name: "b", Email: "bob@example.com", ID: 2},
+		User{Name: "c", Email: "Steve@Example.com", ID: 3},
+		User{Name: "d", ID: 1},
+		User{Name: "e", Email: "bob@example.com", ID: 5},
+		User{Name: "f", Email: "chris@example.com", ID: 3},
+	}
+
+	e := New(`return Email;`)
+
+	_, err := e.DistinctBy(objs)
+	if err == nil {
+		t.Fatalf("expected an error with an unprepared script")
+	}
+
+	names := func(objs []interface{}) string {
+		var out []string
+		for _, obj := range objs {
+			out = append(out, obj.(User).Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return Email;`, Result: "a,b,c,d,f"},
+		{Input: `return lower(Email);`, Result: "a,b,d,f"},
+		{Input: `if ( Email == "" ) { return null; } return lower(Email);`, Result: "a,b,f"},
+		{Input: `return ID;`, Result: "a,b,c,e"},
+		{Input: `return ID > 2;`, Result: "a,c"},
+		{Input: `return null;`, Result: ""},
+	}
+
+	for _, tst := range tests {
+
+		e = New(tst.Input)
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		out, err := e.DistinctBy(objs)
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %s", tst.Input, err.Error())
+		}
+		if names(out) != tst.Result {
+			t.Fatalf("unexpected result for '%s': %s", tst.Input, names(out))
+		}
+	}
+
+	e = New(`return { "id": ID };`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = e.DistinctBy(objs)
+	if err == nil || err.Error() != "element 0: key must be a string, number, or boolean, not HASH" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFilterSliceParallel(t *testing.T) {
+
+	type Item struct {
+		Name  string
+		Count int
+		Tags  []string
+	}
+
+	var objs []interface{}
+	for i := 0; i < 500; i++ {
+		objs = append(objs, Item{Name: fmt.Sprintf("item%d", i), Count: i, Tags: []string{"a", "b", "c"}})
+	}
+
+	// A script which uses variables, and iteration, so that each
+	// worker must have its own state.
+	e := New(`
+total = 0;
+foreach tag in Tags { total = total + len(tag); }
+if ( Name ~= /7/ ) { total++; }
+return Count % 3 == 0 && total == 4;
+`)
+
+	_, err := e.FilterSliceParallel(objs, 4)
+	if err == nil {
+		t.Fatalf("expected an error filtering with an unprepared script")
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	expected, err := e.FilterSlice(objs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(expected) == 0 {
+		t.Fatalf("expected some matches")
+	}
+
+	for _, workers := range []int{-1, 0, 1, 2, 8, 1000} {
+
+		out, err := e.FilterSliceParallel(objs, workers)
+		if err != nil {
+			t.Fatalf("unexpected error with %d workers: %s", workers, err.Error())
+		}
+		if fmt.Sprintf("%v", out) != fmt.Sprintf("%v", expected) {
+			t.Fatalf("%d workers gave different results: %v", workers, out)
+		}
+	}
+
+	// Empty input gives empty output
+	out, err := e.FilterSliceParallel(nil, 4)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("unexpected result filtering nothing: %v %v", out, err)
+	}
+
+	// Errors report the first element which caused them
+	e = New(`return 10 / Count > 1;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = e.FilterSliceParallel([]interface{}{Item{Count: 1}, Item{Count: 0}, Item{Count: 2}, Item{Count: 0}}, 3)
+	if err == nil || !strings.HasPrefix(err.Error(), "element 1:") {
+		t.Fatalf("expected an error for element 1, got %v", err)
+	}
+}
+
+// TestFieldHook ensures that field-accesses are reported.
+func TestFieldHook(t *testing.T) {
+
+	type Person struct {
+		Name string
+		Age  int
+	}
+
+	e := New(`
+name = Name;
+if ( name == "Steve" && Age > 18 && !Missing ) { return true; }
+return false;
+`)
+
+	var reads []string
+	e.SetFieldHook(func(name string, value object.Object) {
+		reads = append(reads, name+"="+value.Inspect())
+	})
+
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	ok, err := e.Run(Person{Name: "Steve", Age: 44})
+	if err != nil || !ok {
+		t.Fatalf("unexpected result: %v %v", ok, err)
+	}
+
+	// The variable "name" is not a field, so it is not reported.
+	expected := "Name=Steve Age=44 Missing=null"
+	if strings.Join(reads, " ") != expected {
+		t.Fatalf("unexpected field reads, got '%s' expected '%s'", strings.Join(reads, " "), expected)
+	}
+
+	// Nested fields are reported by their full path.
+	type Address struct {
+		City string
+	}
+	type User struct {
+		Name    string
+		Address *Address
+		Manager *User
+	}
+	nested := New(`
+if ( User.Address.City == "Helsinki" && User?.Manager?.Name == null ) {
+  return User.Missing == null && Tags[0] == "a";
+}
+return false;
+`)
+	reads = nil
+	nested.SetFieldHook(func(name string, value object.Object) {
+		reads = append(reads, name+"="+value.Inspect())
+	})
+	err = nested.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	obj := map[string]interface{}{
+		"User": User{Name: "Steve", Address: &Address{City: "Helsinki"}},
+		"Tags": []string{"a"},
+	}
+	ok, err = nested.Run(obj)
+	if err != nil || !ok {
+		t.Fatalf("unexpected result: %v %v", ok, err)
+	}
+	expected = "User.Address.City=Helsinki User.Manager=null User.Missing=null Tags=[a]"
+	if strings.Join(reads, " ") != expected {
+		t.Fatalf("unexpected nested field reads, got '%s' expected '%s'", strings.Join(reads, " "), expected)
+	}
+
+	// Removing the hook stops the reports.
+	reads = nil
+	e.SetFieldHook(nil)
+	_, err = e.Run(Person{Name: "Steve", Age: 44})
+	if err != nil || len(reads) != 0 {
+		t.Fatalf("unexpected field reads after removing hook: %v %v", reads, err)
+	}
+}
+
+// TestFields tests the static discovery of referenced fields.
+func TestFields(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Fields string
+	}{
+		{Input: `return true;`, Fields: ""},
+		{Input: `return Name == "Steve" && Age > 18 || Name == "Bob";`, Fields: "Name Age"},
+		{Input: `return len(trim(Title)) > 3 && $Count == 1;`, Fields: "Title Count"},
+		{Input: `x = Origin; if ( x == "MOW" ) { return Country[0:2] == "RU"; } return false;`, Fields: "Origin Country"},
+		{Input: `foreach i, tag in Tags { if ( tag == Wanted ) { return true; } } return false;`, Fields: "Tags Wanted"},
+		{Input: `count = 0; while ( count < Limit ) { count++; } return Person.Name ?? Default;`, Fields: "Limit Person Default"},
+		{Input: `return Value > 3 ? Small : [ Large, Huge ];`, Fields: "Value Small Large Huge"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+
+		_, err := e.Fields()
+		if err == nil {
+			t.Fatalf("expected an error with an unprepared script")
+		}
+
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		fields, err := e.Fields()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if strings.Join(fields, " ") != tst.Fields {
+			t.Fatalf("unexpected fields for '%s', got '%s' expected '%s'", tst.Input, strings.Join(fields, " "), tst.Fields)
+		}
+	}
+}
+
+// TestExplain tests the recording of the comparisons made by a script.
+func TestExplain(t *testing.T) {
+
+	e := New(`
+seen = true;
+if ( Name == "Steve" && Age > 18 ) {
+  if ( Country in [ "FI", "UK" ] ) {
+    return true;
+  }
+  return false;
+}
+return Age < 10;
+`)
+
+	_, err := e.Explain(nil)
+	if err == nil {
+		t.Fatalf("expected an error explaining an unprepared script")
+	}
+
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	obj := map[string]interface{}{"Name": "Steve", "Age": 44, "Country": "US"}
+
+	exp, err := e.Explain(obj)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := `program => false
+  line 3, col 1: if ((Name == "Steve") && (Age > 18))
+    line 3, col 11: "Steve" == "Steve" => true
+    line 3, col 29: 44 > 18 => true
+    then
+      line 4, col 3: if (Country in ["FI", "UK"])
+        line 4, col 16: "US" in [FI, UK] => false
+        else
+`
+	if exp.String() != expected {
+		t.Fatalf("unexpected explanation, got:\n%s\nexpected:\n%s", exp.String(), expected)
+	}
+
+	// The comparisons are available in a structured form
+	cmp := exp.Children[0].Children[1]
+	if cmp.Operator != ">" || cmp.Left.Inspect() != "44" || cmp.Right.Inspect() != "18" || !cmp.Result.True() {
+		t.Fatalf("unexpected comparison: %v", cmp)
+	}
+
+	// The result is the same as running the script
+	ok, err := e.Run(obj)
+	if err != nil || ok != exp.Result.True() {
+		t.Fatalf("explanation disagrees with result: %v %v", ok, err)
+	}
+
+	// The other branch is explained too
+	exp, err = e.Explain(map[string]interface{}{"Name": "Bob", "Age": 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !strings.HasSuffix(exp.String(), "    else\n  line 9, col 12: 4 < 10 => true\n") || !exp.Result.True() {
+		t.Fatalf("unexpected explanation:\n%s", exp.String())
+	}
+
+	// Variables set while explaining are discarded
+	e = New(`seen = true; return true;`)
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = e.Explain(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if e.GetVariable("seen").Type() != object.NULL {
+		t.Fatalf("variable leaked from explanation")
+	}
+
+	// The script is explained with the flags it was prepared with
+	e = New(`assert(Age < 200); return true;`)
+	err = e.Prepare([]byte{NoAssert})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	exp, err = e.Explain(map[string]interface{}{"Age": 300})
+	if err != nil || !exp.Result.True() {
+		t.Fatalf("unexpected explanation without assertions: %v", err)
+	}
+}
+
+// TestNullPresence tests that comparing fields against null tests for
+// their presence, which differs from testing whether they are true.
+func TestNullPresence(t *testing.T) {
+
+	type Inner struct {
+		Name string
+	}
+	type Record struct {
+		Empty   string
+		Zero    int
+		Off     bool
+		Nothing *Inner
+		Tags    []string
+	}
+
+	objects := []interface{}{
+		map[string]interface{}{"Empty": "", "Zero": 0, "Off": false, "Nothing": nil, "Tags": []string{}},
+		&Record{},
+	}
+
+	tests := []struct {
+		Field  string
+		IsNull bool
+	}{
+		{Field: "Missing", IsNull: true},
+		{Field: "Nothing", IsNull: true},
+		{Field: "Empty"},
+		{Field: "Zero"},
+		{Field: "Off"},
+		{Field: "Tags"},
+	}
+
+	for _, obj := range objects {
+		for _, tst := range tests {
+
+			expected := map[string]bool{
+				fmt.Sprintf("return %s == null;", tst.Field): tst.IsNull,
+				fmt.Sprintf("return null == %s;", tst.Field): tst.IsNull,
+				fmt.Sprintf("return %s != null;", tst.Field): !tst.IsNull,
+				fmt.Sprintf("return null != %s;", tst.Field): !tst.IsNull,
+
+				// All of the values are false, null or not.
+				fmt.Sprintf("return !%s;", tst.Field): true,
+			}
+
+			for input, result := range expected {
+
+				e := New(input)
+				err := e.Prepare()
+				if err != nil {
+					t.Fatalf("Failed to compile '%s': %s", input, err.Error())
+				}
+
+				ret, err := e.Run(obj)
+				if err != nil {
+					t.Fatalf("Found unexpected error running '%s' against %T: %s", input, obj, err.Error())
+				}
+				if ret != result {
+					t.Fatalf("Found unexpected result running '%s' against %T: %t", input, obj, ret)
+				}
+			}
+		}
+	}
+
+	// Null is never equal to the zero value of another type.
+	for _, input := range []string{`null == ""`, `null == 0`, `null == 0.0`, `null == false`, `null == []`, `null == {}`, `null ==* ""`, `Missing == Empty`, `Missing == Zero`} {
+
+		e := New(fmt.Sprintf("return %s;", input))
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", input, err.Error())
+		}
+
+		ret, err := e.Run(objects[0])
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", input, err.Error())
+		}
+		if ret {
+			t.Fatalf("Expected '%s' to be false", input)
+		}
+	}
+}
+
+// TestSetPrevious tests that scripts may compare each record in a stream
+// with the one before it.
+func TestSetPrevious(t *testing.T) {
+
+	type Reading struct {
+		Name  string
+		Value float64
+	}
+
+	readings := []interface{}{
+		&Reading{Name: "a", Value: 10},
+		&Reading{Name: "b", Value: 12},
+		map[string]interface{}{"Name": "c", "Value": 20},
+		Reading{Name: "d", Value: 19},
+		Reading{Name: "e", Value: 40},
+	}
+
+	// Detect the readings which jumped by more than 50%.
+	e, err := Compile(`
+if ( prev == null ) {
+  return false;
+}
+return Value > prev.Value * 1.5;`)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	var jumps []int
+	var previous interface{}
+	for i, obj := range readings {
+		e.SetPrevious(previous)
+
+		ok, err := e.Run(obj)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if ok {
+			jumps = append(jumps, i)
+		}
+		previous = obj
+	}
+
+	if fmt.Sprintf("%v", jumps) != "[2 4]" {
+		t.Fatalf("unexpected jumps: %v", jumps)
+	}
+
+	// Run again, recording the names via the optional-chaining operator.
+	e, err = Compile(`return prev?.Name ?? "none";`)
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	var names []string
+	previous = nil
+	for _, obj := range readings {
+		e.SetPrevious(previous)
+
+		ret, err := e.Execute(obj)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		names = append(names, ret.Inspect())
+		previous = obj
+	}
+
+	if strings.Join(names, ",") != "none,a,b,c,d" {
+		t.Fatalf("unexpected previous names: %v", names)
+	}
+}
+
+// TestCompile tests that scripts may be validated, and compiled, without
+// an object to run against.
+func TestCompile(t *testing.T) {
+
+	// A script with two parse errors.
+	_, err := Compile(`if ( Name == "Steve" { return true; }
+return 3 +;`)
+	if err == nil {
+		t.Fatalf("expected an error compiling a bogus script")
+	}
+
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a parse error, got %T", err)
+	}
+	if len(perr.Errors) < 2 {
+		t.Fatalf("expected at least two parse errors, got %v", perr.Errors)
+	}
+	for _, msg := range perr.Errors {
+		if !strings.HasPrefix(msg, "line ") {
+			t.Fatalf("parse error doesn't contain its location: %s", msg)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "\nErrors parsing script:\n"+perr.Errors[0]) {
+		t.Fatalf("unexpected error text: %s", err.Error())
+	}
+
+	// Errors which are found when compiling aren't parse errors.
+	_, err = Compile(`return exists(1);`)
+	if err == nil {
+		t.Fatalf("expected an error compiling a bogus script")
+	}
+	if _, ok = err.(*ParseError); ok {
+		t.Fatalf("didn't expect a parse error: %s", err.Error())
+	}
+
+	// A valid script may be run repeatedly, and flags are honored.
+	e, err := Compile(`return Count > 3;`, []byte{Diagnostics})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	for count, expected := range map[int]bool{1: false, 5: true} {
+		ret, err := e.Run(map[string]interface{}{"Count": count})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if ret != expected {
+			t.Fatalf("unexpected result for %d: %t", count, ret)
+		}
+	}
+	if _, _, err = e.RunWithDiagnostics(map[string]interface{}{"Count": 1}); err != nil {
+		t.Fatalf("expected diagnostics to be enabled: %s", err.Error())
+	}
+}
+
+// TestExists tests that fields may be tested for presence, which differs
+// from comparing them against null.
+func TestExists(t *testing.T) {
+
+	type Address struct {
+		City string
+	}
+	type Person struct {
+		Name    string
+		Address *Address
+		Home    *Address
+	}
+
+	objects := []interface{}{
+		map[string]interface{}{
+			"Name":    "Steve",
+			"Address": map[string]interface{}{"City": "Helsinki"},
+			"Home":    nil,
+		},
+		&Person{Name: "Steve", Address: &Address{City: "Helsinki"}},
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return exists(Name);`, Result: "true"},
+		{Input: `return exists(Missing);`, Result: "false"},
+		{Input: `return exists(Address.City);`, Result: "true"},
+		{Input: `return exists(Address.Street);`, Result: "false"},
+		{Input: `return exists(Name.Length);`, Result: "false"},
+		{Input: `return exists(Missing.City);`, Result: "false"},
+
+		// A field which is present with a null value exists, but
+		// compares equal to null, like a missing field.
+		{Input: `return exists(Home);`, Result: "true"},
+		{Input: `return Home == null && Missing == null;`, Result: "true"},
+		{Input: `return exists(Home.City);`, Result: "false"},
+
+		// Variables exist too, and take precedence.
+		{Input: `x = null; return exists(x);`, Result: "true"},
+		{Input: `cfg = { "debug": null }; return exists(cfg.debug) && !exists(cfg.verbose);`, Result: "true"},
+		{Input: `function f(a) { return exists(a); } return f(3);`, Result: "true"},
+		{Input: `return !exists(Missing) && exists(Name);`, Result: "true"},
+	}
+
+	for _, obj := range objects {
+		for _, tst := range tests {
+
+			e := New(tst.Input)
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s' against %T: %s", tst.Input, obj, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s' against %T: %s", tst.Input, obj, ret.Inspect())
+			}
+		}
+	}
+
+	// The argument must be a field.
+	for _, input := range []string{`return exists();`, `return exists(Name, Age);`, `return exists("Name");`, `return exists(Tags[0]);`, `return exists(len(Name));`} {
+
+		e := New(input)
+		err := e.Prepare()
+		if err == nil || !strings.Contains(err.Error(), "exists requires a single field") {
+			t.Fatalf("expected an error compiling '%s', got %v", input, err)
+		}
+	}
+}
+
+// TestInspect tests that `inspect` returns all of the fields of the
+// object, whatever type of object it is.
+func TestInspect(t *testing.T) {
+
+	type Person struct {
+		Name string
+		Age  int
+	}
+
+	objects := []interface{}{
+		Person{Name: "Steve", Age: 42},
+		&Person{Name: "Steve", Age: 42},
+		map[string]interface{}{"Name": "Steve", "Age": 42},
+		&object.Hash{Pairs: map[string]object.Object{
+			"Name": &object.String{Value: "Steve"},
+			"Age":  &object.Integer{Value: 42},
+		}},
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return toJSON(inspect());`, Result: `{"Age":42,"Name":"Steve"}`},
+		{Input: `return inspect().Name;`, Result: "Steve"},
+		{Input: `return len(inspect());`, Result: "2"},
+
+		// Variables aren't fields.
+		{Input: `x = 3; return len(inspect());`, Result: "2"},
+	}
+
+	for _, obj := range objects {
+		for _, tst := range tests {
+
+			e := New(tst.Input)
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s' against %T: %s", tst.Input, obj, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s' against %T: %s", tst.Input, obj, ret.Inspect())
+			}
+		}
+	}
+
+	// A nil object has no fields.
+	e := New(`return len(inspect());`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := e.Execute(nil)
+	if err != nil || ret.Inspect() != "0" {
+		t.Fatalf("unexpected result inspecting nil: %v %v", ret, err)
+	}
+
+	// There are no arguments.
+	e = New(`return inspect(Name);`)
+	err = e.Prepare()
+	if err == nil || !strings.Contains(err.Error(), "inspect takes no arguments") {
+		t.Fatalf("expected an error compiling, got %v", err)
+	}
+}
+
+// TestNull tests the null literal, and comparisons against it.
+func TestNull(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return null;`, Result: "null"},
+		{Input: `return Missing == null;`, Result: "true"},
+		{Input: `return Name == null;`, Result: "false"},
+		{Input: `return null != Name;`, Result: "true"},
+		{Input: `return null == null;`, Result: "true"},
+		{Input: `return null != null;`, Result: "false"},
+		{Input: `return 0 == null;`, Result: "false"},
+		{Input: `return "" == null;`, Result: "false"},
+		{Input: `return false == null;`, Result: "false"},
+		{Input: `return [] == null;`, Result: "false"},
+		{Input: `return null in [ 1, null ];`, Result: "true"},
+		{Input: `return null ?? "default";`, Result: "default"},
+		{Input: `if ( null ) { return "yes"; } return "no";`, Result: "no"},
+		{Input: `return !null;`, Result: "true"},
+		{Input: `return null && true;`, Result: "false"},
+		{Input: `return null || true;`, Result: "true"},
+		{Input: `x = null; return x == null;`, Result: "true"},
+		{Input: `return type(null);`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Name": "Steve"})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// Null may only be tested for equality
+	for _, input := range []string{`return null < 3;`, `return null + 1;`, `return null < null;`} {
+
+		obj := New(input)
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", input, err.Error())
+		}
+
+		_, err = obj.Execute(nil)
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", input)
+		}
+	}
+}
+
+// TestCheck tests the static checking of scripts.
+func TestCheck(t *testing.T) {
+
+	tests := []struct {
+		Input    string
+		Problems []string
+	}{
+		{Input: `return Name == "Steve" && Count > 3;`},
+		{Input: `return "steve" < 3 || 1 + 2.5 > 3;`,
+			Problems: []string{"line 1, col 16: type mismatch: STRING < INTEGER"}},
+		{Input: `if ( "open" == [ "open", "closed" ] ) { return true; }`,
+			Problems: []string{"line 1, col 13: cannot compare STRING with an array using ==, use 'in' to test whether an array contains a value"}},
+		{Input: `return "steve" ==* 3 || 3 ~=* /3/;`,
+			Problems: []string{"line 1, col 16: type mismatch: STRING ==* INTEGER", "line 1, col 27: type mismatch: INTEGER ~=* STRING"}},
+		{Input: `return [1] < [2];`,
+			Problems: []string{"line 1, col 12: unknown operator: ARRAY < ARRAY"}},
+		{Input: `return (1 < 2) < 3;`,
+			Problems: []string{"line 1, col 16: type mismatch: BOOLEAN < INTEGER"}},
+		{Input: `return Status in "open";`,
+			Problems: []string{"line 1, col 15: operand for 'in' must be an array, not STRING"}},
+		{Input: `return null == Name && null < 3;`,
+			Problems: []string{"line 1, col 29: unknown operator: NULL < INTEGER"}},
+		{Input: `return Count / 0 > 1;`,
+			Problems: []string{"line 1, col 14: division by zero"}},
+		{Input: `return Count % 0.0 > 1;`,
+			Problems: []string{"line 1, col 14: division by zero"}},
+		{Input: `return -"steve";`,
+			Problems: []string{"line 1, col 8: unsupported type for -: STRING"}},
+		{Input: `foreach x in 1.."ten" { print(x); }`,
+			Problems: []string{"line 1, col 15: argument for the end of the range must be an integer"}},
+		{Input: `return len(Name, 3) > 0 && missing() && clamp(1, 2);`,
+			Problems: []string{
+				"line 1, col 11: wrong number of arguments to len: got 2, expected 1",
+				"line 1, col 35: the function missing does not exist",
+				"line 1, col 46: wrong number of arguments to clamp: got 2, expected 3",
+			}},
+		{Input: `print(); printf(); return upper(trim(lower("x")), 2);`,
+			Problems: []string{
+				"line 1, col 16: wrong number of arguments to printf: got 0, expected at least 1",
+				"line 1, col 32: wrong number of arguments to upper: got 2, expected 1",
+			}},
+		{Input: `return 1 < "two" < 3;`,
+			Problems: []string{"line 1, col 10: type mismatch: INTEGER < STRING", "line 1, col 10: type mismatch: STRING < INTEGER"}},
+		{Input: `return custom(1, 2, 3);`},
+		{Input: `function f(a) { return a; } return f(1, 2);`,
+			Problems: []string{"line 1, col 37: wrong number of arguments to f: got 2, expected 1"}},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		e.AddFunction("custom", func(args []object.Object) object.Object { return &object.Null{} })
+
+		_, err := e.Check()
+		if err == nil {
+			t.Fatalf("expected an error checking an unprepared script")
+		}
+
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		problems, err := e.Check()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if strings.Join(problems, "\n") != strings.Join(tst.Problems, "\n") {
+			t.Fatalf("unexpected problems for '%s', got:\n%s\nexpected:\n%s", tst.Input, strings.Join(problems, "\n"), strings.Join(tst.Problems, "\n"))
+		}
+	}
+}
+
+// TestFunctions tests functions defined by scripts.
+func TestFunctions(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `function isAdult(age) { return age >= 18; } return isAdult(Age);`, Result: "true"},
+		{Input: `function isAdult(age) { return age >= 18; } return isAdult(12);`, Result: "false"},
+		{Input: `return add(1, 2); function add(a, b) { return a + b; }`, Result: "3"},
+		{Input: `function name() { return Name; } return name();`, Result: "Steve"},
+		{Input: `function nothing() { x = 1; } return nothing();`, Result: "null"},
+		{Input: `function set() { x = 3; } set(); return x;`, Result: "3"},
+		{Input: `function fact(n) { if (n <= 1) { return 1; } return n * fact(n - 1); } return fact(10);`, Result: "3628800"},
+		{Input: `function find(a, x) { foreach v in a { if (v == x) { return true; } } return false; } return find([1, 2], 2) && !find([1, 2], 3);`, Result: "true"},
+		{Input: `function twice(n) { return n * 2; } return map([1, 2, 3], "twice");`, Result: "[2, 4, 6]"},
+		{Input: `function f(x, i) { return x * i; } return mapIndexed([1, 2, 3], "f");`, Result: "[0, 2, 6]"},
+		{Input: `a = [1, 2]; function f(x, i) { x++; return x; } b = mapIndexed(a, "f"); return a;`, Result: "[1, 2]"},
+		{Input: `function total(p, q) { return p * q; } return sum(zipWith([2, 3, 4], [10, 100], "total"));`, Result: "320"},
+		{Input: `s = ""; foreach pair in zip(["a", "b"], [1, 2]) { s = s + pair[0] + string(pair[1]); } return s;`, Result: "a1b2"},
+		{Input: `s = ""; foreach batch in chunk([1, 2, 3, 4, 5], 2) { s = s + string(sum(batch)) + ","; } return s;`, Result: "3,7,5,"},
+		{Input: `function adult(n) { return n >= 18; } return all([20, 30], "adult") && any([1, 2], "adult") == false;`, Result: "true"},
+		{Input: `a = 1; function f(a) { return a; } return f(2) + a;`, Result: "3"},
+		{Input: `function f() { return x; } foreach x in [1] { return f(); }`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			p := obj.Prepare(flags)
+			if p != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, p.Error())
+			}
+
+			ret, err := obj.Execute(map[string]interface{}{"Name": "Steve", "Age": 42})
+			if err != nil {
+				t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+			}
+
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	// Errors when defining functions.
+	for _, input := range []string{
+		`function f(a) { return a; } function f(b) { return b; }`,
+		`function f(a, a) { return a; }`,
+		`function f(a,) { return a; }`,
+		`function (a) { return a; }`,
+	} {
+		err := New(input).Prepare()
+		if err == nil {
+			t.Fatalf("expected an error compiling '%s'", input)
+		}
+	}
+
+	// Errors when calling functions.
+	tests = []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `function f(a) { return a; } return f(1, 2);`,
+			Result: "line 1, col 37: error calling f: wrong number of arguments: got 2, expected 1"},
+		{Input: `function f(n) { return f(n + 1); } return f(1);`,
+			Result: "line 1, col 25: error calling f: maximum call depth of 1000 exceeded"},
+		{Input: `function f(n) {
+  return n % 0;
+}
+return f(1);`,
+			Result: "line 2, col 12: attempted division by zero: 1 % 0"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		_, err = obj.Execute(nil)
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", tst.Input)
+		}
+		if err.Error() != tst.Result {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+	}
+}
+
+// TestREPL tests evaluating lines interactively.
+func TestREPL(t *testing.T) {
+
+	in := strings.NewReader(`Name
+x = 3
+
+x * 2
+function double(n) { return n * 2; }
+double(x)
+if ( x > 1 ) { return "big"; }
+print("hello\n")
+Name + 1
+len(
+x++; x
+`)
+	var out bytes.Buffer
+
+	obj := New("")
+	err := obj.REPL(map[string]interface{}{"Name": "Steve"}, in, &out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	expected := `> Steve
+> > > 6
+> > 6
+> big
+> hello
+> error: line 1, col 6: type mismatch: STRING OpAdd INTEGER
+> error: Errors parsing script:
+line 1, col 5: unexpected end of file reached
+> 4
+> 
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected output, got:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}
+
+// TestDuration tests comparing the difference between two times with
+// a duration.
+func TestDuration(t *testing.T) {
+
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	obj := map[string]interface{}{
+		"Created": created,
+		"Updated": created.Add(36 * time.Hour),
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return Updated - Created;`, Result: "129600"},
+		{Input: `return Updated - Created > duration("24h");`, Result: "true"},
+		{Input: `return Updated - Created > duration("48h");`, Result: "false"},
+		{Input: `return duration("1h") < duration("90m");`, Result: "true"},
+		{Input: `return duration("1m") == 60;`, Result: "true"},
+		{Input: `return Created + duration("24h") < Updated;`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := e.Execute(obj)
+		if err != nil {
+			t.Fatalf("Found unexpected error running test '%s' - %s\n", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+
+	e := New(`return duration("a day") > 3;`)
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = e.Execute(obj)
+	if err == nil || !strings.Contains(err.Error(), "invalid duration 'a day'") {
+		t.Fatalf("expected an error for an invalid duration, got %v", err)
+	}
+}
+
+// ticket is a custom object, which is true if it is open.
+type ticket struct {
+	open bool
+}
+
+func (t *ticket) Type() object.Type        { return "TICKET" }
+func (t *ticket) Inspect() string          { return fmt.Sprintf("ticket open:%t", t.open) }
+func (t *ticket) True() bool               { return t.open }
+func (t *ticket) ToInterface() interface{} { return t.open }
+
+// TestTruthiness tests that conditions, and the `!` operator, agree upon
+// which values are true.
+func TestTruthiness(t *testing.T) {
+
+	values := map[string]bool{
+		`true`:       true,
+		`false`:      false,
+		`null`:       false,
+		`0`:          false,
+		`3`:          true,
+		`0.0`:        false,
+		`0.5`:        true,
+		`""`:         false,
+		`"steve"`:    true,
+		`[]`:         false,
+		`[ 1 ]`:      true,
+		`Missing`:    false,
+		`Open()`:     true,
+		`Closed()`:   false,
+		`len("")`:    false,
+		`upper("x")`: true,
+		`Name ?? ""`: true,
+		`[ 1 ][1:]`:  false,
+		`1 == 1`:     true,
+		`"a" ~= /b/`: false,
+		`Name != ""`: true,
+		`!!Open()`:   true,
+		`!!Closed()`: false,
+	}
+
+	for value, expected := range values {
+
+		for _, script := range []string{
+			fmt.Sprintf(`if ( %s ) { return true; } return false;`, value),
+			fmt.Sprintf(`if ( !(%s) ) { return false; } return true;`, value),
+			fmt.Sprintf(`return %s ? true : false;`, value),
+		} {
+			e := New(script)
+			e.AddFunction("Open", func(args []object.Object) object.Object { return &ticket{open: true} })
+			e.AddFunction("Closed", func(args []object.Object) object.Object { return &ticket{open: false} })
+
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", script, err.Error())
+			}
+
+			ret, err := e.Run(map[string]interface{}{"Name": "Steve"})
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s': %s", script, err.Error())
+			}
+			if ret != expected {
+				t.Fatalf("Found unexpected result running '%s': %t", script, ret)
+			}
+		}
+	}
+}
+
+// TestNameResolution tests that values and functions are resolved in the
+// documented order, and that they don't shadow each other.
+func TestNameResolution(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		// A variable doesn't hide a function of the same name.
+		{Input: `len = len(Name); return len;`, Result: "5"},
+		{Input: `upper = "x"; return upper(upper);`, Result: "X"},
+		{Input: `function f(len) { return len(len); } return f("abc");`, Result: "3"},
+		{Input: `foreach len in [ "ab" ] { return len(len); }`, Result: "2"},
+
+		// Variables hide fields, and parameters hide variables.
+		{Input: `Name = "Bob"; return Name;`, Result: "Bob"},
+		{Input: `function f(Name) { return Name; } return f("Bob") + Name;`, Result: "BobSteve"},
+		{Input: `x = 1; function f(x) { return x; } return f(2) + x;`, Result: "3"},
+		{Input: `host = "script"; return host;`, Result: "script"},
+		{Input: `return host;`, Result: "host"},
+		{Input: `return Count;`, Result: "3"},
+
+		// Functions defined by the script replace those of the
+		// host, and the built-ins.
+		{Input: `function len(x) { return 7; } return len(Name);`, Result: "7"},
+		{Input: `function len(x) { return 7; } return map([ "a" ], "len");`, Result: "[7]"},
+		{Input: `function hostFn() { return "script"; } return hostFn();`, Result: "script"},
+		{Input: `return hostFn();`, Result: "host"},
+
+		// The regular expression operators always use the built-in.
+		{Input: `function match(a, b) { return false; } return Name ~= /eve/;`, Result: "true"},
+		{Input: `function match(a, b) { return true; } return Name !~ /bob/;`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		e.SetVariable("host", &object.String{Value: "host"})
+		e.AddFunction("hostFn", func(args []object.Object) object.Object {
+			return &object.String{Value: "host"}
+		})
+
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := e.Execute(Input{Name: "Steve", Count: 3})
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+}
+
+// TestBitwise tests the bitwise operators, which only work upon integers.
+func TestBitwise(t *testing.T) {
+
+	type Input struct {
+		Flags int
+		Mask  int64
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return 12 & 10;`, Result: "8"},
+		{Input: `return 12 | 10;`, Result: "14"},
+		{Input: `return 12 ^ 10;`, Result: "6"},
+		{Input: `return 1 << 4;`, Result: "16"},
+		{Input: `return 256 >> 4;`, Result: "16"},
+		{Input: `return -16 >> 2;`, Result: "-4"},
+		{Input: `return 1 << 63;`, Result: "-9223372036854775808"},
+		{Input: `return 3 << 64;`, Result: "0"},
+		{Input: `return -1 >> 100;`, Result: "-1"},
+		{Input: `return 0xF0 & 0b10110000;`, Result: "176"},
+		{Input: `return ( Flags & 4 ) != 0;`, Result: "true"},
+		{Input: `return Flags & 8 == 0;`, Result: "true"},
+		{Input: `return Flags & Mask;`, Result: "4"},
+		{Input: `x = 1; x = x | 2; return x;`, Result: "3"},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := e.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(Input{Flags: 5, Mask: 12})
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+
+	errors := []struct {
+		Input string
+		Error string
+	}{
+		{Input: `return 1.5 & 1;`, Error: "operands of '&' must be integers, not FLOAT and INTEGER"},
+		{Input: `return 1 | "2";`, Error: "operands of '|' must be integers, not INTEGER and STRING"},
+		{Input: `return true ^ false;`, Error: "operands of '^' must be integers, not BOOLEAN and BOOLEAN"},
+		{Input: `return Missing << 1;`, Error: "operands of '<<' must be integers, not NULL and INTEGER"},
+		{Input: `return 1 >> -1;`, Error: "negative shift count: 1 >> -1"},
+	}
+
+	for _, tst := range errors {
+
+		e := New(tst.Input)
+		err := e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		_, err = e.Execute(Input{})
+		if err == nil {
+			t.Fatalf("expected an error running '%s'", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+	}
+}
+
+// TestErrorsAsFalse tests that comparisons which fail may be treated as
+// being false, rather than aborting the script.
+func TestErrorsAsFalse(t *testing.T) {
+
+	objs := []interface{}{
+		map[string]interface{}{"Name": "Steve", "Age": 43},
+		map[string]interface{}{"Name": "Bob", "Age": "unknown"},
+		map[string]interface{}{"Name": "Chris", "Age": 17},
+		map[string]interface{}{"Name": "Dave"},
+	}
+
+	e := New(`return Age >= 18;`)
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// By default the bad record is an error.
+	_, err = e.FilterSlice(objs)
+	if err == nil || !strings.Contains(err.Error(), "element 1: line 1, col 12: type mismatch") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	var failures []string
+	e.SetErrorsAsFalse(true)
+	e.SetErrorHook(func(err error) {
+		failures = append(failures, err.Error())
+	})
+
+	out, err := e.FilterSlice(objs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out) != 1 || out[0].(map[string]interface{})["Name"] != "Steve" {
+		t.Fatalf("unexpected result: %v", out)
+	}
+	if len(failures) != 2 ||
+		failures[0] != "line 1, col 12: type mismatch: STRING OpGreaterEqual INTEGER" ||
+		failures[1] != "line 1, col 12: type mismatch: NULL OpGreaterEqual INTEGER" {
+		t.Fatalf("unexpected failures: %v", failures)
+	}
+
+	// Only comparisons are affected, other errors still abort, and
+	// the hook is optional.
+	e.SetErrorHook(nil)
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		{Input: `return !(Age < 3) && Name == "Bob";`, Result: "true"},
+		{Input: `return Age ~= "(";`, Result: "false"},
+		{Input: `return 3 in Age;`, Result: "false"},
+		{Input: `function old(x) { return x > 65; } return old(Age);`, Result: "false"},
+		{Input: `return Age + 1 > 3;`, Error: "type mismatch: STRING OpAdd INTEGER"},
+		{Input: `return missing(Age);`, Error: "the function missing does not exist"},
+	}
+
+	for _, tst := range tests {
+
+		e = New(tst.Input)
+		e.SetErrorsAsFalse(true)
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := e.Execute(objs[1])
+		if tst.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected an error running '%s', got %v", tst.Input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+}
+
+// TestCounters tests that scripts may maintain state, across the objects
+// they're run against, via the counter store.
+func TestCounters(t *testing.T) {
+
+	type Login struct {
+		IP      string
+		Success bool
+		Time    int64
+	}
+
+	objs := []interface{}{
+		Login{IP: "10.0.0.1", Time: 0},
+		Login{IP: "10.0.0.2", Time: 5},
+		Login{IP: "10.0.0.1", Time: 10},
+		Login{IP: "10.0.0.1", Success: true, Time: 15},
+		Login{IP: "10.0.0.1", Time: 20},
+		Login{IP: "10.0.0.1", Time: 90},
+		Login{IP: "10.0.0.1", Time: 100},
+		Login{IP: "10.0.0.1", Time: 110},
+	}
+
+	e := New(`
+increment("logins");
+if ( Success ) {
+   return false;
+}
+if ( windowCount("failed:" + IP, "1m", Time) >= 3 ) {
+   return true;
+}
+return false;
+`)
+
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = e.FilterSlice(objs)
+	if err == nil || !strings.Contains(err.Error(), "no counter store has been configured") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+
+	store := environment.NewCounters()
+	e.SetCounters(store)
+
+	for i := 0; i < 2; i++ {
+
+		out, err := e.FilterSlice(objs)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(out) != 2 || out[0].(Login).Time != 20 || out[1].(Login).Time != 110 {
+			t.Fatalf("unexpected result: %v", out)
+		}
+		if store.Count("logins") != 8 {
+			t.Fatalf("unexpected count: %d", store.Count("logins"))
+		}
+
+		store.Reset()
+	}
+}
+
+// TestSchema tests that fields may be converted to declared types.
+func TestSchema(t *testing.T) {
+
+	objs := []interface{}{
+		map[string]interface{}{"Name": "a", "Price": "12.50", "Active": "true", "Count": 3.0, "Code": 200},
+		map[string]interface{}{"Name": "b", "Price": 9, "Active": 0, "Count": "7", "Code": "404"},
+		map[string]interface{}{"Name": "c", "Price": 20.25, "Active": true, "Count": 10},
+	}
+
+	e := New(`return Price > 10 && Active && Count < 5 && Code == "200";`)
+
+	err := e.SetSchema("Price: float, Active: bool,\nCount: int, Code: string")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := e.FilterSlice(objs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out) != 1 || out[0].(map[string]interface{})["Name"] != "a" {
+		t.Fatalf("unexpected result: %v", out)
+	}
+
+	// The converted values are visible to the script, and missing
+	// fields remain null.
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return type(Price);`, Result: "float"},
+		{Input: `return Price;`, Result: "9"},
+		{Input: `return type(Count) + ":" + string(Count);`, Result: "integer:7"},
+		{Input: `return Active;`, Result: "false"},
+		{Input: `return Code + "1";`, Result: "4041"},
+		{Input: `return Missing;`, Result: "null"},
+		{Input: `Price = "x"; return Price;`, Result: "x"},
+	}
+
+	for _, tst := range tests {
+
+		e = New(tst.Input)
+		e.SetSchema("Price: float, Active: bool, Count: int, Code: string, Missing: int")
+		err = e.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := e.Execute(objs[1])
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+
+	// Values which can't be converted are an error, or null if
+	// errors are treated as false.
+	e = New(`return Price > 10;`)
+	e.SetSchema("Price: int")
+	err = e.Prepare()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, err = e.FilterSlice(objs)
+	if err == nil || err.Error() != `element 0: line 1, col 14: field Price: cannot convert "12.50" to integer` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var failures []string
+	e.SetErrorsAsFalse(true)
+	e.SetErrorHook(func(err error) {
+		failures = append(failures, err.Error())
+	})
+
+	out, err = e.FilterSlice(objs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("unexpected result: %v", out)
+	}
+	if len(failures) != 4 || failures[0] != `field Price: cannot convert "12.50" to integer` {
+		t.Fatalf("unexpected failures: %v", failures)
+	}
+
+	// Invalid schemas are rejected.
+	for _, schema := range []string{"Price float", "Price: money", ": int", "Price: int: float"} {
+		if e.SetSchema(schema) == nil {
+			t.Fatalf("expected an error for schema '%s'", schema)
+		}
+	}
+}
+
+// TestPluck tests extracting a field from an array of objects, and the
+// functions which find the object with the highest, or lowest, field.
+func TestPluck(t *testing.T) {
+
+	order := map[string]interface{}{
+		"Items": []interface{}{
+			map[string]interface{}{"name": "book", "price": 80},
+			map[string]interface{}{"name": "pen", "price": 25.5},
+			map[string]interface{}{"name": "gift"},
+		},
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return pluck(Items, "name");`, Result: "[book, pen, gift]"},
+		{Input: `return pluck(Items, "price");`, Result: "[80, 25.5, null]"},
+		{Input: `return sum(pluck(Items, "price", true)) > 100;`, Result: "true"},
+		{Input: `return pluck(Items, "missing", true);`, Result: "[]"},
+		{Input: `return maxBy(Items, "price").name;`, Result: "book"},
+		{Input: `return minBy(Items, "price").name;`, Result: "pen"},
+		{Input: `return maxBy(Items, "missing");`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := obj.Execute(order)
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+}
+
+// TestAnyMatch tests matching values found via wildcard paths.
+func TestAnyMatch(t *testing.T) {
+
+	var order interface{}
+	err := json.Unmarshal([]byte(`{
+		"id": 7,
+		"items": [ { "status": "closed", "qty": 2 }, { "status": "open", "qty": 3 } ],
+		"meta": { "owner": { "name": "steve" } }
+	}`), &order)
+	if err != nil {
+		t.Fatalf("failed to decode JSON: %s", err.Error())
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return anyMatch("items.*.status", "open");`, Result: "true"},
+		{Input: `return anyMatch("items.*.status", "pending");`, Result: "false"},
+		{Input: `return anyMatch("items.*.qty", 3);`, Result: "true"},
+		{Input: `return anyMatch("items.0.qty", 3.0);`, Result: "false"},
+		{Input: `return anyMatch("meta.*.name", "steve");`, Result: "true"},
+		{Input: `return anyMatch("id", 7);`, Result: "true"},
+		{Input: `return anyMatch("missing.*.status", "open");`, Result: "false"},
+		{Input: `path = "items.*.status"; return anyMatch(path, "closed");`, Result: "true"},
+
+		// A value may be given explicitly.
+		{Input: `return anyMatch(items, "*.status", "open");`, Result: "true"},
+		{Input: `return anyMatch({ "a": [1, 2] }, "a.*", 2);`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		for _, flags := range [][]byte{nil, {NoOptimize}} {
+
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := obj.Execute(order)
+			if err != nil {
+				t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+			}
+			if ret.Inspect() != tst.Result {
+				t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestMerge tests merging hashes.
+func TestMerge(t *testing.T) {
+
+	record := map[string]interface{}{"id": 7, "status": "new"}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `return toJSON(merge(inspect(), { "processed": true }));`, Result: `{"id":7,"processed":true,"status":"new"}`},
+		{Input: `return toJSON(merge({ "a": 1, "b": 2 }, { "b": 3 }, { "c": 4 }));`, Result: `{"a":1,"b":3,"c":4}`},
+		{Input: `a = { "x": 1 }; b = merge(a, { "x": 2 }); return a.x + b.x;`, Result: "3"},
+		{Input: `return toJSON(merge({ "n": { "a": 1 } }, { "n": { "b": 2 } }));`, Result: `{"n":{"b":2}}`},
+	}
+
+	for _, tst := range tests {
+
+		e := New(tst.Input)
+		if err := e.Prepare(); err != nil {
+			t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+		}
+
+		ret, err := e.Execute(record)
+		if err != nil {
+			t.Fatalf("Found unexpected error running '%s': %s", tst.Input, err.Error())
+		}
+		if ret.Inspect() != tst.Result {
+			t.Fatalf("Found unexpected result running '%s': %s", tst.Input, ret.Inspect())
+		}
+	}
+
+	e := New(`return merge({ "a": 1 }, [1]);`)
+	if err := e.Prepare(); err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	if _, err := e.Execute(record); err == nil || !strings.Contains(err.Error(), "merge: argument 2 must be a hash, not ARRAY") {
+		t.Fatalf("expected an error merging an array, got %v", err)
+	}
+}
+
+// TestMaxDepth tests that deeply nested scripts are rejected.
+func TestMaxDepth(t *testing.T) {
+
+	parens := func(n int) string {
+		return "return " + strings.Repeat("(", n) + "1" + strings.Repeat(")", n) + ";"
+	}
+	ifs := func(n int) string {
+		return strings.Repeat("if ( true ) { ", n) + "return 1;" + strings.Repeat(" }", n)
+	}
+
+	tests := []struct {
+		Input string
+		Depth int
+		Error string
+	}{
+		{Input: parens(100)},
+		{Input: ifs(100)},
+		{Input: parens(5000), Error: "maximum nesting depth of 1000 exceeded"},
+		{Input: ifs(5000), Error: "maximum nesting depth of 1000 exceeded"},
+		{Input: "return " + strings.Repeat("!", 5000) + "true;", Error: "maximum nesting depth of 1000 exceeded"},
+		{Input: parens(5000), Depth: 10000},
+		{Input: parens(5), Depth: 10},
+		{Input: parens(10), Depth: 10, Error: "line 1, col 18: maximum nesting depth of 10 exceeded"},
+		{Input: ifs(10), Depth: 10, Error: "maximum nesting depth of 10 exceeded"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetMaxDepth(tst.Depth)
+
+		err := obj.Prepare()
+		if tst.Error == "" {
+			if err != nil {
+				t.Fatalf("unexpected error with depth %d: %s", tst.Depth, err.Error())
+			}
+			ret, err := obj.Execute(nil)
+			if err != nil || ret.Inspect() != "1" {
+				t.Fatalf("unexpected result with depth %d: %v %v", tst.Depth, ret, err)
+			}
+			continue
+		}
+
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("expected a parse error with depth %d, got %v", tst.Depth, err)
+		}
+		if len(pe.Errors) == 0 || !strings.Contains(pe.Errors[0], tst.Error) {
+			t.Fatalf("unexpected errors with depth %d: %v", tst.Depth, pe.Errors)
+		}
+	}
+}
+
+// TestIntegralFloats tests that whole-number floats may be converted to
+// integers, as is useful for objects decoded from JSON.
+func TestIntegralFloats(t *testing.T) {
+
+	var obj map[string]interface{}
+	err := json.Unmarshal([]byte(`{"id": 12345, "price": 9.99, "big": 1e30, "items": [1, 2.5], "user": {"age": 40}}`), &obj)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err.Error())
+	}
+
+	tests := []struct {
+		Input    string
+		Default  string
+		Integral string
+	}{
+		{Input: `return id;`, Default: "12345", Integral: "12345"},
+		{Input: `return type(id);`, Default: "float", Integral: "integer"},
+		{Input: `return type(price);`, Default: "float", Integral: "float"},
+		{Input: `return type(big);`, Default: "float", Integral: "float"},
+		{Input: `return type(items[0]) + " " + type(items[1]);`, Default: "float float", Integral: "integer float"},
+		{Input: `return type(user.age);`, Default: "float", Integral: "integer"},
+	}
+
+	for _, tst := range tests {
+		for _, integral := range []bool{false, true} {
+
+			e := New(tst.Input)
+			e.SetIntegralFloats(integral)
+
+			err = e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			ret, err := e.Execute(obj)
+			if err != nil {
+				t.Fatalf("unexpected error running '%s': %s", tst.Input, err.Error())
+			}
+
+			expected := tst.Default
+			if integral {
+				expected = tst.Integral
+			}
+			if ret.Inspect() != expected {
+				t.Fatalf("unexpected result running '%s' (integral %t): %s", tst.Input, integral, ret.Inspect())
+			}
+		}
+	}
+}
+
+// TestMaxStringLength tests that scripts cannot construct strings which
+// are longer than the configured limit.
+func TestMaxStringLength(t *testing.T) {
+
+	tests := []struct {
+		Input string
+		Error string
+	}{
+		{Input: `s = "ab"; foreach i in 1..10 { s = s + s; } return len(s);`, Error: "the result of concatenation is longer than the maximum string length of 100"},
+		{Input: `return repeat("x", 1000);`, Error: "repeat: the result is longer than the maximum string length of 100"},
+		{Input: `return padLeft("x", 101);`, Error: "padLeft: the result is longer than the maximum string length of 100"},
+		{Input: `return sprintf("%s%s", repeat("x", 60), repeat("y", 60));`, Error: "sprintf: the result is longer than the maximum string length of 100"},
+		{Input: `return replaceRegex(repeat("x", 90), "", repeat("x", 90));`, Error: "replaceRegex: the result is longer than the maximum string length of 100"},
+		{Input: `return toJSON(1..200);`, Error: "toJSON: the result is longer than the maximum string length of 100"},
+		{Input: `return string(1..200);`, Error: "string: the result is longer than the maximum string length of 100"},
+		{Input: `return len(repeat("x", 100) + "");`, Error: ""},
+		{Input: `return len(sprintf("%s", repeat("x", 100)));`, Error: ""},
+	}
+
+	for _, tst := range tests {
+		for _, limit := range []int{0, 100} {
+
+			e := New(tst.Input)
+			e.SetMaxStringLength(limit)
+
+			err := e.Prepare()
+			if err != nil {
+				t.Fatalf("Failed to compile '%s': %s", tst.Input, err.Error())
+			}
+
+			_, err = e.Execute(nil)
+
+			// By default there is no limit.
+			if limit == 0 || tst.Error == "" {
+				if err != nil {
+					t.Fatalf("unexpected error running '%s' with limit %d: %s", tst.Input, limit, err.Error())
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), tst.Error) {
+				t.Fatalf("expected error running '%s', got %v", tst.Input, err)
+			}
+		}
+	}
+}
+
+// TestVMNew tests that a virtual machine may be constructed without
+// the positions of its instructions, which are only used for errors.
+func TestVMNew(t *testing.T) {
+
+	e := New(`return 1 / 0;`)
+	err := e.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	machine := vm.New(e.constants, e.instructions, e.environment)
+	_, err = machine.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package evalfilter
+
+import "fmt"
+
+// ExampleEval_FilterSlice filters a list of people, to return only those
+// members who are above a particular age, without needing to write the
+// loop ourselves.
+func ExampleEval_FilterSlice() {
+
+	//
+	// This is the structure our script will operate upon.
+	//
+	type Person struct {
+		Name string
+		Age  int
+	}
+
+	//
+	// Here is a list of people.
+	//
+	people := []interface{}{
+		Person{"Bob", 31},
+		Person{"John", 42},
+		Person{"Michael", 17},
+		Person{"Jenny", 26},
+	}
+
+	//
+	// Create, and prepare, the evaluator.
+	//
+	eval := New(`return Age > 30;`)
+
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile the code:%s\n", err.Error())
+		return
+	}
+
+	//
+	// Filter the list, keeping the people for whom the script
+	// returned `true`.
+	//
+	matches, err := eval.FilterSlice(people)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, entry := range matches {
+		fmt.Printf("%v\n", entry)
+	}
+
+	// Output:
+	// {Bob 31}
+	// {John 42}
+}
+
+// ExampleEval_TopN returns the two oldest people from a list, by using
+// a script which calculates a score for each person.
+func ExampleEval_TopN() {
+
+	//
+	// This is the structure our script will operate upon.
+	//
+	type Person struct {
+		Name string
+		Age  int
+	}
+
+	//
+	// Here is a list of people.
+	//
+	people := []interface{}{
+		Person{"Bob", 31},
+		Person{"John", 42},
+		Person{"Michael", 17},
+		Person{"Jenny", 26},
+	}
+
+	//
+	// Create, and prepare, the evaluator.
+	//
+	// The script returns the score of each person.
+	//
+	eval := New(`return Age;`)
+
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile the code:%s\n", err.Error())
+		return
+	}
+
+	//
+	// Find the two people with the highest scores.
+	//
+	oldest, err := eval.TopN(people, 2)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, entry := range oldest {
+		fmt.Printf("%v\n", entry)
+	}
+
+	// Output:
+	// {John 42}
+	// {Bob 31}
+}
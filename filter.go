@@ -0,0 +1,301 @@
+// This file contains helpers for running a compiled program against
+// a collection of objects.
+
+package evalfilter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// FilterSlice runs the compiled program against each of the given
+// objects, and returns those for which the result was true.
+//
+// The order of the objects is preserved.  If running the program against
+// any object results in an error then processing stops, and the error is
+// returned along with the index of the object which caused it.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) FilterSlice(objs []interface{}) ([]interface{}, error) {
+	return e.FilterSliceLimit(objs, len(objs))
+}
+
+// FilterSliceLimit runs the compiled program against the given objects,
+// in order, and returns the first n for which the result was true.
+//
+// Processing stops as soon as n objects have been found, so this is much
+// faster than FilterSlice if you only want a sample of the results from
+// a large slice.  If there are fewer than n matches then they are all
+// returned, and if n is zero, or less, then no objects are tested.
+// Errors are handled in the same way as by FilterSlice.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) FilterSliceLimit(objs []interface{}, n int) ([]interface{}, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	var out []interface{}
+
+	for i, obj := range objs {
+
+		if len(out) >= n {
+			break
+		}
+
+		ok, err := e.Run(obj)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err.Error())
+		}
+
+		if ok {
+			out = append(out, obj)
+		}
+	}
+
+	return out, nil
+}
+
+// FilterSliceParallel runs the compiled program against each of the given
+// objects, using the specified number of workers, and returns those for
+// which the result was true.
+//
+// The results are identical to those of FilterSlice, including the order
+// of the objects, and the error reported if there is a failure.  If the
+// number of workers is less than two then FilterSlice is used instead.
+//
+// Each worker uses its own copy of the environment, so any variables
+// which the script sets are not shared between the workers, or with the
+// original.
+func (e *Eval) FilterSliceParallel(objs []interface{}, workers int) ([]interface{}, error) {
+
+	if workers <= 1 {
+		return e.FilterSlice(objs)
+	}
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	// There's no point in having more workers than objects.
+	if workers > len(objs) {
+		workers = len(objs)
+	}
+
+	// The results, and any error, for each object.
+	results := make([]bool, len(objs))
+	errors := make([]error, len(objs))
+
+	// The indexes of the objects to process.
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+
+		// Each worker gets its own copy of our state.
+		env := e.environment.Clone()
+		worker := &Eval{environment: env, machine: e.machine.Clone(env)}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errors[i] = worker.Run(objs[i])
+			}
+		}()
+	}
+
+	for i := range objs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var out []interface{}
+
+	for i, obj := range objs {
+
+		if errors[i] != nil {
+			return nil, fmt.Errorf("element %d: %s", i, errors[i].Error())
+		}
+
+		if results[i] {
+			out = append(out, obj)
+		}
+	}
+
+	return out, nil
+}
+
+// TopN runs the compiled program against each of the given objects, to
+// calculate a score for each, and returns the n objects with the highest
+// scores, highest first.
+//
+// The program must return a number, for example `return Price * Quantity;`.
+// Objects with equal scores are returned in their original order.  If n
+// is greater than the number of objects then they are all returned, in
+// order of their scores.
+//
+// Scores are compared in the same way as by the relational operators, so
+// integers are compared exactly, however large they are.
+//
+// If running the program against any object results in an error, or the
+// result is not a number, or is NaN, then processing stops, and the error
+// is returned along with the index of the object which caused it.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) TopN(objs []interface{}, n int) ([]interface{}, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	type scored struct {
+		obj   interface{}
+		score object.Object
+	}
+
+	all := make([]scored, 0, len(objs))
+
+	for i, obj := range objs {
+
+		ret, err := e.Execute(obj)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err.Error())
+		}
+
+		switch ret := ret.(type) {
+		case *object.Integer:
+		case *object.Float:
+			// NaN can't be ordered, which would break the sort.
+			if math.IsNaN(ret.Value) {
+				return nil, fmt.Errorf("element %d: score must be a number, not NaN", i)
+			}
+		default:
+			return nil, fmt.Errorf("element %d: score must be a number, not %s", i, ret.Type())
+		}
+
+		all = append(all, scored{obj: obj, score: ret})
+	}
+
+	// A stable sort keeps the original order of equal scores.
+	sort.SliceStable(all, func(i, j int) bool {
+		cmp, _ := e.environment.Compare(all[i].score, all[j].score)
+		return cmp > 0
+	})
+
+	if n > len(all) {
+		n = len(all)
+	}
+
+	var out []interface{}
+	for i := 0; i < n; i++ {
+		out = append(out, all[i].obj)
+	}
+
+	return out, nil
+}
+
+// GroupBy runs the compiled program against each of the given objects, to
+// calculate a key for each, and returns the objects grouped by their keys.
+//
+// The program must return the key, for example `return Country;`.  Keys
+// which are strings, numbers, or booleans are converted to strings, so
+// the integer 3 and the string "3" give the same key.  Objects for which
+// the key is null are omitted from the results, which allows the script
+// to skip objects which shouldn't be grouped.  Within each group the
+// objects are in their original order.
+//
+// If running the program against any object results in an error, or the
+// key is an array or a hash, then processing stops, and the error is
+// returned along with the index of the object which caused it.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) GroupBy(objs []interface{}) (map[string][]interface{}, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	out := make(map[string][]interface{})
+
+	for i, obj := range objs {
+
+		key, ok, err := e.key(obj)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err.Error())
+		}
+
+		if ok {
+			out[key] = append(out[key], obj)
+		}
+	}
+
+	return out, nil
+}
+
+// DistinctBy runs the compiled program against each of the given objects,
+// to calculate a key for each, and returns the first object with each
+// distinct key, removing those which are duplicates.
+//
+// The program must return the key, for example `return Email;`, and keys
+// are compared in the same way as by GroupBy.  Objects for which the key
+// is null are omitted from the results.  The objects are returned in the
+// order their keys first occurred.
+//
+// If running the program against any object results in an error, or the
+// key is an array or a hash, then processing stops, and the error is
+// returned along with the index of the object which caused it.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) DistinctBy(objs []interface{}) ([]interface{}, error) {
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the script has not been prepared")
+	}
+
+	var out []interface{}
+	seen := make(map[string]bool)
+
+	for i, obj := range objs {
+
+		key, ok, err := e.key(obj)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %s", i, err.Error())
+		}
+
+		if ok && !seen[key] {
+			seen[key] = true
+			out = append(out, obj)
+		}
+	}
+
+	return out, nil
+}
+
+// key runs the compiled program against the given object, and returns the
+// key it calculated as a string.
+//
+// Keys which are strings, numbers, or booleans are converted to strings,
+// false is returned if the key is null, and other types are an error.
+func (e *Eval) key(obj interface{}) (string, bool, error) {
+
+	ret, err := e.Execute(obj)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch ret.(type) {
+	case *object.Null:
+		return "", false, nil
+	case *object.String, *object.Integer, *object.Float, *object.Boolean:
+		return ret.Inspect(), true, nil
+	}
+
+	return "", false, fmt.Errorf("key must be a string, number, or boolean, not %s", ret.Type())
+}
@@ -6,8 +6,8 @@
 package lexer
 
 import (
-	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -30,11 +30,16 @@ type Lexer struct {
 
 	// Previous token.
 	prevToken token.Token
+
+	// The line and column of the current character, which are
+	// used to record the position of each token we return.
+	line   int
+	column int
 }
 
 // New creates a Lexer instance from the given string
 func New(input string) *Lexer {
-	l := &Lexer{characters: []rune(input)}
+	l := &Lexer{characters: []rune(input), line: 1}
 	l.readChar()
 	return l
 }
@@ -60,6 +65,14 @@ func (l *Lexer) GetLine() int {
 
 // read forward one character.
 func (l *Lexer) readChar() {
+
+	// Update our position, before we move past the current character.
+	if l.ch == rune('\n') {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -71,16 +84,30 @@ func (l *Lexer) readChar() {
 
 // NextToken reads and returns the next token, skipping any intervening
 // white space, and swallowing any comments, in the process.
+//
+// The token returned will have its position recorded.
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
 	l.skipWhitespace()
 
 	// skip single-line comments
-	if l.ch == rune('/') && l.peekChar() == rune('/') {
+	for l.ch == rune('/') && l.peekChar() == rune('/') {
 		l.skipComment()
-		return (l.NextToken())
 	}
 
+	pos := token.Position{Line: l.line, Column: l.column}
+
+	tok := l.nextToken()
+	tok.Position = pos
+	l.prevToken = tok
+
+	return tok
+}
+
+// nextToken reads the next token from our input, we're called with
+// any leading white space and comments already skipped.
+func (l *Lexer) nextToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 
 	case rune('&'):
@@ -88,19 +115,27 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.AND, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITAND, l.ch)
 		}
 	case rune('|'):
 		if l.peekChar() == rune('|') {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.OR, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BITOR, l.ch)
 		}
 
+	case rune('^'):
+		tok = newToken(token.BITXOR, l.ch)
+
 	case rune('='):
 		if l.peekChar() == rune('=') {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.EQ, Literal: string(ch) + string(l.ch)}
+			tok = l.foldCase(tok, token.EQFOLD)
 		} else {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
@@ -201,7 +236,17 @@ func (l *Lexer) NextToken() token.Token {
 		}
 
 	case rune('?'):
-		tok = newToken(token.QUESTION, l.ch)
+		if l.peekChar() == rune('?') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.COALESCE, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('.') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.OPTCHAIN, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.QUESTION, l.ch)
+		}
 	case rune(':'):
 		tok = newToken(token.COLON, l.ch)
 
@@ -210,6 +255,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.LTEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('<') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHIFTLEFT, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.LT, l.ch)
 		}
@@ -219,6 +268,10 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.GTEQUALS, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == rune('>') {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHIFTRIGHT, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.GT, l.ch)
 		}
@@ -228,6 +281,7 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.CONTAINS, Literal: string(ch) + string(l.ch)}
+			tok = l.foldCase(tok, token.CONTAINSFOLD)
 		}
 
 	case rune('!'):
@@ -235,11 +289,13 @@ func (l *Lexer) NextToken() token.Token {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.NOTEQ, Literal: string(ch) + string(l.ch)}
+			tok = l.foldCase(tok, token.NOTEQFOLD)
 		} else {
 			if l.peekChar() == rune('~') {
 				ch := l.ch
 				l.readChar()
 				tok = token.Token{Type: token.MISSING, Literal: string(ch) + string(l.ch)}
+				tok = l.foldCase(tok, token.MISSINGFOLD)
 			} else {
 				tok = newToken(token.BANG, l.ch)
 			}
@@ -266,6 +322,17 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Literal = err.Error()
 		}
 
+	case rune('`'):
+		str, err := l.readRawString()
+
+		if err == nil {
+			tok.Type = token.STRING
+			tok.Literal = str
+		} else {
+			tok.Type = token.ILLEGAL
+			tok.Literal = err.Error()
+		}
+
 	case rune(0):
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -273,27 +340,22 @@ func (l *Lexer) NextToken() token.Token {
 	default:
 		if isDigit(l.ch) {
 
-			tok := l.readDecimal()
-			l.prevToken = tok
-			return tok
+			return l.readDecimal()
 		}
 
 		tok.Literal = l.readIdentifier()
 		if len(tok.Literal) > 0 {
 			tok.Type = token.LookupIdentifier(tok.Literal)
-			l.prevToken = tok
 			return tok
 		}
 		tok.Type = token.ILLEGAL
-		tok.Literal = fmt.Sprintf("invalid character for indentifier '%c'", l.ch)
+		tok.Literal = fmt.Sprintf("invalid character for indentifier '%c' at line %d, column %d", l.ch, l.line, l.column)
 		return tok
 
 	}
 
 	l.readChar()
 
-	l.prevToken = tok
-
 	return tok
 }
 
@@ -336,7 +398,7 @@ func (l *Lexer) readNumber() string {
 
 	id := ""
 
-	for isDigit(l.ch) {
+	for isDigit(l.ch) || (l.ch == rune('_') && isDigit(l.peekChar())) {
 		id += string(l.ch)
 		l.readChar()
 	}
@@ -344,12 +406,35 @@ func (l *Lexer) readNumber() string {
 }
 
 // read a decimal number, either int or floating-point.
+//
+// We also handle hexadecimal, octal, and binary integers here, as they
+// begin with a digit too.  Validation of the digits is left to the
+// parser.
 func (l *Lexer) readDecimal() token.Token {
 
+	//
+	// Is this a prefixed number, such as `0xFF`?
+	//
+	if l.ch == rune('0') && strings.ContainsRune("xXoObB", l.peekChar()) {
+
+		// Consume the prefix.
+		id := string(l.ch)
+		l.readChar()
+		id += string(l.ch)
+		l.readChar()
+
+		for isHexDigit(l.ch) || l.ch == rune('_') {
+			id += string(l.ch)
+			l.readChar()
+		}
+		return token.Token{Type: token.INT, Literal: id}
+	}
+
 	//
 	// Read an integer-number.
 	//
 	integer := l.readNumber()
+	isFloat := false
 
 	//
 	// If the next token is a `.` we've got a floating-point number.
@@ -361,7 +446,31 @@ func (l *Lexer) readDecimal() token.Token {
 
 		// Get the float-component.
 		fraction := l.readNumber()
-		return token.Token{Type: token.FLOAT, Literal: integer + "." + fraction}
+		integer += "." + fraction
+		isFloat = true
+	}
+
+	//
+	// Is there an exponent?
+	//
+	if (l.ch == rune('e') || l.ch == rune('E')) &&
+		(isDigit(l.peekChar()) ||
+			((l.peekChar() == rune('+') || l.peekChar() == rune('-')) && isDigit(l.peekCharN(2)))) {
+
+		// Get the `e`, and any sign.
+		integer += string(l.ch)
+		l.readChar()
+		if l.ch == rune('+') || l.ch == rune('-') {
+			integer += string(l.ch)
+			l.readChar()
+		}
+
+		integer += l.readNumber()
+		isFloat = true
+	}
+
+	if isFloat {
+		return token.Token{Type: token.FLOAT, Literal: integer}
 	}
 
 	//
@@ -374,15 +483,20 @@ func (l *Lexer) readDecimal() token.Token {
 func (l *Lexer) readString(delim rune) (string, error) {
 	out := ""
 
+	// Record where we started, for error-reporting.
+	line, col := l.line, l.column
+
 	for {
 		l.readChar()
 
 		if l.ch == rune(0) {
-			return "", fmt.Errorf("unterminated string")
+			return "", fmt.Errorf("unterminated string starting at line %d, column %d", line, col)
 		}
 		if l.ch == delim {
 			break
 		}
+		ch := l.ch
+
 		//
 		// Handle \n, \r, \t, \", etc.
 		//
@@ -398,26 +512,78 @@ func (l *Lexer) readString(delim rune) (string, error) {
 			l.readChar()
 
 			if l.ch == rune(0) {
-				return "", errors.New("unterminated string")
-			}
-			if l.ch == rune('n') {
-				l.ch = '\n'
+				return "", fmt.Errorf("unterminated string starting at line %d, column %d", line, col)
 			}
-			if l.ch == rune('r') {
-				l.ch = '\r'
-			}
-			if l.ch == rune('t') {
-				l.ch = '\t'
-			}
-			if l.ch == rune('"') {
-				l.ch = '"'
+			if l.ch == rune('u') {
+				r, err := l.readUnicodeEscape()
+				if err != nil {
+					return "", err
+				}
+				out = out + string(r)
+				continue
 			}
-			if l.ch == rune('\\') {
-				l.ch = '\\'
+
+			// We don't change l.ch, as that would confuse
+			// our position-tracking.
+			ch = l.ch
+			switch l.ch {
+			case rune('n'):
+				ch = '\n'
+			case rune('r'):
+				ch = '\r'
+			case rune('t'):
+				ch = '\t'
 			}
 		}
-		out = out + string(l.ch)
+		out = out + string(ch)
+
+	}
+
+	return out, nil
+}
+
+// readUnicodeEscape reads the four hexadecimal digits of a `\uXXXX`
+// escape-sequence, we're called with the current character being the `u`.
+func (l *Lexer) readUnicodeEscape() (rune, error) {
+
+	line, col := l.line, l.column-1
+
+	hex := ""
+	for i := 0; i < 4; i++ {
+		if !isHexDigit(l.peekChar()) {
+			return 0, fmt.Errorf("invalid unicode escape-sequence at line %d, column %d", line, col)
+		}
+		l.readChar()
+		hex += string(l.ch)
+	}
 
+	val, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unicode escape-sequence at line %d, column %d", line, col)
+	}
+	return rune(val), nil
+}
+
+// readRawString reads a string deliminated by backticks.
+//
+// Raw strings may span multiple lines, and escape-sequences are not
+// processed within them - which is useful for regular expressions.
+func (l *Lexer) readRawString() (string, error) {
+	out := ""
+
+	// Record where we started, for error-reporting.
+	line, col := l.line, l.column
+
+	for {
+		l.readChar()
+
+		if l.ch == rune(0) {
+			return "", fmt.Errorf("unterminated string starting at line %d, column %d", line, col)
+		}
+		if l.ch == rune('`') {
+			break
+		}
+		out = out + string(l.ch)
 	}
 
 	return out, nil
@@ -496,6 +662,28 @@ func (l *Lexer) peekChar() rune {
 	return l.characters[l.readPosition]
 }
 
+// peekCharN returns the character n positions after the current one,
+// without consuming anything.
+func (l *Lexer) peekCharN(n int) rune {
+	pos := l.position + n
+	if pos >= len(l.characters) {
+		return rune(0)
+	}
+	return l.characters[pos]
+}
+
+// foldCase is called after reading one of the operators which has a
+// case-insensitive variant, such as `==`.  If the operator is followed
+// by `*` then that is consumed, and a token of the given type is
+// returned, otherwise the token is returned unchanged.
+func (l *Lexer) foldCase(tok token.Token, fold token.Type) token.Token {
+	if l.peekChar() != rune('*') {
+		return tok
+	}
+	l.readChar()
+	return token.Token{Type: fold, Literal: tok.Literal + "*"}
+}
+
 // determinate ch is identifier or not.  Identifiers may be alphanumeric,
 // but they must start with a letter.  Here that works because we are only
 // called if the first character is alphabetical.
@@ -515,3 +703,8 @@ func isWhitespace(ch rune) bool {
 func isDigit(ch rune) bool {
 	return rune('0') <= ch && ch <= rune('9')
 }
+
+// is hexadecimal digit
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || (rune('a') <= ch && ch <= rune('f')) || (rune('A') <= ch && ch <= rune('F'))
+}
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/skx/evalfilter/v2/token"
@@ -33,6 +34,30 @@ func TestWhile(t *testing.T) {
 	}
 }
 
+func TestNull(t *testing.T) {
+	input := `x == null`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "x"},
+		{token.EQ, "=="},
+		{token.NULL, "null"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken1(t *testing.T) {
 	input := `..=+√%(){},;~= !~"`
 
@@ -53,7 +78,40 @@ func TestNextToken1(t *testing.T) {
 		{token.SEMICOLON, ";"},
 		{token.CONTAINS, "~="},
 		{token.MISSING, "!~"},
-		{token.ILLEGAL, "unterminated string"},
+		{token.ILLEGAL, "unterminated string starting at line 1, column 18"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestCaseInsensitive tests the case-insensitive operators.
+func TestCaseInsensitive(t *testing.T) {
+	input := `a ==* b !=* c ~=* /x/i !~* "y" == *`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.EQFOLD, "==*"},
+		{token.IDENT, "b"},
+		{token.NOTEQFOLD, "!=*"},
+		{token.IDENT, "c"},
+		{token.CONTAINSFOLD, "~=*"},
+		{token.REGEXP, "(?i)x"},
+		{token.MISSINGFOLD, "!~*"},
+		{token.STRING, "y"},
+		{token.EQ, "=="},
+		{token.ASTERISK, "*"},
 		{token.EOF, ""},
 	}
 	l := New(input)
@@ -176,7 +234,7 @@ if(5<10){
 		{token.RSQUARE, "]"},
 		{token.QUESTION, "?"},
 		{token.COLON, ":"},
-		{token.ILLEGAL, "unterminated string"},
+		{token.ILLEGAL, "unterminated string starting at line 25, column 1"},
 		{token.EOF, ""},
 	}
 	l := New(input)
@@ -245,7 +303,7 @@ func TestIntegers(t *testing.T) {
 		{token.INT, "10"},
 		{token.INT, "20"},
 		{token.FLOAT, "33.3"},
-		{token.ILLEGAL, "unterminated string"},
+		{token.ILLEGAL, "unterminated string starting at line 1, column 12"},
 		{token.EOF, ""},
 	}
 	l := New(input)
@@ -489,3 +547,219 @@ a = 3/4;
 		}
 	}
 }
+
+// TestCoalesce is designed to test that `??` is not confused with the
+// ternary operator.
+func TestCoalesce(t *testing.T) {
+	input := `a ?? b ? c : d`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.COALESCE, "??"},
+		{token.IDENT, "b"},
+		{token.QUESTION, "?"},
+		{token.IDENT, "c"},
+		{token.COLON, ":"},
+		{token.IDENT, "d"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestBitwise is designed to test that the bitwise operators are
+// recognized, and not confused with the operators they resemble.
+func TestBitwise(t *testing.T) {
+	input := `a & b && c | d || e ^ f << 2 >> 1 <= 3 >= 4`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.BITAND, "&"},
+		{token.IDENT, "b"},
+		{token.AND, "&&"},
+		{token.IDENT, "c"},
+		{token.BITOR, "|"},
+		{token.IDENT, "d"},
+		{token.OR, "||"},
+		{token.IDENT, "e"},
+		{token.BITXOR, "^"},
+		{token.IDENT, "f"},
+		{token.SHIFTLEFT, "<<"},
+		{token.INT, "2"},
+		{token.SHIFTRIGHT, ">>"},
+		{token.INT, "1"},
+		{token.LTEQUALS, "<="},
+		{token.INT, "3"},
+		{token.GTEQUALS, ">="},
+		{token.INT, "4"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestOptionalChaining is designed to test that `?.` is recognized, and
+// not confused with a ternary operator.
+func TestOptionalChaining(t *testing.T) {
+	input := `a?.b.c; a ? b : 1;`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.OPTCHAIN, "?."},
+		{token.IDENT, "b"},
+		{token.PERIOD, "."},
+		{token.IDENT, "c"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.QUESTION, "?"},
+		{token.IDENT, "b"},
+		{token.COLON, ":"},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestNumericLiterals tests the various forms of numeric literals.
+func TestNumericLiterals(t *testing.T) {
+	input := `0xFF 0o17 0b1010 1_000_000 1.5e3 2E-2 3e+1 1_000.5 1..3 3e`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.INT, "0xFF"},
+		{token.INT, "0o17"},
+		{token.INT, "0b1010"},
+		{token.INT, "1_000_000"},
+		{token.FLOAT, "1.5e3"},
+		{token.FLOAT, "2E-2"},
+		{token.FLOAT, "3e+1"},
+		{token.FLOAT, "1_000.5"},
+		{token.INT, "1"},
+		{token.DOTDOT, ".."},
+		{token.INT, "3"},
+		{token.INT, "3"},
+		{token.IDENT, "e"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestStringEscapes tests escape-sequences, and raw strings.
+func TestStringEscapes(t *testing.T) {
+	input := `"a\tb\n" "say \"hi\"" "back\\slash" "\u00e9\u263A" 'it\'s' ` + "`raw\\n\"string\"\nline two` `unterminated"
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.STRING, "a\tb\n"},
+		{token.STRING, `say "hi"`},
+		{token.STRING, `back\slash`},
+		{token.STRING, "é☺"},
+		{token.STRING, "it's"},
+		{token.STRING, "raw\\n\"string\"\nline two"},
+		{token.ILLEGAL, "unterminated string starting at line 2, column 11"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	// Bogus unicode escapes
+	for _, input := range []string{`"\u12"`, `"\uZZZZ"`, `"\u00`} {
+		l := New(input)
+		tok := l.NextToken()
+		if tok.Type != token.ILLEGAL {
+			t.Fatalf("expected an error lexing %s, got %v", input, tok)
+		}
+		if !strings.Contains(tok.Literal, "invalid unicode escape-sequence at line 1, column 2") {
+			t.Fatalf("unexpected error lexing %s: %s", input, tok.Literal)
+		}
+	}
+}
+
+// TestPositions ensures that tokens record their line and column.
+func TestPositions(t *testing.T) {
+	input := `a = 1;
+  // comment
+  return "str" + b;`
+
+	tests := []struct {
+		expectedLiteral string
+		line            int
+		column          int
+	}{
+		{"a", 1, 1},
+		{"=", 1, 3},
+		{"1", 1, 5},
+		{";", 1, 6},
+		{"return", 3, 3},
+		{"str", 3, 10},
+		{"+", 3, 16},
+		{"b", 3, 18},
+		{";", 3, 19},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.line || tok.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong, expected=%d:%d, got=%d:%d", i, tt.line, tt.column, tok.Line, tok.Column)
+		}
+	}
+}
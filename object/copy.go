@@ -0,0 +1,37 @@
+package object
+
+// Copy returns a deep copy of the given object.
+//
+// Objects are mutable, for example they record their position when
+// they're iterated over, and integers may be incremented in-place.  A
+// copy may be used independently of the original, which allows state
+// to be shared safely between different virtual machines.
+//
+// Objects which cannot be mutated are returned unchanged.
+func Copy(obj Object) Object {
+
+	switch o := obj.(type) {
+	case *Array:
+		elements := make([]Object, len(o.Elements))
+		for i, e := range o.Elements {
+			elements[i] = Copy(e)
+		}
+		return &Array{Elements: elements}
+	case *Boolean:
+		return &Boolean{Value: o.Value}
+	case *Float:
+		return &Float{Value: o.Value}
+	case *Hash:
+		pairs := make(map[string]Object, len(o.Pairs))
+		for k, v := range o.Pairs {
+			pairs[k] = Copy(v)
+		}
+		return &Hash{Pairs: pairs}
+	case *Integer:
+		return &Integer{Value: o.Value}
+	case *String:
+		return &String{Value: o.Value}
+	}
+
+	return obj
+}
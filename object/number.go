@@ -0,0 +1,67 @@
+package object
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseNumber converts the given string to an Integer, or Float, object.
+//
+// As well as plain decimal integers, and floating-point numbers, this
+// supports hexadecimal (`0xFF`), octal (`0o17`), and binary (`0b1010`)
+// integers, scientific notation (`1.5e3`), and underscores as digit
+// separators (`1_000_000`).
+//
+// This is used both for numeric literals in scripts, and for converting
+// strings to numbers at run-time, so that the two always agree.
+func ParseNumber(str string) (Object, error) {
+
+	// Underscores may only appear between digits.
+	if strings.HasPrefix(str, "_") || strings.HasSuffix(str, "_") || strings.Contains(str, "__") {
+		return nil, fmt.Errorf("invalid number %q", str)
+	}
+	num := strings.Replace(str, "_", "", -1)
+
+	// Handle any sign, so that prefixed values may be negated.
+	neg := false
+	digits := num
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		neg = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	// Look for a base-prefix.
+	base := 0
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		}
+	}
+
+	if base != 0 {
+		val, err := strconv.ParseInt(digits[2:], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", str)
+		}
+		if neg {
+			val = -val
+		}
+		return &Integer{Value: val}, nil
+	}
+
+	if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return &Integer{Value: i}, nil
+	}
+
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return &Float{Value: f}, nil
+	}
+
+	return nil, fmt.Errorf("invalid number %q", str)
+}
@@ -5,7 +5,9 @@
 //
 // * Array.
 // * Boolean value.
+// * Error
 // * Floating-point number.
+// * Hash
 // * Integer number.
 // * Null
 // * String value.
@@ -24,7 +26,9 @@ type Type string
 const (
 	ARRAY   = "ARRAY"
 	BOOLEAN = "BOOLEAN"
+	ERROR   = "ERROR"
 	FLOAT   = "FLOAT"
+	HASH    = "HASH"
 	INTEGER = "INTEGER"
 	NULL    = "NULL"
 	STRING  = "STRING"
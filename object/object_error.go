@@ -0,0 +1,37 @@
+package object
+
+// Error wraps a run-time error message and implements our Object interface.
+//
+// If a built-in function, or a function implemented in your host
+// application, returns an Error object then the virtual machine will
+// abort execution of the script, and the message will be returned to
+// the caller.
+type Error struct {
+	// Message holds the error message.
+	Message string
+}
+
+// Type returns the type of this object.
+func (e *Error) Type() Type {
+	return ERROR
+}
+
+// Inspect returns a string-representation of the given object.
+func (e *Error) Inspect() string {
+	return e.Message
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (e *Error) True() bool {
+	return false
+}
+
+// ToInterface converts this object to a go-interface, which will allow
+// it to be used naturally in our sprintf/printf primitives.
+//
+// It might also be helpful for embedded users.
+func (e *Error) ToInterface() interface{} {
+	return e.Message
+}
@@ -0,0 +1,69 @@
+package object
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Hash wraps a map of string-keys to Objects, and implements the
+// Object interface.
+//
+// Hashes are created when reflecting upon nested maps and structures
+// in the object a script is executed against.
+type Hash struct {
+	// Pairs holds the key/value pairs of the hash we're wrapping.
+	Pairs map[string]Object
+}
+
+// Type returns the type of this object.
+func (h *Hash) Type() Type {
+	return HASH
+}
+
+// Keys returns the keys of the hash, in sorted order.
+func (h *Hash) Keys() []string {
+	keys := make([]string, 0, len(h.Pairs))
+	for k := range h.Pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Inspect returns a string-representation of the given object.
+//
+// The keys are sorted, to ensure the output is stable.
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+	pairs := make([]string, 0)
+	for _, k := range h.Keys() {
+		pairs = append(pairs, k+": "+h.Pairs[k].Inspect())
+	}
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+	return out.String()
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (h *Hash) True() bool {
+	return (len(h.Pairs) != 0)
+}
+
+// ToInterface converts this object to a go-interface, which will allow
+// it to be used naturally in our sprintf/printf primitives.
+//
+// It might also be helpful for embedded users.
+func (h *Hash) ToInterface() interface{} {
+
+	res := make(map[string]interface{}, len(h.Pairs))
+
+	for k, v := range h.Pairs {
+		res[k] = v.ToInterface()
+	}
+
+	return res
+}
@@ -7,11 +7,11 @@ package parser
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/lexer"
+	"github.com/skx/evalfilter/v2/object"
 	"github.com/skx/evalfilter/v2/token"
 )
 
@@ -24,6 +24,10 @@ type (
 	postfixParseFn func() ast.Expression
 )
 
+// DefaultMaxDepth is the deepest nesting of expressions, and blocks,
+// which the parser allows by default, see SetMaxDepth.
+const DefaultMaxDepth = 1000
+
 // Here we define values for precedence, lowest to highest.
 const (
 	_ int = iota
@@ -34,40 +38,55 @@ const (
 	EQUALS  // == or !=
 	CMP
 	LESSGREATER // > or <
-	SUM         // + or -
-	PRODUCT     // * or /
+	SUM         // +, -, |, or ^
+	PRODUCT     // *, /, %, &, <<, or >>
 	POWER       // **
-	MOD         // %
 	PREFIX      // -X or !X
 	CALL        // myFunction(X)
 	INDEX       // array[index], map[key]
 )
 
+// MOD is the precedence of `%`, which is the same as that of `*` and `/`.
+const MOD = PRODUCT
+
 // precedence contains the prededence for each token-type, which
 // is part of the magic of a Pratt-Parser.
 var precedences = map[token.Type]int{
-	token.QUESTION: TERNARY,
-	token.ASSIGN:   ASSIGN,
-	token.DOTDOT:   ASSIGN,
-	token.EQ:       EQUALS,
-	token.NOTEQ:    EQUALS,
-	token.LT:       LESSGREATER,
-	token.LTEQUALS: LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.GTEQUALS: LESSGREATER,
-	token.CONTAINS: LESSGREATER,
-	token.MISSING:  LESSGREATER,
-	token.IN:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.POW:      POWER,
-	token.MOD:      MOD,
-	token.AND:      COND,
-	token.OR:       COND,
-	token.LPAREN:   CALL,
-	token.LSQUARE:  INDEX,
+	token.QUESTION:     TERNARY,
+	token.ASSIGN:       ASSIGN,
+	token.DOTDOT:       ASSIGN,
+	token.EQ:           EQUALS,
+	token.EQFOLD:       EQUALS,
+	token.NOTEQ:        EQUALS,
+	token.NOTEQFOLD:    EQUALS,
+	token.LT:           LESSGREATER,
+	token.LTEQUALS:     LESSGREATER,
+	token.GT:           LESSGREATER,
+	token.GTEQUALS:     LESSGREATER,
+	token.CONTAINS:     LESSGREATER,
+	token.CONTAINSFOLD: LESSGREATER,
+	token.MISSING:      LESSGREATER,
+	token.MISSINGFOLD:  LESSGREATER,
+	token.IN:           LESSGREATER,
+	token.NOT:          LESSGREATER,
+	token.PLUS:         SUM,
+	token.MINUS:        SUM,
+	token.BITOR:        SUM,
+	token.BITXOR:       SUM,
+	token.BITAND:       PRODUCT,
+	token.SHIFTLEFT:    PRODUCT,
+	token.SHIFTRIGHT:   PRODUCT,
+	token.SLASH:        PRODUCT,
+	token.ASTERISK:     PRODUCT,
+	token.POW:          POWER,
+	token.MOD:          MOD,
+	token.AND:          COND,
+	token.OR:           COND,
+	token.COALESCE:     COND,
+	token.LPAREN:       CALL,
+	token.LSQUARE:      INDEX,
+	token.PERIOD:       INDEX,
+	token.OPTCHAIN:     INDEX,
 }
 
 // Parser is the object which maintains our parser state.
@@ -109,6 +128,13 @@ type Parser struct {
 	// Nested ternary expressions are illegal so we
 	// need to keep track of this.
 	tern bool
+
+	// depth is the current nesting depth of expressions, and
+	// blocks, which we're parsing.
+	depth int
+
+	// maxDepth is the deepest nesting we allow.
+	maxDepth int
 }
 
 // New returns a new parser.
@@ -116,7 +142,7 @@ type Parser struct {
 // Once constructed it can be used to parse an input-program
 // into an AST.
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []string{}, maxDepth: DefaultMaxDepth}
 	p.nextToken()
 	p.nextToken()
 
@@ -130,9 +156,12 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.LSQUARE, p.parseArrayLiteral)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.NOT, p.parseNotExpression)
+	p.registerPrefix(token.NULL, p.parseNullLiteral)
 	p.registerPrefix(token.REGEXP, p.parseRegexpLiteral)
 	p.registerPrefix(token.SQRT, p.parsePrefixExpression)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
@@ -143,9 +172,15 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.AND, p.parseInfixExpression)
 	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.BITAND, p.parseInfixExpression)
+	p.registerInfix(token.BITOR, p.parseInfixExpression)
+	p.registerInfix(token.BITXOR, p.parseInfixExpression)
+	p.registerInfix(token.COALESCE, p.parseInfixExpression)
 	p.registerInfix(token.CONTAINS, p.parseInfixExpression)
+	p.registerInfix(token.CONTAINSFOLD, p.parseInfixExpression)
 	p.registerInfix(token.DOTDOT, p.parseInfixExpression)
 	p.registerInfix(token.EQ, p.parseInfixExpression)
+	p.registerInfix(token.EQFOLD, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
 	p.registerInfix(token.GTEQUALS, p.parseInfixExpression)
 	p.registerInfix(token.IN, p.parseInfixExpression)
@@ -155,12 +190,19 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.LTEQUALS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.MISSING, p.parseInfixExpression)
+	p.registerInfix(token.MISSINGFOLD, p.parseInfixExpression)
 	p.registerInfix(token.MOD, p.parseInfixExpression)
+	p.registerInfix(token.NOT, p.parseNotInExpression)
 	p.registerInfix(token.NOTEQ, p.parseInfixExpression)
+	p.registerInfix(token.NOTEQFOLD, p.parseInfixExpression)
+	p.registerInfix(token.OPTCHAIN, p.parseMemberExpression)
 	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.PERIOD, p.parseMemberExpression)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.POW, p.parseInfixExpression)
 	p.registerInfix(token.QUESTION, p.parseTernaryExpression)
+	p.registerInfix(token.SHIFTLEFT, p.parseInfixExpression)
+	p.registerInfix(token.SHIFTRIGHT, p.parseInfixExpression)
 	p.registerInfix(token.SLASH, p.parseInfixExpression)
 
 	p.postfixParseFns = make(map[token.Type]postfixParseFn)
@@ -185,15 +227,54 @@ func (p *Parser) registerPostfix(tokenType token.Type, fn postfixParseFn) {
 	p.postfixParseFns[tokenType] = fn
 }
 
+// SetMaxDepth sets the deepest nesting of expressions, and blocks, which
+// the parser will accept.
+//
+// Parsing a deeply nested script, such as one with thousands of nested
+// parentheses, consumes a lot of stack, and a malicious script could
+// crash its host.  Scripts which are nested more deeply than the limit
+// are rejected with an error instead.  A depth of zero, or less, uses
+// DefaultMaxDepth.
+func (p *Parser) SetMaxDepth(depth int) {
+	if depth <= 0 {
+		depth = DefaultMaxDepth
+	}
+	p.maxDepth = depth
+}
+
+// enter is called when we start parsing a nested expression, or block,
+// and returns false if we're nested too deeply.  leave must be called
+// when we've finished, regardless of the result.
+func (p *Parser) enter() bool {
+	p.depth++
+	if p.depth > p.maxDepth {
+		p.errorf(p.curToken, "maximum nesting depth of %d exceeded", p.maxDepth)
+		return false
+	}
+	return true
+}
+
+// leave is called when we've finished parsing a nested expression, or
+// block.
+func (p *Parser) leave() {
+	p.depth--
+}
+
 // Errors return stored errors
 func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// errorf records an error, prefixing it with the position of the
+// token which caused it.
+func (p *Parser) errorf(tok token.Token, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	p.errors = append(p.errors, tok.Position.String()+": "+msg)
+}
+
 // peekError raises an error if the next token is not the expected type.
 func (p *Parser) peekError(t token.Type) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead around line %d", t, p.curToken.Type, p.l.GetLine())
-	p.errors = append(p.errors, msg)
+	p.errorf(p.peekToken, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
 }
 
 // nextToken moves to our next token from the lexer.
@@ -232,6 +313,13 @@ func (p *Parser) parseStatement() ast.Statement {
 		}
 		return r
 
+	case token.FUNCTION:
+		f := p.parseFunctionDefinition()
+		if f == nil {
+			return nil
+		}
+		return f
+
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -244,7 +332,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 	p.nextToken()
 	if p.curToken.Type != token.SEMICOLON {
-		p.errors = append(p.errors, fmt.Sprintf("expected semicolon after return-value; found token '%v'", p.curToken))
+		p.errorf(p.curToken, "expected semicolon after return-value; found token '%s'", p.curToken.Literal)
 		stmt.ReturnValue = nil
 		return nil
 	}
@@ -255,8 +343,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 // Function called on error if there is no prefix-based parsing method
 // for the given token.
 func (p *Parser) noPrefixParseFnError(t token.Type) {
-	msg := fmt.Sprintf("no prefix parse function for %s found around line %d", t, p.l.GetLine())
-	p.errors = append(p.errors, msg)
+	p.errorf(p.curToken, "no prefix parse function for %s found", t)
 }
 
 // parse Expression Statement
@@ -271,6 +358,11 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 
 // parse an expression.
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+	defer p.leave()
+	if !p.enter() {
+		return nil
+	}
+
 	postfix := p.postfixParseFns[p.curToken.Type]
 	if postfix != nil {
 		return (postfix())
@@ -307,14 +399,13 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 //
 // This is generally seen with an unterminated string.
 func (p *Parser) parseIllegal() ast.Expression {
-	msg := fmt.Sprintf("illegal token hit parsing program %s", p.curToken.Literal)
-	p.errors = append(p.errors, msg)
+	p.errorf(p.curToken, "illegal token hit parsing program %s", p.curToken.Literal)
 	return nil
 }
 
 // report an error if we hit an unexpected end of file.
 func (p *Parser) parseEOF() ast.Expression {
-	p.errors = append(p.errors, "unexpected end of file reached")
+	p.errorf(p.curToken, "unexpected end of file reached")
 	return nil
 }
 
@@ -327,29 +418,39 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
-	value, err := strconv.ParseInt(p.curToken.Literal, 10, 64)
-	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer around line %d", p.curToken.Literal, p.l.GetLine())
-		p.errors = append(p.errors, msg)
+	value, err := object.ParseNumber(p.curToken.Literal)
+	if err != nil || value.Type() != object.INTEGER {
+		p.errorf(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
-	lit.Value = value
+	lit.Value = value.(*object.Integer).Value
 	return lit
 }
 
 // parseFloatLiteral parses a float-literal
 func (p *Parser) parseFloatLiteral() ast.Expression {
 	flo := &ast.FloatLiteral{Token: p.curToken}
-	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	value, err := object.ParseNumber(p.curToken.Literal)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as float around line %d", p.curToken.Literal, p.l.GetLine())
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
-	flo.Value = value
+
+	// `1e3` is a float, even though it has an integral value.
+	switch v := value.(type) {
+	case *object.Float:
+		flo.Value = v.Value
+	case *object.Integer:
+		flo.Value = float64(v.Value)
+	}
 	return flo
 }
 
+// parseNullLiteral parses the null literal.
+func (p *Parser) parseNullLiteral() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 // parseBoolean parses a boolean token.
 func (p *Parser) parseBooleanLiteral() ast.Expression {
 	return &ast.BooleanLiteral{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
@@ -362,7 +463,14 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 		Operator: p.curToken.Literal,
 	}
 	p.nextToken()
-	expression.Right = p.parseExpression(PREFIX)
+
+	// Negation binds less tightly than `**`, so that `-2 ** 2`
+	// is `-(2 ** 2)`, as in mathematics.
+	precedence := PREFIX
+	if expression.Operator == "-" {
+		precedence = PRODUCT
+	}
+	expression.Right = p.parseExpression(precedence)
 
 	// If there was an error parsing the target of our
 	// prefix operation then we must abort.
@@ -372,6 +480,50 @@ func (p *Parser) parsePrefixExpression() ast.Expression {
 	return expression
 }
 
+// parseNotExpression parses the `not` keyword, which negates the
+// expression which follows it.
+//
+// Unlike `!`, which applies only to the operand immediately following
+// it, `not` applies to an entire comparison; it binds less tightly than
+// every operator except `&&`, `||`, and `??`.  This means that
+// `not a == b && c` is `(!(a == b)) && c`.
+//
+// The result is the same as if `!` had been used, so the expression
+// is parsed into a regular prefix-expression.
+func (p *Parser) parseNotExpression() ast.Expression {
+	expression := &ast.PrefixExpression{
+		Token:    p.curToken,
+		Operator: "!",
+	}
+	p.nextToken()
+
+	expression.Right = p.parseExpression(COND)
+	if expression.Right == nil {
+		return nil
+	}
+	return expression
+}
+
+// parseNotInExpression parses `not in`, which is the negation of the
+// `in` operator.  `a not in b` is parsed as `!(a in b)`.
+func (p *Parser) parseNotInExpression(left ast.Expression) ast.Expression {
+	expression := &ast.PrefixExpression{
+		Token:    p.curToken,
+		Operator: "!",
+	}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+
+	in := p.parseInfixExpression(left)
+	if in == nil {
+		return nil
+	}
+	expression.Right = in
+	return expression
+}
+
 // parseInfixExpression parses an infix-based expression.
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	expression := &ast.InfixExpression{
@@ -381,6 +533,12 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 
 	precedence := p.curPrecedence()
+
+	// `**` is right-associative, so `2 ** 3 ** 2` is `2 ** 9`.
+	if expression.Token.Type == token.POW {
+		precedence--
+	}
+
 	p.nextToken()
 	expression.Right = p.parseExpression(precedence)
 
@@ -389,9 +547,45 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	if expression.Right == nil {
 		return nil
 	}
+
+	// Is this the start of a chain of comparisons?
+	if isRelational(expression.Token.Type) && isRelational(p.peekToken.Type) {
+		return p.parseChainedComparison(expression)
+	}
 	return expression
 }
 
+// parseChainedComparison parses a chain of relational comparisons, such
+// as `0 < score < 100`.  We're invoked with the first comparison already
+// parsed, and the next token being the second relational operator.
+func (p *Parser) parseChainedComparison(first *ast.InfixExpression) ast.Expression {
+	chain := &ast.ChainedComparison{
+		Token:     first.Token,
+		Operands:  []ast.Expression{first.Left, first.Right},
+		Operators: []string{first.Operator},
+	}
+
+	for isRelational(p.peekToken.Type) {
+		p.nextToken()
+		chain.Operators = append(chain.Operators, p.curToken.Literal)
+
+		p.nextToken()
+		operand := p.parseExpression(LESSGREATER)
+		if operand == nil {
+			return nil
+		}
+		chain.Operands = append(chain.Operands, operand)
+	}
+
+	return chain
+}
+
+// isRelational returns true if the given token-type is one of the
+// relational operators which may be chained: `<`, `<=`, `>`, or `>=`.
+func isRelational(t token.Type) bool {
+	return t == token.LT || t == token.LTEQUALS || t == token.GT || t == token.GTEQUALS
+}
+
 // parsePostfixExpression parses a postfix-based expression.
 func (p *Parser) parsePostfixExpression() ast.Expression {
 	expression := &ast.PostfixExpression{
@@ -405,7 +599,7 @@ func (p *Parser) parsePostfixExpression() ast.Expression {
 func (p *Parser) parseTernaryExpression(condition ast.Expression) ast.Expression {
 
 	if p.tern {
-		p.errors = append(p.errors, "nested ternary expressions are illegal")
+		p.errorf(p.curToken, "nested ternary expressions are illegal")
 		return nil
 	}
 
@@ -516,7 +710,7 @@ func (p *Parser) parseForEach() ast.Expression {
 		p.nextToken()
 
 		if !p.peekTokenIs(token.IDENT) {
-			p.errors = append(p.errors, fmt.Sprintf("second argument to foreach must be ident, got %v", p.peekToken))
+			p.errorf(p.peekToken, "second argument to foreach must be ident, got %s", p.peekToken.Literal)
 			return nil
 		}
 		p.nextToken()
@@ -548,6 +742,54 @@ func (p *Parser) parseForEach() ast.Expression {
 	return expression
 }
 
+// parseFunctionDefinition parses `function name(a, b) { .. block .. }`.
+func (p *Parser) parseFunctionDefinition() *ast.FunctionDefinition {
+	def := &ast.FunctionDefinition{Token: p.curToken}
+
+	// get the name
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	def.Name = p.curToken.Literal
+
+	// get the parameters, if any
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	if !p.peekTokenIs(token.RPAREN) {
+		for {
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			if seen[p.curToken.Literal] {
+				p.errorf(p.curToken, "duplicate parameter %s in definition of %s", p.curToken.Literal, def.Name)
+				return nil
+			}
+			seen[p.curToken.Literal] = true
+			def.Parameters = append(def.Parameters, p.curToken.Literal)
+
+			if !p.peekTokenIs(token.COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+	}
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	// parse the body
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	def.Body = p.parseBlockStatement()
+	if def.Body == nil {
+		return nil
+	}
+	return def
+}
+
 // parseWhileStatement parses a while-statement.
 func (p *Parser) parseWhileStatement() ast.Expression {
 	expression := &ast.WhileStatement{Token: p.curToken}
@@ -574,6 +816,11 @@ func (p *Parser) parseWhileStatement() ast.Expression {
 
 // parseBlockStatement parses a block.
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
+	defer p.leave()
+	if !p.enter() {
+		return nil
+	}
+
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 	p.nextToken()
@@ -586,7 +833,7 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		p.nextToken()
 
 		if p.curToken.Type == token.EOF || p.curToken.Type == token.ILLEGAL {
-			p.errors = append(p.errors, "incomplete block statement")
+			p.errorf(p.curToken, "incomplete block statement")
 			return nil
 		}
 	}
@@ -624,13 +871,48 @@ func (p *Parser) parseRegexpLiteral() ast.Expression {
 	return &ast.RegexpLiteral{Token: p.curToken, Value: val, Flags: flags}
 }
 
-// parseArrayLiteral parses an array literal.
+// parseArrayLiteral parses an array literal, such as `[ "a", "b" ]`.
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 	array.Elements = p.parseExpressionList(token.RSQUARE)
 	return array
 }
 
+// parseHashLiteral parses a hash literal, such as `{ "name": "Steve" }`.
+//
+// The keys and values may be any expression.
+func (p *Parser) parseHashLiteral() ast.Expression {
+	hash := &ast.HashLiteral{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+
+		key := p.parseExpression(LOWEST)
+		if key == nil {
+			return nil
+		}
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
+		p.nextToken()
+
+		value := p.parseExpression(LOWEST)
+		if value == nil {
+			return nil
+		}
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+	return hash
+}
+
 // parse an array of expressions, as used for function-arguments.
 func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 	list := make([]ast.Expression, 0)
@@ -650,6 +932,12 @@ func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 	// Keep going if we hit a comma
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
+
+		// Array literals, like hashes, may have a trailing comma,
+		// which is useful when they're written over several lines.
+		if end == token.RSQUARE && p.peekTokenIs(end) {
+			break
+		}
 		p.nextToken()
 
 		ent := p.parseExpression(LOWEST)
@@ -670,8 +958,7 @@ func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
 	if n, ok := name.(*ast.Identifier); ok {
 		stmt.Name = n
 	} else {
-		msg := fmt.Sprintf("expected assign token to be IDENT, got %s instead around line %d", name.TokenLiteral(), p.l.GetLine())
-		p.errors = append(p.errors, msg)
+		p.errorf(p.curToken, "expected assign token to be IDENT, got %s instead", name.TokenLiteral())
 	}
 
 	// Skip over the `=`
@@ -692,8 +979,19 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 }
 
 // parseIndexExpression parse an array-index expression.
+//
+// This also handles slices, such as `array[1:3]`, `array[:3]`, and
+// `array[1:]`.
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
+
+	// A slice with no start-index.
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(tok, left, nil)
+	}
+
+	exp := &ast.IndexExpression{Token: tok, Left: left}
 	p.nextToken()
 	exp.Index = p.parseExpression(LOWEST)
 
@@ -702,12 +1000,56 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 		return nil
 	}
 
+	// A slice with a start-index.
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(tok, left, exp.Index)
+	}
+
+	if !p.expectPeek(token.RSQUARE) {
+		return nil
+	}
+	return exp
+}
+
+// parseSliceExpression parses the remainder of a slice-expression, we're
+// called when the current token is the `:`.
+func (p *Parser) parseSliceExpression(tok token.Token, left ast.Expression, start ast.Expression) ast.Expression {
+	exp := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+
+	// A slice with no end-index.
+	if p.peekTokenIs(token.RSQUARE) {
+		p.nextToken()
+		return exp
+	}
+
+	p.nextToken()
+	exp.End = p.parseExpression(LOWEST)
+
+	// error?
+	if exp.End == nil {
+		return nil
+	}
+
 	if !p.expectPeek(token.RSQUARE) {
 		return nil
 	}
 	return exp
 }
 
+// parseMemberExpression parses a field-access, such as `user.name`, or
+// an optional-chaining access such as `user?.name`.
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	exp := &ast.MemberExpression{Token: p.curToken, Left: left}
+	exp.Optional = p.curTokenIs(token.OPTCHAIN)
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	exp.Field = p.curToken.Literal
+	return exp
+}
+
 // curTokenIs tests if the current token has the given type.
 func (p *Parser) curTokenIs(t token.Type) bool {
 	return p.curToken.Type == t
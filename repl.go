@@ -0,0 +1,129 @@
+// This file contains a simple read-eval-print loop, which allows
+// expressions to be evaluated interactively.
+
+package evalfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/lexer"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/parser"
+)
+
+// REPL reads lines from the given reader, evaluating each of them against
+// the given object, and writes their results to the given writer.
+//
+// Each line is compiled, and run, as a script of its own, but they share
+// our environment - so variables, and functions, defined by one line are
+// available to those which follow.  If a line ends with an expression,
+// such as `Count * 2`, then its value is shown, as is the value of any
+// `return` statement.  Errors are written to the writer, rather than
+// stopping the loop, which continues until the reader is exhausted.
+// Output from functions such as `print` is also written to the writer.
+//
+// This is intended for authoring, and debugging, scripts.
+func (e *Eval) REPL(obj interface{}, in io.Reader, out io.Writer) error {
+
+	// Output from print, and similar functions, is written
+	// alongside our results.
+	saved := e.environment.Output()
+	e.environment.SetOutput(out)
+	defer e.environment.SetOutput(saved)
+
+	scanner := bufio.NewScanner(in)
+
+	for {
+		fmt.Fprint(out, "> ")
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		ret, err := e.evalLine(line, obj)
+		if err != nil {
+			fmt.Fprintf(out, "error: %s\n", strings.TrimSpace(err.Error()))
+			continue
+		}
+
+		if ret != nil {
+			fmt.Fprintln(out, ret.Inspect())
+		}
+	}
+
+	return scanner.Err()
+}
+
+// evalLine compiles, and runs, a single line of input for our REPL.
+//
+// If the line ends with an expression then it is returned, so that we
+// can show its value.  A nil result is returned for lines which don't
+// produce a value, such as assignments.
+func (e *Eval) evalLine(line string, obj interface{}) (object.Object, error) {
+
+	p := parser.New(lexer.New(line))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	// Lines without a value still need to return something.
+	implicit := true
+
+	if n := len(program.Statements); n > 0 {
+		switch last := program.Statements[n-1].(type) {
+		case *ast.ReturnStatement:
+			implicit = false
+		case *ast.ExpressionStatement:
+			if hasValue(last.Expression) {
+				program.Statements[n-1] = &ast.ReturnStatement{Token: last.Token, ReturnValue: last.Expression}
+				implicit = false
+			}
+		}
+	}
+
+	if implicit {
+		program.Statements = append(program.Statements, &ast.ReturnStatement{ReturnValue: &ast.NullLiteral{}})
+	}
+
+	err := e.build(program, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := e.Execute(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.Type() == object.VOID || (implicit && ret.Type() == object.NULL) {
+		return nil, nil
+	}
+	return ret, nil
+}
+
+// hasValue returns true if the given expression is one whose value is of
+// interest, rather than one which is used for its effect - such as an
+// assignment, or a loop.
+func hasValue(expr ast.Expression) bool {
+
+	switch expr := expr.(type) {
+	case nil, *ast.AssignStatement, *ast.ForeachStatement, *ast.IfExpression,
+		*ast.PostfixExpression, *ast.WhileStatement:
+		return false
+	case *ast.CallExpression:
+		name := expr.Function.String()
+		return name != "print" && name != "printf"
+	}
+	return true
+}
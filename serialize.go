@@ -0,0 +1,305 @@
+// This file contains the code which allows a compiled program to be
+// saved, and later loaded, avoiding the need to parse and compile the
+// script again.
+
+package evalfilter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/lexer"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/parser"
+	"github.com/skx/evalfilter/v2/token"
+	"github.com/skx/evalfilter/v2/vm"
+)
+
+// programVersion is the version of the format we save compiled programs
+// in.  It must be increased whenever the format changes, or the bytecode
+// does - that is whenever an opcode is added, removed, or renumbered, or
+// the meaning of an opcode, or its argument, changes.
+const programVersion = 2
+
+// savedProgram is the structure we use to save a compiled program.
+type savedProgram struct {
+	// Version holds the version of the format.
+	Version int `json:"version"`
+
+	// Optimize is true if the bytecode should be optimized when
+	// it is loaded.
+	Optimize bool `json:"optimize"`
+
+	// Diagnostics is true if the program records failed conditions.
+	Diagnostics bool `json:"diagnostics,omitempty"`
+
+	// NoAssert is true if calls to `assert` were removed.
+	NoAssert bool `json:"noAssert,omitempty"`
+
+	// Source holds the script, which is parsed again when the program
+	// is loaded so that Explain, Fields, and DumpAST may be used.
+	Source string `json:"source"`
+
+	// MaxDepth holds the deepest nesting the parser allowed, if it
+	// was changed.
+	MaxDepth int `json:"maxDepth,omitempty"`
+
+	// Constants holds the constant-pool.
+	Constants []savedConstant `json:"constants"`
+
+	// Instructions holds the bytecode.
+	Instructions []byte `json:"instructions"`
+
+	// Positions holds the source-positions of the bytecode.
+	Positions map[int]token.Position `json:"positions,omitempty"`
+
+	// Functions holds the functions which the script defined.
+	Functions []savedFunction `json:"functions,omitempty"`
+}
+
+// savedFunction is the structure we use to save a single function.
+type savedFunction struct {
+	// Name holds the name of the function.
+	Name string `json:"name"`
+
+	// Parameters holds the names of the function's parameters.
+	Parameters []string `json:"parameters,omitempty"`
+
+	// Instructions holds the bytecode of the function's body.
+	Instructions []byte `json:"instructions"`
+
+	// Positions holds the source-positions of the bytecode.
+	Positions map[int]token.Position `json:"positions,omitempty"`
+}
+
+// savedConstant is the structure we use to save a single constant.
+type savedConstant struct {
+	// Type holds the type of the constant.
+	Type object.Type `json:"type"`
+
+	// Value holds the string-representation of the value.
+	Value string `json:"value"`
+}
+
+// Save writes the compiled program to the given writer, so that it may
+// later be restored via Load.
+//
+// The script must have been compiled, via Prepare, first.
+func (e *Eval) Save(w io.Writer) error {
+
+	if e.machine == nil {
+		return fmt.Errorf("the script has not been prepared")
+	}
+
+	_, optimize := e.environment.Get("OPTIMIZE")
+
+	prg := savedProgram{
+		Version:      programVersion,
+		Optimize:     optimize,
+		Diagnostics:  e.diagnostics,
+		NoAssert:     e.noAssert,
+		Source:       e.Script,
+		MaxDepth:     e.maxDepth,
+		Instructions: e.instructions,
+		Positions:    e.positions,
+	}
+
+	for _, fn := range e.functions {
+		prg.Functions = append(prg.Functions, savedFunction{
+			Name:         fn.Name,
+			Parameters:   fn.Parameters,
+			Instructions: fn.Instructions,
+			Positions:    fn.Positions,
+		})
+	}
+
+	for _, c := range e.constants {
+
+		var val string
+
+		switch c := c.(type) {
+		case *object.Boolean:
+			val = strconv.FormatBool(c.Value)
+		case *object.Float:
+			val = strconv.FormatFloat(c.Value, 'g', -1, 64)
+		case *object.Integer:
+			val = strconv.FormatInt(c.Value, 10)
+		case *object.Null:
+			val = ""
+		case *object.String:
+			val = c.Value
+		default:
+			return fmt.Errorf("cannot save constant of type %s", c.Type())
+		}
+
+		prg.Constants = append(prg.Constants, savedConstant{Type: c.Type(), Value: val})
+	}
+
+	return json.NewEncoder(w).Encode(prg)
+}
+
+// Load reads a compiled program, which was previously written by Save,
+// from the given reader.
+//
+// Load replaces the need to call Prepare, once it has completed the
+// program may be executed via Run or Execute as usual.  The bytecode is
+// checked to ensure that it is well-formed, and the script is parsed
+// again so that Explain, Fields, and DumpAST work as they would after
+// Prepare.
+func (e *Eval) Load(r io.Reader) error {
+
+	var prg savedProgram
+
+	err := json.NewDecoder(r).Decode(&prg)
+	if err != nil {
+		return fmt.Errorf("failed to load program: %s", err.Error())
+	}
+
+	if prg.Version != programVersion {
+		return fmt.Errorf("failed to load program: unsupported version %d", prg.Version)
+	}
+
+	var constants []object.Object
+
+	for i, c := range prg.Constants {
+
+		var obj object.Object
+
+		switch c.Type {
+		case object.BOOLEAN:
+			var val bool
+			val, err = strconv.ParseBool(c.Value)
+			obj = &object.Boolean{Value: val}
+		case object.FLOAT:
+			var val float64
+			val, err = strconv.ParseFloat(c.Value, 64)
+			obj = &object.Float{Value: val}
+		case object.INTEGER:
+			var val int64
+			val, err = strconv.ParseInt(c.Value, 10, 64)
+			obj = &object.Integer{Value: val}
+		case object.NULL:
+			obj = &object.Null{}
+		case object.STRING:
+			obj = &object.String{Value: c.Value}
+		default:
+			err = fmt.Errorf("unknown type %s", c.Type)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to load program: constant %d: %s", i, err.Error())
+		}
+		constants = append(constants, obj)
+	}
+
+	err = validate(prg.Instructions, len(constants))
+	if err != nil {
+		return fmt.Errorf("failed to load program: %s", err.Error())
+	}
+	for _, fn := range prg.Functions {
+		err = validate(fn.Instructions, len(constants))
+		if err != nil {
+			return fmt.Errorf("failed to load program: function %s: %s", fn.Name, err.Error())
+		}
+	}
+
+	// Parse the script again, for the methods which examine it
+	// rather than running it.
+	p := parser.New(lexer.New(prg.Source))
+	p.SetMaxDepth(prg.MaxDepth)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return fmt.Errorf("failed to load program: %s", (&ParseError{Errors: p.Errors()}).Error())
+	}
+
+	e.Script = prg.Source
+	e.maxDepth = prg.MaxDepth
+	e.program = program
+	e.noAssert = prg.NoAssert
+	e.constants = constants
+	e.instructions = code.Instructions(prg.Instructions)
+	e.positions = prg.Positions
+	e.diagnostics = prg.Diagnostics
+
+	if prg.Optimize {
+		e.environment.Set("OPTIMIZE", &object.Boolean{Value: true})
+	}
+
+	e.functions = nil
+	for _, fn := range prg.Functions {
+		e.functions = append(e.functions, &vm.Function{
+			Name:         fn.Name,
+			Parameters:   fn.Parameters,
+			Instructions: code.Instructions(fn.Instructions),
+			Positions:    fn.Positions,
+		})
+	}
+
+	e.machine = vm.NewWithPositions(e.constants, e.instructions, e.positions, e.environment)
+	for _, fn := range e.functions {
+		e.machine.AddFunction(fn)
+	}
+	return nil
+}
+
+// validate checks that the given bytecode, read by Load, is well-formed.
+//
+// Every opcode must be known, and complete, every reference to a constant
+// must be within the constant-pool, and every jump must land upon an
+// instruction, or the end of the bytecode.  Otherwise a corrupted program
+// could cause the virtual machine to panic.
+func validate(ins []byte, constants int) error {
+
+	// The offsets of the instructions, and the targets of the jumps.
+	starts := make(map[int]bool)
+	var targets []int
+
+	for ip := 0; ip < len(ins); {
+
+		op := code.Opcode(ins[ip])
+		if int(op) >= len(code.OpCodeNames) || code.OpCodeNames[op] == "" {
+			return fmt.Errorf("unknown opcode 0x%02X at offset %d", ins[ip], ip)
+		}
+
+		opLen := code.Length(op)
+		if ip+opLen > len(ins) {
+			return fmt.Errorf("truncated %s at offset %d", code.String(op), ip)
+		}
+
+		opArg := 0
+		if opLen > 1 {
+			opArg = int(binary.BigEndian.Uint16(ins[ip+1 : ip+3]))
+		}
+
+		// The last constant the instruction refers to, if any.
+		last := -1
+
+		switch op {
+		case code.OpConstant, code.OpLookup, code.OpInc, code.OpDec, code.OpExists, code.OpCheck, code.OpEnter:
+			last = opArg
+		case code.OpCheckComparison:
+			last = opArg + 2
+		case code.OpJump, code.OpJumpIfFalse, code.OpJumpIfNotNull, code.OpJumpIfNull:
+			targets = append(targets, opArg)
+		}
+
+		if last >= constants {
+			return fmt.Errorf("%s at offset %d refers to missing constant %d", code.String(op), ip, last)
+		}
+
+		starts[ip] = true
+		ip += opLen
+	}
+
+	for _, target := range targets {
+		if target != len(ins) && !starts[target] {
+			return fmt.Errorf("jump to offset %d, which is not an instruction", target)
+		}
+	}
+
+	return nil
+}
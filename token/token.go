@@ -9,77 +9,114 @@
 // instructions which will ultimately be executed by our virtual machine.
 package token
 
+import "fmt"
+
 // Type is a string
 type Type string
 
+// Position holds the location of a token within the input script.
+//
+// Both the line and the column are 1-based, and a zero-value means
+// the position is unknown.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// String returns a human-readable version of the position, suitable
+// for use as the prefix of an error-message.
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, col %d", p.Line, p.Column)
+}
+
 // Token struct represent the lexer token
 type Token struct {
 	Type    Type
 	Literal string
+
+	// Position holds the location of the start of the token.
+	Position
 }
 
 // Our known token-types
 const (
-	AND        = "&&"
-	ASSIGN     = "="
-	ASTERISK   = "*"
-	BANG       = "!"
-	COLON      = ":"
-	COMMA      = ","
-	CONTAINS   = "~="
-	DOTDOT     = ".."
-	ELSE       = "ELSE"
-	EOF        = "EOF"
-	EQ         = "=="
-	FALSE      = "FALSE"
-	FLOAT      = "FLOAT"
-	FOREACH    = "FOREACH"
-	GT         = ">"
-	GTEQUALS   = ">="
-	IDENT      = "IDENT"
-	IF         = "IF"
-	ILLEGAL    = "ILLEGAL"
-	IN         = "IN"
-	INT        = "INT"
-	LBRACE     = "{"
-	LPAREN     = "("
-	LSQUARE    = "["
-	LT         = "<"
-	LTEQUALS   = "<="
-	MINUS      = "-"
-	MINUSMINUS = "--"
-	MISSING    = "!~"
-	MOD        = "%"
-	NOTEQ      = "!="
-	OR         = "||"
-	PERIOD     = "."
-	PLUS       = "+"
-	PLUSPLUS   = "++"
-	POW        = "**"
-	QUESTION   = "?"
-	RBRACE     = "}"
-	REGEXP     = "REGEXP"
-	RETURN     = "RETURN"
-	RPAREN     = ")"
-	RSQUARE    = "]"
-	SEMICOLON  = ";"
-	SLASH      = "/"
-	SQRT       = "√"
-	STRING     = "STRING"
-	TRUE       = "TRUE"
-	WHILE      = "WHILE"
+	AND          = "&&"
+	ASSIGN       = "="
+	ASTERISK     = "*"
+	BANG         = "!"
+	BITAND       = "&"
+	BITOR        = "|"
+	BITXOR       = "^"
+	COALESCE     = "??"
+	COLON        = ":"
+	COMMA        = ","
+	CONTAINS     = "~="
+	CONTAINSFOLD = "~=*"
+	DOTDOT       = ".."
+	ELSE         = "ELSE"
+	EOF          = "EOF"
+	EQ           = "=="
+	EQFOLD       = "==*"
+	FALSE        = "FALSE"
+	FLOAT        = "FLOAT"
+	FOREACH      = "FOREACH"
+	FUNCTION     = "FUNCTION"
+	GT           = ">"
+	GTEQUALS     = ">="
+	IDENT        = "IDENT"
+	IF           = "IF"
+	ILLEGAL      = "ILLEGAL"
+	IN           = "IN"
+	INT          = "INT"
+	LBRACE       = "{"
+	LPAREN       = "("
+	LSQUARE      = "["
+	LT           = "<"
+	LTEQUALS     = "<="
+	MINUS        = "-"
+	MINUSMINUS   = "--"
+	MISSING      = "!~"
+	MISSINGFOLD  = "!~*"
+	MOD          = "%"
+	NOT          = "NOT"
+	NOTEQ        = "!="
+	NOTEQFOLD    = "!=*"
+	NULL         = "NULL"
+	OPTCHAIN     = "?."
+	OR           = "||"
+	PERIOD       = "."
+	PLUS         = "+"
+	PLUSPLUS     = "++"
+	POW          = "**"
+	QUESTION     = "?"
+	RBRACE       = "}"
+	REGEXP       = "REGEXP"
+	RETURN       = "RETURN"
+	RPAREN       = ")"
+	RSQUARE      = "]"
+	SEMICOLON    = ";"
+	SHIFTLEFT    = "<<"
+	SHIFTRIGHT   = ">>"
+	SLASH        = "/"
+	SQRT         = "√"
+	STRING       = "STRING"
+	TRUE         = "TRUE"
+	WHILE        = "WHILE"
 )
 
 // reversed keywords
 var keywords = map[string]Type{
-	"else":    ELSE,
-	"false":   FALSE,
-	"foreach": FOREACH,
-	"if":      IF,
-	"in":      IN,
-	"return":  RETURN,
-	"true":    TRUE,
-	"while":   WHILE,
+	"else":     ELSE,
+	"false":    FALSE,
+	"foreach":  FOREACH,
+	"function": FUNCTION,
+	"if":       IF,
+	"in":       IN,
+	"not":      NOT,
+	"null":     NULL,
+	"return":   RETURN,
+	"true":     TRUE,
+	"while":    WHILE,
 }
 
 // LookupIdentifier used to determinate whether identifier is keyword nor not
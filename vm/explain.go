@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// comparisons maps the opcodes which perform comparisons to the operators
+// which generated them, these are the operations which are recorded in an
+// explanation.
+var comparisons = map[code.Opcode]string{
+	code.OpLess:           "<",
+	code.OpLessEqual:      "<=",
+	code.OpGreater:        ">",
+	code.OpGreaterEqual:   ">=",
+	code.OpEqual:          "==",
+	code.OpNotEqual:       "!=",
+	code.OpMatches:        "~=",
+	code.OpNotMatches:     "!~",
+	code.OpEqualFold:      "==*",
+	code.OpNotEqualFold:   "!=*",
+	code.OpMatchesFold:    "~=*",
+	code.OpNotMatchesFold: "!~*",
+	code.OpArrayIn:        "in",
+}
+
+// Explanation is a node in the record of how a script reached its
+// result, which is produced by Explain.
+//
+// The nodes form a tree which mirrors the structure of the script:  each
+// `if` statement has a child for every comparison made while testing its
+// condition, followed by a child for the branch which was taken.
+type Explanation struct {
+	// Description describes the node, for example "if (Age > 18)",
+	// "then", or "else".  For comparisons it shows the values which
+	// were compared.
+	Description string
+
+	// Position holds the location of the source which generated this
+	// node, if known.
+	Position token.Position
+
+	// Operator holds the operator used by a comparison, and is empty
+	// for other nodes.
+	Operator string
+
+	// Left and Right hold the operands of a comparison.
+	Left  object.Object
+	Right object.Object
+
+	// Result holds the result of a comparison, or for the root node
+	// the value which the script returned.
+	Result object.Object
+
+	// Children holds the nodes nested beneath this one.
+	Children []*Explanation
+
+	// parent is the node which contains this one.
+	parent *Explanation
+}
+
+// String returns an indented, human-readable, version of the explanation.
+func (x *Explanation) String() string {
+	var out bytes.Buffer
+	x.write(&out, 0)
+	return out.String()
+}
+
+// write adds the explanation to the buffer, at the given depth, and
+// then recurses into its children.
+func (x *Explanation) write(out *bytes.Buffer, depth int) {
+
+	out.WriteString(strings.Repeat("  ", depth))
+	if x.Position.Line > 0 {
+		out.WriteString(x.Position.String() + ": ")
+	}
+	out.WriteString(x.Description)
+	if x.Result != nil {
+		out.WriteString(" => " + x.Result.Inspect())
+	}
+	out.WriteString("\n")
+
+	for _, c := range x.Children {
+		c.write(out, depth+1)
+	}
+}
+
+// Explain runs our program, exactly as Run does, but also returns a
+// record of the comparisons which were made, and the branches taken.
+//
+// An explanation is only recorded if the bytecode was compiled to do so,
+// otherwise the result will contain nothing beyond the return value.
+func (vm *VM) Explain(obj interface{}) (*Explanation, error) {
+
+	root := &Explanation{Description: "program"}
+
+	vm.explain = root
+	defer func() { vm.explain = nil }()
+
+	res, err := vm.Run(obj)
+	if err != nil {
+		return root, err
+	}
+
+	root.Result = res
+	return root, nil
+}
+
+// explainBinaryOperation performs a comparison, exactly as the
+// executeBinaryOperation method does, recording the operands and
+// result in our explanation.
+func (vm *VM) explainBinaryOperation(op code.Opcode, ip int) error {
+
+	right, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	left, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	vm.stack.Push(left)
+	vm.stack.Push(right)
+
+	err = vm.executeBinaryOperation(op)
+	if err != nil {
+		return err
+	}
+
+	res, err := vm.stack.Pop()
+	if err != nil {
+		return err
+	}
+	vm.stack.Push(res)
+
+	vm.explain.Children = append(vm.explain.Children, &Explanation{
+		Description: fmt.Sprintf("%s %s %s", describe(left), comparisons[op], describe(right)),
+		Position:    vm.positions[ip],
+		Operator:    comparisons[op],
+		Left:        left,
+		Right:       right,
+		Result:      res,
+		parent:      vm.explain,
+	})
+	return nil
+}
+
+// describe returns a representation of the given object, with strings
+// quoted so that they may be distinguished from other values.
+func describe(obj object.Object) string {
+	if obj.Type() == object.STRING {
+		return fmt.Sprintf("%q", obj.Inspect())
+	}
+	return obj.Inspect()
+}
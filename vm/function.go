@@ -0,0 +1,135 @@
+// This file contains the support for functions which are defined by
+// scripts, rather than by the host application.
+
+package vm
+
+import (
+	"fmt"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/stack"
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// maxCallDepth is the maximum number of nested function calls we allow,
+// which prevents runaway recursion from exhausting our stack.
+const maxCallDepth = 1000
+
+// locatedError is an error, raised within a function, which already
+// contains the position of the instruction which caused it.
+type locatedError struct {
+	error
+}
+
+// Function holds a function which was defined by a script.
+type Function struct {
+	// Name is the name of the function.
+	Name string
+
+	// Parameters holds the names of the function's parameters.
+	Parameters []string
+
+	// Instructions holds the bytecode of the function's body, which
+	// uses the same constants as the main program.
+	Instructions code.Instructions
+
+	// Positions holds the source-positions of the bytecode.
+	Positions map[int]token.Position
+}
+
+// AddFunction makes a function, which was defined by the script, available
+// for the script to call.
+//
+// The function is stored in the environment, alongside those added by
+// the host application, so it may be called by name - including via the
+// `map` and `filter` functions.
+func (vm *VM) AddFunction(fn *Function) {
+
+	// Take a copy, as the optimizer replaces the bytecode.
+	fn = &Function{
+		Name:         fn.Name,
+		Parameters:   fn.Parameters,
+		Instructions: fn.Instructions,
+		Positions:    fn.Positions,
+	}
+
+	// Optimize the bytecode, if we should.
+	if vm.optimize {
+		bytecode, positions := vm.bytecode, vm.positions
+
+		vm.bytecode, vm.positions = fn.Instructions, fn.Positions
+		vm.optimizeBytecode()
+		fn.Instructions, fn.Positions = vm.bytecode, vm.positions
+
+		vm.bytecode, vm.positions = bytecode, positions
+	}
+
+	vm.functions[fn.Name] = fn
+	vm.register(fn)
+}
+
+// register stores a wrapper in our environment which invokes the given
+// function.
+func (vm *VM) register(fn *Function) {
+	vm.environment.SetFunction(fn.Name, func(args []object.Object) object.Object {
+		return vm.call(fn, args)
+	})
+}
+
+// call invokes the given function with the specified arguments, and
+// returns the value it returned.
+//
+// The function's parameters are stored in a new scope, and its body is
+// executed with a stack of its own, so that a `return` within it only
+// terminates the function.
+func (vm *VM) call(fn *Function, args []object.Object) object.Object {
+
+	if len(args) != len(fn.Parameters) {
+		return &object.Error{Message: fmt.Sprintf("wrong number of arguments: got %d, expected %d", len(args), len(fn.Parameters))}
+	}
+
+	if vm.depth >= maxCallDepth {
+		return &object.Error{Message: fmt.Sprintf("maximum call depth of %d exceeded", maxCallDepth)}
+	}
+
+	restore := vm.environment.EnterFunction()
+	defer restore()
+
+	for i, name := range fn.Parameters {
+		vm.environment.SetLocal(name, args[i])
+	}
+
+	bytecode, positions, stk := vm.bytecode, vm.positions, vm.stack
+	defer func() {
+		vm.bytecode, vm.positions, vm.stack = bytecode, positions, stk
+		vm.depth--
+	}()
+
+	vm.bytecode, vm.positions, vm.stack = fn.Instructions, fn.Positions, stack.New()
+	vm.depth++
+
+	out, err := vm.execute(vm.object)
+	if err != nil {
+		vm.failure = err
+		return &object.Error{Message: err.Error()}
+	}
+	return out
+}
+
+// WalkFunction invokes the specified callback function upon every
+// instruction in the body of the named function, as WalkBytecode does
+// for our main program.
+func (vm *VM) WalkFunction(name string, callback BytecodeVisitor) error {
+
+	fn, ok := vm.functions[name]
+	if !ok {
+		return fmt.Errorf("the function %s does not exist", name)
+	}
+
+	bytecode := vm.bytecode
+	defer func() { vm.bytecode = bytecode }()
+
+	vm.bytecode = fn.Instructions
+	return vm.WalkBytecode(callback)
+}
@@ -17,9 +17,9 @@ package vm
 
 import (
 	"encoding/binary"
-	"fmt"
 
 	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/token"
 )
 
 // optimize optimizes our bytecode by working over the program
@@ -185,7 +185,7 @@ func (vm *VM) optimizeMaths() (bool, error) {
 			// reset our argument counters.
 			args = nil
 
-		case code.OpMul, code.OpAdd, code.OpSub, code.OpDiv:
+		case code.OpMul, code.OpAdd, code.OpSub:
 
 			//
 			// Primitive maths operation.
@@ -223,14 +223,6 @@ func (vm *VM) optimizeMaths() (bool, error) {
 				if opCode == code.OpSub {
 					result = b.value - a.value
 				}
-				if opCode == code.OpDiv {
-
-					// found division by zero
-					if a.value == 0 {
-						return false, fmt.Errorf("attempted division by zero")
-					}
-					result = b.value / a.value
-				}
 
 				if result%1 == 0 && result >= 0 && result <= 65534 {
 					// TODO - FIX ME!
@@ -312,6 +304,10 @@ func (vm *VM) optimizeMaths() (bool, error) {
 //
 // Can be rewritten to `OpJump 0x1234` as it will always be taken.
 //
+// Neither rewrite is safe if some other jump lands upon the constant,
+// or the conditional jump, since then the value tested might differ.
+// (The compiler generates such code for chained comparisons.)
+//
 func (vm *VM) optimizeJumps() bool {
 
 	//
@@ -319,6 +315,11 @@ func (vm *VM) optimizeJumps() bool {
 	//
 	prevOp := code.OpNop
 
+	//
+	// The destinations of all jumps.
+	//
+	targets := vm.jumpTargets()
+
 	//
 	// Did we make changes?
 	//
@@ -336,6 +337,13 @@ func (vm *VM) optimizeJumps() bool {
 
 		case code.OpJumpIfFalse:
 
+			//
+			// If something jumps here we can't change it.
+			//
+			if targets[offset] || targets[offset-1] {
+				break
+			}
+
 			//
 			// If the previous opcode was "OpTrue" then
 			// the jump is pointless.
@@ -416,6 +424,26 @@ func (vm *VM) optimizeJumps() bool {
 	return changed
 }
 
+// jumpTargets returns the offsets which are the destination of any
+// jump instruction.
+func (vm *VM) jumpTargets() map[int]bool {
+
+	targets := make(map[int]bool)
+
+	vm.WalkBytecode(func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
+
+		switch opCode {
+		case code.OpJump, code.OpJumpIfFalse, code.OpJumpIfNotNull, code.OpJumpIfNull:
+			targets[opArg.(int)] = true
+		}
+
+		// No error, keep walking.
+		return true, nil
+	})
+
+	return targets
+}
+
 // removeNOPs removes any inline NOP instructions.
 //
 // It also rewrites the destinations for jumps as appropriate, to
@@ -531,7 +559,7 @@ func (vm *VM) removeNOPs() {
 		// We use the rewrite map we already made,
 		// which contains "old -> new".
 		//
-		case code.OpJump, code.OpJumpIfFalse:
+		case code.OpJump, code.OpJumpIfFalse, code.OpJumpIfNotNull, code.OpJumpIfNull:
 
 			// The old destination is in "opArg".
 			//
@@ -564,6 +592,19 @@ func (vm *VM) removeNOPs() {
 		ip += opLen
 	}
 
+	//
+	// Update the positions of our instructions.
+	//
+	if vm.positions != nil {
+		positions := make(map[int]token.Position)
+		for old, pos := range vm.positions {
+			if dst, ok := rewrite[old]; ok && code.Opcode(vm.bytecode[old]) != code.OpNop {
+				positions[dst] = pos
+			}
+		}
+		vm.positions = positions
+	}
+
 	//
 	// Replace the instructions.
 	//
@@ -595,7 +636,7 @@ func (vm *VM) removeDeadCode() {
 		//
 		switch opCode {
 
-		case code.OpJumpIfFalse, code.OpJump:
+		case code.OpJumpIfFalse, code.OpJump, code.OpJumpIfNotNull, code.OpJumpIfNull:
 			// Stop walking
 			return false, nil
 
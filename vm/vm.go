@@ -10,6 +10,7 @@ package vm
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
@@ -21,6 +22,7 @@ import (
 	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/object"
 	"github.com/skx/evalfilter/v2/stack"
+	"github.com/skx/evalfilter/v2/token"
 )
 
 // BytecodeVisitor is the function-signature of the callbackup function which
@@ -38,7 +40,7 @@ var True = &object.Boolean{Value: true}
 // False is our global "false" object.
 var False = &object.Boolean{Value: false}
 
-// Null is our global "false" object.
+// Null is our global "null" object.
 var Null = &object.Null{}
 
 // VM is the structure which holds our state.
@@ -55,6 +57,12 @@ type VM struct {
 	// bytecode contains the actual series of instructions we'll execute.
 	bytecode code.Instructions
 
+	// positions maps the offset of an instruction within our bytecode
+	// to the position of the source which generated it.
+	//
+	// This is used to report the location of run-time errors.
+	positions map[int]token.Position
+
 	// stack holds a pointer to our stack-object.
 	//
 	// We're a stack-based virtual machine so this is used for
@@ -75,6 +83,105 @@ type VM struct {
 
 	// debug can be enabled to dump our execution-log as we run.
 	debug bool
+
+	// diagnostics holds the conditions which failed during the
+	// most recent run.
+	diagnostics []Diagnostic
+
+	// compared holds the operands of the comparison which was just
+	// made, if its result is about to be checked by an
+	// OpCheckComparison instruction.
+	compared *Diagnostic
+
+	// explain holds the current node of the explanation we're
+	// recording, if any, see Explain.
+	explain *Explanation
+
+	// optimize is true if we should optimize our bytecode, and that
+	// of any functions we're given.
+	optimize bool
+
+	// functions holds the functions which the script defined,
+	// keyed by name.
+	functions map[string]*Function
+
+	// object is the object we're currently running against.
+	object interface{}
+
+	// depth is the number of nested function calls we're within.
+	depth int
+
+	// failure holds the error raised by the most recent call to
+	// one of the script's functions, if any.
+	failure error
+
+	// visiting holds the pointers, and maps, which we're converting
+	// to objects, see enter.
+	visiting map[visit]bool
+
+	// match is the function which implements the `~=` and `!~`
+	// operators.  It is looked up when we're constructed, so that
+	// a function defined by the script cannot replace it.
+	match interface{}
+}
+
+// Diagnostic records a condition which failed while a script was running.
+//
+// These are only recorded if the script was compiled with diagnostics
+// enabled.
+type Diagnostic struct {
+	// Condition holds the source of the condition which failed.
+	Condition string
+
+	// Position holds the location of the condition, if known.
+	Position token.Position
+
+	// Operator holds the operator, if the condition was a comparison,
+	// and Left and Right hold the values which were compared.
+	Operator string
+	Left     object.Object
+	Right    object.Object
+
+	// Reason describes why a comparison failed, using the source and
+	// value of each operand, such as `Age (15) is not >= 18`.  It is
+	// empty if the condition wasn't a comparison.
+	Reason string
+}
+
+// String returns a human-readable version of the diagnostic.
+func (d Diagnostic) String() string {
+	if d.Position.Line > 0 {
+		return fmt.Sprintf("%s: %s failed", d.Position, d.Condition)
+	}
+	return fmt.Sprintf("%s failed", d.Condition)
+}
+
+// operands returns the operands of the given comparison, which are on
+// the top of the stack, without removing them.
+func (vm *VM) operands(op code.Opcode) *Diagnostic {
+
+	right, err := vm.stack.Pop()
+	if err != nil {
+		return nil
+	}
+	left, err := vm.stack.Pop()
+	if err != nil {
+		vm.stack.Push(right)
+		return nil
+	}
+	vm.stack.Push(left)
+	vm.stack.Push(right)
+
+	return &Diagnostic{Operator: comparisons[op], Left: left, Right: right}
+}
+
+// operand describes one operand of a failed comparison, for the reason
+// given by a diagnostic, using its source unless it was a literal.
+func operand(source string, val object.Object) string {
+	if source == "" {
+		return describe(val)
+	}
+	return fmt.Sprintf("%s (%s)", source, describe(val))
 }
 
 // New constructs a new virtual machine.
@@ -83,6 +190,14 @@ type VM struct {
 // series of simple optimizer steps.  These are naive, but do speedup carefully constructed
 // test cases.
 func New(constants []object.Object, bytecode code.Instructions, env *environment.Environment) *VM {
+	return NewWithPositions(constants, bytecode, nil, env)
+}
+
+// NewWithPositions constructs a new virtual machine, as New does.
+//
+// The positions map, which may be nil, records the location in the source
+// of the instructions at the given offsets, and is used to report errors.
+func NewWithPositions(constants []object.Object, bytecode code.Instructions, positions map[int]token.Position, env *environment.Environment) *VM {
 
 	// If we have a `DEBUG` environment then we enable debugging.
 	_, debug := env.Get("DEBUG")
@@ -98,8 +213,12 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 		constants:   constants,
 		environment: env,
 		bytecode:    bytecode,
+		positions:   positions,
 		debug:       debug,
+		optimize:    optimize,
+		functions:   make(map[string]*Function),
 	}
+	vm.match, _ = env.GetFunction("match")
 
 	// Optimize the bytecode, if we should.
 	if optimize {
@@ -113,6 +232,44 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 	return vm
 }
 
+// Clone returns a copy of the virtual machine, using the given environment,
+// which may be executed independently of the original.
+//
+// The (already optimized) bytecode is shared, as it is never modified
+// once we've been constructed, but the constants are copied as they may
+// be mutated by a running program.
+func (vm *VM) Clone(env *environment.Environment) *VM {
+
+	constants := make([]object.Object, len(vm.constants))
+	for i, c := range vm.constants {
+		constants[i] = object.Copy(c)
+	}
+
+	c := &VM{
+		constants:   constants,
+		bytecode:    vm.bytecode,
+		positions:   vm.positions,
+		environment: env,
+		debug:       vm.debug,
+		optimize:    vm.optimize,
+		functions:   vm.functions,
+		match:       vm.match,
+	}
+
+	// Our functions must invoke the clone, not us.
+	for _, fn := range c.functions {
+		c.register(fn)
+	}
+
+	return c
+}
+
+// Diagnostics returns the conditions which failed during the most recent
+// run of our program.
+func (vm *VM) Diagnostics() []Diagnostic {
+	return vm.diagnostics
+}
+
 // Run launches our virtual machine, intepreting the bytecode-program we were
 // constructed with.
 //
@@ -122,7 +279,7 @@ func New(constants []object.Object, bytecode code.Instructions, env *environment
 //
 // (Although our compiler does not implement for/while/do/until loops
 // a hand-created program could build such a things via the instruction-set.)
-func (vm *VM) Run(obj interface{}) (object.Object, error) {
+func (vm *VM) Run(obj interface{}) (result object.Object, err error) {
 
 	//
 	// Sanity-check the bytecode program is non-empty
@@ -153,6 +310,19 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 	// cannot assume everybody remember to use that.)
 	//
 	vm.stack = stack.New()
+	vm.diagnostics = nil
+	vm.compared = nil
+
+	vm.object = obj
+	vm.depth = 0
+
+	return vm.execute(obj)
+}
+
+// execute interprets the bytecode we're currently executing, which is
+// either our main program, or the body of a function, against the given
+// object.
+func (vm *VM) execute(obj interface{}) (result object.Object, err error) {
 
 	//
 	// Instruction pointer and length.
@@ -160,6 +330,32 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 	ip := 0
 	ln := len(vm.bytecode)
 
+	//
+	// If we hit an error then we prefix it with the location
+	// of the source which generated the failing instruction.
+	//
+	// Errors raised within a function defined by the script already
+	// contain their location, so they're not prefixed again as they
+	// pass through each of its callers.
+	//
+	defer func() {
+		if err == nil {
+			return
+		}
+		if located, ok := err.(locatedError); ok {
+			if vm.depth == 0 {
+				err = located.error
+			}
+			return
+		}
+		if pos, ok := vm.positions[ip]; ok {
+			err = fmt.Errorf("%s: %s", pos, err.Error())
+		}
+		if vm.depth > 0 {
+			err = locatedError{err}
+		}
+	}()
+
 	//
 	// Loop over all the bytecode.
 	//
@@ -235,10 +431,36 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			// Get the name.
 			name := vm.constants[opArg].Inspect()
 
-			// Lookup the value.
-			val := vm.lookup(obj, name)
+			// Lookup the value, noting which of its members
+			// are accessed next so the field hook receives
+			// the full path which was read.
+			val, err := vm.lookup(obj, name, vm.memberPath(ip+opLen))
+			if err != nil {
+				return nil, err
+			}
 			vm.stack.Push(val)
 
+			// Test whether a field exists
+		case code.OpExists:
+
+			// Get the path.
+			path := vm.constants[opArg].Inspect()
+
+			vm.stack.Push(vm.nativeBoolToBooleanObject(vm.exists(obj, path)))
+
+			// Get all the fields of the object.
+		case code.OpObject:
+
+			if len(vm.fields) == 0 {
+				vm.inspectObject(obj)
+			}
+
+			hash := &object.Hash{Pairs: make(map[string]object.Object)}
+			for name, val := range vm.fields {
+				hash.Pairs[name] = object.Copy(val)
+			}
+			vm.stack.Push(hash)
+
 			// Set a variable by name
 		case code.OpSet:
 
@@ -258,28 +480,64 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			// maths & comparisons
 		case code.OpAdd, // addition
-			code.OpSub,          // subtraction
-			code.OpMul,          // multiplication
-			code.OpDiv,          // division
-			code.OpMod,          // modulus
-			code.OpPower,        // power
-			code.OpLess,         // comparison: <
-			code.OpLessEqual,    // comparison: <=
-			code.OpGreater,      // comparison: >
-			code.OpGreaterEqual, // comparison: >=
-			code.OpEqual,        // comparison: ==
-			code.OpNotEqual,     // comparison: !=
-			code.OpMatches,      // regexp match
-			code.OpNotMatches,   // regexp negative match
-			code.OpAnd,          // logical AND
-			code.OpOr,           // logical OR
-			code.OpArrayIn:      // array membership test
+			code.OpSub,            // subtraction
+			code.OpMul,            // multiplication
+			code.OpDiv,            // division
+			code.OpMod,            // modulus
+			code.OpPower,          // power
+			code.OpBitAnd,         // bitwise AND
+			code.OpBitOr,          // bitwise OR
+			code.OpBitXor,         // bitwise XOR
+			code.OpShiftLeft,      // shift: <<
+			code.OpShiftRight,     // shift: >>
+			code.OpLess,           // comparison: <
+			code.OpLessEqual,      // comparison: <=
+			code.OpGreater,        // comparison: >
+			code.OpGreaterEqual,   // comparison: >=
+			code.OpEqual,          // comparison: ==
+			code.OpNotEqual,       // comparison: !=
+			code.OpMatches,        // regexp match
+			code.OpNotMatches,     // regexp negative match
+			code.OpEqualFold,      // comparison: ==*
+			code.OpNotEqualFold,   // comparison: !=*
+			code.OpMatchesFold,    // regexp match: ~=*
+			code.OpNotMatchesFold, // regexp negative match: !~*
+			code.OpAnd,            // logical AND
+			code.OpOr,             // logical OR
+			code.OpArrayIn:        // array membership test
+
+			// If the result of a comparison is about to be
+			// checked then keep its operands, so that they
+			// may be reported if it failed.
+			var compared *Diagnostic
+			if _, ok := comparisons[op]; ok && ip+opLen < len(vm.bytecode) && code.Opcode(vm.bytecode[ip+opLen]) == code.OpCheckComparison {
+				compared = vm.operands(op)
+			}
 
 			// Run the test, error gets returned, otherwise
 			// we're done.
-			err := vm.executeBinaryOperation(op)
+			var err error
+			if _, ok := comparisons[op]; ok && vm.explain != nil {
+				err = vm.explainBinaryOperation(op, ip)
+			} else {
+				err = vm.executeBinaryOperation(op)
+			}
+			if err == nil {
+				vm.compared = compared
+			}
 			if err != nil {
-				return nil, err
+				// A comparison which fails may be treated as
+				// false, rather than aborting the script.
+				if _, ok := comparisons[op]; !ok || !vm.environment.ErrorsAsFalse() {
+					return nil, err
+				}
+				if hook := vm.environment.ErrorHook(); hook != nil {
+					if pos, ok := vm.positions[ip]; ok {
+						err = fmt.Errorf("%s: %s", pos, err.Error())
+					}
+					hook(err)
+				}
+				vm.stack.Push(False)
 			}
 
 			// Store an array
@@ -297,6 +555,30 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			arr := &object.Array{Elements: elements}
 			vm.stack.Push(arr)
 
+			// Store a hash
+		case code.OpHash:
+
+			// Pop the pairs, then add them in the order they
+			// were written, so later keys replace earlier ones.
+			values := make([]object.Object, opArg*2)
+			for i := len(values) - 1; i >= 0; i-- {
+				var err error
+				values[i], err = vm.stack.Pop()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			pairs := make(map[string]object.Object, opArg)
+			for i := 0; i < len(values); i += 2 {
+				key, ok := values[i].(*object.String)
+				if !ok {
+					return nil, fmt.Errorf("hash keys must be strings, not %s", values[i].Type())
+				}
+				pairs[key.Value] = values[i+1]
+			}
+			vm.stack.Push(&object.Hash{Pairs: pairs})
+
 			// Array/String index
 		case code.OpIndex:
 			index, err := vm.stack.Pop()
@@ -313,6 +595,135 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				return nil, err
 			}
 
+			// Array/String slice
+		case code.OpSlice:
+			end, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			start, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			left, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+
+			err = vm.executeSliceExpression(left, start, end)
+			if err != nil {
+				return nil, err
+			}
+
+			// Stack manipulation
+		case code.OpDup:
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			vm.stack.Push(val)
+			vm.stack.Push(val)
+
+		case code.OpRot:
+			a, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			b, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			c, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			vm.stack.Push(a)
+			vm.stack.Push(c)
+			vm.stack.Push(b)
+
+		case code.OpPop:
+			_, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+
+			// Record a diagnostic if the condition failed
+		case code.OpCheck:
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			if !val.True() {
+				vm.diagnostics = append(vm.diagnostics, Diagnostic{
+					Condition: vm.constants[opArg].Inspect(),
+					Position:  vm.positions[ip],
+				})
+			}
+			vm.stack.Push(val)
+
+			// Record a diagnostic, with the values compared, if
+			// the comparison failed
+		case code.OpCheckComparison:
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			if !val.True() {
+				d := Diagnostic{
+					Condition: vm.constants[opArg].Inspect(),
+					Position:  vm.positions[ip],
+				}
+
+				// The comparison may have been optimized
+				// away, or failed with an error.
+				if c := vm.compared; c != nil {
+					d.Operator = c.Operator
+					d.Left = c.Left
+					d.Right = c.Right
+					d.Reason = fmt.Sprintf("%s is not %s %s",
+						operand(vm.constants[opArg+1].Inspect(), c.Left),
+						c.Operator,
+						operand(vm.constants[opArg+2].Inspect(), c.Right))
+				}
+				vm.diagnostics = append(vm.diagnostics, d)
+			}
+			vm.compared = nil
+			vm.stack.Push(val)
+
+			// Start a new node in the explanation
+		case code.OpEnter:
+			if vm.explain != nil {
+				node := &Explanation{
+					Description: vm.constants[opArg].Inspect(),
+					Position:    vm.positions[ip],
+					parent:      vm.explain,
+				}
+				vm.explain.Children = append(vm.explain.Children, node)
+				vm.explain = node
+			}
+
+			// Finish the current node in the explanation
+		case code.OpLeave:
+			if vm.explain != nil && vm.explain.parent != nil {
+				vm.explain = vm.explain.parent
+			}
+
+			// Hash member access
+		case code.OpMember:
+			name, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			left, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+
+			err = vm.executeMemberExpression(left, name)
+			if err != nil {
+				return nil, err
+			}
+
 			// !true -> false
 		case code.OpBang:
 
@@ -343,6 +754,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 		case code.OpFalse:
 			vm.stack.Push(False)
 
+			// Null literal
+		case code.OpNull:
+			vm.stack.Push(Null)
+
 			// return from script
 		case code.OpReturn:
 			result, err := vm.stack.Pop()
@@ -376,6 +791,36 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				ip = opArg - opLen
 			}
 
+			// flow-control: jump if stack contains non-null
+		case code.OpJumpIfNotNull:
+
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+
+			// If the value is non-null then we leave it
+			// upon the stack, and change the IP.
+			if val.Type() != object.NULL {
+				vm.stack.Push(val)
+				ip = opArg - opLen
+			}
+
+			// flow-control: jump if stack contains null
+		case code.OpJumpIfNull:
+
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			vm.stack.Push(val)
+
+			// If the value is null then we leave it upon
+			// the stack, and change the IP.
+			if val.Type() == object.NULL {
+				ip = opArg - opLen
+			}
+
 			// function-call: This is messy.
 		case code.OpCall:
 
@@ -417,8 +862,21 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			// Cast the function & call it
 			out := fn.(func(args []object.Object) object.Object)
+			vm.failure = nil
 			ret := out(fnArgs)
 
+			// If the function returned an error then we
+			// abort execution.
+			//
+			// If this was one of the script's functions
+			// we return the error it raised unchanged.
+			if ret.Type() == object.ERROR {
+				if _, ok := vm.functions[name]; ok && vm.failure != nil {
+					return nil, vm.failure
+				}
+				return nil, fmt.Errorf("error calling %s: %s", name, ret.Inspect())
+			}
+
 			// store the result back on the stack - unless
 			// it's a weird one.
 			if ret.Type() != object.VOID {
@@ -571,7 +1029,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			name := vm.constants[opArg].Inspect()
 
 			// Lookup the current value of that object.
-			val := vm.lookup(obj, name)
+			val, err := vm.lookup(obj, name, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// Can we use our interface?
 			helper, ok := val.(object.Increment)
@@ -579,12 +1040,20 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				return nil, fmt.Errorf("%s object doesn't implement the Increment() interface", val.Type())
 			}
 
+			// Integers mustn't wrap-around, as with the
+			// arithmetic operators.
+			if i, ok := val.(*object.Integer); ok {
+				if _, ok := integerArithmetic(code.OpAdd, i.Value, 1); !ok {
+					return nil, fmt.Errorf("integer overflow: %d + 1", i.Value)
+				}
+			}
+
 			// Mutate & store
 			helper.Increase()
 			vm.environment.Set(name, val)
 
 			// OpInc follows OpLookup, so we can drop the value we were given
-			_, err := vm.stack.Pop()
+			_, err = vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
@@ -597,7 +1066,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			name := vm.constants[opArg].Inspect()
 
 			// Lookup the current value of that object.
-			val := vm.lookup(obj, name)
+			val, err := vm.lookup(obj, name, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// Can we use our interface?
 			helper, ok := val.(object.Decrement)
@@ -605,12 +1077,20 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				return nil, fmt.Errorf("%s object doesn't implement the Decrement() interface", val.Type())
 			}
 
+			// Integers mustn't wrap-around, as with the
+			// arithmetic operators.
+			if i, ok := val.(*object.Integer); ok {
+				if _, ok := integerArithmetic(code.OpSub, i.Value, 1); !ok {
+					return nil, fmt.Errorf("integer overflow: %d - 1", i.Value)
+				}
+			}
+
 			// Mutate & store
 			helper.Decrease()
 			vm.environment.Set(name, val)
 
 			// OpDec follows OpLookup, so we can drop the value we were given
-			_, err := vm.stack.Pop()
+			_, err = vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
@@ -651,101 +1131,251 @@ func (vm *VM) inspectObject(obj interface{}) {
 	}
 
 	//
-	// Time gets special handling
+	// If we were given a hash then its contents are our fields,
+	// no reflection is required.
 	//
-	timeKind := reflect.TypeOf(time.Time{}).Kind()
+	if hash, ok := obj.(*object.Hash); ok {
+		for name, val := range hash.Pairs {
+			vm.fields[name] = val
+		}
+		return
+	}
 
 	//
-	// Get the value, be it a "thing", or a pointer to a thing.
+	// Otherwise convert the object in the same way as the values
+	// nested within it, and ToHash, so that its fields are named
+	// in the same way.
 	//
-	val := reflect.Indirect(reflect.ValueOf(obj))
+	if hash, ok := vm.reflectValue(reflect.ValueOf(obj)).(*object.Hash); ok {
+		for name, val := range hash.Pairs {
+			vm.fields[name] = val
+		}
+	}
+}
 
-	//
-	// Is this a map?
-	//
-	if val.Kind() == reflect.Map {
+// jsonNumber is the type of the numbers decoded from JSON, when the
+// decoder's UseNumber option is enabled.
+var jsonNumber = reflect.TypeOf(json.Number(""))
 
-		//
-		// Get all keys
-		//
-		for _, key := range val.MapKeys() {
+// coerce converts values which need special handling, returning false
+// for any other value.
+//
+// These are the values of types which the host application registered
+// a function for, via the environment, and json.Number - which would
+// otherwise be treated as a string.
+func (vm *VM) coerce(val reflect.Value) (object.Object, bool) {
+
+	// Look inside interfaces, as found in slices and maps.
+	if val.Kind() == reflect.Interface && !val.IsNil() {
+		val = val.Elem()
+	}
+	if !val.IsValid() || !val.CanInterface() {
+		return nil, false
+	}
 
-			// The name of the key.
-			name := key.Interface().(string)
+	if vm.environment != nil {
+		if fn, ok := vm.environment.Coercion(val.Type()); ok {
+			if ret := fn(val.Interface()); ret != nil {
+				return ret, true
+			}
+			return Null, true
+		}
+	}
 
-			// The actual thing inside it
-			field := val.MapIndex(key).Elem()
+	if val.Type() == jsonNumber {
+		num := val.Interface().(json.Number)
+		if i, err := num.Int64(); err == nil {
+			return &object.Integer{Value: i}, true
+		}
+		if f, err := num.Float64(); err == nil {
+			return &object.Float{Value: f}, true
+		}
+		return &object.String{Value: num.String()}, true
+	}
 
-			// Default
-			var ret object.Object
-			ret = &object.Null{}
+	return nil, false
+}
 
-			switch field.Kind() {
+// float converts a float, found within the object we're running against,
+// to an object.
+//
+// If the environment has asked for it floats which are whole numbers, and
+// which fit within an integer, become integers.
+func (vm *VM) float(val float64) object.Object {
 
-			// Hack.
-			//
-			// Probably broken.
-			case reflect.Slice:
-				ret = vm.createArrayFromSlice(field)
-			case reflect.Int, reflect.Int64:
-				ret = &object.Integer{Value: field.Int()}
-			case reflect.Float32, reflect.Float64:
-				ret = &object.Float{Value: field.Float()}
-			case reflect.String:
-				ret = &object.String{Value: field.String()}
-			case reflect.Bool:
-				ret = &object.Boolean{Value: field.Bool()}
-			case timeKind:
-				time, ok := field.Interface().(time.Time)
-				if ok {
-					ret = &object.Integer{Value: time.Unix()}
-				}
-			}
+	if vm.environment != nil && vm.environment.IntegralFloats() &&
+		val == math.Trunc(val) && val >= math.MinInt64 && val < math.MaxInt64 {
+		return &object.Integer{Value: int64(val)}
+	}
+	return &object.Float{Value: val}
+}
 
-			vm.fields[name] = ret
+// reflectValue converts a nested value, found within the object we're
+// running against, to an object.
+//
+// Maps and structures become hashes, recursively, and nil pointers
+// become null - which allows them to be used with the optional-chaining
+// operator.
+func (vm *VM) reflectValue(val reflect.Value) object.Object {
+
+	// Dereference any pointers, or interfaces, unless they need
+	// special handling.
+	for {
+		if ret, ok := vm.coerce(val); ok {
+			return ret
 		}
-		return
+		if val.Kind() != reflect.Ptr && val.Kind() != reflect.Interface {
+			break
+		}
+		if val.IsNil() {
+			return Null
+		}
+		if val.Kind() == reflect.Ptr {
+			if !vm.enter(val) {
+				return Null
+			}
+			defer vm.leave(val)
+		}
+		val = val.Elem()
 	}
 
-	//
-	// OK this is an object
-	//
-	for i := 0; i < val.NumField(); i++ {
-
-		// Get the field
-		field := val.Field(i)
-
-		// Get the name
-		typeField := val.Type().Field(i)
-		name := typeField.Name
-
-		// Default
-		var ret object.Object
-		ret = &object.Null{}
-
-		switch field.Kind() {
-
-		case reflect.Slice:
-			ret = vm.createArrayFromSlice(field)
-		case reflect.Int, reflect.Int64:
-			ret = &object.Integer{Value: field.Int()}
-		case reflect.Float32, reflect.Float64:
-			ret = &object.Float{Value: field.Float()}
-		case reflect.String:
-			ret = &object.String{Value: field.String()}
-		case reflect.Bool:
-			ret = &object.Boolean{Value: field.Bool()}
-		case timeKind:
-			time, ok := field.Interface().(time.Time)
-			if ok {
-				ret = &object.Integer{Value: time.Unix()}
+	switch val.Kind() {
+	case reflect.Slice:
+		return vm.createArrayFromSlice(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: val.Int()}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &object.Integer{Value: int64(val.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return vm.float(val.Float())
+	case reflect.String:
+		return &object.String{Value: val.String()}
+	case reflect.Bool:
+		return &object.Boolean{Value: val.Bool()}
+	case reflect.Map:
+		if !vm.enter(val) {
+			return Null
+		}
+		defer vm.leave(val)
+
+		hash := &object.Hash{Pairs: make(map[string]object.Object)}
+		for _, key := range val.MapKeys() {
+			hash.Pairs[fmt.Sprintf("%v", key.Interface())] = vm.reflectValue(val.MapIndex(key))
+		}
+		return hash
+	case reflect.Struct:
+		if val.CanInterface() {
+			if tm, ok := val.Interface().(time.Time); ok {
+				return &object.Integer{Value: tm.Unix()}
 			}
-		default:
-			fmt.Printf("Failed to reflect on %T\n", field.Interface())
 		}
+		hash := &object.Hash{Pairs: make(map[string]object.Object)}
+		for i := 0; i < val.NumField(); i++ {
+
+			name, ok := fieldName(val.Type().Field(i))
+			if !ok {
+				continue
+			}
+			hash.Pairs[name] = vm.reflectValue(val.Field(i))
+		}
+		return hash
+	}
+
+	return Null
+}
+
+// fieldName returns the name by which the given structure field is
+// available to scripts, or false if it isn't available.
+//
+// Unexported fields are skipped, and the `json` tags of the fields are
+// honored, so a field tagged `json:"name"` is available as `name`, and
+// a field tagged `json:"-"` is skipped.
+func fieldName(field reflect.StructField) (string, bool) {
+
+	if field.PkgPath != "" {
+		return "", false
+	}
 
-		vm.fields[name] = ret
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return "", false
+	}
+	if tag != "" {
+		return tag, true
 	}
+	return field.Name, true
+}
+
+// visit identifies a pointer, or map, which we're converting.
+//
+// The type is recorded along with the address, as a structure and its
+// first field share the same address.
+type visit struct {
+	addr uintptr
+	typ  reflect.Type
+}
+
+// enter records that we're converting the given pointer, or map, returning
+// false if we already are - because it refers back to itself.
+//
+// Such a value would otherwise be converted forever, so the reference
+// back becomes null instead.  Values which are merely shared by several
+// fields are converted each time.
+func (vm *VM) enter(val reflect.Value) bool {
+
+	if vm.visiting == nil {
+		vm.visiting = make(map[visit]bool)
+	}
+
+	key := visit{addr: val.Pointer(), typ: val.Type()}
+	if vm.visiting[key] {
+		return false
+	}
+	vm.visiting[key] = true
+	return true
+}
+
+// leave records that we've finished converting the given pointer, or map,
+// see enter.
+func (vm *VM) leave(val reflect.Value) {
+	delete(vm.visiting, visit{addr: val.Pointer(), typ: val.Type()})
+}
+
+// ToHash converts the given structure, or map, to a hash, recursively.
+//
+// Running a script against the resulting hash, rather than the original
+// object, avoids the need to use reflection to discover its fields each
+// time the script runs.  This is useful if the same object is going to
+// be tested by several scripts, and it means that all objects are
+// accessed in the same way.
+//
+// Unexported structure fields are skipped, and the `json` tags of the
+// fields are honored, so a field tagged `json:"name"` is available as
+// `name`, and a field tagged `json:"-"` is skipped.  If the object is
+// not a structure, or map, an empty hash is returned.
+//
+// If an environment is given then any coercions registered with it are
+// used, otherwise it may be nil.
+func ToHash(obj interface{}, env *environment.Environment) *object.Hash {
+
+	conv := &VM{environment: env}
+
+	hash, ok := conv.reflectValue(reflect.ValueOf(obj)).(*object.Hash)
+	if !ok {
+		return &object.Hash{Pairs: make(map[string]object.Object)}
+	}
+	return hash
+}
+
+// ToObject converts the given value to an object, in the same way as the
+// fields of the object a script is running against.
+//
+// Structures, and maps, become hashes, recursively, and nil becomes null.
+// If an environment is given then any coercions registered with it are
+// used, otherwise it may be nil.
+func ToObject(obj interface{}, env *environment.Environment) object.Object {
+	conv := &VM{environment: env}
+	return conv.reflectValue(reflect.ValueOf(obj))
 }
 
 // createArrayFromSlice creates an object.Array value from the
@@ -761,6 +1391,12 @@ func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
 	// For each entry
 	for i := 0; i < l; i++ {
 
+		// Types which need special handling
+		if ret, ok := vm.coerce(field.Index(i)); ok {
+			el = append(el, ret)
+			continue
+		}
+
 		// Cast the array-member to an interface
 		in := field.Index(i).Interface()
 
@@ -797,12 +1433,12 @@ func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
 		// is it a float?
 		f, ok := in.(float32)
 		if ok {
-			el = append(el, &object.Float{Value: float64(f)})
+			el = append(el, vm.float(float64(f)))
 			continue
 		}
 		ff, ok := in.(float64)
 		if ok {
-			el = append(el, &object.Float{Value: ff})
+			el = append(el, vm.float(ff))
 			continue
 		}
 
@@ -830,6 +1466,13 @@ func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
 			continue
 		}
 
+		// Is it a nested map, or structure?
+		switch reflect.ValueOf(in).Kind() {
+		case reflect.Map, reflect.Struct, reflect.Ptr:
+			el = append(el, vm.reflectValue(field.Index(i)))
+			continue
+		}
+
 		fmt.Printf("Failed to convert array-member to object")
 	}
 
@@ -854,6 +1497,56 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return err
 	}
 
+	// The case-insensitive operators only differ from their regular
+	// counterparts when both operands are strings.
+	if base, ok := caseInsensitive[op]; ok {
+		if left.Type() != object.STRING || right.Type() != object.STRING {
+			op = base
+		}
+	}
+
+	// The bitwise operators only work upon integers.
+	if sym, ok := bitwise[op]; ok {
+		if left.Type() != object.INTEGER || right.Type() != object.INTEGER {
+			return fmt.Errorf("operands of '%s' must be integers, not %s and %s", sym, left.Type(), right.Type())
+		}
+	}
+
+	// Comparisons are made by the environment, so that the operators
+	// always agree with the functions which compare values.
+	switch op {
+	case code.OpEqual, code.OpNotEqual:
+		equal, ok := vm.environment.Equal(left, right)
+		if !ok {
+			return comparisonError(op, left, right)
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(equal == (op == code.OpEqual)))
+		return nil
+	case code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual:
+		// NaN is neither less than, nor greater than, anything.
+		if environment.Unordered(left, right) {
+			vm.stack.Push(False)
+			return nil
+		}
+		cmp, ok := vm.environment.Compare(left, right)
+		if !ok {
+			return comparisonError(op, left, right)
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(ordered(op, cmp)))
+		return nil
+	case code.OpArrayIn:
+
+		// Ensure we're invoked with an array
+		if right.Type() != object.ARRAY {
+			return fmt.Errorf("operand for 'in' must be an array, not %s", right.Type())
+		}
+
+		// The array contains the value if any member is equal to it.
+		values := right.(*object.Array)
+		vm.stack.Push(vm.nativeBoolToBooleanObject(vm.environment.Contains(values.Elements, left)))
+		return nil
+	}
+
 	switch {
 	case left.Type() == object.INTEGER && right.Type() == object.INTEGER:
 		return vm.evalIntegerInfixExpression(op, left, right)
@@ -889,32 +1582,6 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 			vm.stack.Push(False)
 		}
 		return nil
-	case op == code.OpArrayIn:
-
-		// Ensure we're invoked with an array
-		if right.Type() != object.ARRAY {
-			return fmt.Errorf("operand for 'in' must be an array, not %s", right.Type())
-		}
-
-		// Get the array.
-		values := right.(*object.Array)
-
-		// For each element ..
-		for _, entry := range values.Elements {
-
-			// If the type and values are equal then
-			// the array DOES contain the value.
-			if (left.Type() == entry.Type()) &&
-				(left.Inspect() == entry.Inspect()) {
-				vm.stack.Push(True)
-				return nil
-			}
-		}
-
-		// Examined all members of the array.  No match.
-		vm.stack.Push(False)
-		return nil
-
 	case left.Type() == object.BOOLEAN && right.Type() == object.BOOLEAN:
 		return vm.evalBooleanInfixExpression(op, left, right)
 	case left.Type() != right.Type():
@@ -926,39 +1593,99 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	}
 }
 
+// caseInsensitive maps each of the case-insensitive operators to the
+// regular operator it is a variant of.
+var caseInsensitive = map[code.Opcode]code.Opcode{
+	code.OpEqualFold:      code.OpEqual,
+	code.OpNotEqualFold:   code.OpNotEqual,
+	code.OpMatchesFold:    code.OpMatches,
+	code.OpNotMatchesFold: code.OpNotMatches,
+}
+
+// comparisonError returns the error reported when two values cannot be
+// compared by the given operator.
+func comparisonError(op code.Opcode, left, right object.Object) error {
+
+	switch {
+	case (op == code.OpEqual || op == code.OpNotEqual) && right.Type() == object.ARRAY:
+		// A common mistake is to expect `x == [ .. ]` to test
+		// membership, so point the user at the right operator.
+		return fmt.Errorf("cannot compare %s with an array using %s, use 'in' to test whether an array contains a value",
+			left.Type(), comparisons[op])
+	case left.Type() != right.Type():
+		return fmt.Errorf("type mismatch: %s %s %s",
+			left.Type(), code.String(op), right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s",
+		left.Type(), code.String(op), right.Type())
+}
+
+// ordered returns the result of a relational operator, given the result
+// of comparing its operands.
+func ordered(op code.Opcode, cmp int) bool {
+	switch op {
+	case code.OpLess:
+		return cmp < 0
+	case code.OpLessEqual:
+		return cmp <= 0
+	case code.OpGreater:
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
 // integer OP integer
 func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
 
 	switch op {
-	case code.OpAdd:
-		vm.stack.Push(&object.Integer{Value: leftVal + rightVal})
-	case code.OpSub:
-		vm.stack.Push(&object.Integer{Value: leftVal - rightVal})
-	case code.OpMul:
-		vm.stack.Push(&object.Integer{Value: leftVal * rightVal})
+	case code.OpAdd, code.OpSub, code.OpMul:
+		res, ok := integerArithmetic(op, leftVal, rightVal)
+		if !ok {
+			return fmt.Errorf("integer overflow: %d %s %d", leftVal, arithmetic[op], rightVal)
+		}
+		vm.stack.Push(&object.Integer{Value: res})
 	case code.OpDiv:
 		if rightVal == 0 {
 			return fmt.Errorf("attempted division by zero: %d / %d", leftVal, rightVal)
 		}
-		vm.stack.Push(&object.Integer{Value: leftVal / rightVal})
+		// Division always results in a float, even if it is exact,
+		// so the type of the result doesn't depend upon the values.
+		vm.stack.Push(&object.Float{Value: float64(leftVal) / float64(rightVal)})
 	case code.OpMod:
+		if rightVal == 0 {
+			return fmt.Errorf("attempted division by zero: %d %% %d", leftVal, rightVal)
+		}
 		vm.stack.Push(&object.Integer{Value: leftVal % rightVal})
+	case code.OpBitAnd:
+		vm.stack.Push(&object.Integer{Value: leftVal & rightVal})
+	case code.OpBitOr:
+		vm.stack.Push(&object.Integer{Value: leftVal | rightVal})
+	case code.OpBitXor:
+		vm.stack.Push(&object.Integer{Value: leftVal ^ rightVal})
+	case code.OpShiftLeft, code.OpShiftRight:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d %s %d", leftVal, bitwise[op], rightVal)
+		}
+		// Bits which are shifted out are discarded, and shifting
+		// by 64 or more gives 0, or -1 for a negative value.
+		if op == code.OpShiftLeft {
+			vm.stack.Push(&object.Integer{Value: leftVal << uint64(rightVal)})
+		} else {
+			vm.stack.Push(&object.Integer{Value: leftVal >> uint64(rightVal)})
+		}
 	case code.OpPower:
-		vm.stack.Push(&object.Integer{Value: int64(math.Pow(float64(leftVal), float64(rightVal)))})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
+		// A negative exponent gives a fraction.
+		if rightVal < 0 {
+			vm.stack.Push(&object.Float{Value: math.Pow(float64(leftVal), float64(rightVal))})
+		} else {
+			res, ok := integerPower(leftVal, rightVal)
+			if !ok {
+				return fmt.Errorf("integer overflow: %d ** %d", leftVal, rightVal)
+			}
+			vm.stack.Push(&object.Integer{Value: res})
+		}
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -966,6 +1693,88 @@ func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Obje
 	return nil
 }
 
+// arithmetic contains the symbols of the operators which
+// integerArithmetic supports, for use in error messages.
+var arithmetic = map[code.Opcode]string{
+	code.OpAdd: "+",
+	code.OpSub: "-",
+	code.OpMul: "*",
+}
+
+// bitwise contains the symbols of the bitwise operators, which may
+// only be used upon integers, for use in error messages.
+var bitwise = map[code.Opcode]string{
+	code.OpBitAnd:     "&",
+	code.OpBitOr:      "|",
+	code.OpBitXor:     "^",
+	code.OpShiftLeft:  "<<",
+	code.OpShiftRight: ">>",
+}
+
+// integerArithmetic performs an addition, subtraction, or multiplication
+// of two integers, returning false if the result overflows.
+//
+// Rather than allow a result to silently wrap-around, which would give
+// a wildly incorrect answer, overflows are reported as errors.  We don't
+// convert the result to a float, as that would lose precision, and the
+// type of the result would depend upon the values.
+func integerArithmetic(op code.Opcode, a, b int64) (int64, bool) {
+
+	switch op {
+	case code.OpAdd:
+		res := a + b
+		if (a > 0 && b > 0 && res < 0) || (a < 0 && b < 0 && res >= 0) {
+			return 0, false
+		}
+		return res, true
+
+	case code.OpSub:
+		res := a - b
+		if (a >= 0 && b < 0 && res < 0) || (a < 0 && b > 0 && res >= 0) {
+			return 0, false
+		}
+		return res, true
+
+	case code.OpMul:
+		if a == 0 || b == 0 {
+			return 0, true
+		}
+		res := a * b
+		if res/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+			return 0, false
+		}
+		return res, true
+	}
+
+	return 0, false
+}
+
+// integerPower raises an integer to a non-negative integer power, by
+// repeated squaring, returning false if the result overflows.
+func integerPower(base, exp int64) (int64, bool) {
+
+	res := int64(1)
+	ok := true
+
+	for exp > 0 {
+		if exp&1 == 1 {
+			res, ok = integerArithmetic(code.OpMul, res, base)
+			if !ok {
+				return 0, false
+			}
+		}
+		exp >>= 1
+		if exp > 0 {
+			base, ok = integerArithmetic(code.OpMul, base, base)
+			if !ok {
+				return 0, false
+			}
+		}
+	}
+
+	return res, true
+}
+
 // float OP float
 func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Float).Value
@@ -984,21 +1793,12 @@ func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object
 		}
 		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return fmt.Errorf("attempted division by zero: %f %% %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Mod(leftVal, rightVal)})
 	case code.OpPower:
 		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -1024,21 +1824,12 @@ func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object
 		}
 		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return fmt.Errorf("attempted division by zero: %f %% %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Mod(leftVal, rightVal)})
 	case code.OpPower:
 		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -1064,21 +1855,12 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 		}
 		vm.stack.Push(&object.Float{Value: leftVal / rightVal})
 	case code.OpMod:
-		vm.stack.Push(&object.Float{Value: float64(int(leftVal) % int(rightVal))})
+		if rightVal == 0 {
+			return fmt.Errorf("attempted division by zero: %f %% %f", leftVal, rightVal)
+		}
+		vm.stack.Push(&object.Float{Value: math.Mod(leftVal, rightVal)})
 	case code.OpPower:
 		vm.stack.Push(&object.Float{Value: math.Pow(leftVal, rightVal)})
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal < rightVal))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal <= rightVal))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal > rightVal))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal >= rightVal))
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal == rightVal))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(leftVal != rightVal))
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
 	}
@@ -1091,48 +1873,54 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 	l := left.(*object.String)
 	r := right.(*object.String)
 
+	// The case-insensitive regexp operators are implemented by
+	// adding the `i` flag to the regular expression.
+	if op == code.OpMatchesFold || op == code.OpNotMatchesFold {
+		r = &object.String{Value: "(?i)" + r.Value}
+		op = caseInsensitive[op]
+	}
+
 	switch op {
-	case code.OpEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value == r.Value))
-	case code.OpNotEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value != r.Value))
-	case code.OpGreaterEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value >= r.Value))
-	case code.OpGreater:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value > r.Value))
-	case code.OpLessEqual:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value <= r.Value))
-	case code.OpLess:
-		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value < r.Value))
+	case code.OpEqualFold:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(strings.EqualFold(l.Value, r.Value)))
+	case code.OpNotEqualFold:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!strings.EqualFold(l.Value, r.Value)))
 	case code.OpMatches:
 		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
+		if vm.match == nil {
 			return (fmt.Errorf("failed to lookup match-function"))
 		}
-		out := fn.(func(args []object.Object) object.Object)
+		out := vm.match.(func(args []object.Object) object.Object)
 		ret := out(args)
+		if err, ok := ret.(*object.Error); ok {
+			return fmt.Errorf("%s", err.Message)
+		}
 
-		if ret.(*object.Boolean).Value {
+		if ret.True() {
 			vm.stack.Push(True)
 		} else {
 			vm.stack.Push(False)
 		}
 	case code.OpNotMatches:
 		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
+		if vm.match == nil {
 			return (fmt.Errorf("failed to lookup match-function"))
 		}
-		out := fn.(func(args []object.Object) object.Object)
+		out := vm.match.(func(args []object.Object) object.Object)
 		ret := out(args)
+		if err, ok := ret.(*object.Error); ok {
+			return fmt.Errorf("%s", err.Message)
+		}
 
-		if ret.(*object.Boolean).Value {
+		if ret.True() {
 			vm.stack.Push(False)
 		} else {
 			vm.stack.Push(True)
 		}
 	case code.OpAdd:
+		if limit := vm.environment.MaxStringLength(); limit > 0 && len(l.Value)+len(r.Value) > limit {
+			return fmt.Errorf("the result of concatenation is longer than the maximum string length of %d", limit)
+		}
 		vm.stack.Push(&object.String{Value: l.Value + r.Value})
 	default:
 		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
@@ -1150,7 +1938,7 @@ func (vm *VM) evalBooleanInfixExpression(op code.Opcode, left object.Object, rig
 	// then reuse our implementation, which will work
 	// but might give some "interesting" results.
 	//
-	// e.g. "false < true"
+	// e.g. "true ~= /^t/"
 	//
 	return (vm.evalStringInfixExpression(op, l, r))
 }
@@ -1162,16 +1950,9 @@ func (vm *VM) executeBangOperator() error {
 		return err
 	}
 
-	switch operand {
-	case True:
-		vm.stack.Push(False)
-	case False:
-		vm.stack.Push(True)
-	case Null:
-		vm.stack.Push(True)
-	default:
-		vm.stack.Push(False)
-	}
+	// Use the same notion of truth as conditions do, which each
+	// type - including those added by the host - defines.
+	vm.stack.Push(vm.nativeBoolToBooleanObject(!operand.True()))
 	return nil
 }
 
@@ -1185,6 +1966,9 @@ func (vm *VM) executeMinusOperator() error {
 
 	switch obj := operand.(type) {
 	case *object.Integer:
+		if obj.Value == math.MinInt64 {
+			return fmt.Errorf("integer overflow: -(%d)", obj.Value)
+		}
 		res = &object.Integer{Value: -obj.Value}
 	case *object.Float:
 		res = &object.Float{Value: -obj.Value}
@@ -1226,7 +2010,15 @@ func (vm *VM) nativeBoolToBooleanObject(input bool) *object.Boolean {
 }
 
 // lookup the name of the given field/map-member.
-func (vm *VM) lookup(obj interface{}, name string) object.Object {
+//
+// If a type was declared for the field, via SetFieldType, the value is
+// converted to it, and an error is returned if that isn't possible.
+//
+// The members are the names of the fields which the script accesses
+// from the value next, such as `Address` and `City` when it reads
+// `User.Address.City`, which are used to report the full path of the
+// field to the field hook.
+func (vm *VM) lookup(obj interface{}, name string, members []string) (object.Object, error) {
 
 	//
 	// Remove legacy "$" prefix, if present.
@@ -1236,8 +2028,11 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 	//
 	// Look for this as a variable first, they take precedence.
 	//
+	// Local variables, such as function parameters, are found
+	// before global ones.
+	//
 	if val, ok := vm.environment.Get(name); ok {
-		return val
+		return val, nil
 	}
 
 	//
@@ -1253,14 +2048,120 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 	//
 	// Now perform the lookup
 	//
-	if cached, found := vm.fields[name]; found {
-		return cached
+	// If it was not found it is an unknown/unset value.
+	//
+	val, found := vm.fields[name]
+	if !found {
+		val = Null
 	}
 
 	//
-	// If it was not found it is an unknown/unset value.
+	// Convert the value to the declared type, if there is one.
 	//
-	return Null
+	// We store the converted value, so we only do this once.
+	//
+	if typ, ok := vm.environment.FieldType(name); ok && found && val.Type() != typ && val.Type() != object.NULL {
+		conv, err := environment.Convert(val, typ)
+		if err != nil {
+			if !vm.environment.ErrorsAsFalse() {
+				return nil, fmt.Errorf("field %s: %s", name, err.Error())
+			}
+			if hook := vm.environment.ErrorHook(); hook != nil {
+				hook(fmt.Errorf("field %s: %s", name, err.Error()))
+			}
+			conv = Null
+		}
+		val = conv
+		vm.fields[name] = val
+	}
+
+	//
+	// Let the host know the field was read, if it cares.
+	//
+	// We follow the members which are accessed from it, so
+	// long as they are present, to report the full path.
+	//
+	if hook := vm.environment.FieldHook(); hook != nil {
+		path, cur := name, val
+		for _, member := range members {
+			hash, ok := cur.(*object.Hash)
+			if !ok {
+				break
+			}
+			path += "." + member
+			cur, ok = hash.Pairs[member]
+			if !ok {
+				cur = Null
+			}
+		}
+		hook(path, cur)
+	}
+
+	return val, nil
+}
+
+// memberPath returns the names of the fields which are accessed, via
+// `.` or `?.`, by the instructions starting at the given offset.
+//
+// The compiler emits each access as the name of the member, followed
+// by OpMember, with optional accesses preceded by OpJumpIfNull.
+func (vm *VM) memberPath(ip int) []string {
+
+	var members []string
+
+	for ip < len(vm.bytecode) {
+		op := code.Opcode(vm.bytecode[ip])
+		if op == code.OpJumpIfNull || op == code.OpNop {
+			ip += code.Length(op)
+			continue
+		}
+		if op != code.OpConstant || ip+3 >= len(vm.bytecode) || code.Opcode(vm.bytecode[ip+3]) != code.OpMember {
+			break
+		}
+		arg := int(binary.BigEndian.Uint16(vm.bytecode[ip+1 : ip+3]))
+		if arg >= len(vm.constants) {
+			break
+		}
+		members = append(members, vm.constants[arg].Inspect())
+		ip += code.Length(op) + code.Length(code.OpMember)
+	}
+
+	return members
+}
+
+// exists returns true if the given path, of field-names separated by
+// periods, resolves.
+//
+// The first name may be a variable, or a field of the object we're
+// running against, and each subsequent name must be present within the
+// hash which the previous one resolved to.  The final value may be null.
+func (vm *VM) exists(obj interface{}, path string) bool {
+
+	names := strings.Split(path, ".")
+
+	val, ok := vm.environment.Get(names[0])
+	if !ok {
+		if len(vm.fields) == 0 {
+			vm.inspectObject(obj)
+		}
+		val, ok = vm.fields[names[0]]
+		if !ok {
+			return false
+		}
+	}
+
+	for _, name := range names[1:] {
+		hash, ok := val.(*object.Hash)
+		if !ok {
+			return false
+		}
+		val, ok = hash.Pairs[name]
+		if !ok {
+			return false
+		}
+	}
+
+	return true
 }
 
 // executeIndexExpression performs a string/array indexing operation.
@@ -1314,6 +2215,105 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	return nil
 }
 
+// executeMemberExpression performs a field-access upon a hash.
+//
+// Accessing a missing field results in null, but attempting to access
+// a field of something which isn't a hash is an error.
+func (vm *VM) executeMemberExpression(left, name object.Object) error {
+
+	hash, ok := left.(*object.Hash)
+	if !ok {
+		return fmt.Errorf("cannot access field %s of %s", name.Inspect(), left.Type())
+	}
+
+	val, ok := hash.Pairs[name.Inspect()]
+	if !ok {
+		val = Null
+	}
+
+	vm.stack.Push(val)
+	return nil
+}
+
+// executeSliceExpression performs a string/array slicing operation.
+//
+// The semantics are the same as python's: a missing start-index
+// defaults to zero, a missing end-index defaults to the length of the
+// object, and negative indexes count backwards from the end.  Indexes
+// which are out of range are clamped.
+func (vm *VM) executeSliceExpression(left, start, end object.Object) error {
+
+	// Check arguments
+	if left.Type() != object.ARRAY && left.Type() != object.STRING {
+		return fmt.Errorf("the slice operator can only be applied to strings and arrays, not %s", left.Type())
+	}
+
+	// Get the length of the thing we're slicing.
+	var chars []rune
+	var elements []object.Object
+	var length int64
+
+	if left.Type() == object.STRING {
+		chars = []rune(left.(*object.String).Value)
+		length = int64(len(chars))
+	} else {
+		elements = left.(*object.Array).Elements
+		length = int64(len(elements))
+	}
+
+	// Convert the indexes
+	from, err := sliceIndex(start, 0, length)
+	if err != nil {
+		return err
+	}
+	to, err := sliceIndex(end, length, length)
+	if err != nil {
+		return err
+	}
+
+	// An empty range.
+	if from > to {
+		to = from
+	}
+
+	if left.Type() == object.STRING {
+		vm.stack.Push(&object.String{Value: string(chars[from:to])})
+		return nil
+	}
+
+	// Copy the elements, so that the result is a new array.
+	out := make([]object.Object, to-from)
+	copy(out, elements[from:to])
+	vm.stack.Push(&object.Array{Elements: out})
+	return nil
+}
+
+// sliceIndex converts the given object to an index for our slice
+// operation, handling the default-value, negative indexes, and clamping.
+func sliceIndex(obj object.Object, def int64, length int64) (int64, error) {
+
+	if obj.Type() == object.NULL {
+		return def, nil
+	}
+
+	i, ok := obj.(*object.Integer)
+	if !ok {
+		return 0, fmt.Errorf("slice operator must be given integers, not %s", obj.Type())
+	}
+
+	idx := i.Value
+	if idx < 0 {
+		idx += length
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	if idx > length {
+		idx = length
+	}
+	return idx, nil
+}
+
 // WalkBytecode invokes the specified callbackup function upon every
 // instruction in our bytecode program.
 //